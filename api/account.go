@@ -0,0 +1,237 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/blueambertech-demos/login-svc-gcp/data"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/audit"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/login"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/risk"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/session"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/webhook"
+	"github.com/blueambertech/logging"
+)
+
+type DeleteAccountDetails struct {
+	Password string `json:"password"`
+}
+
+type AccountStatusDetails struct {
+	ID     string             `json:"id"`
+	Status data.AccountStatus `json:"status"`
+	Reason string             `json:"reason"`
+}
+
+// AccountExport is all of the personal data stored for a user, the same data DeleteLogin erases. The password hash and salt
+// are never exported. Sessions include the device and location used to score logins, see Risk
+type AccountExport struct {
+	ExportedAt        time.Time               `json:"exportedAt"`
+	Account           ExportedAccount         `json:"account"`
+	Sessions          []ExportedSession       `json:"sessions"`
+	PasswordResets    []ExportedPasswordReset `json:"passwordResets"`
+	AuditRecords      []audit.Record          `json:"auditRecords"`
+	WebhookDeliveries []webhook.Delivery      `json:"webhookDeliveries"`
+}
+
+type ExportedAccount struct {
+	ID              string             `json:"id"`
+	UserName        string             `json:"userName"`
+	DateCreated     time.Time          `json:"dateCreated"`
+	Status          data.AccountStatus `json:"status"`
+	StatusReason    string             `json:"statusReason,omitempty"`
+	StatusChangedAt time.Time          `json:"statusChangedAt,omitempty"`
+	Roles           []string           `json:"roles"`
+}
+
+// ExportedPasswordReset is a password reset token that has not been used, the token itself is never stored
+type ExportedPasswordReset struct {
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+type ExportedSession struct {
+	ID        string         `json:"id"`
+	Device    string         `json:"device,omitempty"`
+	DeviceID  string         `json:"deviceId,omitempty"`
+	UserAgent string         `json:"userAgent"`
+	IP        string         `json:"ip"`
+	Location  *risk.Location `json:"location,omitempty"`
+	CreatedAt time.Time      `json:"createdAt"`
+	LastSeen  time.Time      `json:"lastSeen"`
+	ExpiresAt time.Time      `json:"expiresAt"`
+	Revoked   bool           `json:"revoked"`
+	RevokedAt time.Time      `json:"revokedAt,omitempty"`
+}
+
+// DeleteAccountHandler is a http handler that accepts a DELETE request to erase the authenticated user's login and personal
+// data, see login.DeleteLogin. The user's password must be supplied again to confirm the request
+func deleteAccountHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, span := logging.Tracer.Start(r.Context(), "delete-account-request")
+	defer span.End()
+
+	if r.Method != http.MethodDelete {
+		methodNotAllowed(w, span, http.MethodDelete)
+		return
+	}
+
+	var form DeleteAccountDetails
+	if err := json.NewDecoder(r.Body).Decode(&form); err != nil {
+		httpError(w, CodeInvalidRequest, "failed to extract form data", http.StatusBadRequest, span, err)
+		return
+	}
+	userID := requestClaims(r).Subject
+	err := login.CheckPassword(ctx, Logins, userID, form.Password)
+	if err == nil {
+		err = login.DeleteLogin(ctx, Logins, DbClient, Events, Audit, userID, span)
+	}
+	rec := auditRecord(r, audit.AccountDeleted, userID, err)
+	rec.ActorID = userID
+	if err == nil {
+		// The request came from the user whose personal details have just been erased
+		rec.IP, rec.UserAgent = "", ""
+	}
+	writeAudit(r, span, rec)
+	if errors.Is(err, login.ErrInvalidCredentials) {
+		loginError(w, "failed to verify password", span, err)
+		return
+	} else if err != nil {
+		loginError(w, "failed to delete account", span, err)
+		return
+	}
+	clearSessionCookies(w)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// AdminDeleteAccountHandler is a http handler that accepts a DELETE request to erase the login and personal data of the user
+// given by the id query parameter
+func adminDeleteAccountHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, span := logging.Tracer.Start(r.Context(), "admin-delete-account-request")
+	defer span.End()
+
+	if r.Method != http.MethodDelete {
+		methodNotAllowed(w, span, http.MethodDelete)
+		return
+	}
+
+	userID := r.URL.Query().Get("id")
+	if userID == "" {
+		httpError(w, CodeInvalidRequest, "id is required", http.StatusBadRequest, span, nil)
+		return
+	}
+	err := login.DeleteLogin(ctx, Logins, DbClient, Events, Audit, userID, span)
+	auditEvent(r, span, audit.AccountDeleted, userID, err)
+	if errors.Is(err, login.ErrUserNotFound) {
+		httpError(w, CodeNotFound, "account not found", http.StatusNotFound, span, err)
+		return
+	} else if err != nil {
+		loginError(w, "failed to delete account", span, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// AdminAccountStatusHandler is a http handler that accepts a POST request to change the status of an account, a reason for the
+// change must be given. Accounts that are not active can't log in and their existing tokens are rejected
+func adminAccountStatusHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, span := logging.Tracer.Start(r.Context(), "admin-account-status-request")
+	defer span.End()
+
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, span, http.MethodPost)
+		return
+	}
+
+	var form AccountStatusDetails
+	if err := json.NewDecoder(r.Body).Decode(&form); err != nil || form.ID == "" || form.Reason == "" {
+		httpError(w, CodeInvalidRequest, "id, status and reason are required", http.StatusBadRequest, span, err)
+		return
+	}
+	err := login.SetStatus(ctx, Logins, Events, form.ID, form.Status, form.Reason, span)
+	auditStatus(r, span, form.ID, form.Status, form.Reason, err)
+	if errors.Is(err, login.ErrUserNotFound) {
+		httpError(w, CodeNotFound, "account not found", http.StatusNotFound, span, err)
+		return
+	} else if err != nil {
+		loginError(w, "failed to change account status", span, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ExportAccountHandler is a http handler that accepts a GET request and returns all of the personal data stored for the
+// authenticated user as an AccountExport
+func exportAccountHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, span := logging.Tracer.Start(r.Context(), "export-account-request")
+	defer span.End()
+
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, span, http.MethodGet)
+		return
+	}
+
+	userID := requestClaims(r).Subject
+	rec, err := Logins.GetByID(ctx, userID)
+	if err != nil {
+		loginError(w, "failed to read account", span, err)
+		return
+	}
+	sessions, err := session.ListAll(ctx, DbClient, userID)
+	if err != nil {
+		httpError(w, CodeInternal, "failed to list sessions", http.StatusInternalServerError, span, err)
+		return
+	}
+	resets, err := login.PendingResets(ctx, DbClient, userID)
+	if err != nil {
+		httpError(w, CodeInternal, "failed to list password resets", http.StatusInternalServerError, span, err)
+		return
+	}
+	records, err := Audit.Query(ctx, userID, time.Time{}, time.Time{})
+	if err != nil {
+		httpError(w, CodeInternal, "failed to read audit records", http.StatusInternalServerError, span, err)
+		return
+	}
+	deliveries, err := webhook.UserDeliveries(ctx, DbClient, userID)
+	if err != nil {
+		httpError(w, CodeInternal, "failed to list webhook deliveries", http.StatusInternalServerError, span, err)
+		return
+	}
+	export := AccountExport{
+		ExportedAt: time.Now().UTC(),
+		Account: ExportedAccount{
+			ID:              rec.ID,
+			UserName:        rec.UserName,
+			DateCreated:     rec.DateCreated,
+			Status:          rec.Status,
+			StatusReason:    rec.StatusReason,
+			StatusChangedAt: rec.StatusChangedAt,
+			Roles:           rec.Roles,
+		},
+		Sessions:          make([]ExportedSession, len(sessions)),
+		PasswordResets:    make([]ExportedPasswordReset, len(resets)),
+		AuditRecords:      records,
+		WebhookDeliveries: deliveries,
+	}
+	for i, expires := range resets {
+		export.PasswordResets[i] = ExportedPasswordReset{ExpiresAt: expires}
+	}
+	for i, s := range sessions {
+		export.Sessions[i] = ExportedSession{
+			ID:        s.ID,
+			Device:    s.Device,
+			DeviceID:  s.DeviceID,
+			UserAgent: s.UserAgent,
+			IP:        s.IP,
+			Location:  sessionLocation(&s),
+			CreatedAt: s.CreatedAt,
+			LastSeen:  s.LastSeen,
+			ExpiresAt: s.ExpiresAt,
+			Revoked:   s.Revoked,
+			RevokedAt: s.RevokedAt,
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="account-export.json"`)
+	_ = json.NewEncoder(w).Encode(export)
+}
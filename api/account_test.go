@@ -0,0 +1,264 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/blueambertech-demos/login-svc-gcp/data"
+	"github.com/blueambertech-demos/login-svc-gcp/mock"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/audit"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/login"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/subscriber"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/token"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/webhook"
+)
+
+func TestDeleteAccountHandler(t *testing.T) {
+	DbClient.(*mock.NoSQLClient).ClearData()
+	tokenString, err := getTestToken("test@test.com", "somepass")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	body, _ := json.Marshal(DeleteAccountDetails{Password: "wrongpass"})
+	resp := doAuthorized(deleteAccountHandler, "DELETE", "/account", tokenString, body)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("wrong password should be rejected, got response code: %d", resp.StatusCode)
+		return
+	}
+
+	body, _ = json.Marshal(DeleteAccountDetails{Password: "somepass"})
+	resp = doAuthorized(deleteAccountHandler, "DELETE", "/account", tokenString, body)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Incorrect response code: %d", resp.StatusCode)
+		return
+	}
+	if _, err = Logins.GetByUsername(testContext, "test@test.com"); !errors.Is(err, login.ErrUserNotFound) {
+		t.Error("login should be deleted, got", err)
+	}
+	resp = doAuthorized(testAuthHandler, "GET", "/testauth", tokenString, nil)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("token of a deleted account should be rejected, got response code: %d", resp.StatusCode)
+	}
+}
+
+func TestExportAccountHandler(t *testing.T) {
+	DbClient.(*mock.NoSQLClient).ClearData()
+	tokenString, err := getTestToken("test@test.com", "somepass")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	resp := doAuthorized(exportAccountHandler, "GET", "/account/export", tokenString, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Incorrect response code: %d", resp.StatusCode)
+		return
+	}
+	defer resp.Body.Close()
+	var raw json.RawMessage
+	if err = json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+		t.Error(err)
+		return
+	}
+	rec, err := Logins.GetByUsername(testContext, "test@test.com")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if strings.Contains(string(raw), rec.PassHash) || strings.Contains(string(raw), rec.Salt) {
+		t.Error("export must not contain the password hash or salt:", string(raw))
+	}
+	var export AccountExport
+	if err = json.Unmarshal(raw, &export); err != nil {
+		t.Error(err)
+		return
+	}
+	if export.Account.ID != rec.ID || export.Account.UserName != "test@test.com" || len(export.Sessions) != 1 {
+		t.Errorf("export is missing data: %+v", export)
+	}
+}
+
+// personalDataCollections are the collections holding personal data of a user, the export must include and deleting the
+// account must erase what each of them holds for the user
+var personalDataCollections = []string{
+	login.DetailsCollection,
+	login.UsernamesCollection,
+	"sessions",
+	login.ResetsCollection,
+	audit.CollectionName,
+	audit.PersonalCollection,
+	webhook.DeliveriesCollection,
+	subscriber.ProcessedCollection,
+	subscriber.DeadLetterCollection,
+}
+
+func TestAccountPersonalData(t *testing.T) {
+	DbClient.(*mock.NoSQLClient).ClearData()
+	userName := "personal@test.com"
+	tokenString, err := getTestToken(userName, "somepass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := token.Parse(testContext, Secrets, tokenString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID := claims.Subject
+	// A failed login is audited with the username as it was typed
+	_, _ = loginTestUser(userName, "wrongpass")
+	if _, err = login.ForcePasswordReset(testContext, Logins, DbClient, Events, userID); err != nil {
+		t.Fatal(err)
+	}
+	if err = login.ChangePassword(testContext, Logins, userID, "somepass"); err != nil {
+		t.Fatal(err)
+	}
+	if tokenString, err = loginTestUser(userName, "somepass"); err != nil {
+		t.Fatal(err)
+	}
+	delivery := &webhook.Delivery{ID: "d1", UserID: userID, EventType: "login.succeeded", State: webhook.StateDelivered}
+	if err = DbClient.InsertWithID(testContext, webhook.DeliveriesCollection, "d1", delivery); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := doAuthorized(exportAccountHandler, "GET", "/account/export", tokenString, nil)
+	var export AccountExport
+	if err = json.NewDecoder(resp.Body).Decode(&export); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("export failed: %d %v", resp.StatusCode, err)
+	}
+	if export.Account.Status != data.StatusActive || len(export.Account.Roles) != 1 || len(export.Sessions) != 2 ||
+		len(export.PasswordResets) != 1 || len(export.WebhookDeliveries) != 1 {
+		t.Errorf("export is missing data: %+v", export)
+	}
+	var ip string
+	types := map[string]bool{}
+	for _, rec := range export.AuditRecords {
+		types[rec.Type] = true
+		if rec.IP != "" {
+			ip = rec.IP
+		}
+	}
+	if !types[audit.LoginSucceeded] || !types[audit.LoginFailed] || ip == "" {
+		t.Errorf("export should include the audit records of the user, got %+v", export.AuditRecords)
+	}
+	// Lifecycle messages about the user from other services, one of them can't be handled and is dead lettered
+	sub := subscriber.New(&mock.PubSubHandler{}, Logins, DbClient, Events, Audit, nil)
+	sub.MaxAttempts = 1
+	msg := []byte(`{"id":"m1","userId":"` + userID + `","reason":"requested by the user"}`)
+	if outcome := sub.Handle(testContext, "user-signout", subscriber.ActionRevokeSessions, msg); outcome != subscriber.OutcomeApplied {
+		t.Fatal("expected the message to be applied, got", outcome)
+	}
+	msg = []byte(`{"id":"m2","userId":"` + userID + `","reason":"requested by the user"}`)
+	if outcome := sub.Handle(testContext, "user-archived", "archive", msg); outcome != subscriber.OutcomeDeadLetter {
+		t.Fatal("expected the message to be dead lettered, got", outcome)
+	}
+	// The sessions were revoked so the user logs in again
+	if tokenString, err = loginTestUser(userName, "somepass"); err != nil {
+		t.Fatal(err)
+	}
+
+	body, _ := json.Marshal(DeleteAccountDetails{Password: "somepass"})
+	if resp = doAuthorized(deleteAccountHandler, "DELETE", "/account", tokenString, body); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("delete failed: %d", resp.StatusCode)
+	}
+	for _, collection := range personalDataCollections {
+		docs, err := DbClient.List(testContext, collection)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for id, doc := range docs {
+			s := fmt.Sprint(doc)
+			if strings.Contains(s, userName) || strings.Contains(s, ip) {
+				t.Errorf("%s/%s still holds personal data: %s", collection, id, s)
+			}
+			// Erased audit records keep the user ID so that the events can still be counted
+			if collection != audit.CollectionName && (id == userID || strings.Contains(s, userID)) {
+				t.Errorf("%s/%s still belongs to the deleted user: %s", collection, id, s)
+			}
+		}
+	}
+}
+
+func TestAdminDeleteAccountHandler(t *testing.T) {
+	DbClient.(*mock.NoSQLClient).ClearData()
+	userToken, err := getTestToken("user@test.com", "somepass")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	adminToken, err := getAdminToken("admin@test.com", "somepass")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	user, _ := token.Parse(testContext, Secrets, userToken)
+	admin, _ := token.Parse(testContext, Secrets, adminToken)
+
+	handler := RequireRole(data.RoleAdmin)(http.HandlerFunc(adminDeleteAccountHandler)).ServeHTTP
+	resp := doAuthorized(handler, "DELETE", "/admin/account?id="+admin.Subject, userToken, nil)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("non admin should be rejected, got response code: %d", resp.StatusCode)
+		return
+	}
+	resp = doAuthorized(handler, "DELETE", "/admin/account?id="+user.Subject, adminToken, nil)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Incorrect response code: %d", resp.StatusCode)
+		return
+	}
+	resp = doAuthorized(handler, "DELETE", "/admin/account?id="+user.Subject, adminToken, nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("deleting a missing account should return not found, got response code: %d", resp.StatusCode)
+	}
+}
+
+func TestAdminAccountStatusHandler(t *testing.T) {
+	DbClient.(*mock.NoSQLClient).ClearData()
+	userToken, err := getTestToken("user@test.com", "somepass")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	adminToken, err := getAdminToken("admin@test.com", "somepass")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	user, _ := token.Parse(testContext, Secrets, userToken)
+	handler := RequireRole(data.RoleAdmin)(http.HandlerFunc(adminAccountStatusHandler)).ServeHTTP
+
+	body, _ := json.Marshal(AccountStatusDetails{ID: user.Subject, Status: "deleted", Reason: "testing"})
+	resp := doAuthorized(handler, "POST", "/admin/account/status", adminToken, body)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unknown status should be rejected, got response code: %d", resp.StatusCode)
+	}
+	body, _ = json.Marshal(AccountStatusDetails{ID: user.Subject, Status: data.StatusDisabled})
+	resp = doAuthorized(handler, "POST", "/admin/account/status", adminToken, body)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("missing reason should be rejected, got response code: %d", resp.StatusCode)
+	}
+
+	body, _ = json.Marshal(AccountStatusDetails{ID: user.Subject, Status: data.StatusDisabled, Reason: "testing"})
+	resp = doAuthorized(handler, "POST", "/admin/account/status", adminToken, body)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Incorrect response code: %d", resp.StatusCode)
+		return
+	}
+	resp = doAuthorized(testAuthHandler, "GET", "/testauth", userToken, nil)
+	if resp.StatusCode != http.StatusForbidden || decodeProblem(t, resp).Code != CodeAccountDisabled {
+		t.Errorf("token of a disabled account should be rejected, got response code: %d", resp.StatusCode)
+	}
+	if tok, _ := loginTestUser("user@test.com", "somepass"); tok != "" {
+		t.Error("disabled account should not be able to log in")
+	}
+
+	body, _ = json.Marshal(AccountStatusDetails{ID: user.Subject, Status: data.StatusActive, Reason: "testing"})
+	doAuthorized(handler, "POST", "/admin/account/status", adminToken, body)
+	resp = doAuthorized(testAuthHandler, "GET", "/testauth", userToken, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("token should be accepted once the account is enabled, got response code: %d", resp.StatusCode)
+	}
+}
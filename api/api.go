@@ -6,28 +6,48 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strings"
 	"syscall"
+	"time"
 
-	"github.com/blueambertech/db"
+	"github.com/blueambertech-demos/login-svc-gcp/data"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/audit"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/login"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/risk"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/session"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/storage"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/token"
 	"github.com/blueambertech/httpauth"
 	"github.com/blueambertech/logging"
-	"github.com/blueambertech/login-svc-with-gcp/pkg/login"
 	"github.com/blueambertech/pubsub"
 	"github.com/blueambertech/secretmanager"
-	"go.opentelemetry.io/otel/codes"
-	"go.opentelemetry.io/otel/trace"
 )
 
 type LoginFormDetails struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
+	Device   string `json:"device,omitempty"`
 }
 
 var (
 	ShutdownChannel chan os.Signal = make(chan os.Signal, 1)
 	Secrets         secretmanager.SecretManager
-	DbClient        db.NoSQLClient
+	DbClient        storage.Client
+	Logins          login.Repository
 	Events          pubsub.Handler
+	Audit           *audit.Log
+
+	// CookieSessions switches loginHandler to issue tokens as secure cookies for browser clients instead of writing them to
+	// the response body
+	CookieSessions bool
+
+	// LegacyTokenResponse makes loginHandler write the bare JWT as plain text, as it did before the JSON response was introduced,
+	// unless the client asks for JSON in its Accept header
+	LegacyTokenResponse bool
+
+	// TrustedProxies is the number of proxies in front of the service that append to X-Forwarded-For, Cloud Run adds one. With
+	// 0 the header is ignored and the address of the connection is used
+	TrustedProxies = 1
 )
 
 // SetupHandlers sets up the http handlers for the required endpoints in this service using the default serve mux
@@ -35,8 +55,22 @@ func SetupHandlers() {
 	http.HandleFunc("/health", healthHandler)
 	http.HandleFunc("/login/add", addLoginHandler)
 	http.HandleFunc("/login", loginHandler)
-	http.Handle("/shutdown", httpauth.Authorize(http.HandlerFunc(shutdownHandler), Secrets))
-	http.Handle("/testauth", httpauth.Authorize(http.HandlerFunc(testAuthHandler), Secrets))
+	http.Handle("/shutdown", authorize(RequireRole(data.RoleAdmin)(http.HandlerFunc(shutdownHandler))))
+	http.Handle("/logout", authorizeAny(http.HandlerFunc(logoutHandler)))
+	http.Handle("/testauth", authorizeAny(http.HandlerFunc(testAuthHandler)))
+	http.Handle("/sessions", authorizeAny(http.HandlerFunc(listSessionsHandler)))
+	http.Handle("/sessions/revoke", authorizeAny(http.HandlerFunc(revokeSessionHandler)))
+	http.Handle("/sessions/revoke-all", authorizeAny(http.HandlerFunc(revokeAllSessionsHandler)))
+	http.Handle("/account", authorizeAny(RequireScope(login.ScopeAccount)(http.HandlerFunc(deleteAccountHandler))))
+	http.Handle("/account/export", authorizeAny(RequireScope(login.ScopeAccount)(http.HandlerFunc(exportAccountHandler))))
+	http.Handle("/admin/account", authorize(RequireRole(data.RoleAdmin)(http.HandlerFunc(adminDeleteAccountHandler))))
+	http.Handle("/admin/account/status", authorize(RequireRole(data.RoleAdmin)(http.HandlerFunc(adminAccountStatusHandler))))
+	http.Handle("/admin/audit", authorize(RequireRole(data.RoleAdmin)(http.HandlerFunc(auditQueryHandler))))
+	http.Handle(webhooksPath, authorize(RequireRole(data.RoleAdmin)(http.HandlerFunc(adminWebhooksHandler))))
+	http.Handle(webhooksPath+"/", authorize(RequireRole(data.RoleAdmin)(http.HandlerFunc(adminWebhooksHandler))))
+	http.Handle(usersPath, authorize(http.HandlerFunc(adminUsersHandler)))
+	http.Handle(usersPath+"/", authorize(http.HandlerFunc(adminUsersHandler)))
+	http.HandleFunc("/password/reset", resetPasswordHandler)
 }
 
 // ShutdownHandler is a http handler that will gracefully shut the service down
@@ -60,63 +94,144 @@ func addLoginHandler(w http.ResponseWriter, r *http.Request) {
 	defer span.End()
 
 	if r.Method != http.MethodPost {
-		w.WriteHeader(http.StatusMethodNotAllowed)
+		methodNotAllowed(w, span, http.MethodPost)
 		return
 	}
 
 	form, err := extractLoginFormDetails(r)
 	if err != nil {
-		httpError(w, "failed to extract form data", http.StatusBadRequest, span, err)
+		httpError(w, CodeInvalidRequest, "failed to extract form data", http.StatusBadRequest, span, err)
 		return
 	}
 
-	if !login.ValidateAddLogin(form.Username, form.Password, span) {
-		httpError(w, "form data is invalid", http.StatusBadRequest, span, err)
+	if err = login.CheckCredentials(form.Username, form.Password, span); err != nil {
+		loginError(w, "form data is invalid", span, err)
 		return
 	}
 
-	err = login.AddLogin(r.Context(), DbClient, Events, form.Username, form.Password, span)
+	err = login.AddLogin(r.Context(), Logins, Events, form.Username, form.Password, span)
+	rec := auditRecord(r, audit.Registered, "", err)
+	rec.UserName = login.CanonicalUsername(form.Username)
+	if err == nil {
+		if l, lErr := Logins.GetByUsername(r.Context(), form.Username); lErr == nil {
+			rec.ActorID, rec.TargetID = l.ID, l.ID
+		}
+	}
+	writeAudit(r, span, rec)
 	if err != nil {
-		httpError(w, "failed to add login", http.StatusInternalServerError, span, err)
+		loginError(w, "failed to add login", span, err)
 		return
 	}
 }
 
 // LoginHandler is a http handler that accepts a POST request and verifies supplied credentials are valid, the response will contain a JWT which
-// can be used to authenticate other requests
+// can be used to authenticate other requests. Each successful login creates a session linked to the ID of the token. When CookieSessions is
+// enabled the JWT is set as a cookie instead, along with a CSRF token that must be echoed back on state changing requests. The response is
+// a LoginResponse in JSON unless the legacy plain text format is requested, see wantsLegacyResponse. When Risk is set the
+// attempt is scored first, a suspicious login is reported and may be refused
 func loginHandler(w http.ResponseWriter, r *http.Request) {
-	_, span := logging.Tracer.Start(r.Context(), "login-request")
+	ctx, span := logging.Tracer.Start(r.Context(), "login-request")
 	defer span.End()
 
 	if r.Method != http.MethodPost {
-		w.WriteHeader(http.StatusMethodNotAllowed)
+		methodNotAllowed(w, span, http.MethodPost)
 		return
 	}
 
 	form, err := extractLoginFormDetails(r)
 	if err != nil {
-		httpError(w, "failed to extract form data", http.StatusBadRequest, span, err)
+		httpError(w, CodeInvalidRequest, "failed to extract form data", http.StatusBadRequest, span, err)
 		return
 	}
 
-	validCreds, _, err := login.Validate(r.Context(), DbClient, form.Username, form.Password)
+	rec, err := login.Authenticate(ctx, Logins, form.Username, form.Password)
 	if err != nil {
-		httpError(w, "failed to validate", http.StatusForbidden, span, err)
+		recordLogin(r, span, form, nil, err)
+		loginError(w, "failed to validate", span, err)
 		return
 	}
-	if !validCreds {
-		w.WriteHeader(http.StatusForbidden)
+	userID := rec.ID
+	lr := assessLogin(r, span, userID)
+	if lr != nil && lr.assessment.Decision == risk.Block {
+		reportSuspicious(r, span, lr, "")
+		recordLogin(r, span, form, nil, errLoginBlocked)
+		httpError(w, CodeLoginBlocked, "login refused as suspicious", http.StatusForbidden, span, errLoginBlocked)
 		return
 	}
-	claims := map[string]interface{}{
-		"exp": httpauth.StandardTokenLife,
+	if lr != nil && lr.assessment.Decision == risk.StepUp {
+		// There is no second factor to complete yet so the login is refused, configureRisk doesn't allow a step up threshold
+		reportSuspicious(r, span, lr, "")
+		recordLogin(r, span, form, nil, errStepUpRequired)
+		httpError(w, CodeMFARequired, "a second factor is required to log in", http.StatusUnauthorized, span, errStepUpRequired)
+		return
+	}
+	now := time.Now()
+	claims, err := token.New(userID, now, httpauth.StandardTokenLife)
+	if err != nil {
+		httpError(w, CodeInternal, "failed to create token", http.StatusInternalServerError, span, err)
+		return
 	}
-	token, err := httpauth.CreateJWTWithClaims(r.Context(), Secrets, claims)
+	claims.Roles = rec.AccountRoles()
+	claims.Scope = strings.Join(login.Scopes(claims.Roles), " ")
+	tokenString, err := token.Sign(r.Context(), Secrets, claims)
 	if err != nil {
-		httpError(w, "failed to create token", http.StatusInternalServerError, span, err)
+		httpError(w, CodeInternal, "failed to create token", http.StatusInternalServerError, span, err)
+		return
+	}
+	s := data.Session{
+		ID:        claims.Id,
+		UserID:    userID,
+		Device:    form.Device,
+		UserAgent: r.UserAgent(),
+		IP:        clientIP(r),
+		CreatedAt: now,
+		LastSeen:  now,
+		ExpiresAt: time.Unix(claims.ExpiresAt, 0),
+	}
+	if err = applyRisk(w, lr, &s); err != nil {
+		httpError(w, CodeInternal, "failed to create session", http.StatusInternalServerError, span, err)
+		return
+	}
+	if err = session.Create(r.Context(), DbClient, &s); err != nil {
+		httpError(w, CodeInternal, "failed to create session", http.StatusInternalServerError, span, err)
+		return
+	}
+	recordLogin(r, span, form, &s, nil)
+	reportSuspicious(r, span, lr, s.ID)
+	if CookieSessions {
+		csrfToken, err := token.CSRF(r.Context(), Secrets, claims.Id)
+		if err != nil {
+			httpError(w, CodeInternal, "failed to create token", http.StatusInternalServerError, span, err)
+			return
+		}
+		setSessionCookies(w, tokenString, csrfToken, s.ExpiresAt)
+		// The token is only available to the browser through the HttpOnly cookie
+		tokenString = ""
+	}
+	if wantsLegacyResponse(r) {
+		_, _ = w.Write([]byte(tokenString))
+		return
+	}
+	writeLoginResponse(w, tokenString, userID, httpauth.StandardTokenLife)
+}
+
+// LogoutHandler is a http handler that accepts a POST request to revoke the session used to make the request, any session cookies are
+// cleared
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	_, span := logging.Tracer.Start(r.Context(), "logout-request")
+	defer span.End()
+
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, span, http.MethodPost)
 		return
 	}
-	_, _ = w.Write([]byte(token))
+
+	claims := requestClaims(r)
+	if err := session.Revoke(r.Context(), DbClient, claims.Subject, claims.Id); err != nil {
+		httpError(w, CodeInternal, "failed to revoke session", http.StatusInternalServerError, span, err)
+		return
+	}
+	clearSessionCookies(w)
 }
 
 // TestAuthHandler is an example http handler that can be used to test requests are being authenticated correctly, it should be initialised using
@@ -127,12 +242,6 @@ func testAuthHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
-func httpError(w http.ResponseWriter, msg string, httpStatus int, span trace.Span, err error) {
-	http.Error(w, msg, httpStatus)
-	span.RecordError(err)
-	span.SetStatus(codes.Error, msg)
-}
-
 func extractLoginFormDetails(r *http.Request) (*LoginFormDetails, error) {
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
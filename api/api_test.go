@@ -4,14 +4,21 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/blueambertech-demos/login-svc-gcp/data"
 	"github.com/blueambertech-demos/login-svc-gcp/mock"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/audit"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/events"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/login"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/outbox"
 	"github.com/blueambertech/logging"
+	"github.com/blueambertech/pubsub"
 )
 
 var testContext context.Context = context.Background()
@@ -20,8 +27,10 @@ func TestMain(m *testing.M) {
 	logging.Setup(testContext, data.ServiceName)
 	defer logging.DeferredCleanup(testContext)
 	DbClient = mock.NewNoSQLClient()
+	Logins = login.NewFirestoreRepository(DbClient)
 	Secrets = mock.NewSecretManager()
 	Events = &mock.PubSubHandler{}
+	Audit = audit.New(DbClient, Events, Secrets)
 	m.Run()
 }
 
@@ -166,3 +175,47 @@ func getTestPostBody(un, pw string) ([]byte, error) {
 	}
 	return json.Marshal(details)
 }
+
+func TestAddLoginHandlerPubSubDown(t *testing.T) {
+	DbClient.(*mock.NoSQLClient).ClearData()
+	broker := &mock.PubSubHandler{}
+	broker.FailPushes("", errors.New("pubsub unavailable"))
+	defer func(e pubsub.Handler) { Events = e }(Events)
+	Events = outbox.New(DbClient)
+
+	body, err := getTestPostBody("test@test.com", "somepass")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	req := httptest.NewRequest("POST", "/login/add", bytes.NewReader(body)).WithContext(testContext)
+	w := httptest.NewRecorder()
+	addLoginHandler(w, req)
+	if resp := w.Result(); resp.StatusCode != http.StatusOK {
+		t.Errorf("registration should succeed while Pub/Sub is down, got response code: %d", resp.StatusCode)
+	}
+
+	relay := outbox.NewRelay(DbClient, broker)
+	if n, _ := relay.RelayOnce(testContext); n != 0 || len(broker.Published(events.TopicID)) != 0 {
+		t.Error("nothing should be published while Pub/Sub is down")
+	}
+	// Make the failed entries due again once Pub/Sub recovers
+	broker.FailPushes("", nil)
+	docs, _ := DbClient.List(testContext, outbox.CollectionName)
+	for id, doc := range docs {
+		doc["NextAttempt"] = time.Now().Add(-time.Second)
+		_ = DbClient.Update(testContext, outbox.CollectionName, id, doc)
+	}
+	if _, err = relay.RelayOnce(testContext); err != nil {
+		t.Error(err)
+	}
+	rec, _ := Logins.GetByUsername(testContext, "test@test.com")
+	msgs := broker.Published(events.TopicID)
+	if len(msgs) != 1 {
+		t.Errorf("expected the created event to be published once Pub/Sub recovers, got %d", len(msgs))
+		return
+	}
+	if env, err := events.Parse([]byte(msgs[0])); err != nil || env.Type != events.LoginCreated || env.UserID != rec.ID {
+		t.Error("unexpected event:", msgs[0])
+	}
+}
@@ -0,0 +1,142 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/blueambertech-demos/login-svc-gcp/data"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/audit"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/events"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/login"
+	"github.com/blueambertech/logging"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// AuditLog is the response to an audit log query
+type AuditLog struct {
+	Records []audit.Record `json:"records"`
+}
+
+// auditEvent writes an audit record for a request, the actor is the user the request is authorised as. A failure to write the
+// record is added to the span rather than failing the request
+func auditEvent(r *http.Request, span trace.Span, eventType, targetID string, err error) {
+	rec := auditRecord(r, eventType, targetID, err)
+	if claims := requestClaims(r); claims != nil {
+		rec.ActorID = claims.Subject
+	}
+	writeAudit(r, span, rec)
+}
+
+// auditRecord returns an audit record with the details of a request filled in, the outcome is a failure if err is not nil
+func auditRecord(r *http.Request, eventType, targetID string, err error) *audit.Record {
+	rec := &audit.Record{
+		Type:      eventType,
+		TargetID:  targetID,
+		IP:        clientIP(r),
+		UserAgent: r.UserAgent(),
+		Outcome:   audit.Success,
+	}
+	if err != nil {
+		rec.Outcome = audit.Failure
+		rec.Reason = err.Error()
+	}
+	if sc := trace.SpanContextFromContext(r.Context()); sc.HasTraceID() {
+		rec.TraceID = sc.TraceID().String()
+	}
+	return rec
+}
+
+func writeAudit(r *http.Request, span trace.Span, rec *audit.Record) {
+	if err := Audit.Write(r.Context(), rec); err != nil {
+		span.AddEvent("failed to write audit record: " + rec.Type)
+	}
+}
+
+// AuditQueryHandler is a http handler that accepts a GET request with a user ID and optional RFC 3339 from and to times, and
+// returns the audit records where the user is the actor or the target, oldest first
+func auditQueryHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, span := logging.Tracer.Start(r.Context(), "audit-query-request")
+	defer span.End()
+
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, span, http.MethodGet)
+		return
+	}
+
+	q := r.URL.Query()
+	userID := q.Get("user")
+	from, fErr := parseQueryTime(q.Get("from"))
+	to, tErr := parseQueryTime(q.Get("to"))
+	if userID == "" || fErr != nil || tErr != nil {
+		httpError(w, CodeInvalidRequest, "user is required, from and to must be RFC 3339 times", http.StatusBadRequest, span,
+			errors.Join(fErr, tErr))
+		return
+	}
+	records, err := Audit.Query(ctx, userID, from, to)
+	if err != nil {
+		httpError(w, CodeInternal, "failed to query audit log", http.StatusInternalServerError, span, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(AuditLog{Records: records})
+}
+
+func parseQueryTime(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+// auditStatus audits a change of account status, locking an account is recorded as a lockout so that it stands out from other
+// status changes
+func auditStatus(r *http.Request, span trace.Span, userID string, status data.AccountStatus, reason string, err error) {
+	eventType := audit.StatusChanged
+	if status == data.StatusLocked {
+		eventType = audit.AccountLocked
+	}
+	rec := auditRecord(r, eventType, userID, err)
+	if claims := requestClaims(r); claims != nil {
+		rec.ActorID = claims.Subject
+	}
+	if err == nil {
+		rec.Reason = string(status) + ": " + reason
+	}
+	writeAudit(r, span, rec)
+}
+
+// recordLogin audits a login attempt and publishes it as an event, when the attempt fails the user is looked up by username so
+// that failures against an existing account can be found by its ID. s is the session created by a successful login. The error
+// text is only kept in the audit record, the event carries its problem code. Logins refused by risk scoring are audited as
+// refused rather than failed so that they don't count as failures when the next login is scored
+func recordLogin(r *http.Request, span trace.Span, form *LoginFormDetails, s *data.Session, err error) {
+	eventType, auditType := events.LoginSucceeded, audit.LoginSucceeded
+	payload := &events.LoginPayload{Device: form.Device}
+	userID := ""
+	if err != nil {
+		eventType, auditType = events.LoginFailed, audit.LoginFailed
+		if errors.Is(err, errLoginBlocked) || errors.Is(err, errStepUpRequired) {
+			auditType = audit.LoginRefused
+		}
+		payload.Reason = loginFailureCode(err)
+		if rec, lErr := Logins.GetByUsername(r.Context(), form.Username); lErr == nil {
+			userID = rec.ID
+		}
+	} else {
+		userID, payload.SessionID = s.UserID, s.ID
+	}
+	rec := auditRecord(r, auditType, userID, err)
+	rec.ActorID = userID
+	rec.UserName = login.CanonicalUsername(form.Username)
+	writeAudit(r, span, rec)
+	publishEvent(r, span, eventType, userID, payload)
+}
+
+// publishEvent publishes an event caused by a request, a failure to publish is added to the span rather than failing the request
+func publishEvent(r *http.Request, span trace.Span, eventType events.Type, userID string, payload interface{}) {
+	if err := events.Publish(r.Context(), Events, eventType, userID, payload); err != nil {
+		span.AddEvent("failed to publish event: " + string(eventType))
+	}
+}
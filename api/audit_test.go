@@ -0,0 +1,121 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/blueambertech-demos/login-svc-gcp/mock"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/audit"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/events"
+)
+
+func TestAuditQueryHandler(t *testing.T) {
+	DbClient.(*mock.NoSQLClient).ClearData()
+	adminToken, err := getAdminToken("admin@test.com", "somepass")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err = getTestToken("user@test.com", "somepass"); err != nil {
+		t.Error(err)
+		return
+	}
+	if tokenString, _ := loginTestUser("user@test.com", "wrongpass"); tokenString != "" {
+		t.Error("login with the wrong password should fail")
+		return
+	}
+	rec, err := Logins.GetByUsername(testContext, "user@test.com")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	resp := doAuthorized(auditQueryHandler, "GET", "/admin/audit?user="+rec.ID, adminToken, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Incorrect response code: %d", resp.StatusCode)
+		return
+	}
+	var log AuditLog
+	if err = json.NewDecoder(resp.Body).Decode(&log); err != nil {
+		t.Error(err)
+		return
+	}
+	expected := []string{audit.Registered, audit.LoginSucceeded, audit.LoginFailed}
+	if len(log.Records) != len(expected) {
+		t.Errorf("expected %d records, got %+v", len(expected), log.Records)
+		return
+	}
+	for i, r := range log.Records {
+		if r.Type != expected[i] || r.TargetID != rec.ID || r.UserName != "user@test.com" || r.IP == "" {
+			t.Errorf("unexpected record %d: %+v", i, r)
+		}
+	}
+	if failed := log.Records[2]; failed.Outcome != audit.Failure || failed.Reason == "" {
+		t.Errorf("failed login should be recorded with a reason: %+v", failed)
+	}
+	var reasons []string
+	for _, msg := range Events.(*mock.PubSubHandler).Published(events.TopicID) {
+		env, err := events.Parse([]byte(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var p events.LoginPayload
+		if env.Type == events.LoginFailed && env.DecodePayload(&p) == nil {
+			reasons = append(reasons, p.Reason)
+		}
+	}
+	if len(reasons) == 0 || reasons[len(reasons)-1] != CodeInvalidCredentials {
+		t.Errorf("login failed events should carry the problem code, got %v", reasons)
+	}
+
+	future := url.QueryEscape(time.Now().Add(time.Hour).Format(time.RFC3339))
+	resp = doAuthorized(auditQueryHandler, "GET", "/admin/audit?user="+rec.ID+"&from="+future, adminToken, nil)
+	if err = json.NewDecoder(resp.Body).Decode(&log); err != nil || len(log.Records) != 0 {
+		t.Error("expected no records after the from time, got", log.Records, err)
+	}
+	resp = doAuthorized(auditQueryHandler, "GET", "/admin/audit?user="+rec.ID+"&from=yesterday", adminToken, nil)
+	if p := decodeProblem(t, resp); resp.StatusCode != http.StatusBadRequest || p.Code != CodeInvalidRequest {
+		t.Errorf("expected %s for an invalid time, got %d %s", CodeInvalidRequest, resp.StatusCode, p.Code)
+	}
+}
+
+func TestAdminActionsAudited(t *testing.T) {
+	DbClient.(*mock.NoSQLClient).ClearData()
+	adminToken, err := getAdminToken("admin@test.com", "somepass")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err = getTestToken("user@test.com", "somepass"); err != nil {
+		t.Error(err)
+		return
+	}
+	rec, _ := Logins.GetByUsername(testContext, "user@test.com")
+	admin, _ := Logins.GetByUsername(testContext, "admin@test.com")
+	body := []byte(`{"roles":["user","support"],"status":"locked","reason":"suspicious activity"}`)
+	if resp := doAuthorized(adminUsersHandler, "PATCH", "/admin/users/"+rec.ID, adminToken, body); resp.StatusCode != http.StatusOK {
+		t.Errorf("Incorrect response code: %d", resp.StatusCode)
+		return
+	}
+
+	records, err := Audit.Query(testContext, admin.ID, time.Time{}, time.Time{})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	var types []string
+	for _, r := range records {
+		if r.TargetID == rec.ID {
+			types = append(types, r.Type)
+			if r.ActorID != admin.ID {
+				t.Errorf("admin should be the actor: %+v", r)
+			}
+		}
+	}
+	if len(types) != 2 || types[0] != audit.RolesChanged || types[1] != audit.AccountLocked {
+		t.Error("expected the role change and lockout to be audited, got", types)
+	}
+}
@@ -0,0 +1,219 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/login"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/session"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/token"
+	"github.com/blueambertech/logging"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type contextKey int
+
+const claimsKey contextKey = iota
+
+const (
+	// The __Host- prefix makes browsers reject the cookies unless they are Secure, have no Domain and use the root path
+	sessionCookieName = "__Host-session"
+	csrfCookieName    = "__Host-csrf"
+	csrfHeaderName    = "X-CSRF-Token"
+)
+
+// authorize is a middleware func that checks a request has a valid JWT bearer token, and that the session the token was issued
+// with has not been revoked, before allowing the request to continue
+func authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := logging.Tracer.Start(r.Context(), "authorize")
+		defer span.End()
+		tokenString, err := token.FromRequest(r)
+		if err != nil {
+			httpError(w, CodeUnauthorized, "error extracting token", http.StatusUnauthorized, span, err)
+			return
+		}
+		claims, ok := verifySession(ctx, w, tokenString, span)
+		if !ok {
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), claimsKey, claims)))
+	})
+}
+
+// authorizeAny is a variant of authorize for endpoints used by browsers, it accepts either a bearer token or a session cookie.
+// Requests authenticated with a cookie that change state must also carry the CSRF token issued at login in the X-CSRF-Token header
+func authorizeAny(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := logging.Tracer.Start(r.Context(), "authorize")
+		defer span.End()
+		tokenString, fromCookie, err := requestToken(r)
+		if err != nil {
+			httpError(w, CodeUnauthorized, "error extracting token", http.StatusUnauthorized, span, err)
+			return
+		}
+		claims, ok := verifySession(ctx, w, tokenString, span)
+		if !ok {
+			return
+		}
+		if fromCookie && !safeMethod(r.Method) {
+			if err = token.VerifyCSRF(ctx, Secrets, claims.Id, r.Header.Get(csrfHeaderName)); err != nil {
+				httpError(w, CodeInvalidCSRFToken, "failed to verify csrf token", http.StatusForbidden, span, err)
+				return
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), claimsKey, claims)))
+	})
+}
+
+// RequireRole returns a middleware func that only allows requests with a token issued to a user with the role to continue, it
+// must be used inside authorize or authorizeAny
+func RequireRole(role string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, span := logging.Tracer.Start(r.Context(), "require-role")
+			defer span.End()
+			if claims := requestClaims(r); claims == nil || !claims.HasRole(role) {
+				httpError(w, CodeForbidden, "the "+role+" role is required", http.StatusForbidden, span, nil)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireScope returns a middleware func that only allows requests with a token granted the scope to continue, it must be used
+// inside authorize or authorizeAny
+func RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, span := logging.Tracer.Start(r.Context(), "require-scope")
+			defer span.End()
+			if claims := requestClaims(r); claims == nil || !claims.HasScope(scope) {
+				httpError(w, CodeForbidden, "the "+scope+" scope is required", http.StatusForbidden, span, nil)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// verifySession verifies a token and the session it belongs to, writing an error response if either is invalid
+func verifySession(ctx context.Context, w http.ResponseWriter, tokenString string, span trace.Span) (*token.Claims, bool) {
+	claims, err := token.Parse(ctx, Secrets, tokenString)
+	if err != nil {
+		httpError(w, CodeInvalidToken, "failed to verify token", http.StatusForbidden, span, err)
+		return nil, false
+	}
+	s, err := session.Get(ctx, DbClient, claims.Id)
+	if err != nil {
+		httpError(w, CodeSessionInactive, "failed to verify session", http.StatusForbidden, span, err)
+		return nil, false
+	}
+	if s.UserID != claims.Subject || !s.Active(time.Now()) {
+		httpError(w, CodeSessionInactive, "session is no longer active", http.StatusForbidden, span, session.ErrNotFound)
+		return nil, false
+	}
+	// Tokens stop working as soon as an account is disabled or deleted, even though their sessions are still active
+	rec, err := Logins.GetByID(ctx, claims.Subject)
+	if err == nil {
+		err = login.StatusError(rec.Status)
+	}
+	if err == nil && !login.HasRoles(rec.AccountRoles(), claims.Roles...) {
+		// A role has been removed since the token was issued, the user must log in again to get a token with their current roles
+		httpError(w, CodeInvalidToken, "token roles are out of date", http.StatusForbidden, span, nil)
+		return nil, false
+	}
+	if errors.Is(err, login.ErrUserNotFound) {
+		httpError(w, CodeSessionInactive, "session is no longer active", http.StatusForbidden, span, err)
+		return nil, false
+	} else if err != nil {
+		loginError(w, "failed to verify account", span, err)
+		return nil, false
+	}
+	if err = session.Touch(ctx, DbClient, s); err != nil {
+		span.AddEvent("failed to update session last seen time")
+	}
+	return claims, true
+}
+
+// requestToken extracts the token from the Authorization header of a request, falling back to the session cookie
+func requestToken(r *http.Request) (string, bool, error) {
+	if r.Header.Get("Authorization") != "" {
+		tokenString, err := token.FromRequest(r)
+		return tokenString, false, err
+	}
+	c, err := r.Cookie(sessionCookieName)
+	if err != nil || c.Value == "" {
+		return "", false, errors.New("no auth header or session cookie")
+	}
+	return c.Value, true, nil
+}
+
+// requestClaims returns the token claims of a request that has passed through the authorize middleware
+func requestClaims(r *http.Request) *token.Claims {
+	claims, _ := r.Context().Value(claimsKey).(*token.Claims)
+	return claims
+}
+
+func setSessionCookies(w http.ResponseWriter, tokenString, csrfToken string, expires time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    tokenString,
+		Path:     "/",
+		Expires:  expires,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	// The CSRF cookie is readable by scripts so that browser clients can copy it into the X-CSRF-Token header
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    csrfToken,
+		Path:     "/",
+		Expires:  expires,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	w.Header().Set(csrfHeaderName, csrfToken)
+}
+
+func clearSessionCookies(w http.ResponseWriter) {
+	for _, name := range []string{sessionCookieName, csrfCookieName} {
+		http.SetCookie(w, &http.Cookie{
+			Name:     name,
+			Path:     "/",
+			MaxAge:   -1,
+			Secure:   true,
+			HttpOnly: name == sessionCookieName,
+			SameSite: http.SameSiteStrictMode,
+		})
+	}
+}
+
+func safeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// clientIP returns the IP address of the client that made a request. Each proxy appends the address it received the request
+// from to the X-Forwarded-For header, and anything before that is supplied by the client, so the client address is the entry
+// added by the outermost of the TrustedProxies. On Cloud Run that is the right-most entry
+func clientIP(r *http.Request) string {
+	if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" && TrustedProxies > 0 {
+		hops := strings.Split(fwd, ",")
+		// With fewer entries than proxies the request skipped the outer ones, every entry was still added by a trusted proxy
+		i := len(hops) - TrustedProxies
+		if i < 0 {
+			i = 0
+		}
+		return strings.TrimSpace(hops[i])
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
@@ -0,0 +1,212 @@
+package api
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/blueambertech-demos/login-svc-gcp/data"
+	"github.com/blueambertech-demos/login-svc-gcp/mock"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/login"
+)
+
+func TestAuthorizeMissingToken(t *testing.T) {
+	DbClient.(*mock.NoSQLClient).ClearData()
+	req := httptest.NewRequest("GET", "/testauth", nil).WithContext(testContext)
+	w := httptest.NewRecorder()
+	authorize(http.HandlerFunc(testAuthHandler)).ServeHTTP(w, req)
+	resp := w.Result()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Incorrect response code: %d", resp.StatusCode)
+	}
+}
+
+func TestAuthorizeValidToken(t *testing.T) {
+	DbClient.(*mock.NoSQLClient).ClearData()
+	tokenString, err := getTestToken("test@test.com", "somepass")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	resp := doAuthorized(testAuthHandler, "GET", "/testauth", tokenString, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Incorrect response code: %d", resp.StatusCode)
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	DbClient.(*mock.NoSQLClient).ClearData()
+	userToken, err := getTestToken("user@test.com", "somepass")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	adminToken, err := getAdminToken("admin@test.com", "somepass")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	handler := RequireRole(data.RoleAdmin)(http.HandlerFunc(testAuthHandler)).ServeHTTP
+	if resp := doAuthorized(handler, "GET", "/testauth", userToken, nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("user without the role should be rejected, got response code: %d", resp.StatusCode)
+	}
+	if resp := doAuthorized(handler, "GET", "/testauth", adminToken, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("Incorrect response code: %d", resp.StatusCode)
+	}
+
+	// Removing the role invalidates tokens issued with it
+	rec, _ := Logins.GetByUsername(testContext, "admin@test.com")
+	if err = login.SetRoles(testContext, Logins, rec.ID, []string{data.RoleUser}); err != nil {
+		t.Error(err)
+		return
+	}
+	if resp := doAuthorized(testAuthHandler, "GET", "/testauth", adminToken, nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("token with a removed role should be rejected, got response code: %d", resp.StatusCode)
+	}
+}
+
+func TestRequireScope(t *testing.T) {
+	DbClient.(*mock.NoSQLClient).ClearData()
+	userToken, err := getTestToken("user@test.com", "somepass")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	handler := RequireScope(login.ScopeAccount)(http.HandlerFunc(testAuthHandler)).ServeHTTP
+	if resp := doAuthorized(handler, "GET", "/testauth", userToken, nil); resp.StatusCode != http.StatusOK {
+		t.Errorf("Incorrect response code: %d", resp.StatusCode)
+	}
+	handler = RequireScope(login.ScopeService)(http.HandlerFunc(testAuthHandler)).ServeHTTP
+	if resp := doAuthorized(handler, "GET", "/testauth", userToken, nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("token without the scope should be rejected, got response code: %d", resp.StatusCode)
+	}
+}
+
+func TestLoginHandlerCookieSessions(t *testing.T) {
+	DbClient.(*mock.NoSQLClient).ClearData()
+	CookieSessions = true
+	defer func() { CookieSessions = false }()
+
+	cookies, csrfToken, err := getTestCookies("test@test.com", "somepass")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	session := findCookie(cookies, sessionCookieName)
+	if session == nil || !session.HttpOnly || !session.Secure || session.SameSite != http.SameSiteStrictMode {
+		t.Errorf("session cookie missing or insecure: %+v", session)
+	}
+	if findCookie(cookies, csrfCookieName) == nil || csrfToken == "" {
+		t.Error("csrf token not issued")
+	}
+
+	req := httptest.NewRequest("GET", "/testauth", nil).WithContext(testContext)
+	addCookies(req, cookies)
+	w := httptest.NewRecorder()
+	authorizeAny(http.HandlerFunc(testAuthHandler)).ServeHTTP(w, req)
+	if resp := w.Result(); resp.StatusCode != http.StatusOK {
+		t.Errorf("Incorrect response code: %d", resp.StatusCode)
+	}
+}
+
+func TestAuthorizeAnyCSRF(t *testing.T) {
+	DbClient.(*mock.NoSQLClient).ClearData()
+	CookieSessions = true
+	defer func() { CookieSessions = false }()
+
+	cookies, csrfToken, err := getTestCookies("test@test.com", "somepass")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	req := httptest.NewRequest("POST", "/sessions/revoke-all", nil).WithContext(testContext)
+	addCookies(req, cookies)
+	w := httptest.NewRecorder()
+	authorizeAny(http.HandlerFunc(revokeAllSessionsHandler)).ServeHTTP(w, req)
+	if resp := w.Result(); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("state changing request without csrf token should be rejected, got response code: %d", resp.StatusCode)
+	}
+
+	req = httptest.NewRequest("POST", "/logout", nil).WithContext(testContext)
+	addCookies(req, cookies)
+	req.Header.Set(csrfHeaderName, csrfToken)
+	w = httptest.NewRecorder()
+	authorizeAny(http.HandlerFunc(logoutHandler)).ServeHTTP(w, req)
+	resp := w.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Incorrect response code: %d", resp.StatusCode)
+	}
+	if c := findCookie(resp.Cookies(), sessionCookieName); c == nil || c.MaxAge >= 0 {
+		t.Error("session cookie not cleared on logout")
+	}
+}
+
+// getAdminToken adds a login with the supplied details, grants it the admin role and logs in with it
+func getAdminToken(un, pw string) (string, error) {
+	if _, err := getTestToken(un, pw); err != nil {
+		return "", err
+	}
+	if err := login.BootstrapAdmin(testContext, Logins, un); err != nil {
+		return "", err
+	}
+	return loginTestUser(un, pw)
+}
+
+func getTestCookies(un, pw string) ([]*http.Cookie, string, error) {
+	body, err := getTestPostBody(un, pw)
+	if err != nil {
+		return nil, "", err
+	}
+	req := httptest.NewRequest("POST", "/login/add", bytes.NewReader(body)).WithContext(testContext)
+	addLoginHandler(httptest.NewRecorder(), req)
+
+	req = httptest.NewRequest("POST", "/login", bytes.NewReader(body)).WithContext(testContext)
+	w := httptest.NewRecorder()
+	loginHandler(w, req)
+	resp := w.Result()
+	return resp.Cookies(), resp.Header.Get(csrfHeaderName), nil
+}
+
+func findCookie(cookies []*http.Cookie, name string) *http.Cookie {
+	for _, c := range cookies {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func addCookies(r *http.Request, cookies []*http.Cookie) {
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	defer func() { TrustedProxies = 1 }()
+	for _, tc := range []struct {
+		proxies int
+		fwd     string
+		want    string
+	}{
+		{1, "", "192.0.2.1"},
+		{1, "203.0.113.7", "203.0.113.7"},
+		// Entries before the one added by the proxy are supplied by the client
+		{1, "198.51.100.1, 203.0.113.7", "203.0.113.7"},
+		{2, "198.51.100.1, 203.0.113.7, 10.0.0.2", "203.0.113.7"},
+		{2, "203.0.113.7", "203.0.113.7"},
+		{0, "203.0.113.7", "192.0.2.1"},
+	} {
+		TrustedProxies = tc.proxies
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		if tc.fwd != "" {
+			req.Header.Set("X-Forwarded-For", tc.fwd)
+		}
+		if got := clientIP(req); got != tc.want {
+			t.Errorf("%d proxies, X-Forwarded-For %q: expected %s, got %s", tc.proxies, tc.fwd, tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/login"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Problem codes are stable, machine readable identifiers for each kind of error a client may need to handle
+const (
+	CodeInvalidRequest     = "invalid_request"
+	CodeMethodNotAllowed   = "method_not_allowed"
+	CodeInvalidEmail       = "invalid_email"
+	CodeWeakPassword       = "weak_password"
+	CodeUserExists         = "user_exists"
+	CodeInvalidCredentials = "invalid_credentials"
+	CodeAccountLocked      = "account_locked"
+	CodeAccountDisabled    = "account_disabled"
+	CodeAccountNotVerified = "account_not_verified"
+	CodeInvalidStatus      = "invalid_status"
+	CodeInvalidResetToken  = "invalid_reset_token"
+	CodeLoginBlocked       = "login_blocked"
+	CodeMFARequired        = "mfa_required"
+	CodeUnauthorized       = "unauthorized"
+	CodeForbidden          = "forbidden"
+	CodeInvalidToken       = "invalid_token"
+	CodeInvalidCSRFToken   = "invalid_csrf_token"
+	CodeSessionInactive    = "session_inactive"
+	CodeNotFound           = "not_found"
+	CodeConflict           = "conflict"
+	CodeUnavailable        = "service_unavailable"
+	CodeInternal           = "internal_error"
+)
+
+const problemContentType = "application/problem+json"
+
+// Problem is an RFC 7807 problem details error response
+type Problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Code   string `json:"code"`
+}
+
+// httpError writes a problem details response and records the error against the trace span. The message is sent to the client
+// so must never contain internal error text, the underlying error is only recorded on the span. Following the OpenTelemetry
+// HTTP conventions only server errors mark the span status as an error
+func httpError(w http.ResponseWriter, code, msg string, httpStatus int, span trace.Span, err error) {
+	w.Header().Set("Content-Type", problemContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(httpStatus)
+	_ = json.NewEncoder(w).Encode(Problem{
+		Type:   "/problems/" + strings.ReplaceAll(code, "_", "-"),
+		Title:  msg,
+		Status: httpStatus,
+		Code:   code,
+	})
+
+	span.SetAttributes(
+		attribute.Int("http.response.status_code", httpStatus),
+		attribute.String("error.type", code),
+	)
+	if err != nil {
+		span.RecordError(err)
+	}
+	if httpStatus >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, msg)
+	}
+}
+
+// methodNotAllowed writes a problem details response for a request made with an unsupported method
+func methodNotAllowed(w http.ResponseWriter, span trace.Span, allowed string) {
+	w.Header().Set("Allow", allowed)
+	httpError(w, CodeMethodNotAllowed, "method not allowed", http.StatusMethodNotAllowed, span, nil)
+}
+
+// loginError writes the problem details response for an error returned by the login package, msg is used for any unexpected errors
+func loginError(w http.ResponseWriter, msg string, span trace.Span, err error) {
+	var storageErr *login.StorageError
+	switch {
+	case errors.Is(err, login.ErrInvalidEmail):
+		httpError(w, CodeInvalidEmail, "username must be a valid email address", http.StatusBadRequest, span, err)
+	case errors.Is(err, login.ErrWeakPassword):
+		httpError(w, CodeWeakPassword, "password does not meet requirements", http.StatusBadRequest, span, err)
+	case errors.Is(err, login.ErrUserExists):
+		httpError(w, CodeUserExists, "a user already exists with this username", http.StatusConflict, span, err)
+	case errors.Is(err, login.ErrUserNotFound), errors.Is(err, login.ErrInvalidCredentials):
+		// Both are reported the same way so that the response can't be used to find out which usernames exist
+		httpError(w, CodeInvalidCredentials, "invalid username or password", http.StatusForbidden, span, err)
+	case errors.Is(err, login.ErrAccountDisabled):
+		httpError(w, CodeAccountDisabled, "account is disabled", http.StatusForbidden, span, err)
+	case errors.Is(err, login.ErrAccountLocked):
+		httpError(w, CodeAccountLocked, "account is locked", http.StatusForbidden, span, err)
+	case errors.Is(err, login.ErrAccountNotVerified):
+		httpError(w, CodeAccountNotVerified, "account is pending verification", http.StatusForbidden, span, err)
+	case errors.Is(err, login.ErrInvalidStatus):
+		httpError(w, CodeInvalidStatus, "status must be one of active, disabled, locked or pending_verification", http.StatusBadRequest, span, err)
+	case errors.Is(err, login.ErrConflict):
+		httpError(w, CodeConflict, "the login was changed by another request, try again", http.StatusConflict, span, err)
+	case errors.As(err, &storageErr):
+		httpError(w, CodeUnavailable, "login storage is unavailable", http.StatusServiceUnavailable, span, err)
+	default:
+		httpError(w, CodeInternal, msg, http.StatusInternalServerError, span, err)
+	}
+}
+
+// loginFailureCode returns the problem code of a failed login, it is published in login events in place of the error text so
+// that subscribers get a stable reason that reveals nothing about the service or whether the username exists
+func loginFailureCode(err error) string {
+	var storageErr *login.StorageError
+	switch {
+	case errors.Is(err, login.ErrUserNotFound), errors.Is(err, login.ErrInvalidCredentials), errors.Is(err, login.ErrInvalidEmail):
+		return CodeInvalidCredentials
+	case errors.Is(err, login.ErrAccountDisabled):
+		return CodeAccountDisabled
+	case errors.Is(err, login.ErrAccountLocked):
+		return CodeAccountLocked
+	case errors.Is(err, login.ErrAccountNotVerified):
+		return CodeAccountNotVerified
+	case errors.Is(err, errLoginBlocked):
+		return CodeLoginBlocked
+	case errors.Is(err, errStepUpRequired):
+		return CodeMFARequired
+	case errors.As(err, &storageErr):
+		return CodeUnavailable
+	default:
+		return CodeInternal
+	}
+}
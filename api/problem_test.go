@@ -0,0 +1,119 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/blueambertech-demos/login-svc-gcp/mock"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/login"
+	"github.com/blueambertech/logging"
+)
+
+func TestHTTPErrorDoesNotLeakInternalError(t *testing.T) {
+	_, span := logging.Tracer.Start(testContext, "test-span")
+	defer span.End()
+	w := httptest.NewRecorder()
+	httpError(w, CodeInternal, "failed to add login", http.StatusInternalServerError, span, errors.New("rpc error: secret internals"))
+	resp := w.Result()
+	if ct := resp.Header.Get("Content-Type"); ct != problemContentType {
+		t.Errorf("Incorrect content type: %s", ct)
+	}
+	body := w.Body.String()
+	if strings.Contains(body, "secret internals") {
+		t.Error("internal error text leaked in response:", body)
+	}
+	var p Problem
+	if err := json.Unmarshal([]byte(body), &p); err != nil {
+		t.Error(err)
+		return
+	}
+	if p.Code != CodeInternal || p.Status != http.StatusInternalServerError || p.Type == "" {
+		t.Errorf("incorrect problem details: %+v", p)
+	}
+}
+
+func TestAddLoginHandlerProblemCodes(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		password string
+		status   int
+		code     string
+	}{
+		{"invalid email", "notanemail", "somepass", http.StatusBadRequest, CodeInvalidEmail},
+		{"weak password", "test@test.com", "", http.StatusBadRequest, CodeWeakPassword},
+		{"duplicate user", "exists@test.com", "somepass", http.StatusConflict, CodeUserExists},
+	}
+	DbClient.(*mock.NoSQLClient).ClearData()
+	body, _ := getTestPostBody("exists@test.com", "somepass")
+	addLoginHandler(httptest.NewRecorder(), httptest.NewRequest("POST", "/login/add", bytes.NewReader(body)).WithContext(testContext))
+
+	for _, tc := range tests {
+		body, _ := getTestPostBody(tc.username, tc.password)
+		w := httptest.NewRecorder()
+		addLoginHandler(w, httptest.NewRequest("POST", "/login/add", bytes.NewReader(body)).WithContext(testContext))
+		p := decodeProblem(t, w.Result())
+		if p.Status != tc.status || p.Code != tc.code {
+			t.Errorf("%s: expected %d %s got %d %s", tc.name, tc.status, tc.code, p.Status, p.Code)
+		}
+	}
+}
+
+func TestMethodNotAllowedProblem(t *testing.T) {
+	w := httptest.NewRecorder()
+	loginHandler(w, httptest.NewRequest("GET", "/login", nil).WithContext(testContext))
+	resp := w.Result()
+	if resp.Header.Get("Allow") != http.MethodPost {
+		t.Errorf("Incorrect Allow header: %s", resp.Header.Get("Allow"))
+	}
+	if p := decodeProblem(t, resp); p.Code != CodeMethodNotAllowed {
+		t.Errorf("Incorrect problem code: %s", p.Code)
+	}
+}
+
+func decodeProblem(t *testing.T, resp *http.Response) Problem {
+	t.Helper()
+	defer resp.Body.Close()
+	var p Problem
+	if ct := resp.Header.Get("Content-Type"); ct != problemContentType {
+		t.Errorf("Incorrect content type: %s", ct)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&p); err != nil {
+		t.Error(err)
+	}
+	return p
+}
+
+func TestLoginErrorStatusCodes(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{login.ErrUserExists, http.StatusConflict, CodeUserExists},
+		{login.ErrUserNotFound, http.StatusForbidden, CodeInvalidCredentials},
+		{login.ErrInvalidCredentials, http.StatusForbidden, CodeInvalidCredentials},
+		{login.ErrDuplicateRecords, http.StatusInternalServerError, CodeInternal},
+		{login.ErrAccountDisabled, http.StatusForbidden, CodeAccountDisabled},
+		{login.ErrAccountLocked, http.StatusForbidden, CodeAccountLocked},
+		{login.ErrAccountNotVerified, http.StatusForbidden, CodeAccountNotVerified},
+		{login.ErrInvalidStatus, http.StatusBadRequest, CodeInvalidStatus},
+		{&login.StorageError{Op: "read", Err: errors.New("down")}, http.StatusServiceUnavailable, CodeUnavailable},
+		{fmt.Errorf("wrapped: %w", login.ErrWeakPassword), http.StatusBadRequest, CodeWeakPassword},
+	}
+	_, span := logging.Tracer.Start(testContext, "test-span")
+	defer span.End()
+	for _, tc := range tests {
+		w := httptest.NewRecorder()
+		loginError(w, "unexpected", span, tc.err)
+		if p := decodeProblem(t, w.Result()); p.Status != tc.status || p.Code != tc.code {
+			t.Errorf("%v: expected %d %s got %d %s", tc.err, tc.status, tc.code, p.Status, p.Code)
+		}
+	}
+}
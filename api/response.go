@@ -0,0 +1,55 @@
+package api
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// LoginResponseVersion is the version of the LoginResponse format, it is incremented whenever a breaking change is made
+const LoginResponseVersion = 1
+
+type LoginResponse struct {
+	Version      int    `json:"version"`
+	AccessToken  string `json:"access_token,omitempty"`
+	TokenType    string `json:"token_type,omitempty"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	UserID       string `json:"user_id"`
+	MFARequired  bool   `json:"mfa_required"`
+}
+
+// wantsLegacyResponse reports whether the bare JWT should be written as plain text rather than a LoginResponse. A client can
+// ask for either format explicitly in its Accept header, otherwise the LegacyTokenResponse setting decides
+func wantsLegacyResponse(r *http.Request) bool {
+	var plain bool
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err != nil {
+			continue
+		}
+		if mediaType == "application/json" || strings.HasSuffix(mediaType, "+json") {
+			return false
+		}
+		if mediaType == "text/plain" {
+			plain = true
+		}
+	}
+	return plain || LegacyTokenResponse
+}
+
+func writeLoginResponse(w http.ResponseWriter, tokenString, userID string, life time.Duration) {
+	resp := LoginResponse{
+		Version:     LoginResponseVersion,
+		AccessToken: tokenString,
+		ExpiresIn:   int64(life / time.Second),
+		UserID:      userID,
+	}
+	if tokenString != "" {
+		resp.TokenType = "Bearer"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,85 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/blueambertech-demos/login-svc-gcp/mock"
+)
+
+func TestWantsLegacyResponse(t *testing.T) {
+	tests := []struct {
+		accept string
+		legacy bool
+		want   bool
+	}{
+		{"", false, false},
+		{"*/*", false, false},
+		{"application/json", false, false},
+		{"text/plain", false, true},
+		{"text/plain; charset=utf-8", false, true},
+		{"", true, true},
+		{"application/json", true, false},
+		{"text/plain, application/json;q=0.9", true, false},
+	}
+	defer func() { LegacyTokenResponse = false }()
+	for _, tc := range tests {
+		LegacyTokenResponse = tc.legacy
+		req := httptest.NewRequest("POST", "/login", nil)
+		req.Header.Set("Accept", tc.accept)
+		if got := wantsLegacyResponse(req); got != tc.want {
+			t.Errorf("accept %q with legacy %v: expected %v got %v", tc.accept, tc.legacy, tc.want, got)
+		}
+	}
+}
+
+func TestLoginHandlerJSONResponse(t *testing.T) {
+	DbClient.(*mock.NoSQLClient).ClearData()
+	if _, err := getTestToken("test@test.com", "somepass"); err != nil {
+		t.Error(err)
+		return
+	}
+	body, _ := getTestPostBody("test@test.com", "somepass")
+	req := httptest.NewRequest("POST", "/login", bytes.NewReader(body)).WithContext(testContext)
+	req.Header.Set("Accept", "application/json")
+	w := httptest.NewRecorder()
+	loginHandler(w, req)
+	resp := w.Result()
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Incorrect content type: %s", ct)
+	}
+	var lr LoginResponse
+	if err := json.NewDecoder(resp.Body).Decode(&lr); err != nil {
+		t.Error(err)
+		return
+	}
+	if lr.Version != LoginResponseVersion || lr.AccessToken == "" || lr.TokenType != "Bearer" || lr.ExpiresIn <= 0 || lr.UserID == "" {
+		t.Errorf("incomplete login response: %+v", lr)
+	}
+}
+
+func TestLoginHandlerLegacyResponse(t *testing.T) {
+	DbClient.(*mock.NoSQLClient).ClearData()
+	if _, err := getTestToken("test@test.com", "somepass"); err != nil {
+		t.Error(err)
+		return
+	}
+	body, _ := getTestPostBody("test@test.com", "somepass")
+	req := httptest.NewRequest("POST", "/login", bytes.NewReader(body)).WithContext(testContext)
+	req.Header.Set("Accept", "text/plain")
+	w := httptest.NewRecorder()
+	loginHandler(w, req)
+	resp := w.Result()
+	tokenString, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if resp.StatusCode != http.StatusOK || len(tokenString) == 0 || tokenString[0] == '{' {
+		t.Errorf("expected a bare token, got %d %s", resp.StatusCode, tokenString)
+	}
+}
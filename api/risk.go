@@ -0,0 +1,185 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/blueambertech-demos/login-svc-gcp/data"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/audit"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/events"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/risk"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/session"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// deviceCookieName holds a random ID that identifies the client in the session history of the accounts it logs in to
+	deviceCookieName = "__Host-device"
+	deviceCookieLife = 400 * 24 * time.Hour
+
+	// riskFailureWindow is how far back failed logins are counted when scoring an attempt
+	riskFailureWindow = time.Hour
+)
+
+var (
+	// Risk scores logins with valid credentials before a session is created, nil disables scoring
+	Risk *risk.Engine
+	// GeoIP locates the IP of each login for the rules that use locations, nil leaves locations unknown
+	GeoIP risk.Locator
+
+	errLoginBlocked = errors.New("login blocked by risk assessment")
+	// errStepUpRequired refuses a login that needs a second factor, none is supported yet
+	errStepUpRequired = errors.New("login needs a second factor")
+)
+
+// loginRisk is a scored login attempt
+type loginRisk struct {
+	attempt    *risk.Attempt
+	assessment *risk.Assessment
+}
+
+// assessLogin scores a login to an account whose credentials have just been checked, it returns nil when scoring is disabled.
+// History that can't be read is added to the span and left out, so an attempt is never refused because the history is
+// unavailable
+func assessLogin(r *http.Request, span trace.Span, userID string) *loginRisk {
+	if Risk == nil {
+		return nil
+	}
+	ctx := r.Context()
+	a := &risk.Attempt{
+		UserID:    userID,
+		Time:      time.Now(),
+		IP:        clientIP(r),
+		UserAgent: r.UserAgent(),
+	}
+	if c, err := r.Cookie(deviceCookieName); err == nil {
+		a.DeviceID = c.Value
+	}
+	if GeoIP != nil {
+		loc, err := GeoIP.Locate(a.IP)
+		if err != nil {
+			span.AddEvent("failed to locate IP")
+		}
+		a.Location = loc
+	}
+
+	if sessions, err := session.ListAll(ctx, DbClient, userID); err != nil {
+		span.AddEvent("failed to read login history")
+	} else {
+		for i := range sessions {
+			s := &sessions[i]
+			a.History = append(a.History, risk.Login{
+				Time:      s.CreatedAt,
+				IP:        s.IP,
+				UserAgent: s.UserAgent,
+				DeviceID:  s.DeviceID,
+				Location:  sessionLocation(s),
+			})
+		}
+	}
+	since := a.Time.Add(-riskFailureWindow)
+	if records, err := Audit.Query(ctx, userID, since, time.Time{}); err != nil {
+		span.AddEvent("failed to read account failures")
+	} else {
+		for _, rec := range records {
+			if rec.Type == audit.LoginFailed && rec.TargetID == userID {
+				a.AccountFailures++
+			}
+		}
+	}
+	if records, err := Audit.QueryIP(ctx, a.IP, since, time.Time{}); err != nil {
+		span.AddEvent("failed to read IP failures")
+	} else {
+		usernames := map[string]bool{}
+		for _, rec := range records {
+			if rec.Type == audit.LoginFailed {
+				a.IPFailures++
+				usernames[rec.UserName] = true
+			}
+		}
+		a.IPUsernames = len(usernames)
+	}
+
+	assessment := Risk.Assess(a)
+	span.SetAttributes(attribute.Int("risk.score", assessment.Score), attribute.String("risk.decision", string(assessment.Decision)))
+	return &loginRisk{attempt: a, assessment: assessment}
+}
+
+// applyRisk copies the device and location of a scored attempt to its session, the device cookie is set for a client that
+// doesn't have one yet
+func applyRisk(w http.ResponseWriter, lr *loginRisk, s *data.Session) error {
+	if lr == nil {
+		return nil
+	}
+	if lr.attempt.DeviceID == "" {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return err
+		}
+		lr.attempt.DeviceID = hex.EncodeToString(b)
+	}
+	s.DeviceID = lr.attempt.DeviceID
+	if loc := lr.attempt.Location; loc != nil {
+		s.Located, s.Country, s.Latitude, s.Longitude = true, loc.Country, loc.Latitude, loc.Longitude
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     deviceCookieName,
+		Value:    s.DeviceID,
+		Path:     "/",
+		Expires:  time.Now().Add(deviceCookieLife),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// reportSuspicious audits a suspicious login and publishes it as a login.suspicious event, sessionID is empty when the login
+// was not allowed to complete
+func reportSuspicious(r *http.Request, span trace.Span, lr *loginRisk, sessionID string) {
+	if lr == nil || !lr.assessment.Suspicious {
+		return
+	}
+	a, assessment := lr.attempt, lr.assessment
+	payload := &events.SuspiciousPayload{
+		SessionID: sessionID,
+		IP:        a.IP,
+		Score:     assessment.Score,
+		Decision:  string(assessment.Decision),
+		Signals:   make([]events.RiskSignal, len(assessment.Signals)),
+	}
+	if a.Location != nil {
+		payload.Country = a.Location.Country
+	}
+	for i, s := range assessment.Signals {
+		payload.Signals[i] = events.RiskSignal{Rule: s.Rule, Score: s.Score, Reason: s.Reason}
+	}
+	rec := auditRecord(r, audit.SuspiciousLogin, a.UserID, nil)
+	rec.ActorID = a.UserID
+	rec.Reason = riskReason(assessment)
+	writeAudit(r, span, rec)
+	publishEvent(r, span, events.SuspiciousLogin, a.UserID, payload)
+}
+
+// riskReason summarises an assessment for an audit record, e.g. "step_up: new_device, impossible_travel"
+func riskReason(assessment *risk.Assessment) string {
+	reason := string(assessment.Decision) + ":"
+	for i, s := range assessment.Signals {
+		if i > 0 {
+			reason += ","
+		}
+		reason += " " + s.Rule
+	}
+	return reason
+}
+
+func sessionLocation(s *data.Session) *risk.Location {
+	if !s.Located {
+		return nil
+	}
+	return &risk.Location{Country: s.Country, Latitude: s.Latitude, Longitude: s.Longitude}
+}
@@ -0,0 +1,188 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/blueambertech-demos/login-svc-gcp/mock"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/audit"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/events"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/risk"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/session"
+)
+
+type fakeLocator map[string]*risk.Location
+
+func (f fakeLocator) Locate(ip string) (*risk.Location, error) {
+	return f[ip], nil
+}
+
+const (
+	londonIP = "81.2.69.160"
+	sydneyIP = "1.128.0.1"
+)
+
+func riskLogin(t *testing.T, ip, userAgent string, cookies ...*http.Cookie) *http.Response {
+	t.Helper()
+	body, err := getTestPostBody("risky@test.com", "somepass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("POST", "/login", bytes.NewReader(body)).WithContext(testContext)
+	req.Header.Set("X-Forwarded-For", ip)
+	req.Header.Set("User-Agent", userAgent)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	loginHandler(w, req)
+	return w.Result()
+}
+
+func TestLoginRiskScoring(t *testing.T) {
+	DbClient.(*mock.NoSQLClient).ClearData()
+	Events.(*mock.PubSubHandler).Reset()
+	Risk = &risk.Engine{Rules: risk.DefaultRules(), SuspiciousScore: 30, StepUpScore: 50, BlockScore: 100}
+	GeoIP = fakeLocator{
+		londonIP: {Country: "GB", Latitude: 51.5074, Longitude: -0.1278},
+		sydneyIP: {Country: "AU", Latitude: -33.8688, Longitude: 151.2093},
+	}
+	defer func() { Risk, GeoIP = nil, nil }()
+	if _, err := getTestToken("risky@test.com", "somepass"); err != nil {
+		t.Fatal(err)
+	}
+	rec, err := Logins.GetByUsername(testContext, "risky@test.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first login had no history to compare with, start again from a known device in London
+	if _, err = session.DeleteAll(testContext, DbClient, rec.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := riskLogin(t, londonIP, "browser/1")
+	var lr LoginResponse
+	if err = json.NewDecoder(resp.Body).Decode(&lr); err != nil || resp.StatusCode != http.StatusOK || lr.AccessToken == "" {
+		t.Fatalf("first login should be allowed, got %d %+v", resp.StatusCode, lr)
+	}
+	device := findCookie(resp.Cookies(), deviceCookieName)
+	if device == nil || device.Value == "" || !device.HttpOnly || !device.Secure {
+		t.Fatalf("login should set a secure device cookie, got %+v", device)
+	}
+	sessions, _ := session.List(testContext, DbClient, rec.ID)
+	if len(sessions) != 1 || sessions[0].DeviceID != device.Value || !sessions[0].Located || sessions[0].Country != "GB" {
+		t.Errorf("session should record the device and location, got %+v", sessions)
+	}
+
+	// The same device in the same place is not suspicious
+	if resp = riskLogin(t, londonIP, "browser/1", device); resp.StatusCode != http.StatusOK {
+		t.Errorf("login from a known device should be allowed, got %d", resp.StatusCode)
+	}
+	if msgs := suspiciousEvents(t); len(msgs) != 0 {
+		t.Errorf("expected no suspicious login events, got %+v", msgs)
+	}
+
+	// Sydney moments later is a new country and impossible travel, which needs a second factor. None is supported yet so the
+	// login is refused and audited as a failure
+	resp = riskLogin(t, sydneyIP, "browser/1", device)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("step up should refuse the login, got %d", resp.StatusCode)
+	}
+	if p := decodeProblem(t, resp); p.Code != CodeMFARequired {
+		t.Errorf("unexpected problem code: %s", p.Code)
+	}
+	if sessions, _ = session.List(testContext, DbClient, rec.ID); len(sessions) != 2 {
+		t.Errorf("no session should be created for a step up, got %d sessions", len(sessions))
+	}
+	msgs := suspiciousEvents(t)
+	if len(msgs) != 1 || msgs[0].Decision != string(risk.StepUp) || msgs[0].Country != "AU" || msgs[0].SessionID != "" ||
+		len(msgs[0].Signals) != 2 {
+		t.Errorf("expected a suspicious login event for the step up, got %+v", msgs)
+	}
+
+	// A new device as well is refused
+	resp = riskLogin(t, sydneyIP, "other/2")
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("login should be blocked, got %d", resp.StatusCode)
+	}
+	if p := decodeProblem(t, resp); p.Code != CodeLoginBlocked {
+		t.Errorf("unexpected problem code: %s", p.Code)
+	}
+	if msgs = suspiciousEvents(t); len(msgs) != 2 || msgs[1].Decision != string(risk.Block) {
+		t.Errorf("expected a suspicious login event for the block, got %+v", msgs)
+	}
+
+	records, err := Audit.Query(testContext, rec.ID, time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var suspicious, steppedUp, blocked, failed int
+	for _, r := range records {
+		switch {
+		case r.Type == audit.SuspiciousLogin:
+			suspicious++
+		case r.Type == audit.LoginRefused && r.Reason == errStepUpRequired.Error():
+			steppedUp++
+		case r.Type == audit.LoginRefused && r.Reason == errLoginBlocked.Error():
+			blocked++
+		case r.Type == audit.LoginFailed:
+			failed++
+		}
+	}
+	if suspicious != 2 || steppedUp != 1 || blocked != 1 || failed != 0 {
+		t.Errorf("expected 2 suspicious logins, 1 step up and 1 blocked login to be audited and no failures, got %d, %d, %d and %d",
+			suspicious, steppedUp, blocked, failed)
+	}
+}
+
+func TestLoginRiskCredentialStuffing(t *testing.T) {
+	DbClient.(*mock.NoSQLClient).ClearData()
+	Events.(*mock.PubSubHandler).Reset()
+	Risk = risk.NewEngine()
+	defer func() { Risk = nil }()
+	if _, err := getTestToken("risky@test.com", "somepass"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		body, _ := getTestPostBody("victim"+string(rune('a'+i))+"@test.com", "guess")
+		req := httptest.NewRequest("POST", "/login", bytes.NewReader(body)).WithContext(testContext)
+		req.Header.Set("X-Forwarded-For", londonIP)
+		loginHandler(httptest.NewRecorder(), req)
+	}
+
+	// The default engine only reports the attempt, it is from the same client as the first login so only the IP stands out
+	if resp := riskLogin(t, londonIP, ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("login should be allowed, got %d", resp.StatusCode)
+	}
+	msgs := suspiciousEvents(t)
+	if len(msgs) != 1 || msgs[0].Decision != string(risk.Allow) || msgs[0].SessionID == "" {
+		t.Fatalf("expected a suspicious login event, got %+v", msgs)
+	}
+	if s := msgs[0].Signals; len(s) != 1 || s[0].Rule != "credential_stuffing" {
+		t.Errorf("expected a credential stuffing signal, got %+v", s)
+	}
+}
+
+func suspiciousEvents(t *testing.T) []events.SuspiciousPayload {
+	t.Helper()
+	var payloads []events.SuspiciousPayload
+	for _, msg := range Events.(*mock.PubSubHandler).Published(events.TopicID) {
+		env, err := events.Parse([]byte(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if env.Type != events.SuspiciousLogin {
+			continue
+		}
+		var p events.SuspiciousPayload
+		if err = env.DecodePayload(&p); err != nil {
+			t.Fatal(err)
+		}
+		payloads = append(payloads, p)
+	}
+	return payloads
+}
@@ -0,0 +1,100 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/session"
+	"github.com/blueambertech/logging"
+)
+
+type SessionDetails struct {
+	ID        string    `json:"id"`
+	Device    string    `json:"device,omitempty"`
+	UserAgent string    `json:"userAgent"`
+	IP        string    `json:"ip"`
+	CreatedAt time.Time `json:"createdAt"`
+	LastSeen  time.Time `json:"lastSeen"`
+	Current   bool      `json:"current"`
+}
+
+type RevokeSessionDetails struct {
+	ID string `json:"id"`
+}
+
+// ListSessionsHandler is a http handler that accepts a GET request and returns the active sessions of the authenticated user
+func listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	_, span := logging.Tracer.Start(r.Context(), "list-sessions-request")
+	defer span.End()
+
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, span, http.MethodGet)
+		return
+	}
+
+	claims := requestClaims(r)
+	sessions, err := session.List(r.Context(), DbClient, claims.Subject)
+	if err != nil {
+		httpError(w, CodeInternal, "failed to list sessions", http.StatusInternalServerError, span, err)
+		return
+	}
+	resp := make([]SessionDetails, len(sessions))
+	for i, s := range sessions {
+		resp[i] = SessionDetails{
+			ID:        s.ID,
+			Device:    s.Device,
+			UserAgent: s.UserAgent,
+			IP:        s.IP,
+			CreatedAt: s.CreatedAt,
+			LastSeen:  s.LastSeen,
+			Current:   s.ID == claims.Id,
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// RevokeSessionHandler is a http handler that accepts a POST request to revoke one of the authenticated user's sessions
+func revokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	_, span := logging.Tracer.Start(r.Context(), "revoke-session-request")
+	defer span.End()
+
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, span, http.MethodPost)
+		return
+	}
+
+	var form RevokeSessionDetails
+	if err := json.NewDecoder(r.Body).Decode(&form); err != nil || form.ID == "" {
+		httpError(w, CodeInvalidRequest, "failed to extract form data", http.StatusBadRequest, span, err)
+		return
+	}
+
+	err := session.Revoke(r.Context(), DbClient, requestClaims(r).Subject, form.ID)
+	if errors.Is(err, session.ErrNotFound) {
+		httpError(w, CodeNotFound, "session not found", http.StatusNotFound, span, err)
+		return
+	} else if err != nil {
+		httpError(w, CodeInternal, "failed to revoke session", http.StatusInternalServerError, span, err)
+		return
+	}
+}
+
+// RevokeAllSessionsHandler is a http handler that accepts a POST request to revoke every session of the authenticated user,
+// including the one used to make the request
+func revokeAllSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	_, span := logging.Tracer.Start(r.Context(), "revoke-all-sessions-request")
+	defer span.End()
+
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, span, http.MethodPost)
+		return
+	}
+
+	if _, err := session.RevokeAll(r.Context(), DbClient, requestClaims(r).Subject); err != nil {
+		httpError(w, CodeInternal, "failed to revoke sessions", http.StatusInternalServerError, span, err)
+		return
+	}
+}
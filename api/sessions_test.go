@@ -0,0 +1,132 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/blueambertech-demos/login-svc-gcp/mock"
+)
+
+func TestListSessionsHandler(t *testing.T) {
+	DbClient.(*mock.NoSQLClient).ClearData()
+	tokenString, err := getTestToken("test@test.com", "somepass")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	resp := doAuthorized(listSessionsHandler, "GET", "/sessions", tokenString, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Incorrect response code: %d", resp.StatusCode)
+		return
+	}
+	defer resp.Body.Close()
+	var sessions []SessionDetails
+	if err = json.NewDecoder(resp.Body).Decode(&sessions); err != nil {
+		t.Error(err)
+		return
+	}
+	if len(sessions) != 1 || !sessions[0].Current {
+		t.Errorf("expected the current session to be listed, got %+v", sessions)
+	}
+}
+
+func TestRevokeSessionHandler(t *testing.T) {
+	DbClient.(*mock.NoSQLClient).ClearData()
+	tokenString, err := getTestToken("test@test.com", "somepass")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	resp := doAuthorized(listSessionsHandler, "GET", "/sessions", tokenString, nil)
+	defer resp.Body.Close()
+	var sessions []SessionDetails
+	if err = json.NewDecoder(resp.Body).Decode(&sessions); err != nil || len(sessions) == 0 {
+		t.Error("failed to list sessions", err)
+		return
+	}
+
+	body, _ := json.Marshal(RevokeSessionDetails{ID: sessions[0].ID})
+	resp = doAuthorized(revokeSessionHandler, "POST", "/sessions/revoke", tokenString, body)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Incorrect response code: %d", resp.StatusCode)
+		return
+	}
+	resp = doAuthorized(testAuthHandler, "GET", "/testauth", tokenString, nil)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("revoked token should be rejected, got response code: %d", resp.StatusCode)
+	}
+}
+
+func TestRevokeSessionHandlerNotFound(t *testing.T) {
+	DbClient.(*mock.NoSQLClient).ClearData()
+	tokenString, err := getTestToken("test@test.com", "somepass")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	body, _ := json.Marshal(RevokeSessionDetails{ID: "missing"})
+	resp := doAuthorized(revokeSessionHandler, "POST", "/sessions/revoke", tokenString, body)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Incorrect response code: %d", resp.StatusCode)
+	}
+}
+
+func TestRevokeAllSessionsHandler(t *testing.T) {
+	DbClient.(*mock.NoSQLClient).ClearData()
+	first, err := getTestToken("test@test.com", "somepass")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	second, err := loginTestUser("test@test.com", "somepass")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	resp := doAuthorized(revokeAllSessionsHandler, "POST", "/sessions/revoke-all", first, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Incorrect response code: %d", resp.StatusCode)
+		return
+	}
+	for _, tokenString := range []string{first, second} {
+		resp = doAuthorized(testAuthHandler, "GET", "/testauth", tokenString, nil)
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("revoked token should be rejected, got response code: %d", resp.StatusCode)
+		}
+	}
+}
+
+// getTestToken adds a login with the supplied details and logs in with it, returning the issued token
+func getTestToken(un, pw string) (string, error) {
+	body, err := getTestPostBody(un, pw)
+	if err != nil {
+		return "", err
+	}
+	req := httptest.NewRequest("POST", "/login/add", bytes.NewReader(body)).WithContext(testContext)
+	addLoginHandler(httptest.NewRecorder(), req)
+	return loginTestUser(un, pw)
+}
+
+func loginTestUser(un, pw string) (string, error) {
+	body, err := getTestPostBody(un, pw)
+	if err != nil {
+		return "", err
+	}
+	req := httptest.NewRequest("POST", "/login", bytes.NewReader(body)).WithContext(testContext)
+	w := httptest.NewRecorder()
+	loginHandler(w, req)
+	var resp LoginResponse
+	err = json.NewDecoder(w.Result().Body).Decode(&resp)
+	return resp.AccessToken, err
+}
+
+func doAuthorized(h http.HandlerFunc, method, target, tokenString string, body []byte) *http.Response {
+	req := httptest.NewRequest(method, target, bytes.NewReader(body)).WithContext(testContext)
+	req.Header.Set("Authorization", "Bearer "+tokenString)
+	w := httptest.NewRecorder()
+	authorize(h).ServeHTTP(w, req)
+	return w.Result()
+}
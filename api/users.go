@@ -0,0 +1,305 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blueambertech-demos/login-svc-gcp/data"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/audit"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/events"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/login"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/session"
+	"github.com/blueambertech/logging"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	usersPath        = "/admin/users"
+	defaultUserLimit = 50
+	maxUserLimit     = 200
+)
+
+// AdminUser is the view of a login returned by the admin users API, it never includes the password hash or salt
+type AdminUser struct {
+	ID              string             `json:"id"`
+	UserName        string             `json:"userName"`
+	DateCreated     time.Time          `json:"dateCreated"`
+	Status          data.AccountStatus `json:"status"`
+	StatusReason    string             `json:"statusReason,omitempty"`
+	StatusChangedAt *time.Time         `json:"statusChangedAt,omitempty"`
+	Roles           []string           `json:"roles"`
+}
+
+type AdminUserList struct {
+	Users      []AdminUser `json:"users"`
+	NextCursor string      `json:"nextCursor,omitempty"`
+}
+
+// AdminUserUpdate changes the fields of a login that are set, a reason is required when changing the status
+type AdminUserUpdate struct {
+	UserName *string             `json:"userName,omitempty"`
+	Roles    []string            `json:"roles,omitempty"`
+	Status   *data.AccountStatus `json:"status,omitempty"`
+	Reason   string              `json:"reason,omitempty"`
+}
+
+// PasswordResetDetails is returned when a reset is forced, the reset token itself is only sent to the user
+type PasswordResetDetails struct {
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+type RevokedSessionsDetails struct {
+	Revoked int `json:"revoked"`
+}
+
+type ResetPasswordForm struct {
+	ResetToken string `json:"resetToken"`
+	Password   string `json:"password"`
+}
+
+// adminUsersHandler routes requests to the admin users API. Reading users requires the users:read scope and changing them the
+// users:write scope
+func adminUsersHandler(w http.ResponseWriter, r *http.Request) {
+	id, action, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, usersPath), "/"), "/")
+	var h http.HandlerFunc
+	switch {
+	case id == "" && action == "":
+		h = listUsersHandler
+	case action == "" && r.Method == http.MethodGet:
+		h = getUserHandler
+	case action == "":
+		h = updateUserHandler
+	case action == "reset-password":
+		h = forcePasswordResetHandler
+	case action == "revoke-sessions":
+		h = revokeUserSessionsHandler
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	scope := login.ScopeUsersWrite
+	if safeMethod(r.Method) {
+		scope = login.ScopeUsersRead
+	}
+	RequireScope(scope)(h).ServeHTTP(w, r)
+}
+
+// ListUsersHandler is a http handler that accepts a GET request and returns a page of users ordered by ID. The q query parameter
+// searches usernames, cursor is the nextCursor of the previous page and limit sets the page size
+func listUsersHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, span := logging.Tracer.Start(r.Context(), "list-users-request")
+	defer span.End()
+
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, span, http.MethodGet)
+		return
+	}
+
+	q := r.URL.Query()
+	limit := defaultUserLimit
+	if l := q.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 || n > maxUserLimit {
+			httpError(w, CodeInvalidRequest, "limit must be between 1 and "+strconv.Itoa(maxUserLimit), http.StatusBadRequest, span, err)
+			return
+		}
+		limit = n
+	}
+	records, next, err := login.Search(ctx, Logins, q.Get("q"), q.Get("cursor"), limit)
+	auditEvent(r, span, audit.UsersListed, "", err)
+	if err != nil {
+		loginError(w, "failed to list users", span, err)
+		return
+	}
+	resp := AdminUserList{Users: make([]AdminUser, len(records)), NextCursor: next}
+	for i := range records {
+		resp.Users[i] = adminUser(&records[i])
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// GetUserHandler is a http handler that accepts a GET request and returns a single user
+func getUserHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, span := logging.Tracer.Start(r.Context(), "get-user-request")
+	defer span.End()
+
+	id := userPathID(r)
+	rec, err := Logins.GetByID(ctx, id)
+	auditEvent(r, span, audit.UserRead, id, err)
+	if err != nil {
+		userError(w, "failed to read user", span, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(adminUser(rec))
+}
+
+// UpdateUserHandler is a http handler that accepts a PATCH request to change the username, roles or status of a user and
+// returns the updated user
+func updateUserHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, span := logging.Tracer.Start(r.Context(), "update-user-request")
+	defer span.End()
+
+	if r.Method != http.MethodPatch {
+		methodNotAllowed(w, span, http.MethodGet+", "+http.MethodPatch)
+		return
+	}
+
+	var form AdminUserUpdate
+	if err := json.NewDecoder(r.Body).Decode(&form); err != nil || (form.Status != nil && form.Reason == "") {
+		httpError(w, CodeInvalidRequest, "failed to extract form data, a reason is required to change the status", http.StatusBadRequest, span, err)
+		return
+	}
+	id := userPathID(r)
+	err := updateUser(r, id, &form, span)
+	if err != nil {
+		userError(w, "failed to update user", span, err)
+		return
+	}
+	rec, err := Logins.GetByID(ctx, id)
+	if err != nil {
+		userError(w, "failed to read user", span, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(adminUser(rec))
+}
+
+// updateUser makes every change in the form in one update, so that an invalid change leaves the user as it was, and audits
+// each of them with the outcome
+func updateUser(r *http.Request, id string, form *AdminUserUpdate, span trace.Span) error {
+	changes := &login.AccountChanges{UserName: form.UserName, Roles: form.Roles, Status: form.Status, Reason: form.Reason}
+	err := login.UpdateAccount(r.Context(), Logins, Events, id, changes, span)
+	if form.UserName != nil {
+		auditEvent(r, span, audit.UsernameChanged, id, err)
+	}
+	if form.Roles != nil {
+		auditEvent(r, span, audit.RolesChanged, id, err)
+	}
+	if form.Status != nil {
+		auditStatus(r, span, id, *form.Status, form.Reason, err)
+	}
+	return err
+}
+
+// ForcePasswordResetHandler is a http handler that accepts a POST request to stop a user's password from working, it revokes
+// their sessions and sends the user a reset token, the response only says when the token expires
+func forcePasswordResetHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, span := logging.Tracer.Start(r.Context(), "force-password-reset-request")
+	defer span.End()
+
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, span, http.MethodPost)
+		return
+	}
+
+	id := userPathID(r)
+	expires, err := login.ForcePasswordReset(ctx, Logins, DbClient, Events, id)
+	auditEvent(r, span, audit.PasswordResetForced, id, err)
+	if err != nil {
+		userError(w, "failed to reset password", span, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(PasswordResetDetails{ExpiresAt: expires})
+}
+
+// RevokeUserSessionsHandler is a http handler that accepts a POST request to revoke every session of a user
+func revokeUserSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, span := logging.Tracer.Start(r.Context(), "revoke-user-sessions-request")
+	defer span.End()
+
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, span, http.MethodPost)
+		return
+	}
+
+	id := userPathID(r)
+	_, err := Logins.GetByID(ctx, id)
+	n := 0
+	if err == nil {
+		n, err = session.RevokeAll(ctx, DbClient, id)
+	}
+	auditEvent(r, span, audit.SessionsRevoked, id, err)
+	if err != nil {
+		userError(w, "failed to revoke sessions", span, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(RevokedSessionsDetails{Revoked: n})
+}
+
+// ResetPasswordHandler is a http handler that accepts a POST request with a reset token from an admin and sets a new password
+func resetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, span := logging.Tracer.Start(r.Context(), "reset-password-request")
+	defer span.End()
+
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, span, http.MethodPost)
+		return
+	}
+
+	var form ResetPasswordForm
+	if err := json.NewDecoder(r.Body).Decode(&form); err != nil || form.ResetToken == "" {
+		httpError(w, CodeInvalidRequest, "failed to extract form data", http.StatusBadRequest, span, err)
+		return
+	}
+	userID, err := login.ResetPassword(ctx, Logins, DbClient, form.ResetToken, form.Password)
+	rec := auditRecord(r, audit.PasswordChanged, userID, err)
+	rec.ActorID = userID
+	writeAudit(r, span, rec)
+	if err == nil {
+		publishEvent(r, span, events.PasswordChanged, userID, &events.PasswordPayload{Reset: true})
+	}
+	if errors.Is(err, login.ErrInvalidResetToken) {
+		httpError(w, CodeInvalidResetToken, "reset token is invalid or has expired", http.StatusForbidden, span, err)
+		return
+	} else if err != nil {
+		loginError(w, "failed to reset password", span, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// userError writes the response for an error from an admin users API call, unlike loginError a missing user is reported as not
+// found because the caller is trusted
+func userError(w http.ResponseWriter, msg string, span trace.Span, err error) {
+	if errors.Is(err, login.ErrUserNotFound) {
+		httpError(w, CodeNotFound, "user not found", http.StatusNotFound, span, err)
+		return
+	}
+	if errors.Is(err, login.ErrInvalidRole) {
+		httpError(w, CodeInvalidRequest, "roles must be user, support or admin", http.StatusBadRequest, span, err)
+		return
+	}
+	loginError(w, msg, span, err)
+}
+
+func userPathID(r *http.Request) string {
+	id, _, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, usersPath), "/"), "/")
+	return id
+}
+
+func adminUser(rec *login.Record) AdminUser {
+	u := AdminUser{
+		ID:           rec.ID,
+		UserName:     rec.UserName,
+		DateCreated:  rec.DateCreated,
+		Status:       rec.Status,
+		StatusReason: rec.StatusReason,
+		Roles:        rec.AccountRoles(),
+	}
+	if u.Status == "" {
+		u.Status = data.StatusActive
+	}
+	if !rec.StatusChangedAt.IsZero() {
+		u.StatusChangedAt = &rec.StatusChangedAt
+	}
+	return u
+}
@@ -0,0 +1,237 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/blueambertech-demos/login-svc-gcp/data"
+	"github.com/blueambertech-demos/login-svc-gcp/mock"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/events"
+)
+
+func TestAdminUsersRequiresScope(t *testing.T) {
+	DbClient.(*mock.NoSQLClient).ClearData()
+	userToken, err := getTestToken("user@test.com", "somepass")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	resp := doAuthorized(adminUsersHandler, "GET", "/admin/users", userToken, nil)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("user without the users:read scope should be rejected, got response code: %d", resp.StatusCode)
+	}
+}
+
+func TestListUsersHandler(t *testing.T) {
+	DbClient.(*mock.NoSQLClient).ClearData()
+	adminToken, err := getAdminToken("admin@test.com", "somepass")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for _, un := range []string{"alice@test.com", "bob@test.com", "alicia@test.com"} {
+		if _, err = getTestToken(un, "somepass"); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	var users []AdminUser
+	cursor := ""
+	for {
+		resp := doAuthorized(adminUsersHandler, "GET", "/admin/users?limit=2&cursor="+cursor, adminToken, nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Incorrect response code: %d", resp.StatusCode)
+			return
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if strings.Contains(string(body), "PassHash") || strings.Contains(string(body), "Salt") {
+			t.Error("response must not contain the password hash or salt:", string(body))
+		}
+		var page AdminUserList
+		if err = json.Unmarshal(body, &page); err != nil {
+			t.Error(err)
+			return
+		}
+		users = append(users, page.Users...)
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+	if len(users) != 4 {
+		t.Errorf("expected 4 users, got %d", len(users))
+	}
+
+	resp := doAuthorized(adminUsersHandler, "GET", "/admin/users?q=ALI", adminToken, nil)
+	var page AdminUserList
+	if err = json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		t.Error(err)
+		return
+	}
+	if len(page.Users) != 2 {
+		t.Errorf("expected 2 users matching the search, got %+v", page.Users)
+	}
+}
+
+func TestGetAndUpdateUserHandler(t *testing.T) {
+	DbClient.(*mock.NoSQLClient).ClearData()
+	adminToken, err := getAdminToken("admin@test.com", "somepass")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err = getTestToken("user@test.com", "somepass"); err != nil {
+		t.Error(err)
+		return
+	}
+	rec, _ := Logins.GetByUsername(testContext, "user@test.com")
+
+	resp := doAuthorized(adminUsersHandler, "GET", "/admin/users/missing", adminToken, nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected not found for a missing user, got response code: %d", resp.StatusCode)
+	}
+
+	userName := "renamed@test.com"
+	status := data.StatusLocked
+	body, _ := json.Marshal(AdminUserUpdate{UserName: &userName, Roles: []string{data.RoleUser, data.RoleSupport}, Status: &status, Reason: "testing"})
+	resp = doAuthorized(adminUsersHandler, "PATCH", "/admin/users/"+rec.ID, adminToken, body)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Incorrect response code: %d", resp.StatusCode)
+		return
+	}
+	var user AdminUser
+	if err = json.NewDecoder(resp.Body).Decode(&user); err != nil {
+		t.Error(err)
+		return
+	}
+	if user.UserName != userName || len(user.Roles) != 2 || user.Status != data.StatusLocked || user.StatusReason != "testing" {
+		t.Errorf("user was not updated: %+v", user)
+	}
+
+	body, _ = json.Marshal(AdminUserUpdate{Status: &status})
+	resp = doAuthorized(adminUsersHandler, "PATCH", "/admin/users/"+rec.ID, adminToken, body)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("status change without a reason should be rejected, got response code: %d", resp.StatusCode)
+	}
+	// An invalid change stops the valid changes made with it
+	other := "other@test.com"
+	active := data.StatusActive
+	body, _ = json.Marshal(AdminUserUpdate{UserName: &other, Roles: []string{"superuser"}, Status: &active, Reason: "testing"})
+	resp = doAuthorized(adminUsersHandler, "PATCH", "/admin/users/"+rec.ID, adminToken, body)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unknown role should be rejected, got response code: %d", resp.StatusCode)
+	}
+	if changed, _ := Logins.GetByID(testContext, rec.ID); changed.UserName != userName || changed.Status != data.StatusLocked {
+		t.Errorf("no change should be made when one is invalid: %+v", changed.LoginDetails)
+	}
+
+	resp = doAuthorized(adminUsersHandler, "GET", "/admin/users/"+rec.ID, adminToken, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Incorrect response code: %d", resp.StatusCode)
+	}
+}
+
+func TestForcePasswordResetHandler(t *testing.T) {
+	DbClient.(*mock.NoSQLClient).ClearData()
+	adminToken, err := getAdminToken("admin@test.com", "somepass")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	userToken, err := getTestToken("user@test.com", "somepass")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	rec, _ := Logins.GetByUsername(testContext, "user@test.com")
+
+	resp := doAuthorized(adminUsersHandler, "POST", "/admin/users/"+rec.ID+"/reset-password", adminToken, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Incorrect response code: %d", resp.StatusCode)
+		return
+	}
+	var raw map[string]interface{}
+	if err = json.NewDecoder(resp.Body).Decode(&raw); err != nil || raw["expiresAt"] == nil {
+		t.Error("reset expiry not returned", err)
+		return
+	}
+	if _, ok := raw["resetToken"]; ok {
+		t.Error("the reset token should only be sent to the user")
+	}
+	resetToken := resetNotification(t, rec.ID)
+	if resp = doAuthorized(testAuthHandler, "GET", "/testauth", userToken, nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("sessions should be revoked by a forced reset, got response code: %d", resp.StatusCode)
+	}
+
+	body, _ := json.Marshal(ResetPasswordForm{ResetToken: resetToken, Password: "newpass"})
+	w := httptest.NewRecorder()
+	resetPasswordHandler(w, httptest.NewRequest("POST", "/password/reset", bytes.NewReader(body)).WithContext(testContext))
+	if w.Code != http.StatusNoContent {
+		t.Errorf("Incorrect response code: %d", w.Code)
+		return
+	}
+	if tok, _ := loginTestUser("user@test.com", "newpass"); tok == "" {
+		t.Error("user should be able to log in with the new password")
+	}
+	w = httptest.NewRecorder()
+	resetPasswordHandler(w, httptest.NewRequest("POST", "/password/reset", bytes.NewReader(body)).WithContext(testContext))
+	if w.Code != http.StatusForbidden || decodeProblem(t, w.Result()).Code != CodeInvalidResetToken {
+		t.Errorf("reset token should only be usable once, got response code: %d", w.Code)
+	}
+}
+
+// resetNotification returns the reset token from the last password reset notification sent to a user
+func resetNotification(t *testing.T, userID string) string {
+	t.Helper()
+	msgs := Events.(*mock.PubSubHandler).Published(events.NotificationTopicID)
+	for i := len(msgs) - 1; i >= 0; i-- {
+		env, err := events.Parse([]byte(msgs[i]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if env.Type != events.PasswordResetRequested || env.UserID != userID {
+			continue
+		}
+		var p events.ResetPayload
+		if err = env.DecodePayload(&p); err != nil {
+			t.Fatal(err)
+		}
+		return p.ResetToken
+	}
+	t.Fatal("expected a password reset notification")
+	return ""
+}
+
+func TestRevokeUserSessionsHandler(t *testing.T) {
+	DbClient.(*mock.NoSQLClient).ClearData()
+	adminToken, err := getAdminToken("admin@test.com", "somepass")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	userToken, err := getTestToken("user@test.com", "somepass")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	rec, _ := Logins.GetByUsername(testContext, "user@test.com")
+
+	resp := doAuthorized(adminUsersHandler, "POST", "/admin/users/"+rec.ID+"/revoke-sessions", adminToken, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Incorrect response code: %d", resp.StatusCode)
+		return
+	}
+	var revoked RevokedSessionsDetails
+	if err = json.NewDecoder(resp.Body).Decode(&revoked); err != nil || revoked.Revoked != 1 {
+		t.Error("expected one session revoked, got", revoked, err)
+	}
+	if resp = doAuthorized(testAuthHandler, "GET", "/testauth", userToken, nil); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("revoked token should be rejected, got response code: %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,141 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/audit"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/webhook"
+	"github.com/blueambertech/logging"
+)
+
+const webhooksPath = "/admin/webhooks"
+
+type WebhookForm struct {
+	URL        string   `json:"url"`
+	EventTypes []string `json:"eventTypes"`
+	// Secret is generated if it is empty
+	Secret string `json:"secret,omitempty"`
+}
+
+// WebhookCreated is the response to registering a webhook, it is the only time the secret is returned
+type WebhookCreated struct {
+	webhook.Subscription
+	Secret string `json:"secret"`
+}
+
+type WebhookList struct {
+	Webhooks []webhook.Subscription `json:"webhooks"`
+}
+
+type WebhookDeliveryList struct {
+	Deliveries []webhook.Delivery `json:"deliveries"`
+}
+
+// adminWebhooksHandler routes requests to the admin webhooks API: GET and POST /admin/webhooks list and register webhooks,
+// DELETE /admin/webhooks/{id} removes one and GET /admin/webhooks/{id}/deliveries lists its deliveries
+func adminWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	id, action, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, webhooksPath), "/"), "/")
+	switch {
+	case id == "" && r.Method == http.MethodPost:
+		registerWebhookHandler(w, r)
+	case id == "":
+		listWebhooksHandler(w, r)
+	case action == "":
+		deleteWebhookHandler(w, r, id)
+	case action == "deliveries":
+		listWebhookDeliveriesHandler(w, r, id)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// ListWebhooksHandler is a http handler that accepts a GET request and returns every webhook subscription without its secret
+func listWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, span := logging.Tracer.Start(r.Context(), "list-webhooks-request")
+	defer span.End()
+
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, span, http.MethodGet+", "+http.MethodPost)
+		return
+	}
+	subs, err := webhook.List(ctx, DbClient)
+	if err != nil {
+		httpError(w, CodeInternal, "failed to list webhooks", http.StatusInternalServerError, span, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(WebhookList{Webhooks: subs})
+}
+
+// RegisterWebhookHandler is a http handler that accepts a POST request to register a webhook subscription and returns it with
+// its secret
+func registerWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, span := logging.Tracer.Start(r.Context(), "register-webhook-request")
+	defer span.End()
+
+	var form WebhookForm
+	if err := json.NewDecoder(r.Body).Decode(&form); err != nil {
+		httpError(w, CodeInvalidRequest, "failed to extract form data", http.StatusBadRequest, span, err)
+		return
+	}
+	sub, err := webhook.Register(ctx, DbClient, form.URL, form.EventTypes, form.Secret)
+	target := ""
+	if sub != nil {
+		target = sub.ID
+	}
+	auditEvent(r, span, audit.WebhookRegistered, target, err)
+	if errors.Is(err, webhook.ErrInvalidSubscription) {
+		httpError(w, CodeInvalidRequest, "a https url and at least one event type are required", http.StatusBadRequest, span, err)
+		return
+	} else if err != nil {
+		httpError(w, CodeInternal, "failed to register webhook", http.StatusInternalServerError, span, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(WebhookCreated{Subscription: *sub, Secret: sub.Secret})
+}
+
+// DeleteWebhookHandler is a http handler that accepts a DELETE request to remove a webhook subscription
+func deleteWebhookHandler(w http.ResponseWriter, r *http.Request, id string) {
+	ctx, span := logging.Tracer.Start(r.Context(), "delete-webhook-request")
+	defer span.End()
+
+	if r.Method != http.MethodDelete {
+		methodNotAllowed(w, span, http.MethodDelete)
+		return
+	}
+	err := webhook.Delete(ctx, DbClient, id)
+	auditEvent(r, span, audit.WebhookDeleted, id, err)
+	if errors.Is(err, webhook.ErrNotFound) {
+		httpError(w, CodeNotFound, "webhook not found", http.StatusNotFound, span, err)
+		return
+	} else if err != nil {
+		httpError(w, CodeInternal, "failed to delete webhook", http.StatusInternalServerError, span, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListWebhookDeliveriesHandler is a http handler that accepts a GET request and returns the deliveries made to a webhook, most
+// recent first
+func listWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request, id string) {
+	ctx, span := logging.Tracer.Start(r.Context(), "list-webhook-deliveries-request")
+	defer span.End()
+
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, span, http.MethodGet)
+		return
+	}
+	deliveries, err := webhook.Deliveries(ctx, DbClient, id)
+	if err != nil {
+		httpError(w, CodeInternal, "failed to list webhook deliveries", http.StatusInternalServerError, span, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(WebhookDeliveryList{Deliveries: deliveries})
+}
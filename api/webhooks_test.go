@@ -0,0 +1,55 @@
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/blueambertech-demos/login-svc-gcp/mock"
+)
+
+func TestAdminWebhooksHandler(t *testing.T) {
+	DbClient.(*mock.NoSQLClient).ClearData()
+	adminToken, err := getAdminToken("admin@test.com", "somepass")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	resp := doAuthorized(adminWebhooksHandler, "POST", "/admin/webhooks", adminToken, []byte(`{"url":"ftp://example.com"}`))
+	if p := decodeProblem(t, resp); resp.StatusCode != http.StatusBadRequest || p.Code != CodeInvalidRequest {
+		t.Errorf("expected %s for an invalid webhook, got %d %s", CodeInvalidRequest, resp.StatusCode, p.Code)
+	}
+	body := []byte(`{"url":"https://partner.example.com/hook","eventTypes":["login.created"]}`)
+	resp = doAuthorized(adminWebhooksHandler, "POST", "/admin/webhooks", adminToken, body)
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("Incorrect response code: %d", resp.StatusCode)
+		return
+	}
+	var created WebhookCreated
+	if err = json.NewDecoder(resp.Body).Decode(&created); err != nil || created.ID == "" || created.Secret == "" {
+		t.Errorf("expected the webhook to be returned with its secret, got %+v, %v", created, err)
+		return
+	}
+
+	resp = doAuthorized(adminWebhooksHandler, "GET", "/admin/webhooks", adminToken, nil)
+	listBody, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(listBody), created.ID) || strings.Contains(string(listBody), created.Secret) {
+		t.Errorf("expected the webhook to be listed without its secret, got %d %s", resp.StatusCode, listBody)
+	}
+	resp = doAuthorized(adminWebhooksHandler, "GET", "/admin/webhooks/"+created.ID+"/deliveries", adminToken, nil)
+	var deliveries WebhookDeliveryList
+	if err = json.NewDecoder(resp.Body).Decode(&deliveries); err != nil || resp.StatusCode != http.StatusOK || len(deliveries.Deliveries) != 0 {
+		t.Errorf("expected no deliveries, got %d %+v %v", resp.StatusCode, deliveries, err)
+	}
+
+	if resp = doAuthorized(adminWebhooksHandler, "DELETE", "/admin/webhooks/"+created.ID, adminToken, nil); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Incorrect response code deleting webhook: %d", resp.StatusCode)
+	}
+	resp = doAuthorized(adminWebhooksHandler, "DELETE", "/admin/webhooks/"+created.ID, adminToken, nil)
+	if p := decodeProblem(t, resp); resp.StatusCode != http.StatusNotFound || p.Code != CodeNotFound {
+		t.Errorf("expected %s deleting a missing webhook, got %d %s", CodeNotFound, resp.StatusCode, p.Code)
+	}
+}
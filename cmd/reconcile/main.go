@@ -0,0 +1,49 @@
+// Command reconcile scans the login details collection for duplicate usernames and prints a JSON report, it can optionally
+// delete or disable the duplicates. Changes are only made when -dry-run=false is passed
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+	"time"
+
+	"github.com/blueambertech-demos/login-svc-gcp/data"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/backend"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/reconcile"
+)
+
+func main() {
+	projectID := flag.String("project", data.ProjectID, "GCP project ID")
+	backendName := flag.String("backend", os.Getenv("STORAGE_BACKEND"), "storage backend: firestore, postgres or sqlite, see STORAGE_BACKEND")
+	dbName := flag.String("database", "", "Firestore database name")
+	actionName := flag.String("action", string(reconcile.ActionReport), "action to take on duplicates: report, delete or disable")
+	dryRun := flag.Bool("dry-run", true, "report what would be changed without changing anything")
+	timeout := flag.Duration("timeout", 5*time.Minute, "maximum time to run for")
+	flag.Parse()
+
+	action, err := reconcile.ParseAction(*actionName)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, canc := context.WithTimeout(context.Background(), *timeout)
+	defer canc()
+	store, err := backend.Open(ctx, *backendName, *projectID, *dbName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close()
+
+	report, err := reconcile.Run(ctx, store.Client, action, *dryRun)
+	if report != nil {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(report)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
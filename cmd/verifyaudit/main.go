@@ -0,0 +1,48 @@
+// Command verifyaudit walks a range of the audit log hash chain and prints a JSON report of missing, modified or unlinked
+// records. It exits with a non-zero status if any problems are found
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+	"time"
+
+	"github.com/blueambertech-demos/login-svc-gcp/data"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/audit"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/backend"
+	"github.com/blueambertech/googlesecret"
+)
+
+func main() {
+	projectID := flag.String("project", data.ProjectID, "GCP project ID")
+	backendName := flag.String("backend", os.Getenv("STORAGE_BACKEND"), "storage backend: firestore, postgres or sqlite, see STORAGE_BACKEND")
+	dbName := flag.String("database", "", "Firestore database name")
+	from := flag.Int64("from", 1, "sequence number of the first record to check")
+	to := flag.Int64("to", 0, "sequence number of the last record to check, 0 checks to the end of the chain")
+	timeout := flag.Duration("timeout", 5*time.Minute, "maximum time to run for")
+	flag.Parse()
+
+	ctx, canc := context.WithTimeout(context.Background(), *timeout)
+	defer canc()
+	store, err := backend.Open(ctx, *backendName, *projectID, *dbName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close()
+
+	report, err := audit.Verify(ctx, store.Client, googlesecret.NewManager(*projectID), *from, *to)
+	if report != nil {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(report)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !report.OK() {
+		os.Exit(1)
+	}
+}
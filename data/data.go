@@ -7,9 +7,66 @@ const (
 	ServiceName = "login-svc-with-gcp"
 )
 
+// LoginDetailsSchemaVersion is the version of LoginDetails written by this version of the service, older documents are upgraded
+// when they are read, see login.UpgradeDetails
+const LoginDetailsSchemaVersion = 4
+
+// AccountStatus controls whether a login can be used, only active accounts can log in or use their tokens
+type AccountStatus string
+
+const (
+	StatusActive              AccountStatus = "active"
+	StatusDisabled            AccountStatus = "disabled"
+	StatusLocked              AccountStatus = "locked"
+	StatusPendingVerification AccountStatus = "pending_verification"
+)
+
+// Roles grant access to endpoints beyond a user's own account
+const (
+	RoleUser    = "user"
+	RoleSupport = "support"
+	RoleAdmin   = "admin"
+)
+
+// LoginDetails fields tagged redact are hidden when the details are logged or formatted, see the redact package
 type LoginDetails struct {
 	UserName    string
-	PassHash    string
-	Salt        string
+	PassHash    string `redact:"true"`
+	Salt        string `redact:"true"`
+	DateCreated time.Time
+	// SchemaVersion is the version of LoginDetails the record was written with, documents written before it was added are version 0
+	SchemaVersion int
+	// HashAlgorithm identifies the function used to produce PassHash
+	HashAlgorithm string
+	Status        AccountStatus
+	// StatusReason records why the status was last changed
+	StatusReason    string
+	StatusChangedAt time.Time
+	Roles           []string
+}
+
+// UsernameReservation records that a canonical username belongs to a login, its document ID is the canonical username
+type UsernameReservation struct {
+	UserID      string
 	DateCreated time.Time
 }
+
+type Session struct {
+	ID        string
+	UserID    string
+	Device    string
+	UserAgent string
+	IP        string
+	// DeviceID is the value of the device cookie of the client, see api.Risk
+	DeviceID string
+	// Country, Latitude and Longitude are where the IP was when the session was created, they are only set when Located is true
+	Located   bool
+	Country   string
+	Latitude  float64
+	Longitude float64
+	CreatedAt time.Time
+	LastSeen  time.Time
+	ExpiresAt time.Time
+	Revoked   bool
+	RevokedAt time.Time
+}
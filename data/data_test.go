@@ -1,22 +1,73 @@
 package data
 
 import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"strings"
 	"testing"
 	"time"
 )
 
 func TestDetailsStringer(t *testing.T) {
 	d := LoginDetails{
-		UserName:    "Test",
-		PassHash:    "hash",
-		Salt:        "12345",
-		DateCreated: time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC),
+		UserName:      "Test",
+		PassHash:      "hash",
+		Salt:          "12345",
+		DateCreated:   time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC),
+		SchemaVersion: 3,
+		HashAlgorithm: "sha256x1000",
+		Status:        StatusActive,
+		Roles:         []string{RoleUser},
 	}
 
-	expected := `{"UserName":"Test","PassHash":"hash","Salt":"12345","DateCreated":"2023-01-01T12:00:00Z"}`
+	expected := `{"UserName":"Test","PassHash":"[REDACTED]","Salt":"[REDACTED]","DateCreated":"2023-01-01T12:00:00Z","SchemaVersion":3,"HashAlgorithm":"sha256x1000","Status":"active","StatusReason":"","StatusChangedAt":"0001-01-01T00:00:00Z","Roles":["user"]}`
 	result := d.String()
 
 	if result != expected {
 		t.Errorf("stringer not produing correct result, expected %s got %s", expected, result)
 	}
 }
+
+func TestAccountStatusValid(t *testing.T) {
+	for _, s := range []AccountStatus{StatusActive, StatusDisabled, StatusLocked, StatusPendingVerification} {
+		if !s.Valid() {
+			t.Error("status should be valid:", s)
+		}
+	}
+	if AccountStatus("").Valid() || AccountStatus("deleted").Valid() {
+		t.Error("unknown statuses should not be valid")
+	}
+}
+
+func TestSessionActive(t *testing.T) {
+	now := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	s := Session{ExpiresAt: now.Add(time.Hour)}
+	if !s.Active(now) {
+		t.Error("unexpired session should be active")
+	}
+	if s.Active(now.Add(2 * time.Hour)) {
+		t.Error("expired session should not be active")
+	}
+	s.Revoked = true
+	if s.Active(now) {
+		t.Error("revoked session should not be active")
+	}
+}
+
+func TestDetailsRedacted(t *testing.T) {
+	d := LoginDetails{UserName: "Test", PassHash: "secret-hash", Salt: "secret-salt"}
+
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, nil))
+	logger.Info("details", "details", d, "ptr", &d)
+	outputs := []string{d.String(), fmt.Sprint(d), fmt.Sprint(&d), fmt.Sprintf("%v", d), buf.String()}
+	for _, out := range outputs {
+		if strings.Contains(out, "secret-hash") || strings.Contains(out, "secret-salt") {
+			t.Error("password hash or salt included in output:", out)
+		}
+		if !strings.Contains(out, "Test") {
+			t.Error("username missing from output:", out)
+		}
+	}
+}
@@ -1,10 +1,37 @@
 package data
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"log/slog"
+	"time"
 
-func (d *LoginDetails) String() string {
-	if j, err := json.Marshal(d); err == nil {
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/redact"
+)
+
+// String returns the details as JSON with the password hash and salt redacted, it has a value receiver so that the details are
+// redacted when printed by value or by pointer
+func (d LoginDetails) String() string {
+	if j, err := json.Marshal(redact.Copy(d)); err == nil {
 		return string(j)
 	}
 	return "could not convert to string"
 }
+
+// LogValue implements slog.LogValuer so that the password hash and salt are redacted when the details are logged
+func (d LoginDetails) LogValue() slog.Value {
+	return redact.LogValue(d)
+}
+
+// Valid reports whether the status is one of the known account statuses
+func (s AccountStatus) Valid() bool {
+	switch s {
+	case StatusActive, StatusDisabled, StatusLocked, StatusPendingVerification:
+		return true
+	}
+	return false
+}
+
+// Active reports whether the session can still be used to authenticate requests at the given time
+func (s *Session) Active(now time.Time) bool {
+	return !s.Revoked && now.Before(s.ExpiresAt)
+}
@@ -0,0 +1,8 @@
+// Package integration contains tests that run the service against the Firestore and Pub/Sub emulators. They are only built
+// with the integration build tag, and use the standard FIRESTORE_EMULATOR_HOST and PUBSUB_EMULATOR_HOST environment variables
+// to find the emulators:
+//
+//	gcloud emulators firestore start --host-port=localhost:8081
+//	gcloud beta emulators pubsub start --host-port=localhost:8085
+//	FIRESTORE_EMULATOR_HOST=localhost:8081 PUBSUB_EMULATOR_HOST=localhost:8085 go test -tags integration ./integration/...
+package integration
@@ -0,0 +1,205 @@
+//go:build integration
+
+package integration
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	gpubsub "cloud.google.com/go/pubsub"
+	"github.com/blueambertech-demos/login-svc-gcp/api"
+	"github.com/blueambertech-demos/login-svc-gcp/data"
+	"github.com/blueambertech-demos/login-svc-gcp/mock"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/audit"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/events"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/login"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/login/logintest"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/storage"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/storage/storagetest"
+	"github.com/blueambertech/googlepubsub"
+	"github.com/blueambertech/logging"
+)
+
+const (
+	projectID = "demo-login-svc"
+	dbName    = "(default)"
+	topicID   = events.TopicID
+)
+
+var (
+	dbClient     *storage.Firestore
+	eventQueue   *googlepubsub.GooglePubSub
+	pubsubClient *gpubsub.Client
+	server       *httptest.Server
+)
+
+func TestMain(m *testing.M) {
+	if os.Getenv("FIRESTORE_EMULATOR_HOST") == "" || os.Getenv("PUBSUB_EMULATOR_HOST") == "" {
+		fmt.Println("FIRESTORE_EMULATOR_HOST and PUBSUB_EMULATOR_HOST must be set to run the integration tests")
+		os.Exit(1)
+	}
+	ctx := context.Background()
+	logging.Setup(ctx, data.ServiceName)
+	defer logging.DeferredCleanup(ctx)
+
+	var err error
+	if dbClient, err = storage.NewFirestore(projectID, dbName); err != nil {
+		panic(err)
+	}
+	defer dbClient.Close()
+	if pubsubClient, err = gpubsub.NewClient(ctx, projectID); err != nil {
+		panic(err)
+	}
+	defer pubsubClient.Close()
+	for _, t := range []string{topicID, audit.TopicID} {
+		if _, err = pubsubClient.CreateTopic(ctx, t); err != nil && !strings.Contains(err.Error(), "AlreadyExists") {
+			panic(err)
+		}
+	}
+	if eventQueue, err = googlepubsub.New(ctx, projectID); err != nil {
+		panic(err)
+	}
+
+	api.DbClient = dbClient
+	api.Logins = login.NewFirestoreRepository(dbClient)
+	api.Events = eventQueue
+	// There is no Secret Manager emulator, the signing key is supplied by the mock instead
+	api.Secrets = mock.NewSecretManager()
+	api.Audit = audit.New(dbClient, eventQueue, api.Secrets)
+	api.SetupHandlers()
+	server = httptest.NewServer(http.DefaultServeMux)
+	defer server.Close()
+
+	m.Run()
+}
+
+func TestFirestoreClientConformance(t *testing.T) {
+	storagetest.RunClientTests(t, dbClient)
+}
+
+func TestFirestoreRepositoryConformance(t *testing.T) {
+	logintest.RunRepositoryTests(t, func() login.Repository {
+		// The repository always uses the same collections, so clear them between tests
+		clearCollection(t, login.DetailsCollection)
+		clearCollection(t, login.UsernamesCollection)
+		return login.NewFirestoreRepository(dbClient)
+	})
+}
+
+func TestLoginFlow(t *testing.T) {
+	ctx, canc := context.WithTimeout(context.Background(), 30*time.Second)
+	defer canc()
+	sub, err := pubsubClient.CreateSubscription(ctx, fmt.Sprintf("login-flow-%d", time.Now().UnixNano()), gpubsub.SubscriptionConfig{
+		Topic: pubsubClient.Topic(topicID),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Delete(context.Background())
+
+	userName := fmt.Sprintf("flow-%d@test.com", time.Now().UnixNano())
+	body, _ := json.Marshal(api.LoginFormDetails{Username: userName, Password: "somepass"})
+
+	resp := post(t, "/login/add", body, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("add login failed: %d", resp.StatusCode)
+	}
+	resp = post(t, "/login/add", body, "")
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("duplicate add login should conflict, got %d", resp.StatusCode)
+	}
+
+	resp = post(t, "/login", body, "")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("login failed: %d", resp.StatusCode)
+	}
+	var lr api.LoginResponse
+	if err = json.NewDecoder(resp.Body).Decode(&lr); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	req, _ := http.NewRequest("GET", server.URL+"/testauth", nil)
+	req.Header.Set("Authorization", "Bearer "+lr.AccessToken)
+	if resp, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("authorized request failed: %d", resp.StatusCode)
+	}
+
+	resp = post(t, "/sessions/revoke-all", nil, lr.AccessToken)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("revoke sessions failed: %d", resp.StatusCode)
+	}
+	if resp, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("revoked token should be rejected, got %d", resp.StatusCode)
+	}
+
+	// The created event should have been published
+	received := make(chan *events.Envelope, 1)
+	rctx, rcanc := context.WithTimeout(ctx, 10*time.Second)
+	defer rcanc()
+	_ = sub.Receive(rctx, func(_ context.Context, msg *gpubsub.Message) {
+		msg.Ack()
+		env, err := events.Parse(msg.Data)
+		if err != nil || env.Type != events.LoginCreated {
+			return
+		}
+		select {
+		case received <- env:
+		default:
+		}
+		rcanc()
+	})
+	select {
+	case env := <-received:
+		if env.UserID != lr.UserID {
+			t.Errorf("unexpected event: %+v", env)
+		}
+	default:
+		t.Error("no created event was published")
+	}
+}
+
+func post(t *testing.T, path string, body []byte, tokenString string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest("POST", server.URL+path, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if tokenString != "" {
+		req.Header.Set("Authorization", "Bearer "+tokenString)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func clearCollection(t *testing.T, collection string) {
+	t.Helper()
+	ctx := context.Background()
+	docs, err := dbClient.List(ctx, collection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id := range docs {
+		if err = dbClient.Delete(ctx, collection, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -3,16 +3,25 @@ package main
 import (
 	"context"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 
 	"github.com/blueambertech-demos/login-svc-gcp/api"
 	"github.com/blueambertech-demos/login-svc-gcp/data"
-	"github.com/blueambertech/firestoredb"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/audit"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/backend"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/login"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/outbox"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/risk"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/risk/geoip"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/subscriber"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/webhook"
 	"github.com/blueambertech/googlepubsub"
 	"github.com/blueambertech/googlesecret"
 	"github.com/blueambertech/logging"
@@ -33,10 +42,11 @@ func main() {
 		Addr: ":" + port,
 	}
 
-	dbClient, err := firestoredb.New(data.ProjectID, dbName)
+	store, err := backend.Open(bgCtx, os.Getenv("STORAGE_BACKEND"), data.ProjectID, dbName)
 	if err != nil {
 		log.Fatal(err)
 	}
+	dbClient, logins := store.Client, store.Logins
 	pubsub, err := googlepubsub.New(bgCtx, data.ProjectID)
 	if err != nil {
 		log.Fatal(err)
@@ -44,8 +54,48 @@ func main() {
 	secrets := googlesecret.NewManager(data.ProjectID)
 
 	api.DbClient = dbClient
+	api.Logins = logins
 	api.Secrets = secrets
-	api.Events = pubsub
+	// Events are written to the outbox with the changes they describe and published to Pub/Sub by the relay
+	box := outbox.New(dbClient)
+	relay := outbox.NewRelay(dbClient, pubsub)
+	relay.Start(bgCtx)
+	auditLog := audit.New(dbClient, box, secrets)
+
+	// Lifecycle events from other services, SUBSCRIPTIONS binds subscriptions to actions, e.g. user-deleted=delete
+	bindings, err := subscriber.ParseBindings(os.Getenv("SUBSCRIPTIONS"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	lifecycle := subscriber.New(pubsub, logins, dbClient, box, auditLog, bindings)
+	lifecycle.Start(bgCtx)
+
+	// Webhooks receive the published login events from their own subscription to the topic
+	webhooks := webhook.NewDispatcher(dbClient, pubsub, webhook.NewClient(10*time.Second))
+	if subID := os.Getenv("WEBHOOK_SUBSCRIPTION"); subID != "" {
+		webhooks.SubscriptionID = subID
+	}
+	webhooks.Start(bgCtx)
+
+	api.Events = box
+	api.Audit = auditLog
+	api.CookieSessions = os.Getenv("COOKIE_SESSIONS") == "true"
+	api.LegacyTokenResponse = os.Getenv("LEGACY_TOKEN_RESPONSE") == "true"
+	if v := os.Getenv("TRUSTED_PROXIES"); v != "" {
+		// The number of proxies that append to X-Forwarded-For, Cloud Run's front end is the only one by default
+		if api.TrustedProxies, err = strconv.Atoi(v); err != nil || api.TrustedProxies < 0 {
+			log.Fatalf("TRUSTED_PROXIES must be a number of proxies: %q", v)
+		}
+	}
+	if err = configureRisk(); err != nil {
+		log.Fatal(err)
+	}
+	if admin := os.Getenv("BOOTSTRAP_ADMIN"); admin != "" {
+		// Grants the admin role to an existing login so that the first admin can manage everyone else
+		if err = login.BootstrapAdmin(bgCtx, logins, admin); err != nil {
+			log.Println("Failed to bootstrap admin:", err)
+		}
+	}
 	api.SetupHandlers()
 
 	go func() {
@@ -57,10 +107,47 @@ func main() {
 		log.Println("Stopped serving new connections")
 	}()
 
-	waitForShutdown(server)
+	waitForShutdown(server, lifecycle, relay, webhooks)
+}
+
+// configureRisk enables login risk scoring when RISK_SCORING is true. RISK_SUSPICIOUS_SCORE and RISK_BLOCK_SCORE override the
+// thresholds, by default suspicious logins are only reported. RISK_STEP_UP_SCORE is refused as there is no second factor to
+// step up to yet. GEOIP_DB_PATH is an optional MaxMind DB file used to locate IPs
+func configureRisk() error {
+	if os.Getenv("RISK_SCORING") != "true" {
+		return nil
+	}
+	if os.Getenv("RISK_STEP_UP_SCORE") != "" {
+		return errors.New("RISK_STEP_UP_SCORE: a second factor is not supported yet")
+	}
+	engine := risk.NewEngine()
+	for env, threshold := range map[string]*int{
+		"RISK_SUSPICIOUS_SCORE": &engine.SuspiciousScore,
+		"RISK_BLOCK_SCORE":      &engine.BlockScore,
+	} {
+		if v := os.Getenv(env); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("%s: %w", env, err)
+			}
+			*threshold = n
+		}
+	}
+	if path := os.Getenv("GEOIP_DB_PATH"); path != "" {
+		reader, err := geoip.Open(path)
+		if err != nil {
+			return err
+		}
+		api.GeoIP = reader
+	}
+	api.Risk = engine
+	return nil
 }
 
-func waitForShutdown(server *http.Server) {
+// waitForShutdown blocks until a shutdown signal is received, then stops the server, the lifecycle subscriber, the outbox relay
+// and the webhook dispatcher. The relay is stopped after everything that writes events so that it publishes the events of the
+// requests and messages that were finished
+func waitForShutdown(server *http.Server, lifecycle *subscriber.Subscriber, relay *outbox.Relay, webhooks *webhook.Dispatcher) {
 	signal.Notify(api.ShutdownChannel, syscall.SIGINT, syscall.SIGTERM)
 	<-api.ShutdownChannel
 
@@ -70,5 +157,14 @@ func waitForShutdown(server *http.Server) {
 	if err := server.Shutdown(shutdownCtx); err != nil {
 		log.Fatalf("Service shutdown error: %v", err)
 	}
+	if err := lifecycle.Stop(shutdownCtx); err != nil {
+		log.Println("Subscriber shutdown error:", err)
+	}
+	if err := relay.Stop(shutdownCtx); err != nil {
+		log.Println("Outbox relay shutdown error:", err)
+	}
+	if err := webhooks.Stop(shutdownCtx); err != nil {
+		log.Println("Webhook dispatcher shutdown error:", err)
+	}
 	log.Println("Service shutdown complete")
 }
@@ -3,68 +3,273 @@ package mock
 import (
 	"context"
 	"fmt"
-	"math/rand"
+	"sort"
+	"sync"
+	"time"
 
-	"github.com/blueambertech-demos/login-svc-gcp/data"
-	"github.com/fatih/structs"
-	"github.com/mitchellh/mapstructure"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/storage"
 )
 
+// NoSQLClient is an in-memory implementation of storage.Client that behaves like Firestore. Documents are stored per collection
+// and converted on write the way the Firestore client converts them, so nested structs become maps, slices become []interface{}
+// and integers become int64. It is safe for concurrent use
 type NoSQLClient struct {
-	data map[string]map[string]interface{}
+	mu   sync.RWMutex
+	data map[string]map[string]map[string]interface{}
 }
 
 func NewNoSQLClient() *NoSQLClient {
 	return &NoSQLClient{
-		data: map[string]map[string]interface{}{},
+		data: map[string]map[string]map[string]interface{}{},
 	}
 }
 
-func (f *NoSQLClient) Read(_ context.Context, _, id string) (map[string]interface{}, error) {
-	d := f.data[id]
-	return structs.Map(d), nil
+func (f *NoSQLClient) Read(_ context.Context, collection, id string) (map[string]interface{}, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	d, ok := f.data[collection][id]
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+	return storage.CopyDocument(d), nil
+}
+
+func (f *NoSQLClient) Insert(_ context.Context, collection string, data interface{}) (string, error) {
+	doc, err := storage.ToDocument(data)
+	if err != nil {
+		return "", err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c := f.collection(collection)
+	for {
+		id, err := storage.NewID()
+		if err != nil {
+			return "", err
+		}
+		if _, ok := c[id]; !ok {
+			c[id] = doc
+			return id, nil
+		}
+	}
+}
+
+func (f *NoSQLClient) InsertWithID(_ context.Context, collection, id string, data interface{}) error {
+	doc, err := storage.ToDocument(data)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c := f.collection(collection)
+	if _, ok := c[id]; ok {
+		return storage.ErrAlreadyExists
+	}
+	c[id] = doc
+	return nil
+}
+
+func (f *NoSQLClient) InsertAll(ctx context.Context, writes ...storage.Write) error {
+	for _, w := range writes {
+		if w.Op != storage.OpInsert {
+			return fmt.Errorf("mock: InsertAll given a write that is not an insert: %s/%s", w.Collection, w.ID)
+		}
+	}
+	return f.Commit(ctx, writes...)
+}
+
+func (f *NoSQLClient) Commit(_ context.Context, writes ...storage.Write) error {
+	docs := make([]map[string]interface{}, len(writes))
+	for i, w := range writes {
+		var err error
+		switch w.Op {
+		case storage.OpInsert:
+			docs[i], err = storage.ToDocument(w.Data)
+		case storage.OpUpdate:
+			docs[i], err = storage.ToDocument(w.Fields)
+		case storage.OpDelete:
+		default:
+			err = fmt.Errorf("mock: unknown write op %d", w.Op)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, w := range writes {
+		doc, ok := f.data[w.Collection][w.ID]
+		if w.Op == storage.OpInsert {
+			if ok {
+				return storage.ErrAlreadyExists
+			}
+			continue
+		}
+		if !ok {
+			return storage.ErrNotFound
+		}
+		if w.IfKey == "" {
+			continue
+		}
+		if current, _ := doc[w.IfKey].(string); current != w.IfValue {
+			return storage.ErrConflict
+		}
+	}
+	for i, w := range writes {
+		switch w.Op {
+		case storage.OpInsert:
+			f.collection(w.Collection)[w.ID] = docs[i]
+		case storage.OpUpdate:
+			for k, v := range docs[i] {
+				f.data[w.Collection][w.ID][k] = v
+			}
+		case storage.OpDelete:
+			delete(f.data[w.Collection], w.ID)
+		}
+	}
+	return nil
 }
 
-func (f *NoSQLClient) Insert(_ context.Context, _ string, data interface{}) (string, error) {
-	id := fmt.Sprintf("%d", rand.New(rand.NewSource(535345)).Int())
-	f.data[id] = structs.Map(data)
-	return id, nil
+func (f *NoSQLClient) Update(_ context.Context, collection, id string, data interface{}) error {
+	doc, err := storage.ToDocument(data)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.data[collection][id]; !ok {
+		return storage.ErrNotFound
+	}
+	f.data[collection][id] = doc
+	return nil
 }
 
-func (f *NoSQLClient) InsertWithID(_ context.Context, _, id string, data interface{}) error {
-	f.data[id] = structs.Map(data)
+func (f *NoSQLClient) UpdateFields(_ context.Context, collection, id string, fields map[string]interface{}) error {
+	values, err := storage.ToDocument(fields)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	doc, ok := f.data[collection][id]
+	if !ok {
+		return storage.ErrNotFound
+	}
+	for k, v := range values {
+		doc[k] = v
+	}
 	return nil
 }
 
-func (f *NoSQLClient) Where(_ context.Context, _, _, _, val string) (map[string]map[string]interface{}, error) {
-	var details = map[string]map[string]interface{}{}
-	for i, v := range f.data {
-		var d data.LoginDetails
-		if err := mapstructure.Decode(v, &d); err != nil {
-			return nil, err
+func (f *NoSQLClient) UpdateFieldsIf(ctx context.Context, collection, id, key, value string, fields map[string]interface{}) error {
+	return f.Commit(ctx, storage.UpdateIf(collection, id, key, value, fields))
+}
+
+func (f *NoSQLClient) Delete(_ context.Context, collection, id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.data[collection], id)
+	return nil
+}
+
+// Where supports the same operators as Firestore. As with Firestore the value is a string so only string fields, or string
+// elements of array fields, can match, except for "!=" and "not-in" which also match fields of other types. Documents without
+// the field never match. The "in", "not-in" and "array-contains-any" operators take a comma separated list of values
+func (f *NoSQLClient) Where(_ context.Context, collection, key, operator, val string) (map[string]map[string]interface{}, error) {
+	match, err := storage.Matcher(operator, val)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	var docs = map[string]map[string]interface{}{}
+	for i, v := range f.data[collection] {
+		field, ok := v[key]
+		if ok && match(field) {
+			docs[i] = storage.CopyDocument(v)
 		}
-		// Assuming key is UserName and op is == for simplicity
-		if d.UserName == val {
-			details[i] = v
+	}
+	return docs, nil
+}
+
+func (f *NoSQLClient) List(_ context.Context, collection string) (map[string]map[string]interface{}, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	var docs = map[string]map[string]interface{}{}
+	for i, v := range f.data[collection] {
+		docs[i] = storage.CopyDocument(v)
+	}
+	return docs, nil
+}
+
+func (f *NoSQLClient) ListPage(_ context.Context, collection, after string, limit int) ([]storage.Document, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	ids := make([]string, 0, len(f.data[collection]))
+	for id := range f.data[collection] {
+		if id > after {
+			ids = append(ids, id)
 		}
 	}
-	return details, nil
+	sort.Strings(ids)
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+	page := make([]storage.Document, len(ids))
+	for i, id := range ids {
+		page[i] = storage.Document{ID: id, Data: storage.CopyDocument(f.data[collection][id])}
+	}
+	return page, nil
 }
 
-func (f *NoSQLClient) Exists(_ context.Context, _, key string) (bool, error) {
-	_, ok := f.data[key]
+func (f *NoSQLClient) ListBefore(_ context.Context, collection, key string, t time.Time, limit int) ([]storage.Document, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	docs := make(map[string]map[string]interface{}, len(f.data[collection]))
+	for id, doc := range f.data[collection] {
+		docs[id] = storage.CopyDocument(doc)
+	}
+	return storage.SortBefore(docs, key, t, limit), nil
+}
+
+func (f *NoSQLClient) Exists(_ context.Context, collection, id string) (bool, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	_, ok := f.data[collection][id]
 	if !ok {
 		return false, nil
 	}
 	return true, nil
 }
 
-func (f *NoSQLClient) SetData(d map[string]map[string]interface{}) {
-	f.data = d
+// SetData replaces the contents of a collection, the documents are converted as they would be if they had been inserted
+func (f *NoSQLClient) SetData(collection string, d map[string]map[string]interface{}) {
+	docs := make(map[string]map[string]interface{}, len(d))
+	for id, v := range d {
+		doc, err := storage.ToDocument(v)
+		if err != nil {
+			panic(err)
+		}
+		docs[id] = doc
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.data[collection] = docs
 }
 
 func (f *NoSQLClient) ClearData() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	for k := range f.data {
 		delete(f.data, k)
 	}
 }
+
+func (f *NoSQLClient) collection(name string) map[string]map[string]interface{} {
+	c, ok := f.data[name]
+	if !ok {
+		c = map[string]map[string]interface{}{}
+		f.data[name] = c
+	}
+	return c
+}
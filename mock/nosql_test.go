@@ -0,0 +1,27 @@
+package mock
+
+import (
+	"context"
+	"testing"
+
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/storage/storagetest"
+)
+
+func TestNoSQLClientConformance(t *testing.T) {
+	storagetest.RunClientTests(t, NewNoSQLClient())
+}
+
+func TestNoSQLClientReadReturnsCopy(t *testing.T) {
+	ctx := context.Background()
+	c := NewNoSQLClient()
+	if err := c.InsertWithID(ctx, "test", "doc", map[string]interface{}{"Tags": []string{"a"}}); err != nil {
+		t.Error(err)
+		return
+	}
+	doc, _ := c.Read(ctx, "test", "doc")
+	doc["Tags"].([]interface{})[0] = "changed"
+	doc, _ = c.Read(ctx, "test", "doc")
+	if doc["Tags"].([]interface{})[0] != "a" {
+		t.Error("changes to a read document should not affect the stored document")
+	}
+}
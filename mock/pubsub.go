@@ -2,16 +2,107 @@ package mock
 
 import (
 	"context"
+	"sync"
 	"time"
 )
 
+// PubSubHandler is an in-memory pubsub.Handler. A message pushed to a topic is queued for every subscription to the topic and
+// delivered by Subscribe, a subscription that has not been added with AddSubscription receives the messages of the topic with
+// the same ID. Every message that is accepted is recorded so that tests can check what was published, and pushes can be made
+// to fail with FailPushes. The zero value is ready to use
 type PubSubHandler struct {
+	mu        sync.Mutex
+	topics    map[string]string   // subscription ID to topic ID
+	queues    map[string][]string // subscription ID to undelivered messages
+	published map[string][]string // topic ID to every accepted message
+	failures  map[string]error    // topic ID, or "" for every topic, to the error returned by Push
 }
 
-func (pb *PubSubHandler) Subscribe(_ context.Context, _ string, _ time.Duration, _ func(c context.Context, msgData []byte)) error {
-	return nil
+// AddSubscription creates a subscription to a topic, messages pushed to the topic from now on are queued for it
+func (pb *PubSubHandler) AddSubscription(subID, topicID string) {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+	if pb.topics == nil {
+		pb.topics = map[string]string{}
+	}
+	pb.topics[subID] = topicID
+}
+
+// FailPushes makes pushes to the topic return err, an empty topic ID fails pushes to every topic. A nil err stops the failures
+func (pb *PubSubHandler) FailPushes(topicID string, err error) {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+	if pb.failures == nil {
+		pb.failures = map[string]error{}
+	}
+	if err == nil {
+		delete(pb.failures, topicID)
+		return
+	}
+	pb.failures[topicID] = err
 }
 
-func (pb *PubSubHandler) Push(_ context.Context, _, _ string) error {
+// Published returns every message accepted for a topic, oldest first
+func (pb *PubSubHandler) Published(topicID string) []string {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+	return append([]string(nil), pb.published[topicID]...)
+}
+
+// Reset removes all messages, subscriptions and failures
+func (pb *PubSubHandler) Reset() {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+	pb.topics, pb.queues, pb.published, pb.failures = nil, nil, nil, nil
+}
+
+// Subscribe delivers the messages queued for the subscription to msgProc one at a time, checking for new messages at the refresh
+// rate. It blocks until cancCtx is done
+func (pb *PubSubHandler) Subscribe(cancCtx context.Context, subID string, refreshRate time.Duration, msgProc func(c context.Context, msgData []byte)) error {
+	ticker := time.NewTicker(refreshRate)
+	defer ticker.Stop()
+	for {
+		for _, msg := range pb.take(subID) {
+			msgProc(cancCtx, []byte(msg))
+		}
+		select {
+		case <-cancCtx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Push queues a message for every subscription to the topic, unless pushes to the topic have been made to fail
+func (pb *PubSubHandler) Push(_ context.Context, topicID, msg string) error {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+	if err, ok := pb.failures[topicID]; ok {
+		return err
+	}
+	if err, ok := pb.failures[""]; ok {
+		return err
+	}
+	if pb.queues == nil {
+		pb.queues = map[string][]string{}
+		pb.published = map[string][]string{}
+	}
+	pb.published[topicID] = append(pb.published[topicID], msg)
+	if _, ok := pb.topics[topicID]; !ok {
+		pb.queues[topicID] = append(pb.queues[topicID], msg)
+	}
+	for subID, t := range pb.topics {
+		if t == topicID {
+			pb.queues[subID] = append(pb.queues[subID], msg)
+		}
+	}
 	return nil
 }
+
+func (pb *PubSubHandler) take(subID string) []string {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+	msgs := pb.queues[subID]
+	delete(pb.queues, subID)
+	return msgs
+}
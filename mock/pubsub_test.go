@@ -0,0 +1,77 @@
+package mock
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPubSubHandlerDelivers(t *testing.T) {
+	ctx, canc := context.WithTimeout(context.Background(), time.Second)
+	defer canc()
+	pb := &PubSubHandler{}
+	pb.AddSubscription("sub-a", "topic")
+	pb.AddSubscription("sub-b", "topic")
+	_ = pb.Push(ctx, "topic", "one")
+	_ = pb.Push(ctx, "other", "ignored")
+	_ = pb.Push(ctx, "topic", "two")
+
+	for _, subID := range []string{"sub-a", "sub-b"} {
+		sctx, scanc := context.WithCancel(ctx)
+		var got []string
+		err := pb.Subscribe(sctx, subID, time.Millisecond, func(_ context.Context, msg []byte) {
+			if got = append(got, string(msg)); len(got) == 2 {
+				scanc()
+			}
+		})
+		scanc()
+		if err != nil || len(got) != 2 || got[0] != "one" || got[1] != "two" {
+			t.Errorf("%s: expected both messages in order, got %v, %v", subID, got, err)
+		}
+	}
+}
+
+func TestPubSubHandlerSubscriptionNamedAfterTopic(t *testing.T) {
+	ctx, canc := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer canc()
+	pb := &PubSubHandler{}
+	_ = pb.Push(ctx, "topic", "one")
+	var got []string
+	_ = pb.Subscribe(ctx, "topic", time.Millisecond, func(_ context.Context, msg []byte) {
+		got = append(got, string(msg))
+	})
+	if len(got) != 1 {
+		t.Error("expected the subscription with the topic's ID to receive its messages, got", got)
+	}
+}
+
+func TestPubSubHandlerFailures(t *testing.T) {
+	ctx := context.Background()
+	pb := &PubSubHandler{}
+	errDown := errors.New("pubsub down")
+	pb.FailPushes("topic", errDown)
+	if err := pb.Push(ctx, "topic", "lost"); !errors.Is(err, errDown) {
+		t.Error("expected the injected error, got", err)
+	}
+	if err := pb.Push(ctx, "other", "kept"); err != nil {
+		t.Error("only the failing topic should fail, got", err)
+	}
+	pb.FailPushes("", errDown)
+	if err := pb.Push(ctx, "other", "lost"); !errors.Is(err, errDown) {
+		t.Error("expected every topic to fail, got", err)
+	}
+	pb.FailPushes("", nil)
+	pb.FailPushes("topic", nil)
+	if err := pb.Push(ctx, "topic", "kept"); err != nil {
+		t.Error(err)
+	}
+
+	if got := pb.Published("topic"); len(got) != 1 || got[0] != "kept" {
+		t.Error("only accepted messages should be recorded, got", got)
+	}
+	pb.Reset()
+	if got := pb.Published("other"); len(got) != 0 {
+		t.Error("reset should remove recorded messages, got", got)
+	}
+}
@@ -11,6 +11,7 @@ func NewSecretManager() *SecretManager {
 		data: map[string]interface{}{},
 	}
 	sm.data["jwt-auth-token-key"] = "somekey"
+	sm.data["audit-log-key"] = "someauditkey"
 	return sm
 }
 
@@ -0,0 +1,246 @@
+// Package audit records security relevant events such as logins, registrations and admin actions. Records are written to an
+// append only collection, where they can be queried by user and time, and published to a dedicated topic. Each record is
+// linked to the one before it in a hash chain and signed with a key from the secret manager so that edits can be detected,
+// see Verify
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/storage"
+	"github.com/blueambertech/pubsub"
+	"github.com/blueambertech/secretmanager"
+	"github.com/mitchellh/mapstructure"
+)
+
+const (
+	// CollectionName is the collection audit records are written to, records are only ever inserted
+	CollectionName = "audit"
+	// PersonalCollection holds the username, IP address and user agent of each audit record under the ID of the record, they
+	// are kept apart from the record so that Erase can delete them without changing the chain
+	PersonalCollection = "audit-personal"
+	// TopicID is the topic each audit record is published to as JSON
+	TopicID = "login-audit"
+)
+
+// Event types
+const (
+	LoginSucceeded = "login.succeeded"
+	LoginFailed    = "login.failed"
+	// LoginRefused is a login with valid credentials that risk scoring refused, it is not a failure so it doesn't count
+	// towards the failures that make later logins riskier
+	LoginRefused        = "login.refused"
+	SuspiciousLogin     = "login.suspicious"
+	Registered          = "login.registered"
+	PasswordChanged     = "password.changed"
+	PasswordResetForced = "password.reset_forced"
+	AccountLocked       = "account.locked"
+	StatusChanged       = "account.status_changed"
+	RolesChanged        = "account.roles_changed"
+	UsernameChanged     = "account.username_changed"
+	AccountDeleted      = "account.deleted"
+	SessionsRevoked     = "sessions.revoked"
+	UsersListed         = "admin.users_listed"
+	UserRead            = "admin.user_read"
+	WebhookRegistered   = "admin.webhook_registered"
+	WebhookDeleted      = "admin.webhook_deleted"
+	// Erasure records that the personal details of the records listed in Erases were deleted by Erase
+	Erasure = "audit.erased"
+)
+
+// Outcomes
+const (
+	Success = "success"
+	Failure = "failure"
+)
+
+type Record struct {
+	ID      string    `json:"id"`
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	ActorID string    `json:"actorId,omitempty"`
+	// TargetID is the user the event happened to, it is the same as ActorID when a user acts on their own account
+	TargetID string `json:"targetId,omitempty"`
+	// UserName is the username given in a login attempt, it identifies failed attempts against usernames that don't exist
+	UserName  string `json:"userName,omitempty"`
+	IP        string `json:"ip,omitempty"`
+	UserAgent string `json:"userAgent,omitempty"`
+	Outcome   string `json:"outcome"`
+	Reason    string `json:"reason,omitempty"`
+	TraceID   string `json:"traceId,omitempty"`
+	// PersonalHash is the SHA-256 of the salted UserName, IP and UserAgent, which are stored in PersonalCollection. It is
+	// part of the chain in place of them so that the rest of the record can still be verified once they are erased, it is
+	// empty when the record has none of them
+	PersonalHash string `json:"personalHash,omitempty"`
+	// Erases holds the sequences of the records whose personal details were deleted, it is only set on Erasure records
+	Erases []int64 `json:"erases,omitempty"`
+	// Erased is set on records read back after their personal details were deleted by Erase, it is never stored
+	Erased bool `json:"erased,omitempty"`
+
+	// Sequence is the position of the record in the hash chain, starting at 1
+	Sequence int64 `json:"sequence"`
+	// PrevHash is the Hash of the record before this one in the chain, it is empty for the first record
+	PrevHash string `json:"prevHash,omitempty"`
+	// Hash is the SHA-256 of the record with Hash and MAC empty
+	Hash string `json:"hash"`
+	// MAC is an HMAC-SHA256 of Hash using the audit log key
+	MAC string `json:"mac"`
+}
+
+// Log writes audit records to a database and an event queue
+type Log struct {
+	dbClient   storage.Client
+	eventQueue pubsub.Handler
+	secrets    secretmanager.SecretManager
+
+	// mu serialises writes so that records from this instance are appended to the chain in order, head is the last record
+	// this instance knows about or nil if it has to be found in the database
+	mu   sync.Mutex
+	head *chainHead
+}
+
+// New returns a Log that writes records using the supplied database client and event queue, records are signed with a key
+// from the secret manager
+func New(dbClient storage.Client, eventQueue pubsub.Handler, secrets secretmanager.SecretManager) *Log {
+	return &Log{dbClient: dbClient, eventQueue: eventQueue, secrets: secrets}
+}
+
+// Write appends an audit record to the chain and publishes it, the time is set if it is empty and the ID and chain fields
+// are always set. The record is stored before it is published so that a failure to publish never loses it
+func (l *Log) Write(ctx context.Context, rec *Record) error {
+	if rec.Time.IsZero() {
+		rec.Time = time.Now()
+	}
+	// Firestore stores times to the microsecond, the time is truncated so the hash still matches when the record is read back
+	rec.Time = rec.Time.UTC().Truncate(time.Microsecond)
+	key, err := getKey(ctx, l.secrets)
+	if err != nil {
+		return err
+	}
+	rec.Erased = false
+	personal, err := newPersonalDetails(rec)
+	if err != nil {
+		return err
+	}
+	if err = l.append(ctx, rec, personal, key); err != nil {
+		return err
+	}
+	msg, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if err = l.eventQueue.Push(ctx, TopicID, string(msg)); err != nil {
+		return fmt.Errorf("publishing audit record: %w", err)
+	}
+	return nil
+}
+
+// Query returns the audit records where the user is the actor or the target with a time in [from, to), oldest first. A zero
+// from or to leaves that end of the range open
+func (l *Log) Query(ctx context.Context, userID string, from, to time.Time) ([]Record, error) {
+	return l.query(ctx, CollectionName, []string{"ActorID", "TargetID"}, userID, from, to)
+}
+
+// QueryIP returns the audit records of requests from an IP address with a time in [from, to), oldest first
+func (l *Log) QueryIP(ctx context.Context, ip string, from, to time.Time) ([]Record, error) {
+	return l.query(ctx, PersonalCollection, []string{"IP"}, ip, from, to)
+}
+
+// Erase deletes the username, IP address and user agent of every record where the user is the actor or the target, or the
+// username is one of userNames, and returns the number of records changed. The records themselves are never changed, an
+// Erasure record listing them is appended to the chain first so that Verify can tell the deletions apart from tampering.
+// Copies already published to TopicID are not changed
+func (l *Log) Erase(ctx context.Context, userID string, userNames ...string) (int, error) {
+	records, err := l.query(ctx, CollectionName, []string{"ActorID", "TargetID"}, userID, time.Time{}, time.Time{})
+	if err != nil {
+		return 0, err
+	}
+	for _, userName := range userNames {
+		named, err := l.query(ctx, PersonalCollection, []string{"UserName"}, userName, time.Time{}, time.Time{})
+		if err != nil {
+			return 0, err
+		}
+		records = append(records, named...)
+	}
+	var erases []int64
+	seen := map[int64]bool{}
+	for _, rec := range records {
+		if rec.PersonalHash == "" || rec.Erased || seen[rec.Sequence] {
+			continue
+		}
+		seen[rec.Sequence] = true
+		erases = append(erases, rec.Sequence)
+	}
+	if len(erases) == 0 {
+		return 0, nil
+	}
+	sort.Slice(erases, func(i, j int) bool { return erases[i] < erases[j] })
+	if err = l.Write(ctx, &Record{Type: Erasure, TargetID: userID, Outcome: Success, Erases: erases}); err != nil {
+		return 0, fmt.Errorf("recording audit erasure: %w", err)
+	}
+	for n, seq := range erases {
+		err = l.dbClient.Delete(ctx, PersonalCollection, recordID(seq))
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return n, fmt.Errorf("erasing audit record %d: %w", seq, err)
+		}
+	}
+	return len(erases), nil
+}
+
+// query returns the records where any of the fields of the documents in collection equal value, collection is either
+// CollectionName or PersonalCollection
+func (l *Log) query(ctx context.Context, collection string, fields []string, value string, from, to time.Time) ([]Record, error) {
+	records := map[string]Record{}
+	for _, field := range fields {
+		docs, err := l.dbClient.Where(ctx, collection, field, "==", value)
+		if err != nil {
+			return nil, err
+		}
+		for id, doc := range docs {
+			if _, ok := records[id]; ok {
+				continue
+			}
+			var rec *Record
+			if collection == CollectionName {
+				rec, err = decode(doc)
+			} else {
+				rec, err = readRecord(ctx, l.dbClient, id)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("reading audit record %s: %w", id, err)
+			}
+			if (!from.IsZero() && rec.Time.Before(from)) || (!to.IsZero() && !rec.Time.Before(to)) {
+				continue
+			}
+			if err = readPersonal(ctx, l.dbClient, rec); err != nil {
+				return nil, err
+			}
+			records[id] = *rec
+		}
+	}
+	result := make([]Record, 0, len(records))
+	for _, rec := range records {
+		result = append(result, rec)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if !result[i].Time.Equal(result[j].Time) {
+			return result[i].Time.Before(result[j].Time)
+		}
+		return result[i].Sequence < result[j].Sequence
+	})
+	return result, nil
+}
+
+func decode(doc map[string]interface{}) (*Record, error) {
+	var rec Record
+	if err := mapstructure.Decode(doc, &rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
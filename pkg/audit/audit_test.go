@@ -0,0 +1,65 @@
+package audit_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/blueambertech-demos/login-svc-gcp/mock"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/audit"
+)
+
+func TestWriteAndQuery(t *testing.T) {
+	ctx := context.Background()
+	log := audit.New(mock.NewNoSQLClient(), &mock.PubSubHandler{}, mock.NewSecretManager())
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	records := []audit.Record{
+		{Time: start, Type: audit.LoginSucceeded, ActorID: "alice", TargetID: "alice", IP: "203.0.113.1", Outcome: audit.Success},
+		{Time: start.Add(time.Hour), Type: audit.RolesChanged, ActorID: "admin", TargetID: "alice", Outcome: audit.Success},
+		{Time: start.Add(2 * time.Hour), Type: audit.LoginFailed, ActorID: "bob", TargetID: "bob", IP: "203.0.113.1", Outcome: audit.Failure},
+		{Time: start.Add(3 * time.Hour), Type: audit.UserRead, ActorID: "alice", TargetID: "bob", Outcome: audit.Success},
+	}
+	for i := range records {
+		if err := log.Write(ctx, &records[i]); err != nil {
+			t.Error(err)
+			return
+		}
+		if records[i].ID == "" {
+			t.Error("Write should set the record ID")
+		}
+	}
+
+	got, err := log.Query(ctx, "alice", time.Time{}, time.Time{})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(got) != 3 || got[0].Type != audit.LoginSucceeded || got[1].Type != audit.RolesChanged || got[2].Type != audit.UserRead {
+		t.Errorf("expected alice's records as actor and target in time order, got %+v", got)
+	}
+	if !got[1].Time.Equal(start.Add(time.Hour)) {
+		t.Error("unexpected record time:", got[1].Time)
+	}
+
+	got, err = log.Query(ctx, "alice", start.Add(time.Hour), start.Add(3*time.Hour))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(got) != 1 || got[0].Type != audit.RolesChanged {
+		t.Errorf("expected only the records in the time range, got %+v", got)
+	}
+
+	if got, _ = log.Query(ctx, "nobody", time.Time{}, time.Time{}); len(got) != 0 {
+		t.Error("expected no records for an unknown user, got", got)
+	}
+
+	got, err = log.QueryIP(ctx, "203.0.113.1", start.Add(time.Minute), time.Time{})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(got) != 1 || got[0].Type != audit.LoginFailed {
+		t.Errorf("expected the records from the IP in the time range, got %+v", got)
+	}
+}
@@ -0,0 +1,353 @@
+package audit
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/storage"
+	"github.com/blueambertech/secretmanager"
+	"github.com/mitchellh/mapstructure"
+)
+
+const (
+	// ChainCollection holds the head of the hash chain, the sequence and hash of the last record written. It is a hint for
+	// finding the end of the chain quickly and lets Verify detect records deleted from the end
+	ChainCollection = "audit-chain"
+	// KeyName is the name of the secret used to sign audit records
+	KeyName = "audit-log-key"
+
+	headID = "head"
+
+	// maxAppendAttempts limits how many times a write is retried when other instances are appending to the chain
+	maxAppendAttempts = 10
+)
+
+// ErrChainContention is returned by Write when a record could not be appended because other writers kept taking the next
+// position in the chain
+var ErrChainContention = errors.New("audit: too many concurrent writers appending to the chain")
+
+// personalDetails are the parts of a record that identify a person, stored in PersonalCollection under the ID of the record
+type personalDetails struct {
+	UserName  string
+	IP        string
+	UserAgent string
+	// Salt stops the PersonalHash of an erased record being reversed by hashing likely usernames and addresses
+	Salt string
+}
+
+type chainHead struct {
+	Sequence int64
+	Hash     string
+}
+
+// VerifyReport is the result of checking a range of the audit chain, each list holds the sequence numbers of the records with
+// that problem
+type VerifyReport struct {
+	From    int64 `json:"from"`
+	To      int64 `json:"to"`
+	Checked int   `json:"checked"`
+	// Gaps are records that are missing from the chain
+	Gaps []int64 `json:"gaps"`
+	// Modified are records whose content no longer matches their hash
+	Modified []int64 `json:"modified"`
+	// InvalidMAC are records whose hash was not signed with the audit log key
+	InvalidMAC []int64 `json:"invalidMac"`
+	// BrokenLinks are records whose PrevHash does not match the hash of the record before them
+	BrokenLinks []int64 `json:"brokenLinks"`
+	// Erased are records whose personal details were deleted by Erase, the rest of their content is still checked against
+	// their hash and an Erasure record in the chain must list them, otherwise the missing details are reported as Modified
+	Erased []int64 `json:"erased"`
+}
+
+// OK returns true if no problems were found
+func (r *VerifyReport) OK() bool {
+	return len(r.Gaps) == 0 && len(r.Modified) == 0 && len(r.InvalidMAC) == 0 && len(r.BrokenLinks) == 0
+}
+
+// append sets the chain fields of the record and stores it as the next record in the chain, along with its personal details
+// when it has any. Records are stored by sequence with create-if-absent semantics, so when another instance has already
+// written the next sequence the end of the chain is found again and the write is retried
+func (l *Log) append(ctx context.Context, rec *Record, personal *personalDetails, key []byte) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for attempt := 0; attempt < maxAppendAttempts; attempt++ {
+		if l.head == nil {
+			head, err := findHead(ctx, l.dbClient)
+			if err != nil {
+				return err
+			}
+			l.head = head
+		}
+		rec.Sequence = l.head.Sequence + 1
+		rec.ID = recordID(rec.Sequence)
+		rec.PrevHash = l.head.Hash
+		hash, err := hashRecord(rec)
+		if err != nil {
+			return err
+		}
+		rec.Hash, rec.MAC = hash, sign(key, hash)
+
+		stored := *rec
+		stored.UserName, stored.IP, stored.UserAgent = "", "", ""
+		writes := []storage.Write{{Collection: CollectionName, ID: rec.ID, Data: &stored}}
+		if personal != nil {
+			writes = append(writes, storage.Write{Collection: PersonalCollection, ID: rec.ID, Data: personal})
+		}
+		err = l.dbClient.InsertAll(ctx, writes...)
+		if errors.Is(err, storage.ErrAlreadyExists) {
+			l.head = nil
+			continue
+		} else if err != nil {
+			return fmt.Errorf("storing audit record: %w", err)
+		}
+		l.head = &chainHead{Sequence: rec.Sequence, Hash: rec.Hash}
+		// The head is only a hint, findHead reads past it to the real end of the chain, so a failure to store it doesn't
+		// fail the write
+		_ = saveHead(ctx, l.dbClient, l.head)
+		return nil
+	}
+	return ErrChainContention
+}
+
+// Verify walks the records in the chain from sequence from to sequence to inclusive, checking that each one exists, matches
+// its hash, is signed with the audit log key and links to the record before it. The personal details of each record must
+// match its PersonalHash, or be missing and listed by a valid Erasure record. A to of 0 checks up to the end of the chain
+func Verify(ctx context.Context, dbClient storage.Client, secrets secretmanager.SecretManager, from, to int64) (*VerifyReport, error) {
+	key, err := getKey(ctx, secrets)
+	if err != nil {
+		return nil, err
+	}
+	if from < 1 {
+		from = 1
+	}
+	if to == 0 {
+		head, err := findHead(ctx, dbClient)
+		if err != nil {
+			return nil, err
+		}
+		to = head.Sequence
+	}
+	erasures, err := findErasures(ctx, dbClient, key)
+	if err != nil {
+		return nil, err
+	}
+	report := &VerifyReport{From: from, To: to, Gaps: []int64{}, Modified: []int64{}, InvalidMAC: []int64{}, BrokenLinks: []int64{}, Erased: []int64{}}
+
+	var prev *Record
+	if from > 1 {
+		if prev, err = readRecord(ctx, dbClient, recordID(from-1)); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return report, err
+		}
+	}
+	for seq := from; seq <= to; seq++ {
+		rec, err := readRecord(ctx, dbClient, recordID(seq))
+		if errors.Is(err, storage.ErrNotFound) {
+			report.Gaps = append(report.Gaps, seq)
+			prev = nil
+			continue
+		} else if err != nil {
+			return report, err
+		}
+		report.Checked++
+
+		hash, err := hashRecord(rec)
+		if err != nil {
+			return report, err
+		}
+		personalOK := true
+		if rec.PersonalHash != "" {
+			personal, err := readPersonalDetails(ctx, dbClient, rec.ID)
+			if errors.Is(err, storage.ErrNotFound) && erasures[seq] {
+				report.Erased = append(report.Erased, seq)
+			} else if errors.Is(err, storage.ErrNotFound) {
+				personalOK = false
+			} else if err != nil {
+				return report, err
+			} else {
+				personalOK = personal.hash() == rec.PersonalHash
+			}
+		} else {
+			personalOK = rec.UserName == "" && rec.IP == "" && rec.UserAgent == ""
+		}
+		if hash != rec.Hash || rec.Sequence != seq || !personalOK {
+			report.Modified = append(report.Modified, seq)
+		}
+		if !hmac.Equal([]byte(sign(key, rec.Hash)), []byte(rec.MAC)) {
+			report.InvalidMAC = append(report.InvalidMAC, seq)
+		}
+		// A link can't be checked after a gap, the gap has already been reported
+		if (seq == 1 && rec.PrevHash != "") || (prev != nil && rec.PrevHash != prev.Hash) {
+			report.BrokenLinks = append(report.BrokenLinks, seq)
+		}
+		prev = rec
+	}
+	return report, nil
+}
+
+// findHead returns the last record in the chain, starting from the stored head and reading forward past any records written
+// after it was stored
+func findHead(ctx context.Context, dbClient storage.Client) (*chainHead, error) {
+	head := &chainHead{}
+	doc, err := dbClient.Read(ctx, ChainCollection, headID)
+	if err == nil {
+		if err = mapstructure.Decode(doc, head); err != nil {
+			return nil, fmt.Errorf("decoding audit chain head: %w", err)
+		}
+	} else if !errors.Is(err, storage.ErrNotFound) {
+		return nil, err
+	}
+	for {
+		rec, err := readRecord(ctx, dbClient, recordID(head.Sequence+1))
+		if errors.Is(err, storage.ErrNotFound) {
+			return head, nil
+		} else if err != nil {
+			return nil, err
+		}
+		head = &chainHead{Sequence: rec.Sequence, Hash: rec.Hash}
+	}
+}
+
+func saveHead(ctx context.Context, dbClient storage.Client, head *chainHead) error {
+	err := dbClient.Update(ctx, ChainCollection, headID, head)
+	if errors.Is(err, storage.ErrNotFound) {
+		err = dbClient.InsertWithID(ctx, ChainCollection, headID, head)
+	}
+	return err
+}
+
+// findErasures returns the sequences listed by the Erasure records in the chain that match their hash and are signed with the
+// audit log key
+func findErasures(ctx context.Context, dbClient storage.Client, key []byte) (map[int64]bool, error) {
+	docs, err := dbClient.Where(ctx, CollectionName, "Type", "==", Erasure)
+	if err != nil {
+		return nil, err
+	}
+	erasures := map[int64]bool{}
+	for id, doc := range docs {
+		rec, err := decode(doc)
+		if err != nil {
+			return nil, fmt.Errorf("decoding audit record %s: %w", id, err)
+		}
+		hash, err := hashRecord(rec)
+		if err != nil {
+			return nil, err
+		}
+		if hash != rec.Hash || !hmac.Equal([]byte(sign(key, rec.Hash)), []byte(rec.MAC)) {
+			continue
+		}
+		for _, seq := range rec.Erases {
+			erasures[seq] = true
+		}
+	}
+	return erasures, nil
+}
+
+func readRecord(ctx context.Context, dbClient storage.Client, id string) (*Record, error) {
+	doc, err := dbClient.Read(ctx, CollectionName, id)
+	if err != nil {
+		return nil, err
+	}
+	rec, err := decode(doc)
+	if err != nil {
+		return nil, fmt.Errorf("decoding audit record %s: %w", id, err)
+	}
+	return rec, nil
+}
+
+// readPersonal fills in the personal details of the record, or marks it as erased when they have been deleted
+func readPersonal(ctx context.Context, dbClient storage.Client, rec *Record) error {
+	if rec.PersonalHash == "" {
+		return nil
+	}
+	personal, err := readPersonalDetails(ctx, dbClient, rec.ID)
+	if errors.Is(err, storage.ErrNotFound) {
+		rec.Erased = true
+		return nil
+	} else if err != nil {
+		return err
+	}
+	rec.UserName, rec.IP, rec.UserAgent = personal.UserName, personal.IP, personal.UserAgent
+	return nil
+}
+
+func readPersonalDetails(ctx context.Context, dbClient storage.Client, id string) (*personalDetails, error) {
+	doc, err := dbClient.Read(ctx, PersonalCollection, id)
+	if err != nil {
+		return nil, err
+	}
+	var personal personalDetails
+	if err = mapstructure.Decode(doc, &personal); err != nil {
+		return nil, fmt.Errorf("decoding personal details of audit record %s: %w", id, err)
+	}
+	return &personal, nil
+}
+
+// newPersonalDetails returns the personal details of the record with a new salt and sets its PersonalHash, it returns nil
+// when the record has none
+func newPersonalDetails(rec *Record) (*personalDetails, error) {
+	rec.PersonalHash = ""
+	if rec.UserName == "" && rec.IP == "" && rec.UserAgent == "" {
+		return nil, nil
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	personal := &personalDetails{UserName: rec.UserName, IP: rec.IP, UserAgent: rec.UserAgent, Salt: hex.EncodeToString(salt)}
+	rec.PersonalHash = personal.hash()
+	return personal, nil
+}
+
+// hash returns the hex SHA-256 of the JSON encoding of the personal details
+func (p *personalDetails) hash() string {
+	b, _ := json.Marshal(p)
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+// recordID returns the ID of the record at a position in the chain, it is zero padded so that IDs sort in chain order
+func recordID(seq int64) string {
+	return fmt.Sprintf("%020d", seq)
+}
+
+// hashRecord returns the hex SHA-256 of the JSON encoding of the record without its Hash, MAC and personal details, which
+// are covered by PersonalHash instead
+func hashRecord(rec *Record) (string, error) {
+	c := *rec
+	c.Hash, c.MAC = "", ""
+	c.UserName, c.IP, c.UserAgent, c.Erased = "", "", "", false
+	c.Time = c.Time.UTC()
+	b, err := json.Marshal(&c)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:]), nil
+}
+
+func sign(key []byte, hash string) string {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(hash))
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+func getKey(ctx context.Context, sm secretmanager.SecretManager) ([]byte, error) {
+	key, err := sm.Get(ctx, KeyName)
+	if err != nil {
+		return nil, err
+	}
+	switch v := key.(type) {
+	case []byte:
+		return v, nil
+	case string:
+		return []byte(v), nil
+	default:
+		return nil, errors.New("audit log key was an unrecognised type")
+	}
+}
@@ -0,0 +1,205 @@
+package audit_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/blueambertech-demos/login-svc-gcp/mock"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/audit"
+)
+
+func writeRecords(t *testing.T, log *audit.Log, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		if err := log.Write(context.Background(), &audit.Record{Type: audit.LoginSucceeded, ActorID: "alice", Outcome: audit.Success}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func verify(t *testing.T, dbClient *mock.NoSQLClient, from, to int64) *audit.VerifyReport {
+	t.Helper()
+	report, err := audit.Verify(context.Background(), dbClient, mock.NewSecretManager(), from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+func recordID(seq int64) string {
+	return fmt.Sprintf("%020d", seq)
+}
+
+func TestChainVerifies(t *testing.T) {
+	dbClient := mock.NewNoSQLClient()
+	writeRecords(t, audit.New(dbClient, &mock.PubSubHandler{}, mock.NewSecretManager()), 5)
+	// A new instance carries on from the end of the chain
+	writeRecords(t, audit.New(dbClient, &mock.PubSubHandler{}, mock.NewSecretManager()), 2)
+
+	report := verify(t, dbClient, 0, 0)
+	if !report.OK() || report.Checked != 7 || report.To != 7 {
+		t.Errorf("expected an intact chain of 7 records, got %+v", report)
+	}
+	if report = verify(t, dbClient, 3, 5); !report.OK() || report.Checked != 3 {
+		t.Errorf("expected a range of the chain to verify, got %+v", report)
+	}
+}
+
+func TestChainDetectsModification(t *testing.T) {
+	ctx := context.Background()
+	dbClient := mock.NewNoSQLClient()
+	writeRecords(t, audit.New(dbClient, &mock.PubSubHandler{}, mock.NewSecretManager()), 4)
+
+	doc, _ := dbClient.Read(ctx, audit.CollectionName, recordID(2))
+	doc["Outcome"] = audit.Failure
+	if err := dbClient.Update(ctx, audit.CollectionName, recordID(2), doc); err != nil {
+		t.Fatal(err)
+	}
+	report := verify(t, dbClient, 0, 0)
+	if len(report.Modified) != 1 || report.Modified[0] != 2 || len(report.InvalidMAC) != 0 {
+		t.Errorf("expected record 2 to be reported as modified, got %+v", report)
+	}
+
+	// Rewriting the hash without the key is caught by the MAC, and the next record no longer links to it
+	h := sha256.Sum256([]byte("forged"))
+	doc["Hash"] = hex.EncodeToString(h[:])
+	if err := dbClient.Update(ctx, audit.CollectionName, recordID(2), doc); err != nil {
+		t.Fatal(err)
+	}
+	report = verify(t, dbClient, 0, 0)
+	if len(report.InvalidMAC) != 1 || report.InvalidMAC[0] != 2 || len(report.BrokenLinks) != 1 || report.BrokenLinks[0] != 3 {
+		t.Errorf("expected an invalid MAC on record 2 and a broken link at 3, got %+v", report)
+	}
+}
+
+func TestChainErasedRecords(t *testing.T) {
+	ctx := context.Background()
+	dbClient := mock.NewNoSQLClient()
+	log := audit.New(dbClient, &mock.PubSubHandler{}, mock.NewSecretManager())
+	writeRecords(t, log, 1)
+	records := []*audit.Record{
+		{Type: audit.LoginSucceeded, ActorID: "alice", IP: "203.0.113.1", UserAgent: "test", Outcome: audit.Success},
+		{Type: audit.LoginFailed, UserName: "alice@test.com", IP: "203.0.113.1", Outcome: audit.Failure},
+		{Type: audit.LoginSucceeded, ActorID: "bob", IP: "203.0.113.2", Outcome: audit.Success},
+	}
+	for _, rec := range records {
+		if err := log.Write(ctx, rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if doc, _ := dbClient.Read(ctx, audit.CollectionName, recordID(2)); doc["IP"] != "" || doc["PersonalHash"] == "" {
+		t.Errorf("personal details should be stored apart from the record, got %v", doc)
+	}
+
+	n, err := log.Erase(ctx, "alice", "alice@test.com")
+	if err != nil || n != 2 {
+		t.Fatalf("expected 2 records to be erased, got %d %v", n, err)
+	}
+	for _, seq := range []int64{2, 3} {
+		if _, err = dbClient.Read(ctx, audit.PersonalCollection, recordID(seq)); err == nil {
+			t.Errorf("personal details of record %d should be deleted", seq)
+		}
+	}
+	if doc, _ := dbClient.Read(ctx, audit.PersonalCollection, recordID(4)); doc["IP"] != "203.0.113.2" {
+		t.Errorf("records of other users should not be changed, got %v", doc)
+	}
+	got, err := log.Query(ctx, "alice", time.Time{}, time.Time{})
+	if err != nil || len(got) != 3 || !got[1].Erased || got[1].IP != "" || got[2].Type != audit.Erasure {
+		t.Errorf("expected the erased records and the erasure, got %+v %v", got, err)
+	}
+
+	report := verify(t, dbClient, 0, 0)
+	if !report.OK() || len(report.Erased) != 2 || report.Checked != 5 {
+		t.Errorf("erased records should be reported without breaking the chain, got %+v", report)
+	}
+	if n, err = log.Erase(ctx, "alice", "alice@test.com"); err != nil || n != 0 {
+		t.Errorf("erasing again should change nothing, got %d %v", n, err)
+	}
+}
+
+func TestChainDetectsForgedErasure(t *testing.T) {
+	ctx := context.Background()
+	dbClient := mock.NewNoSQLClient()
+	log := audit.New(dbClient, &mock.PubSubHandler{}, mock.NewSecretManager())
+	if err := log.Write(ctx, &audit.Record{Type: audit.LoginSucceeded, ActorID: "bob", IP: "203.0.113.2", Outcome: audit.Success}); err != nil {
+		t.Fatal(err)
+	}
+	writeRecords(t, log, 1)
+
+	// Deleting personal details without an erasure in the chain is tampering
+	if err := dbClient.Delete(ctx, audit.PersonalCollection, recordID(1)); err != nil {
+		t.Fatal(err)
+	}
+	report := verify(t, dbClient, 0, 0)
+	if len(report.Modified) != 1 || report.Modified[0] != 1 || len(report.Erased) != 0 {
+		t.Errorf("expected record 1 to be reported as modified, got %+v", report)
+	}
+
+	// An erasure record that isn't signed with the key doesn't count
+	forged := map[string]interface{}{"ID": recordID(3), "Type": audit.Erasure, "Sequence": int64(3), "Erases": []interface{}{int64(1)}, "Hash": "forged", "MAC": "forged"}
+	if err := dbClient.InsertWithID(ctx, audit.CollectionName, recordID(3), forged); err != nil {
+		t.Fatal(err)
+	}
+	report = verify(t, dbClient, 0, 0)
+	if len(report.Modified) != 2 || report.Modified[0] != 1 || len(report.InvalidMAC) != 1 || len(report.Erased) != 0 {
+		t.Errorf("expected record 1 to stay modified and the forged erasure to be reported, got %+v", report)
+	}
+
+	// Personal details that don't match the record are caught as well
+	if err := log.Write(ctx, &audit.Record{Type: audit.LoginSucceeded, ActorID: "carol", IP: "203.0.113.3", Outcome: audit.Success}); err != nil {
+		t.Fatal(err)
+	}
+	doc, _ := dbClient.Read(ctx, audit.PersonalCollection, recordID(4))
+	doc["IP"] = "198.51.100.1"
+	if err := dbClient.Update(ctx, audit.PersonalCollection, recordID(4), doc); err != nil {
+		t.Fatal(err)
+	}
+	if report = verify(t, dbClient, 4, 4); len(report.Modified) != 1 || report.Modified[0] != 4 {
+		t.Errorf("expected record 4 to be reported as modified, got %+v", report)
+	}
+}
+
+func TestChainDetectsGaps(t *testing.T) {
+	ctx := context.Background()
+	dbClient := mock.NewNoSQLClient()
+	writeRecords(t, audit.New(dbClient, &mock.PubSubHandler{}, mock.NewSecretManager()), 5)
+
+	for _, seq := range []int64{2, 5} {
+		if err := dbClient.Delete(ctx, audit.CollectionName, recordID(seq)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	report := verify(t, dbClient, 0, 0)
+	if len(report.Gaps) != 2 || report.Gaps[0] != 2 || report.Gaps[1] != 5 || report.Checked != 3 {
+		t.Errorf("expected gaps at 2 and 5, got %+v", report)
+	}
+	if len(report.Modified) != 0 || len(report.BrokenLinks) != 0 {
+		t.Errorf("remaining records should still verify, got %+v", report)
+	}
+}
+
+func TestChainConcurrentWriters(t *testing.T) {
+	dbClient := mock.NewNoSQLClient()
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			log := audit.New(dbClient, &mock.PubSubHandler{}, mock.NewSecretManager())
+			for j := 0; j < 5; j++ {
+				if err := log.Write(context.Background(), &audit.Record{Type: audit.UserRead, Outcome: audit.Success}); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if report := verify(t, dbClient, 0, 0); !report.OK() || report.Checked != 15 {
+		t.Errorf("expected an intact chain of 15 records, got %+v", report)
+	}
+}
@@ -0,0 +1,77 @@
+// Package backend opens the storage backend the service and its commands are configured to use, see Open
+package backend
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/login"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/storage"
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+)
+
+// Backend is an open storage backend, the document client and login repository use the same database
+type Backend struct {
+	Client storage.Client
+	Logins login.Repository
+	close  func() error
+}
+
+// Close closes the connection to the database
+func (b *Backend) Close() error {
+	return b.close()
+}
+
+// Open connects to the named storage backend: firestore (the default) using the Firestore database in the project, postgres
+// using the connection string in DATABASE_URL, or sqlite using the database file at SQLITE_PATH. The SQL backends create or
+// migrate their tables when they are opened
+func Open(ctx context.Context, name, projectID, firestoreDB string) (*Backend, error) {
+	var dialect storage.Dialect
+	var db *sql.DB
+	var err error
+	switch name {
+	case "", "firestore":
+		if firestoreDB == "" {
+			return nil, errors.New("a Firestore database name is required")
+		}
+		dbClient, err := storage.NewFirestore(projectID, firestoreDB)
+		if err != nil {
+			return nil, err
+		}
+		return &Backend{Client: dbClient, Logins: login.NewFirestoreRepository(dbClient), close: dbClient.Close}, nil
+	case "postgres":
+		dialect = storage.Postgres
+		db, err = sql.Open("postgres", os.Getenv("DATABASE_URL"))
+	case "sqlite":
+		path := os.Getenv("SQLITE_PATH")
+		if path == "" {
+			path = "login.db"
+		}
+		dialect = storage.SQLite
+		db, err = sql.Open("sqlite", path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if dialect == storage.SQLite {
+		// SQLite only allows one writer at a time
+		db.SetMaxOpenConns(1)
+	}
+	dbClient, err := storage.NewSQL(ctx, db, dialect)
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	logins, err := login.NewSQLRepository(ctx, db, dialect)
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &Backend{Client: dbClient, Logins: logins, close: db.Close}, nil
+}
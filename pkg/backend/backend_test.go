@@ -0,0 +1,46 @@
+package backend_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/blueambertech-demos/login-svc-gcp/mock"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/backend"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/login"
+)
+
+func TestOpenSQLite(t *testing.T) {
+	ctx := context.Background()
+	t.Setenv("SQLITE_PATH", filepath.Join(t.TempDir(), "test.db"))
+	b, err := backend.Open(ctx, "sqlite", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = login.AddLogin(ctx, b.Logins, &mock.PubSubHandler{}, "hello@test.com", "password", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Opening the same database again finds the login
+	b, err = backend.Open(ctx, "sqlite", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if _, err = b.Logins.GetByUsername(ctx, "hello@test.com"); err != nil {
+		t.Error("login should be stored in the database file:", err)
+	}
+}
+
+func TestOpenInvalid(t *testing.T) {
+	ctx := context.Background()
+	if _, err := backend.Open(ctx, "mongodb", "", ""); err == nil {
+		t.Error("expected an unknown backend to be rejected")
+	}
+	if _, err := backend.Open(ctx, "firestore", "project", ""); err == nil {
+		t.Error("expected Firestore without a database name to be rejected")
+	}
+}
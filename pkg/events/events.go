@@ -0,0 +1,225 @@
+// Package events defines the versioned JSON envelope used for the events this service publishes to the login-events topic.
+// Consumers can import it to decode messages:
+//
+//	env, err := events.Parse(msg)
+//	if err != nil {
+//		// not a message this version of the package understands
+//	}
+//	ctx = env.Context(ctx)
+//	switch env.Type {
+//	case events.LoginCreated:
+//		var p events.CreatedPayload
+//		err = env.DecodePayload(&p)
+//	}
+package events
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/blueambertech/pubsub"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+const (
+	// SchemaVersion is the version of the envelope this package writes, it is increased when a change is made that older
+	// consumers can't safely ignore. Adding fields or event types does not change the version
+	SchemaVersion = 1
+
+	// TopicID is the topic events are published to
+	TopicID = "login-events"
+	// NotificationTopicID is the topic for messages the notification service delivers to the user, such as password reset
+	// tokens. They carry secrets so they are kept off TopicID, which is forwarded to webhooks
+	NotificationTopicID = "login-notifications"
+)
+
+// Type identifies what happened, it determines the type of the payload
+type Type string
+
+// Event types, the payload of each is given in brackets
+const (
+	LoginCreated    Type = "login.created"          // CreatedPayload
+	LoginVerified   Type = "login.verified"         // StatusPayload
+	LoginSucceeded  Type = "login.succeeded"        // LoginPayload
+	LoginFailed     Type = "login.failed"           // LoginPayload
+	SuspiciousLogin Type = "login.suspicious"       // SuspiciousPayload
+	PasswordChanged Type = "login.password_changed" // PasswordPayload
+	AccountLocked   Type = "login.locked"           // StatusPayload
+	StatusChanged   Type = "login.status_changed"   // StatusPayload
+	AccountDeleted  Type = "login.deleted"          // no payload
+)
+
+// Notification types, these are published to NotificationTopicID
+const (
+	PasswordResetRequested Type = "login.password_reset_requested" // ResetPayload
+)
+
+var (
+	// ErrUnsupportedVersion is returned by Parse for an envelope written with a newer schema version than this package
+	ErrUnsupportedVersion = errors.New("events: unsupported schema version")
+	// ErrInvalidEnvelope is returned by Parse for a message that is not an event envelope
+	ErrInvalidEnvelope = errors.New("events: invalid envelope")
+)
+
+var propagator = propagation.TraceContext{}
+
+// Envelope wraps every event published by the service
+type Envelope struct {
+	SchemaVersion int       `json:"schemaVersion"`
+	ID            string    `json:"id"`
+	Type          Type      `json:"type"`
+	OccurredAt    time.Time `json:"occurredAt"`
+	UserID        string    `json:"userId,omitempty"`
+	// TraceParent and TraceState are the W3C trace context of the operation that caused the event
+	TraceParent string          `json:"traceparent,omitempty"`
+	TraceState  string          `json:"tracestate,omitempty"`
+	Payload     json.RawMessage `json:"payload,omitempty"`
+}
+
+type CreatedPayload struct {
+	Roles []string `json:"roles"`
+}
+
+type LoginPayload struct {
+	SessionID string `json:"sessionId,omitempty"`
+	Device    string `json:"device,omitempty"`
+	// Reason is the problem code of a failed login, such as invalid_credentials or account_disabled
+	Reason string `json:"reason,omitempty"`
+}
+
+// SuspiciousPayload describes a login with valid credentials that scored as risky, the session ID is empty when the login was
+// not allowed to complete
+type SuspiciousPayload struct {
+	SessionID string       `json:"sessionId,omitempty"`
+	IP        string       `json:"ip"`
+	Country   string       `json:"country,omitempty"`
+	Score     int          `json:"score"`
+	Decision  string       `json:"decision"`
+	Signals   []RiskSignal `json:"signals"`
+}
+
+// RiskSignal is a rule that contributed to the score of a suspicious login
+type RiskSignal struct {
+	Rule   string `json:"rule"`
+	Score  int    `json:"score"`
+	Reason string `json:"reason"`
+}
+
+type PasswordPayload struct {
+	// Reset is true when the password was set with a reset token rather than changed by the user
+	Reset bool `json:"reset"`
+}
+
+// ResetPayload is the token a user chooses a new password with after a reset was forced
+type ResetPayload struct {
+	ResetToken string    `json:"resetToken"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+}
+
+type StatusPayload struct {
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// New returns an envelope for an event that has just happened, the trace context is taken from ctx. payload may be nil
+func New(ctx context.Context, eventType Type, userID string, payload interface{}) (*Envelope, error) {
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	env := &Envelope{
+		SchemaVersion: SchemaVersion,
+		ID:            id,
+		Type:          eventType,
+		OccurredAt:    time.Now().UTC(),
+		UserID:        userID,
+	}
+	if payload != nil {
+		if env.Payload, err = json.Marshal(payload); err != nil {
+			return nil, err
+		}
+	}
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+	env.TraceParent = carrier.Get("traceparent")
+	env.TraceState = carrier.Get("tracestate")
+	return env, nil
+}
+
+// Parse decodes an envelope from a message, ErrUnsupportedVersion is returned if the envelope is from a newer schema version
+func Parse(msg []byte) (*Envelope, error) {
+	var env Envelope
+	if err := json.Unmarshal(msg, &env); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidEnvelope, err)
+	}
+	if env.SchemaVersion < 1 || env.Type == "" || env.ID == "" {
+		return nil, ErrInvalidEnvelope
+	}
+	if env.SchemaVersion > SchemaVersion {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, env.SchemaVersion)
+	}
+	return &env, nil
+}
+
+// DecodePayload decodes the payload of the envelope into v, which should be the payload type for the event type
+func (e *Envelope) DecodePayload(v interface{}) error {
+	if len(e.Payload) == 0 {
+		return nil
+	}
+	return json.Unmarshal(e.Payload, v)
+}
+
+// Context returns a copy of ctx carrying the trace context of the envelope, so that work done by a consumer is linked to the
+// trace of the operation that caused the event
+func (e *Envelope) Context(ctx context.Context) context.Context {
+	carrier := propagation.MapCarrier{"traceparent": e.TraceParent}
+	if e.TraceState != "" {
+		carrier["tracestate"] = e.TraceState
+	}
+	return propagator.Extract(ctx, carrier)
+}
+
+// Publish creates an envelope for an event and pushes it to TopicID
+func Publish(ctx context.Context, eventQueue pubsub.Handler, eventType Type, userID string, payload interface{}) error {
+	return push(ctx, eventQueue, TopicID, eventType, userID, payload)
+}
+
+// Notify creates an envelope for a notification to the user and pushes it to NotificationTopicID
+func Notify(ctx context.Context, eventQueue pubsub.Handler, eventType Type, userID string, payload interface{}) error {
+	return push(ctx, eventQueue, NotificationTopicID, eventType, userID, payload)
+}
+
+func push(ctx context.Context, eventQueue pubsub.Handler, topicID string, eventType Type, userID string, payload interface{}) error {
+	msg, err := Message(ctx, eventType, userID, payload)
+	if err != nil {
+		return err
+	}
+	return eventQueue.Push(ctx, topicID, msg)
+}
+
+// Message creates an envelope for an event and encodes it as a message, for callers that store the message to be published
+// later rather than pushing it
+func Message(ctx context.Context, eventType Type, userID string, payload interface{}) (string, error) {
+	env, err := New(ctx, eventType, userID, payload)
+	if err != nil {
+		return "", err
+	}
+	msg, err := json.Marshal(env)
+	if err != nil {
+		return "", err
+	}
+	return string(msg), nil
+}
+
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,91 @@
+package events_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/events"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	ctx := trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+	}))
+
+	env, err := events.New(ctx, events.AccountLocked, "user-1", &events.StatusPayload{Status: "locked", Reason: "testing"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	msg, err := json.Marshal(env)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	got, err := events.Parse(msg)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if got.SchemaVersion != events.SchemaVersion || got.ID == "" || got.Type != events.AccountLocked || got.UserID != "user-1" ||
+		got.OccurredAt.IsZero() {
+		t.Errorf("unexpected envelope: %+v", got)
+	}
+	var p events.StatusPayload
+	if err = got.DecodePayload(&p); err != nil || p.Status != "locked" || p.Reason != "testing" {
+		t.Errorf("unexpected payload: %+v, %v", p, err)
+	}
+	if sc := trace.SpanContextFromContext(got.Context(context.Background())); sc.TraceID() != traceID || !sc.IsRemote() {
+		t.Error("trace context was not carried by the envelope:", got.TraceParent)
+	}
+}
+
+func TestParseRejectsUnknownVersions(t *testing.T) {
+	future := `{"schemaVersion":99,"id":"1","type":"login.created","occurredAt":"2024-01-01T00:00:00Z"}`
+	if _, err := events.Parse([]byte(future)); !errors.Is(err, events.ErrUnsupportedVersion) {
+		t.Error("expected ErrUnsupportedVersion, got", err)
+	}
+	for _, msg := range []string{"created: user-1", `{"id":"1","type":"login.created"}`, `{"schemaVersion":1,"id":"1"}`} {
+		if _, err := events.Parse([]byte(msg)); !errors.Is(err, events.ErrInvalidEnvelope) {
+			t.Errorf("expected ErrInvalidEnvelope for %s, got %v", msg, err)
+		}
+	}
+}
+
+func TestPublish(t *testing.T) {
+	q := &recordingQueue{}
+	if err := events.Publish(context.Background(), q, events.LoginCreated, "user-1", &events.CreatedPayload{Roles: []string{"user"}}); err != nil {
+		t.Error(err)
+		return
+	}
+	if q.topic != events.TopicID {
+		t.Error("event published to the wrong topic:", q.topic)
+	}
+	env, err := events.Parse([]byte(q.msg))
+	if err != nil || env.Type != events.LoginCreated || env.UserID != "user-1" {
+		t.Errorf("unexpected published event: %s, %v", q.msg, err)
+	}
+}
+
+// recordingQueue is a pubsub.Handler that keeps the last message pushed to it
+type recordingQueue struct {
+	topic, msg string
+}
+
+func (q *recordingQueue) Subscribe(_ context.Context, _ string, _ time.Duration, _ func(context.Context, []byte)) error {
+	return nil
+}
+
+func (q *recordingQueue) Push(_ context.Context, topicID, msg string) error {
+	q.topic, q.msg = topicID, msg
+	return nil
+}
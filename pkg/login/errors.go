@@ -0,0 +1,66 @@
+package login
+
+import (
+	"errors"
+
+	"github.com/blueambertech-demos/login-svc-gcp/data"
+)
+
+var (
+	// ErrUserExists is returned when adding a login with a username that is already taken
+	ErrUserExists = errors.New("a user already exists with this username")
+	// ErrUserNotFound is returned when there is no login for a username
+	ErrUserNotFound = errors.New("no user found with this username")
+	// ErrDuplicateRecords is returned when more than one login exists for a username
+	ErrDuplicateRecords = errors.New("multiple logins found with this username")
+	// ErrInvalidCredentials is returned when a password does not match the one stored for the login
+	ErrInvalidCredentials = errors.New("invalid username or password")
+	// ErrInvalidEmail is returned when a username is not a valid email address
+	ErrInvalidEmail = errors.New("username must be a valid email address")
+	// ErrWeakPassword is returned when a password does not meet the password requirements
+	ErrWeakPassword = errors.New("password does not meet requirements")
+	// ErrAccountDisabled is returned when logging in to an account that has been disabled by an admin
+	ErrAccountDisabled = errors.New("account is disabled")
+	// ErrAccountLocked is returned when logging in to an account that has been locked
+	ErrAccountLocked = errors.New("account is locked")
+	// ErrAccountNotVerified is returned when logging in to an account that is pending verification
+	ErrAccountNotVerified = errors.New("account is pending verification")
+	// ErrInvalidStatus is returned when changing an account to a status that does not exist
+	ErrInvalidStatus = errors.New("invalid account status")
+	// ErrInvalidRole is returned when giving an account a role that does not exist
+	ErrInvalidRole = errors.New("invalid role")
+	// ErrConflict is returned by Update when the login was changed by another request after it was read
+	ErrConflict = errors.New("login was changed by another request")
+	// ErrInvalidResetToken is returned when a password reset token does not exist, has expired or has already been used
+	ErrInvalidResetToken = errors.New("invalid password reset token")
+)
+
+// StorageError is returned when the login database could not be read from or written to
+type StorageError struct {
+	Op  string
+	Err error
+}
+
+func (e *StorageError) Error() string {
+	return "login storage: " + e.Op + ": " + e.Err.Error()
+}
+
+func (e *StorageError) Unwrap() error {
+	return e.Err
+}
+
+// StatusError returns the error explaining why an account with the given status can't be used, or nil if it can. Records written
+// before the status was introduced have no status and are active
+func StatusError(status data.AccountStatus) error {
+	switch status {
+	case data.StatusActive, "":
+		return nil
+	case data.StatusDisabled:
+		return ErrAccountDisabled
+	case data.StatusLocked:
+		return ErrAccountLocked
+	case data.StatusPendingVerification:
+		return ErrAccountNotVerified
+	}
+	return ErrInvalidStatus
+}
@@ -0,0 +1,70 @@
+package login
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/blueambertech-demos/login-svc-gcp/data"
+)
+
+var errStorage = errors.New("storage unavailable")
+
+func TestAuthenticateErrors(t *testing.T) {
+	defer fakeDbClient.ClearData()
+	ctx, canc := context.WithTimeout(context.Background(), time.Second*10)
+	defer canc()
+
+	if _, err := Authenticate(ctx, fakeRepo, "hello@test.com", "password"); !errors.Is(err, ErrUserNotFound) {
+		t.Error("expected ErrUserNotFound, got", err)
+	}
+	if err := AddLogin(ctx, fakeRepo, fakeEventQueue, "hello@test.com", "password", nil); err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err := Authenticate(ctx, fakeRepo, "hello@test.com", "wrong"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Error("expected ErrInvalidCredentials, got", err)
+	}
+	if rec, err := Authenticate(ctx, fakeRepo, "hello@test.com", "password"); err != nil || rec.ID == "" {
+		t.Error("expected successful authentication, got", err)
+	}
+}
+
+func TestDuplicateRecords(t *testing.T) {
+	defer fakeDbClient.ClearData()
+	ctx := context.Background()
+	for _, id := range []string{"a", "b"} {
+		if err := fakeDbClient.InsertWithID(ctx, DetailsCollection, id, &data.LoginDetails{UserName: "dup@test.com"}); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	if _, err := Authenticate(ctx, fakeRepo, "dup@test.com", "password"); !errors.Is(err, ErrDuplicateRecords) {
+		t.Error("expected ErrDuplicateRecords, got", err)
+	}
+}
+
+func TestDuplicateRecordsDifferentCase(t *testing.T) {
+	defer fakeDbClient.ClearData()
+	ctx := context.Background()
+	// Records that differ only by case are duplicates, as they are to the reconcile command
+	fakeDbClient.SetData(DetailsCollection, map[string]map[string]interface{}{
+		"a": {"UserName": "dup@test.com", "CanonicalUserName": "dup@test.com", "SchemaVersion": data.LoginDetailsSchemaVersion},
+		"b": {"UserName": "Dup@Test.com", "CanonicalUserName": "dup@test.com", "SchemaVersion": data.LoginDetailsSchemaVersion},
+	})
+	if _, err := Authenticate(ctx, fakeRepo, "DUP@test.com", "password"); !errors.Is(err, ErrDuplicateRecords) {
+		t.Error("expected ErrDuplicateRecords, got", err)
+	}
+}
+
+func TestStorageError(t *testing.T) {
+	err := error(&StorageError{Op: "read login details", Err: errStorage})
+	var se *StorageError
+	if !errors.As(err, &se) || se.Op != "read login details" {
+		t.Error("StorageError should be matched with errors.As")
+	}
+	if !errors.Is(err, errStorage) {
+		t.Error("StorageError should unwrap to the underlying error")
+	}
+}
@@ -0,0 +1,308 @@
+package login
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/blueambertech-demos/login-svc-gcp/data"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/storage"
+	"github.com/mitchellh/mapstructure"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// canonicalField holds the canonical username in documents in the DetailsCollection, Firestore can only match exact values so
+// usernames are looked up by their canonical form
+const canonicalField = "CanonicalUserName"
+
+// revisionField holds the Revision of a record in documents in the DetailsCollection, documents that have never been updated
+// don't have one
+const revisionField = "Revision"
+
+// listBatchSize is the number of logins read at a time when every login is listed
+const listBatchSize = 100
+
+// FirestoreRepository is a Repository that stores login records in the DetailsCollection of a NoSQL database such as Firestore.
+// Each username is reserved with a document in the UsernamesCollection keyed by its canonical form
+type FirestoreRepository struct {
+	dbClient storage.Client
+}
+
+// NewFirestoreRepository returns a Repository using the supplied database client
+func NewFirestoreRepository(dbClient storage.Client) *FirestoreRepository {
+	return &FirestoreRepository{dbClient: dbClient}
+}
+
+func (f *FirestoreRepository) GetByUsername(ctx context.Context, userName string) (*Record, error) {
+	records, err := f.findUsername(ctx, userName)
+	if err != nil {
+		return nil, &StorageError{Op: "read login details", Err: err}
+	}
+	if len(records) == 0 {
+		return nil, ErrUserNotFound
+	}
+	if len(records) > 1 {
+		// Refuse to pick one of the records, the password could be checked against the wrong login. The duplicates can be
+		// resolved with the reconcile command
+		trace.SpanFromContext(ctx).AddEvent("duplicate login records", trace.WithAttributes(
+			attribute.String("login.username", CanonicalUsername(userName)),
+			attribute.Int("login.record_count", len(records)),
+		))
+		duplicateRecordsCounter.Add(ctx, 1)
+		return nil, ErrDuplicateRecords
+	}
+	for id, doc := range records {
+		return decodeRecord(id, doc)
+	}
+	return nil, ErrUserNotFound
+}
+
+func (f *FirestoreRepository) GetByID(ctx context.Context, id string) (*Record, error) {
+	doc, err := f.dbClient.Read(ctx, DetailsCollection, id)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, ErrUserNotFound
+	} else if err != nil {
+		return nil, &StorageError{Op: "read login details", Err: err}
+	}
+	return decodeRecord(id, doc)
+}
+
+// Create stores a new login record. The canonical username is reserved atomically before the details are written, so concurrent
+// requests for the same username cannot both succeed
+func (f *FirestoreRepository) Create(ctx context.Context, details *data.LoginDetails) (string, error) {
+	return f.CreateWith(ctx, details, nil)
+}
+
+// CreateWith reserves the username and inserts the login with the documents returned by with in one transaction
+func (f *FirestoreRepository) CreateWith(ctx context.Context, details *data.LoginDetails, with func(id string) ([]storage.Write, error)) (string, error) {
+	// Check doesn't exist, logins created before usernames were reserved have no reservation
+	docs, err := f.findUsername(ctx, details.UserName)
+	if err != nil {
+		return "", &StorageError{Op: "check username", Err: err}
+	}
+	if len(docs) > 0 {
+		return "", ErrUserExists
+	}
+
+	id, err := generateID()
+	if err != nil {
+		return "", err
+	}
+	doc, err := detailsDocument(details)
+	if err != nil {
+		return "", err
+	}
+	reservation := data.UsernameReservation{UserID: id, DateCreated: details.DateCreated}
+	writes := []storage.Write{
+		{Collection: UsernamesCollection, ID: CanonicalUsername(details.UserName), Data: &reservation},
+		{Collection: DetailsCollection, ID: id, Data: doc},
+	}
+	if with != nil {
+		extra, err := with(id)
+		if err != nil {
+			return "", err
+		}
+		writes = append(writes, extra...)
+	}
+	// The login ID is random so only the reservation can already exist
+	err = f.dbClient.InsertAll(ctx, writes...)
+	if errors.Is(err, storage.ErrAlreadyExists) {
+		return "", ErrUserExists
+	} else if err != nil {
+		return "", &StorageError{Op: "insert login details", Err: err}
+	}
+	return id, nil
+}
+
+// Update replaces a login record if its revision has not changed since it was read. When the username changes the new one is
+// reserved and the old one released in the same transaction as the details are written
+func (f *FirestoreRepository) Update(ctx context.Context, rec *Record) error {
+	return f.UpdateWith(ctx, rec)
+}
+
+// UpdateWith updates the login in the same way as Update and makes the writes in the same transaction
+func (f *FirestoreRepository) UpdateWith(ctx context.Context, rec *Record, extra ...storage.Write) error {
+	old, err := f.GetByID(ctx, rec.ID)
+	if err != nil {
+		return err
+	}
+	doc, err := detailsDocument(&rec.LoginDetails)
+	if err != nil {
+		return err
+	}
+	revision, err := generateID()
+	if err != nil {
+		return err
+	}
+	doc[revisionField] = revision
+	writes := []storage.Write{storage.UpdateIf(DetailsCollection, rec.ID, revisionField, rec.Revision, doc)}
+
+	oldName, newName := CanonicalUsername(old.UserName), CanonicalUsername(rec.UserName)
+	if oldName != newName {
+		// Logins created before usernames were reserved have no reservation, so they are found by their details
+		docs, err := f.findUsername(ctx, rec.UserName)
+		if err != nil {
+			return &StorageError{Op: "check username", Err: err}
+		}
+		for id := range docs {
+			if id != rec.ID {
+				return ErrUserExists
+			}
+		}
+		reservation := data.UsernameReservation{UserID: rec.ID, DateCreated: rec.DateCreated}
+		writes = append(writes, storage.Write{Collection: UsernamesCollection, ID: newName, Data: &reservation})
+		if release, err := f.releaseWrite(ctx, oldName, rec.ID); err != nil {
+			return err
+		} else if release != nil {
+			writes = append(writes, *release)
+		}
+	}
+
+	err = f.dbClient.Commit(ctx, append(writes, extra...)...)
+	switch {
+	case err == nil:
+		rec.Revision = revision
+		return nil
+	case errors.Is(err, storage.ErrAlreadyExists):
+		return ErrUserExists
+	case errors.Is(err, storage.ErrConflict), errors.Is(err, storage.ErrNotFound):
+		// The login or the reservation of its old username changed after they were read
+		return ErrConflict
+	default:
+		return &StorageError{Op: "update login details", Err: err}
+	}
+}
+
+// Delete removes a login record and releases its username
+func (f *FirestoreRepository) Delete(ctx context.Context, id string) error {
+	return f.DeleteWith(ctx, id)
+}
+
+// DeleteWith removes a login record, releases its username and makes the writes in one transaction
+func (f *FirestoreRepository) DeleteWith(ctx context.Context, id string, extra ...storage.Write) error {
+	rec, err := f.GetByID(ctx, id)
+	if err != nil {
+		return err
+	}
+	writes := []storage.Write{{Collection: DetailsCollection, ID: id, Op: storage.OpDelete}}
+	if release, err := f.releaseWrite(ctx, CanonicalUsername(rec.UserName), id); err != nil {
+		return err
+	} else if release != nil {
+		writes = append(writes, *release)
+	}
+	err = f.dbClient.Commit(ctx, append(writes, extra...)...)
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, storage.ErrNotFound):
+		return ErrUserNotFound
+	case errors.Is(err, storage.ErrConflict):
+		return ErrConflict
+	default:
+		return &StorageError{Op: "delete login details", Err: err}
+	}
+}
+
+// List reads one page of logins with an ordered query, one more record than the limit is read to find out if there is another
+// page. A limit of zero or less reads every login a batch at a time
+func (f *FirestoreRepository) List(ctx context.Context, cursor string, limit int) ([]Record, string, error) {
+	if limit <= 0 {
+		var records []Record
+		for {
+			page, next, err := f.List(ctx, cursor, listBatchSize)
+			if err != nil {
+				return nil, "", err
+			}
+			records = append(records, page...)
+			if next == "" {
+				return records, "", nil
+			}
+			cursor = next
+		}
+	}
+	docs, err := f.dbClient.ListPage(ctx, DetailsCollection, cursor, limit+1)
+	if err != nil {
+		return nil, "", &StorageError{Op: "list login details", Err: err}
+	}
+	next := ""
+	if len(docs) > limit {
+		docs = docs[:limit]
+		next = docs[limit-1].ID
+	}
+	records := make([]Record, len(docs))
+	for i, d := range docs {
+		rec, err := decodeRecord(d.ID, d.Data)
+		if err != nil {
+			return nil, "", err
+		}
+		records[i] = *rec
+	}
+	return records, next, nil
+}
+
+// findUsername returns the documents of logins with the canonical form of userName. Documents written before the canonical
+// username was stored only have the username as it was typed, so they are also matched on the exact username until they are
+// migrated
+func (f *FirestoreRepository) findUsername(ctx context.Context, userName string) (map[string]map[string]interface{}, error) {
+	docs, err := f.dbClient.Where(ctx, DetailsCollection, canonicalField, "==", CanonicalUsername(userName))
+	if err != nil {
+		return nil, err
+	}
+	legacy, err := f.dbClient.Where(ctx, DetailsCollection, "UserName", "==", userName)
+	if err != nil {
+		return nil, err
+	}
+	for id, doc := range legacy {
+		docs[id] = doc
+	}
+	return docs, nil
+}
+
+// detailsDocument converts login details to the document stored for them, which also holds the canonical username
+func detailsDocument(details *data.LoginDetails) (map[string]interface{}, error) {
+	doc, err := storage.ToDocument(details)
+	if err != nil {
+		return nil, err
+	}
+	doc[canonicalField] = CanonicalUsername(details.UserName)
+	return doc, nil
+}
+
+// releaseWrite returns the write that deletes a username reservation if it belongs to the user, or nil if it doesn't, the
+// delete fails with a conflict if the reservation changes before it is made
+func (f *FirestoreRepository) releaseWrite(ctx context.Context, canonical, id string) (*storage.Write, error) {
+	doc, err := f.dbClient.Read(ctx, UsernamesCollection, canonical)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, &StorageError{Op: "read username reservation", Err: err}
+	}
+	if doc["UserID"] != id {
+		return nil, nil
+	}
+	w := storage.DeleteIf(UsernamesCollection, canonical, "UserID", id)
+	return &w, nil
+}
+
+// decodeRecord upgrades a stored document to the current schema version before decoding it, the upgrade is only written back
+// when the record is next updated or by MigrateDetails
+func decodeRecord(id string, doc map[string]interface{}) (*Record, error) {
+	if _, err := UpgradeDetails(doc); err != nil {
+		return nil, fmt.Errorf("decoding login details %s: %w", id, err)
+	}
+	rec := Record{ID: id}
+	dec, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook: mapstructure.StringToTimeHookFunc(time.RFC3339Nano),
+		Result:     &rec.LoginDetails,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err = dec.Decode(doc); err != nil {
+		return nil, fmt.Errorf("decoding login details %s: %w", id, err)
+	}
+	rec.Revision, _ = doc[revisionField].(string)
+	return &rec, nil
+}
@@ -7,80 +7,323 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/blueambertech-demos/login-svc-gcp/data"
-	"github.com/blueambertech/db"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/audit"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/events"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/redact"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/session"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/storage"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/webhook"
 	"github.com/blueambertech/login-svc-with-gcp/pkg/verification"
 	"github.com/blueambertech/pubsub"
-
-	"github.com/mitchellh/mapstructure"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
 	"go.opentelemetry.io/otel/trace"
 )
 
 const (
 	hashIterations = 1000
-	collectionName = "details"
-	topicID        = "login-events"
+
+	// DeletedTopicID is the topic the ID of a deleted login is published to, so that other services can delete their data
+	// for the user
+	DeletedTopicID = "login-deleted"
+
+	// DetailsCollection is the collection login details are stored in
+	DetailsCollection = "details"
+	// UsernamesCollection is the collection of username reservations, keyed by canonical username
+	UsernamesCollection = "usernames"
 )
 
-// VerifyCredentials takes a username and password and verifies it against the details stored for this user in the login database,
-// it also returns the user ID. If the user is not found, the result will be false and no error will be returned.
-func VerifyCredentials(ctx context.Context, dbClient db.NoSQLClient, userName, password string) (bool, string, error) {
-	details, id, err := getDetails(ctx, dbClient, userName)
-	if err != nil {
+var duplicateRecordsCounter, _ = otel.Meter(data.ServiceName).Int64Counter("login.duplicate_records",
+	metric.WithDescription("Number of logins attempted against a username with more than one login record"))
+
+// VerifyCredentials takes a username and password and verifies it against the details stored for this user in the login repository,
+// it also returns the user ID. If the user is not found, the result will be false and ErrUserNotFound will be returned. If the
+// password is correct but the account is not active the result will be false and the error is the one given by StatusError
+func VerifyCredentials(ctx context.Context, repo Repository, userName, password string) (bool, string, error) {
+	rec, err := Authenticate(ctx, repo, userName, password)
+	if errors.Is(err, ErrInvalidCredentials) {
+		return false, "", nil
+	} else if err != nil {
 		return false, "", err
 	}
-	hash := hashPassword(password + details.Salt)
-	return hash == details.PassHash, id, nil
+	return true, rec.ID, nil
+}
+
+// Authenticate verifies a username and password and returns the login record, ErrInvalidCredentials is returned if the password is
+// wrong and ErrUserNotFound if there is no login for the username
+func Authenticate(ctx context.Context, repo Repository, userName, password string) (*Record, error) {
+	rec, err := repo.GetByUsername(ctx, userName)
+	if err != nil {
+		return nil, err
+	}
+	if hashPassword(password+rec.Salt) != rec.PassHash {
+		return nil, ErrInvalidCredentials
+	}
+	// The status is only checked once the password is known to be correct so it is not revealed to anyone else
+	if err = StatusError(rec.Status); err != nil {
+		return nil, err
+	}
+	return rec, nil
 }
 
 // ValidateCredentials validates the provided login details are acceptable
 func ValidateCredentials(userName, password string, traceSpan trace.Span) bool {
+	return CheckCredentials(userName, password, traceSpan) == nil
+}
+
+// CheckCredentials validates the provided login details are acceptable, returning ErrInvalidEmail or ErrWeakPassword to explain
+// why they are not
+func CheckCredentials(userName, password string, traceSpan trace.Span) error {
 	if !verification.VerifyEmail(userName) {
 		if traceSpan != nil {
 			traceSpan.AddEvent("email invalid: " + userName)
 		}
-		return false
+		return ErrInvalidEmail
+	}
+	if len(password) == 0 {
+		return ErrWeakPassword
 	}
-	return len(password) > 0
+	return nil
 }
 
-// AddLogin creates a new set of login details in the login database
-func AddLogin(ctx context.Context, dbClient db.NoSQLClient, eventQueue pubsub.Handler, userName, password string, traceSpan trace.Span) error {
-	// Check doesn't exist (user name must be unique)
-	docs, err := dbClient.Where(ctx, collectionName, "UserName", "==", userName)
+// EventStore is an event queue that stores messages in the database to be published later, such as an outbox.Outbox, so that
+// a message can be written in the same transaction as the change it describes
+type EventStore interface {
+	pubsub.Handler
+	Write(topicID, msg string) (storage.Write, error)
+}
+
+// AddLogin creates a new set of login details in the login repository and publishes a created event. When the repository is a
+// TransactionalRepository and eventQueue is an EventStore the login and its event are written in one transaction, they must
+// share a database. Otherwise a failure to publish the event is only recorded on the trace span, the login is kept
+func AddLogin(ctx context.Context, repo Repository, eventQueue pubsub.Handler, userName, password string, traceSpan trace.Span) error {
+	salt, err := generateSalt()
 	if err != nil {
 		return err
 	}
-	if len(docs) > 0 {
-		return errors.New("a user already exists with this username")
+
+	d := data.LoginDetails{
+		UserName:      userName,
+		PassHash:      hashPassword(password + salt),
+		Salt:          salt,
+		DateCreated:   time.Now(),
+		SchemaVersion: data.LoginDetailsSchemaVersion,
+		HashAlgorithm: HashSHA256x1000,
+		Status:        data.StatusActive,
+		Roles:         []string{data.RoleUser},
 	}
 
-	salt, err := generateSalt()
+	payload := &events.CreatedPayload{Roles: d.Roles}
+	if txRepo, store, ok := transactional(repo, eventQueue); ok {
+		id, err := txRepo.CreateWith(ctx, &d, func(id string) ([]storage.Write, error) {
+			w, err := eventWrite(ctx, store, events.LoginCreated, id, payload)
+			if err != nil {
+				return nil, err
+			}
+			return []storage.Write{w}, nil
+		})
+		if err != nil {
+			return err
+		}
+		addLoginAttributes(traceSpan, id, &d)
+		return nil
+	}
+
+	id, err := repo.Create(ctx, &d)
 	if err != nil {
 		return err
 	}
+	addLoginAttributes(traceSpan, id, &d)
+	if err = events.Publish(ctx, eventQueue, events.LoginCreated, id, payload); err != nil && traceSpan != nil {
+		traceSpan.AddEvent("failed to push login created event to queue")
+		traceSpan.RecordError(err)
+	}
+	return nil
+}
 
-	d := data.LoginDetails{
-		UserName:    userName,
-		PassHash:    hashPassword(password + salt),
-		Salt:        salt,
-		DateCreated: time.Now(),
+func addLoginAttributes(traceSpan trace.Span, id string, d *data.LoginDetails) {
+	if traceSpan != nil {
+		traceSpan.SetAttributes(attribute.String("login.id", id))
+		traceSpan.SetAttributes(redact.Attributes("login", d)...)
 	}
+}
 
-	id, err := dbClient.Insert(ctx, collectionName, &d)
+// CheckPassword re-authenticates a user by ID before a sensitive change, ErrInvalidCredentials is returned if the password is wrong
+func CheckPassword(ctx context.Context, repo Repository, userID, password string) error {
+	rec, err := repo.GetByID(ctx, userID)
 	if err != nil {
 		return err
 	}
-	if err = eventQueue.Push(ctx, topicID, "created: "+id); err != nil {
-		if traceSpan != nil {
-			traceSpan.AddEvent("failed to push login notification to queue")
+	if hashPassword(password+rec.Salt) != rec.PassHash {
+		return ErrInvalidCredentials
+	}
+	return nil
+}
+
+// DeleteLogin erases a login and the personal data held for the user: sessions, password reset tokens, webhook deliveries of
+// events about the user and the personal details in the audit log. The user ID is then published to DeletedTopicID along with
+// an AccountDeleted event, in the same transaction as the login is deleted when the repository and event queue allow it. The
+// login is deleted last so that a failure part way through never leaves a usable token for a deleted login, and can be retried
+func DeleteLogin(ctx context.Context, repo Repository, dbClient storage.Client, eventQueue pubsub.Handler, auditLog *audit.Log, userID string, traceSpan trace.Span) error {
+	rec, err := repo.GetByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if _, err = session.DeleteAll(ctx, dbClient, userID); err != nil {
+		return &StorageError{Op: "delete sessions", Err: err}
+	}
+	if err = deleteResets(ctx, dbClient, userID); err != nil {
+		return &StorageError{Op: "delete password resets", Err: err}
+	}
+	if _, err = webhook.DeleteUserDeliveries(ctx, dbClient, userID); err != nil {
+		return &StorageError{Op: "delete webhook deliveries", Err: err}
+	}
+	if _, err = auditLog.Erase(ctx, userID, rec.UserName, CanonicalUsername(rec.UserName)); err != nil {
+		return &StorageError{Op: "erase audit records", Err: err}
+	}
+	if txRepo, store, ok := transactional(repo, eventQueue); ok {
+		deleted, err := store.Write(DeletedTopicID, userID)
+		if err != nil {
+			return err
+		}
+		event, err := eventWrite(ctx, store, events.AccountDeleted, userID, nil)
+		if err != nil {
+			return err
+		}
+		return txRepo.DeleteWith(ctx, userID, deleted, event)
+	}
+
+	if err = repo.Delete(ctx, userID); err != nil {
+		return err
+	}
+	if err := eventQueue.Push(ctx, DeletedTopicID, userID); err != nil && traceSpan != nil {
+		traceSpan.AddEvent("failed to push login deleted notification to queue")
+		traceSpan.RecordError(err)
+	}
+	if err := events.Publish(ctx, eventQueue, events.AccountDeleted, userID, nil); err != nil && traceSpan != nil {
+		traceSpan.AddEvent("failed to push login deleted event to queue")
+		traceSpan.RecordError(err)
+	}
+	return nil
+}
+
+// SetStatus changes the status of an account, recording the reason and time of the change, and publishes the new status. Tokens
+// of accounts that are not active are rejected, see StatusError
+func SetStatus(ctx context.Context, repo Repository, eventQueue pubsub.Handler, userID string, status data.AccountStatus, reason string, traceSpan trace.Span) error {
+	return UpdateAccount(ctx, repo, eventQueue, userID, &AccountChanges{Status: &status, Reason: reason}, traceSpan)
+}
+
+// ChangeUsername changes the username of a login, the new username must be a valid email address that is not already taken
+func ChangeUsername(ctx context.Context, repo Repository, userID, userName string) error {
+	return UpdateAccount(ctx, repo, nil, userID, &AccountChanges{UserName: &userName}, nil)
+}
+
+// AccountChanges are changes to an account made together by UpdateAccount, nil fields are left as they are
+type AccountChanges struct {
+	UserName *string
+	Roles    []string
+	Status   *data.AccountStatus
+	// Reason is why the status was changed
+	Reason string
+}
+
+// UpdateAccount checks every change is valid before writing them to the login in one update, so either all of them are made or
+// none are. A change of status is published once it has been written
+func UpdateAccount(ctx context.Context, repo Repository, eventQueue pubsub.Handler, userID string, changes *AccountChanges, traceSpan trace.Span) error {
+	if changes.UserName != nil && !verification.VerifyEmail(*changes.UserName) {
+		return ErrInvalidEmail
+	}
+	for _, role := range changes.Roles {
+		if !ValidRole(role) {
+			return ErrInvalidRole
+		}
+	}
+	if changes.Status != nil && !changes.Status.Valid() {
+		return ErrInvalidStatus
+	}
+
+	var event *statusEvent
+	_, err := modify(ctx, repo, userID, func(rec *Record) ([]storage.Write, error) {
+		if changes.UserName != nil {
+			rec.UserName = *changes.UserName
+		}
+		if changes.Roles != nil {
+			rec.Roles = changes.Roles
+		}
+		if changes.Status == nil {
+			return nil, nil
+		}
+		event = newStatusEvent(accountStatus(&rec.LoginDetails), *changes.Status, changes.Reason)
+		rec.Status = *changes.Status
+		rec.StatusReason = changes.Reason
+		rec.StatusChangedAt = time.Now()
+		if _, store, ok := transactional(repo, eventQueue); ok {
+			w, err := eventWrite(ctx, store, event.eventType, userID, event.payload)
+			if err != nil {
+				return nil, err
+			}
+			event.stored = true
+			return []storage.Write{w}, nil
 		}
+		return nil, nil
+	})
+	if err != nil || event == nil || event.stored {
+		return err
+	}
+	if err = events.Publish(ctx, eventQueue, event.eventType, userID, event.payload); err != nil && traceSpan != nil {
+		traceSpan.AddEvent("failed to push status change notification to queue")
+		traceSpan.RecordError(err)
 	}
 	return nil
 }
 
+// statusEvent is the event published when the status of an account changes
+type statusEvent struct {
+	eventType events.Type
+	payload   *events.StatusPayload
+	// stored is set when the event was written to the outbox with the change
+	stored bool
+}
+
+func newStatusEvent(previous, status data.AccountStatus, reason string) *statusEvent {
+	eventType := events.StatusChanged
+	if status == data.StatusLocked {
+		eventType = events.AccountLocked
+	} else if status == data.StatusActive && previous == data.StatusPendingVerification {
+		eventType = events.LoginVerified
+	}
+	return &statusEvent{eventType: eventType, payload: &events.StatusPayload{Status: string(status), Reason: reason}}
+}
+
+// transactional returns the repository and event store to use when the messages published about a change to a login can be
+// stored in the outbox in the same transaction as the change, ok is false when the repository is not a TransactionalRepository
+// or eventQueue is not an EventStore and the messages have to be published once the change has been made
+func transactional(repo Repository, eventQueue pubsub.Handler) (txRepo TransactionalRepository, store EventStore, ok bool) {
+	txRepo, isTx := repo.(TransactionalRepository)
+	store, isStore := eventQueue.(EventStore)
+	return txRepo, store, isTx && isStore
+}
+
+// eventWrite returns the write that stores an event about a user in the outbox
+func eventWrite(ctx context.Context, store EventStore, eventType events.Type, userID string, payload interface{}) (storage.Write, error) {
+	msg, err := events.Message(ctx, eventType, userID, payload)
+	if err != nil {
+		return storage.Write{}, err
+	}
+	return store.Write(events.TopicID, msg)
+}
+
+// CanonicalUsername returns the form of a username used to check it is unique, usernames that differ only by case or surrounding
+// whitespace are treated as the same
+func CanonicalUsername(userName string) string {
+	return strings.ToLower(strings.TrimSpace(userName))
+}
+
 func hashPassword(pw string) string {
 	hp := []byte(pw)
 	for i := 0; i < hashIterations; i++ {
@@ -91,29 +334,12 @@ func hashPassword(pw string) string {
 	return fmt.Sprintf("%x", hp)
 }
 
-func getDetails(ctx context.Context, dbClient db.NoSQLClient, userName string) (*data.LoginDetails, string, error) {
-	records, err := dbClient.Where(ctx, collectionName, "UserName", "==", userName)
-	if err != nil {
-		return nil, "", err
-	}
-	if len(records) == 0 {
-		return nil, "", errors.New("no user found with this username")
-	}
-	if len(records) > 1 {
-		// TODO: Raise a warning message about data duplicity
-	}
-
-	var d data.LoginDetails
-	var id string
-	for i, val := range records {
-		err = mapstructure.Decode(val, &d)
-		if err != nil {
-			return nil, "", err
-		}
-		id = i
-		break
+func generateID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
 	}
-	return &d, id, nil
+	return hex.EncodeToString(id), nil
 }
 
 func generateSalt() (string, error) {
@@ -2,19 +2,29 @@ package login
 
 import (
 	"context"
+	"errors"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/blueambertech-demos/login-svc-gcp/data"
 	"github.com/blueambertech-demos/login-svc-gcp/mock"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/audit"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/events"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/session"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/webhook"
 )
 
 var fakeDbClient *mock.NoSQLClient
+var fakeRepo Repository
 var fakeEventQueue *mock.PubSubHandler
+var fakeAuditLog *audit.Log
 
 func TestMain(m *testing.M) {
-	fakeDbClient = &mock.NoSQLClient{}
-	fakeDbClient.SetData(make(map[string]map[string]interface{}))
+	fakeDbClient = mock.NewNoSQLClient()
+	fakeRepo = NewFirestoreRepository(fakeDbClient)
 	fakeEventQueue = &mock.PubSubHandler{}
+	fakeAuditLog = audit.New(fakeDbClient, fakeEventQueue, mock.NewSecretManager())
 	m.Run()
 }
 
@@ -22,23 +32,48 @@ func TestAddLogin(t *testing.T) {
 	defer fakeDbClient.ClearData()
 	ctx, canc := context.WithTimeout(context.Background(), time.Second*10)
 	defer canc()
-	err := AddLogin(ctx, fakeDbClient, fakeEventQueue, "hello@test.com", "password", nil)
+	err := AddLogin(ctx, fakeRepo, fakeEventQueue, "hello@test.com", "password", nil)
 	if err != nil {
 		t.Error(err)
 	}
 }
 
+func TestAddLoginPublishesEvent(t *testing.T) {
+	defer fakeDbClient.ClearData()
+	fakeEventQueue.Reset()
+	ctx, canc := context.WithTimeout(context.Background(), time.Second*10)
+	defer canc()
+	if err := AddLogin(ctx, fakeRepo, fakeEventQueue, "hello@test.com", "password", nil); err != nil {
+		t.Error(err)
+		return
+	}
+	rec, err := fakeRepo.GetByUsername(ctx, "hello@test.com")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	msgs := fakeEventQueue.Published(events.TopicID)
+	if len(msgs) != 1 {
+		t.Errorf("expected one event, got %d", len(msgs))
+		return
+	}
+	env, err := events.Parse([]byte(msgs[0]))
+	if err != nil || env.Type != events.LoginCreated || env.UserID != rec.ID {
+		t.Errorf("expected a created event for %s, got %s", rec.ID, msgs[0])
+	}
+}
+
 func TestAddLoginDuplicate(t *testing.T) {
 	defer fakeDbClient.ClearData()
 	ctx, canc := context.WithTimeout(context.Background(), time.Second*10)
 	defer canc()
-	err := AddLogin(ctx, fakeDbClient, fakeEventQueue, "hello@test.com", "password", nil)
+	err := AddLogin(ctx, fakeRepo, fakeEventQueue, "hello@test.com", "password", nil)
 	if err != nil {
 		t.Error(err)
 	}
-	err = AddLogin(ctx, fakeDbClient, fakeEventQueue, "hello@test.com", "password", nil)
-	if err == nil {
-		t.Error("Duplicate user should be rejected")
+	err = AddLogin(ctx, fakeRepo, fakeEventQueue, "hello@test.com", "password", nil)
+	if !errors.Is(err, ErrUserExists) {
+		t.Error("Duplicate user should be rejected with ErrUserExists, got", err)
 	}
 }
 
@@ -46,12 +81,12 @@ func TestVerifyCredentials(t *testing.T) {
 	defer fakeDbClient.ClearData()
 	ctx, canc := context.WithTimeout(context.Background(), time.Second*10)
 	defer canc()
-	err := AddLogin(ctx, fakeDbClient, fakeEventQueue, "hello@test.com", "password", nil)
+	err := AddLogin(ctx, fakeRepo, fakeEventQueue, "hello@test.com", "password", nil)
 	if err != nil {
 		t.Error(err)
 	}
 
-	result, _, err := VerifyCredentials(ctx, fakeDbClient, "hello@test.com", "password")
+	result, _, err := VerifyCredentials(ctx, fakeRepo, "hello@test.com", "password")
 	if err != nil {
 		t.Error(err)
 		return
@@ -65,12 +100,12 @@ func TestVerifyCredentialsWrongPass(t *testing.T) {
 	defer fakeDbClient.ClearData()
 	ctx, canc := context.WithTimeout(context.Background(), time.Second*10)
 	defer canc()
-	err := AddLogin(ctx, fakeDbClient, fakeEventQueue, "hello@test.com", "password", nil)
+	err := AddLogin(ctx, fakeRepo, fakeEventQueue, "hello@test.com", "password", nil)
 	if err != nil {
 		t.Error(err)
 	}
 
-	result, _, err := VerifyCredentials(ctx, fakeDbClient, "hello@test.com", "passwfgdford")
+	result, _, err := VerifyCredentials(ctx, fakeRepo, "hello@test.com", "passwfgdford")
 	if err != nil {
 		t.Error(err)
 		return
@@ -85,7 +120,7 @@ func TestVerifyCredentialsMissingUser(t *testing.T) {
 	ctx, canc := context.WithTimeout(context.Background(), time.Second*10)
 	defer canc()
 
-	result, _, err := VerifyCredentials(ctx, fakeDbClient, "hello@test.com", "password")
+	result, _, err := VerifyCredentials(ctx, fakeRepo, "hello@test.com", "password")
 	if err == nil {
 		t.Error("Error was nil")
 		return
@@ -113,3 +148,259 @@ func TestValidateCredentials(t *testing.T) {
 		return
 	}
 }
+
+func TestCheckCredentials(t *testing.T) {
+	if err := CheckCredentials("valid@valid.com", "validpassword", nil); err != nil {
+		t.Error("incorrect validation of valid details", err)
+	}
+	if err := CheckCredentials("invaliduser", "validpassword", nil); !errors.Is(err, ErrInvalidEmail) {
+		t.Error("expected ErrInvalidEmail, got", err)
+	}
+	if err := CheckCredentials("valid@valid.com", "", nil); !errors.Is(err, ErrWeakPassword) {
+		t.Error("expected ErrWeakPassword, got", err)
+	}
+}
+
+func TestAddLoginConcurrent(t *testing.T) {
+	defer fakeDbClient.ClearData()
+	ctx, canc := context.WithTimeout(context.Background(), time.Second*10)
+	defer canc()
+
+	const attempts = 20
+	var wg sync.WaitGroup
+	results := make(chan error, attempts)
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// Vary the case to check the canonical username is what is reserved
+			userName := "hello@test.com"
+			if i%2 == 0 {
+				userName = "Hello@Test.com"
+			}
+			results <- AddLogin(ctx, fakeRepo, fakeEventQueue, userName, "password", nil)
+		}(i)
+	}
+	wg.Wait()
+	close(results)
+
+	var succeeded int
+	for err := range results {
+		if err == nil {
+			succeeded++
+		} else if !errors.Is(err, ErrUserExists) {
+			t.Error("unexpected error:", err)
+		}
+	}
+	if succeeded != 1 {
+		t.Errorf("expected exactly one sign up to succeed, %d did", succeeded)
+	}
+}
+
+func TestCanonicalUsername(t *testing.T) {
+	if CanonicalUsername(" Hello@Test.COM ") != "hello@test.com" {
+		t.Error("incorrect canonical username")
+	}
+}
+
+func TestDeleteLogin(t *testing.T) {
+	defer fakeDbClient.ClearData()
+	ctx, canc := context.WithTimeout(context.Background(), time.Second*10)
+	defer canc()
+	if err := AddLogin(ctx, fakeRepo, fakeEventQueue, "hello@test.com", "password", nil); err != nil {
+		t.Error(err)
+		return
+	}
+	rec, err := Authenticate(ctx, fakeRepo, "hello@test.com", "password")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	userID := rec.ID
+	if err = CheckPassword(ctx, fakeRepo, userID, "wrong"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Error("expected ErrInvalidCredentials for the wrong password, got", err)
+	}
+	if err = CheckPassword(ctx, fakeRepo, userID, "password"); err != nil {
+		t.Error(err)
+	}
+	if err = session.Create(ctx, fakeDbClient, &data.Session{ID: "s1", UserID: userID}); err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err = ForcePasswordReset(ctx, fakeRepo, fakeDbClient, fakeEventQueue, userID); err != nil {
+		t.Fatal(err)
+	}
+	delivery := &webhook.Delivery{ID: "d1", UserID: userID, Body: `{"userId":"` + userID + `"}`, State: webhook.StatePending}
+	if err = fakeDbClient.InsertWithID(ctx, webhook.DeliveriesCollection, "d1", delivery); err != nil {
+		t.Fatal(err)
+	}
+	auditRec := &audit.Record{Type: audit.LoginFailed, TargetID: userID, UserName: "Hello@test.com", IP: "203.0.113.1", Outcome: audit.Failure}
+	if err = fakeAuditLog.Write(ctx, auditRec); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = DeleteLogin(ctx, fakeRepo, fakeDbClient, fakeEventQueue, fakeAuditLog, userID, nil); err != nil {
+		t.Error(err)
+		return
+	}
+	if resets, _ := PendingResets(ctx, fakeDbClient, userID); len(resets) != 0 {
+		t.Error("password resets should be deleted, got", resets)
+	}
+	if deliveries, _ := webhook.UserDeliveries(ctx, fakeDbClient, userID); len(deliveries) != 0 {
+		t.Error("webhook deliveries should be deleted, got", deliveries)
+	}
+	if records, _ := fakeAuditLog.Query(ctx, userID, time.Time{}, time.Time{}); len(records) != 2 || !records[0].Erased ||
+		records[0].IP != "" || records[0].UserName != "" || records[1].Type != audit.Erasure {
+		t.Errorf("audit records should be erased, got %+v", records)
+	}
+	if _, err = fakeRepo.GetByID(ctx, userID); !errors.Is(err, ErrUserNotFound) {
+		t.Error("login should be deleted, got", err)
+	}
+	if _, err = session.Get(ctx, fakeDbClient, "s1"); !errors.Is(err, session.ErrNotFound) {
+		t.Error("sessions should be deleted, got", err)
+	}
+	if err = AddLogin(ctx, fakeRepo, fakeEventQueue, "hello@test.com", "password", nil); err != nil {
+		t.Error("username should be available after deletion, got", err)
+	}
+	if err = DeleteLogin(ctx, fakeRepo, fakeDbClient, fakeEventQueue, fakeAuditLog, userID, nil); !errors.Is(err, ErrUserNotFound) {
+		t.Error("expected ErrUserNotFound deleting a missing login, got", err)
+	}
+}
+
+func TestSetStatus(t *testing.T) {
+	defer fakeDbClient.ClearData()
+	ctx, canc := context.WithTimeout(context.Background(), time.Second*10)
+	defer canc()
+	if err := AddLogin(ctx, fakeRepo, fakeEventQueue, "hello@test.com", "password", nil); err != nil {
+		t.Error(err)
+		return
+	}
+	rec, err := Authenticate(ctx, fakeRepo, "hello@test.com", "password")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	userID := rec.ID
+	if err = SetStatus(ctx, fakeRepo, fakeEventQueue, userID, "deleted", "", nil); !errors.Is(err, ErrInvalidStatus) {
+		t.Error("expected ErrInvalidStatus for an unknown status, got", err)
+	}
+
+	statuses := map[data.AccountStatus]error{
+		data.StatusDisabled:            ErrAccountDisabled,
+		data.StatusLocked:              ErrAccountLocked,
+		data.StatusPendingVerification: ErrAccountNotVerified,
+		data.StatusActive:              nil,
+	}
+	for status, expected := range statuses {
+		if err = SetStatus(ctx, fakeRepo, fakeEventQueue, userID, status, "testing", nil); err != nil {
+			t.Error(err)
+			return
+		}
+		if _, err = Authenticate(ctx, fakeRepo, "hello@test.com", "password"); !errors.Is(err, expected) {
+			t.Errorf("expected %v logging in to a %s account, got %v", expected, status, err)
+		}
+		if _, err = Authenticate(ctx, fakeRepo, "hello@test.com", "wrong"); !errors.Is(err, ErrInvalidCredentials) {
+			t.Errorf("wrong password for a %s account should return ErrInvalidCredentials, got %v", status, err)
+		}
+	}
+	rec, _ = fakeRepo.GetByID(ctx, userID)
+	if rec.StatusReason != "testing" || rec.StatusChangedAt.IsZero() {
+		t.Errorf("status change was not recorded: %+v", rec)
+	}
+}
+
+func TestRoles(t *testing.T) {
+	defer fakeDbClient.ClearData()
+	ctx, canc := context.WithTimeout(context.Background(), time.Second*10)
+	defer canc()
+	if err := AddLogin(ctx, fakeRepo, fakeEventQueue, "hello@test.com", "password", nil); err != nil {
+		t.Error(err)
+		return
+	}
+	rec, err := fakeRepo.GetByUsername(ctx, "hello@test.com")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !HasRoles(rec.AccountRoles(), data.RoleUser) || HasRoles(rec.AccountRoles(), data.RoleAdmin) {
+		t.Error("new logins should only have the user role, got", rec.Roles)
+	}
+	if err = SetRoles(ctx, fakeRepo, rec.ID, []string{"superuser"}); !errors.Is(err, ErrInvalidRole) {
+		t.Error("expected ErrInvalidRole for an unknown role, got", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err = BootstrapAdmin(ctx, fakeRepo, "hello@test.com"); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	rec, _ = fakeRepo.GetByID(ctx, rec.ID)
+	if len(rec.Roles) != 2 || !HasRoles(rec.Roles, data.RoleUser, data.RoleAdmin) {
+		t.Error("bootstrap should add the admin role once, got", rec.Roles)
+	}
+	if err = BootstrapAdmin(ctx, fakeRepo, "missing@test.com"); !errors.Is(err, ErrUserNotFound) {
+		t.Error("expected ErrUserNotFound bootstrapping a missing login, got", err)
+	}
+}
+
+func TestConcurrentChanges(t *testing.T) {
+	defer fakeDbClient.ClearData()
+	ctx, canc := context.WithTimeout(context.Background(), time.Second*10)
+	defer canc()
+	if err := AddLogin(ctx, fakeRepo, fakeEventQueue, "hello@test.com", "password", nil); err != nil {
+		t.Error(err)
+		return
+	}
+	rec, _ := fakeRepo.GetByUsername(ctx, "hello@test.com")
+
+	// Each change reads and writes the whole record, none of them should overwrite the others
+	var wg sync.WaitGroup
+	changes := []func() error{
+		func() error { return SetRoles(ctx, fakeRepo, rec.ID, []string{data.RoleUser, data.RoleSupport}) },
+		func() error {
+			return SetStatus(ctx, fakeRepo, fakeEventQueue, rec.ID, data.StatusLocked, "testing", nil)
+		},
+		func() error { return ChangeUsername(ctx, fakeRepo, rec.ID, "renamed@test.com") },
+	}
+	for _, change := range changes {
+		wg.Add(1)
+		go func(change func() error) {
+			defer wg.Done()
+			if err := change(); err != nil {
+				t.Error(err)
+			}
+		}(change)
+	}
+	wg.Wait()
+	rec, _ = fakeRepo.GetByID(ctx, rec.ID)
+	if len(rec.Roles) != 2 || rec.Status != data.StatusLocked || rec.UserName != "renamed@test.com" {
+		t.Errorf("expected every change to be kept, got %+v", rec)
+	}
+}
+
+func TestScopes(t *testing.T) {
+	if s := Scopes([]string{data.RoleUser}); len(s) != 1 || s[0] != ScopeAccount {
+		t.Error("unexpected user scopes:", s)
+	}
+	if s := Scopes([]string{data.RoleUser, data.RoleSupport}); len(s) != 2 || s[1] != ScopeUsersRead {
+		t.Error("unexpected support scopes:", s)
+	}
+	if s := Scopes([]string{data.RoleAdmin}); !HasRoles(s, ScopeService, ScopeUsersWrite) {
+		t.Error("unexpected admin scopes:", s)
+	}
+}
+
+func TestAddLoginEventFailure(t *testing.T) {
+	defer fakeDbClient.ClearData()
+	ctx, canc := context.WithTimeout(context.Background(), time.Second*10)
+	defer canc()
+	queue := &mock.PubSubHandler{}
+	queue.FailPushes("", errors.New("queue unavailable"))
+	if err := AddLogin(ctx, fakeRepo, queue, "hello@test.com", "password", nil); err != nil {
+		t.Error("registration should succeed when the created event can't be published, got", err)
+	}
+	if _, err := fakeRepo.GetByUsername(ctx, "hello@test.com"); err != nil {
+		t.Error("login should be kept when its created event can't be published, got", err)
+	}
+}
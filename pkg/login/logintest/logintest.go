@@ -0,0 +1,302 @@
+// Package logintest provides a conformance test suite for implementations of login.Repository
+package logintest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/blueambertech-demos/login-svc-gcp/data"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/login"
+)
+
+// RunRepositoryTests runs the conformance suite against repositories returned by newRepo, which must return an empty repository
+// each time it is called
+func RunRepositoryTests(t *testing.T, newRepo func() login.Repository) {
+	tests := []struct {
+		name string
+		test func(*testing.T, login.Repository)
+	}{
+		{"CreateAndGet", testCreateAndGet},
+		{"CreateDuplicate", testCreateDuplicate},
+		{"GetMixedCase", testGetMixedCase},
+		{"CreateConcurrent", testCreateConcurrent},
+		{"GetMissing", testGetMissing},
+		{"Update", testUpdate},
+		{"UpdateUsernameTaken", testUpdateUsernameTaken},
+		{"UpdateStatus", testUpdateStatus},
+		{"UpdateConflict", testUpdateConflict},
+		{"Delete", testDelete},
+		{"List", testList},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.test(t, newRepo())
+		})
+	}
+}
+
+func testCreateAndGet(t *testing.T, repo login.Repository) {
+	ctx := context.Background()
+	id, err := repo.Create(ctx, newDetails("hello@test.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, err := repo.GetByUsername(ctx, "hello@test.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.ID != id || rec.PassHash != "hash" || rec.Salt != "salt" {
+		t.Errorf("incorrect record returned by username: %+v", rec)
+	}
+	rec, err = repo.GetByID(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.UserName != "hello@test.com" || !rec.DateCreated.Equal(testTime) {
+		t.Errorf("incorrect record returned by ID: %+v", rec)
+	}
+}
+
+func testCreateDuplicate(t *testing.T, repo login.Repository) {
+	ctx := context.Background()
+	if _, err := repo.Create(ctx, newDetails("hello@test.com")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.Create(ctx, newDetails("Hello@Test.com")); !errors.Is(err, login.ErrUserExists) {
+		t.Errorf("expected ErrUserExists for a username differing only by case, got %v", err)
+	}
+}
+
+func testGetMixedCase(t *testing.T, repo login.Repository) {
+	ctx := context.Background()
+	id, err := repo.Create(ctx, newDetails("Hello@Test.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, userName := range []string{"Hello@Test.com", "hello@test.com", "HELLO@TEST.COM"} {
+		rec, err := repo.GetByUsername(ctx, userName)
+		if err != nil {
+			t.Errorf("%s: %v", userName, err)
+			continue
+		}
+		if rec.ID != id || rec.UserName != "Hello@Test.com" {
+			t.Errorf("%s: the username should be kept as it was typed, got %+v", userName, rec)
+		}
+	}
+}
+
+func testCreateConcurrent(t *testing.T, repo login.Repository) {
+	ctx := context.Background()
+	const attempts = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, attempts)
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := repo.Create(ctx, newDetails("hello@test.com"))
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	var succeeded int
+	for err := range errs {
+		if err == nil {
+			succeeded++
+		} else if !errors.Is(err, login.ErrUserExists) {
+			t.Error("unexpected error:", err)
+		}
+	}
+	if succeeded != 1 {
+		t.Errorf("expected exactly one create to succeed, %d did", succeeded)
+	}
+}
+
+func testGetMissing(t *testing.T, repo login.Repository) {
+	ctx := context.Background()
+	if _, err := repo.GetByUsername(ctx, "missing@test.com"); !errors.Is(err, login.ErrUserNotFound) {
+		t.Errorf("expected ErrUserNotFound by username, got %v", err)
+	}
+	if _, err := repo.GetByID(ctx, "missing"); !errors.Is(err, login.ErrUserNotFound) {
+		t.Errorf("expected ErrUserNotFound by ID, got %v", err)
+	}
+	if err := repo.Update(ctx, &login.Record{ID: "missing", LoginDetails: *newDetails("missing@test.com")}); !errors.Is(err, login.ErrUserNotFound) {
+		t.Errorf("expected ErrUserNotFound on update, got %v", err)
+	}
+	if err := repo.Delete(ctx, "missing"); !errors.Is(err, login.ErrUserNotFound) {
+		t.Errorf("expected ErrUserNotFound on delete, got %v", err)
+	}
+}
+
+func testUpdate(t *testing.T, repo login.Repository) {
+	ctx := context.Background()
+	id, err := repo.Create(ctx, newDetails("hello@test.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, err := repo.GetByID(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.UserName = "renamed@test.com"
+	rec.PassHash = "newhash"
+	if err = repo.Update(ctx, rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec, err = repo.GetByUsername(ctx, "renamed@test.com"); err != nil || rec.PassHash != "newhash" {
+		t.Errorf("update not stored: %+v, %v", rec, err)
+	}
+	if _, err = repo.GetByUsername(ctx, "hello@test.com"); !errors.Is(err, login.ErrUserNotFound) {
+		t.Errorf("old username should no longer be found, got %v", err)
+	}
+	// The old username should have been released
+	if _, err = repo.Create(ctx, newDetails("hello@test.com")); err != nil {
+		t.Errorf("old username should be available again, got %v", err)
+	}
+}
+
+func testUpdateUsernameTaken(t *testing.T, repo login.Repository) {
+	ctx := context.Background()
+	if _, err := repo.Create(ctx, newDetails("taken@test.com")); err != nil {
+		t.Fatal(err)
+	}
+	id, err := repo.Create(ctx, newDetails("hello@test.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := &login.Record{ID: id, LoginDetails: *newDetails("taken@test.com")}
+	if err = repo.Update(ctx, rec); !errors.Is(err, login.ErrUserExists) {
+		t.Errorf("expected ErrUserExists, got %v", err)
+	}
+}
+
+func testDelete(t *testing.T, repo login.Repository) {
+	ctx := context.Background()
+	id, err := repo.Create(ctx, newDetails("hello@test.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = repo.Delete(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = repo.GetByID(ctx, id); !errors.Is(err, login.ErrUserNotFound) {
+		t.Errorf("expected ErrUserNotFound after delete, got %v", err)
+	}
+	if _, err = repo.Create(ctx, newDetails("hello@test.com")); err != nil {
+		t.Errorf("username should be available after delete, got %v", err)
+	}
+}
+
+func testList(t *testing.T, repo login.Repository) {
+	ctx := context.Background()
+	const total = 5
+	for i := 0; i < total; i++ {
+		if _, err := repo.Create(ctx, newDetails(fmt.Sprintf("user%d@test.com", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	seen := map[string]bool{}
+	var cursor string
+	for pages := 0; ; pages++ {
+		if pages > total {
+			t.Fatal("pagination did not terminate")
+		}
+		records, next, err := repo.List(ctx, cursor, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) > 2 {
+			t.Errorf("page larger than limit: %d", len(records))
+		}
+		for _, rec := range records {
+			if seen[rec.ID] {
+				t.Errorf("record %s returned twice", rec.ID)
+			}
+			seen[rec.ID] = true
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if len(seen) != total {
+		t.Errorf("expected %d records listed, got %d", total, len(seen))
+	}
+}
+
+func testUpdateStatus(t *testing.T, repo login.Repository) {
+	ctx := context.Background()
+	id, err := repo.Create(ctx, newDetails("hello@test.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, err := repo.GetByID(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.Status = data.StatusDisabled
+	rec.StatusReason = "testing"
+	rec.StatusChangedAt = testTime.Add(time.Hour)
+	if err = repo.Update(ctx, rec); err != nil {
+		t.Fatal(err)
+	}
+	rec, err = repo.GetByUsername(ctx, "hello@test.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Status != data.StatusDisabled || rec.StatusReason != "testing" || !rec.StatusChangedAt.Equal(testTime.Add(time.Hour)) {
+		t.Errorf("status was not updated: %+v", rec)
+	}
+}
+
+func testUpdateConflict(t *testing.T, repo login.Repository) {
+	ctx := context.Background()
+	id, err := repo.Create(ctx, newDetails("hello@test.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := repo.GetByID(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := repo.GetByID(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.Roles = []string{data.RoleUser, data.RoleAdmin}
+	if err = repo.Update(ctx, first); err != nil {
+		t.Fatal(err)
+	}
+	second.Status = data.StatusDisabled
+	if err = repo.Update(ctx, second); !errors.Is(err, login.ErrConflict) {
+		t.Errorf("expected ErrConflict updating a stale record, got %v", err)
+	}
+	rec, err := repo.GetByID(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.Roles) != 2 || rec.Status == data.StatusDisabled {
+		t.Errorf("the stale update should not be written: %+v", rec)
+	}
+	// The record returned by a successful update can be updated again
+	first.StatusReason = "testing"
+	if err = repo.Update(ctx, first); err != nil {
+		t.Errorf("expected the updated record to be current, got %v", err)
+	}
+}
+
+var testTime = time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+
+func newDetails(userName string) *data.LoginDetails {
+	return &data.LoginDetails{
+		UserName:    userName,
+		PassHash:    "hash",
+		Salt:        "salt",
+		DateCreated: testTime,
+	}
+}
@@ -0,0 +1,195 @@
+package login
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/blueambertech-demos/login-svc-gcp/data"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/storage"
+)
+
+// Record is a set of login details along with the ID they are stored under, the ID is the user ID
+type Record struct {
+	ID string
+	data.LoginDetails
+	// Revision changes each time the record is updated, Update only writes a record if the stored one has the same revision
+	Revision string
+}
+
+// Repository stores login records. Implementations must keep usernames unique by their canonical form, returning ErrUserExists
+// from Create and Update when a username is taken, and return ErrUserNotFound when a record does not exist. Update must return
+// ErrConflict when the record has been updated since it was read, and set the new revision on the record when it succeeds
+type Repository interface {
+	GetByUsername(ctx context.Context, userName string) (*Record, error)
+	GetByID(ctx context.Context, id string) (*Record, error)
+	Create(ctx context.Context, details *data.LoginDetails) (string, error)
+	Update(ctx context.Context, rec *Record) error
+	Delete(ctx context.Context, id string) error
+	// List returns up to limit records ordered by ID, starting after the cursor. The returned cursor is empty when there are no
+	// more records
+	List(ctx context.Context, cursor string, limit int) ([]Record, string, error)
+}
+
+// TransactionalRepository is a Repository that can create, update or delete a login and write other documents in one
+// transaction. The writes are made with a storage.Client using the same database as the repository, for CreateWith they are
+// returned by with which is given the ID of the new login
+type TransactionalRepository interface {
+	Repository
+	CreateWith(ctx context.Context, details *data.LoginDetails, with func(id string) ([]storage.Write, error)) (string, error)
+	UpdateWith(ctx context.Context, rec *Record, writes ...storage.Write) error
+	DeleteWith(ctx context.Context, id string, writes ...storage.Write) error
+}
+
+// maxUpdateAttempts limits how many times a change to a login is retried when other requests keep changing it
+const maxUpdateAttempts = 5
+
+// modify reads a login, applies change to it and writes it back. When the login was changed by another request in between the
+// change is applied again to the new copy, so concurrent changes to different fields are never lost. change can return writes
+// to make in the same transaction, it must only do so when the repository is a TransactionalRepository, see transactional
+func modify(ctx context.Context, repo Repository, userID string, change func(rec *Record) ([]storage.Write, error)) (*Record, error) {
+	for attempt := 1; ; attempt++ {
+		rec, err := repo.GetByID(ctx, userID)
+		if err != nil {
+			return nil, err
+		}
+		writes, err := change(rec)
+		if err != nil {
+			return nil, err
+		}
+		if len(writes) > 0 {
+			err = repo.(TransactionalRepository).UpdateWith(ctx, rec, writes...)
+		} else {
+			err = repo.Update(ctx, rec)
+		}
+		if err == nil {
+			return rec, nil
+		} else if !errors.Is(err, ErrConflict) || attempt == maxUpdateAttempts {
+			return nil, err
+		}
+	}
+}
+
+// MemoryRepository is a Repository that holds records in memory, it is intended for tests and local development
+type MemoryRepository struct {
+	mu        sync.RWMutex
+	records   map[string]data.LoginDetails
+	revisions map[string]string
+	usernames map[string]string
+}
+
+// NewMemoryRepository returns an empty MemoryRepository
+func NewMemoryRepository() *MemoryRepository {
+	return &MemoryRepository{
+		records:   map[string]data.LoginDetails{},
+		revisions: map[string]string{},
+		usernames: map[string]string{},
+	}
+}
+
+func (m *MemoryRepository) GetByUsername(_ context.Context, userName string) (*Record, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	id, ok := m.usernames[CanonicalUsername(userName)]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	return &Record{ID: id, LoginDetails: m.records[id], Revision: m.revisions[id]}, nil
+}
+
+func (m *MemoryRepository) GetByID(_ context.Context, id string) (*Record, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	d, ok := m.records[id]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	return &Record{ID: id, LoginDetails: d, Revision: m.revisions[id]}, nil
+}
+
+func (m *MemoryRepository) Create(_ context.Context, details *data.LoginDetails) (string, error) {
+	id, err := generateID()
+	if err != nil {
+		return "", err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	canonical := CanonicalUsername(details.UserName)
+	if _, ok := m.usernames[canonical]; ok {
+		return "", ErrUserExists
+	}
+	m.usernames[canonical] = id
+	m.records[id] = *details
+	return id, nil
+}
+
+func (m *MemoryRepository) Update(_ context.Context, rec *Record) error {
+	revision, err := generateID()
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	old, ok := m.records[rec.ID]
+	if !ok {
+		return ErrUserNotFound
+	}
+	if m.revisions[rec.ID] != rec.Revision {
+		return ErrConflict
+	}
+	oldName, newName := CanonicalUsername(old.UserName), CanonicalUsername(rec.UserName)
+	if oldName != newName {
+		if _, ok = m.usernames[newName]; ok {
+			return ErrUserExists
+		}
+		delete(m.usernames, oldName)
+		m.usernames[newName] = rec.ID
+	}
+	m.records[rec.ID] = rec.LoginDetails
+	m.revisions[rec.ID] = revision
+	rec.Revision = revision
+	return nil
+}
+
+func (m *MemoryRepository) Delete(_ context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d, ok := m.records[id]
+	if !ok {
+		return ErrUserNotFound
+	}
+	delete(m.usernames, CanonicalUsername(d.UserName))
+	delete(m.records, id)
+	delete(m.revisions, id)
+	return nil
+}
+
+func (m *MemoryRepository) List(_ context.Context, cursor string, limit int) ([]Record, string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	ids := make([]string, 0, len(m.records))
+	for id := range m.records {
+		ids = append(ids, id)
+	}
+	page, next := paginate(ids, cursor, limit)
+	records := make([]Record, len(page))
+	for i, id := range page {
+		records[i] = Record{ID: id, LoginDetails: m.records[id], Revision: m.revisions[id]}
+	}
+	return records, next, nil
+}
+
+// paginate sorts the IDs and returns up to limit of them starting after the cursor, along with the cursor for the next page
+func paginate(ids []string, cursor string, limit int) ([]string, string) {
+	sort.Strings(ids)
+	start := sort.SearchStrings(ids, cursor)
+	if start < len(ids) && ids[start] == cursor {
+		start++
+	}
+	ids = ids[start:]
+	if limit <= 0 || len(ids) <= limit {
+		return ids, ""
+	}
+	return ids[:limit], ids[limit-1]
+}
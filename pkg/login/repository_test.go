@@ -0,0 +1,210 @@
+package login_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/blueambertech-demos/login-svc-gcp/data"
+	"github.com/blueambertech-demos/login-svc-gcp/mock"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/audit"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/events"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/login"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/login/logintest"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/outbox"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/storage"
+	_ "modernc.org/sqlite"
+)
+
+func TestMemoryRepository(t *testing.T) {
+	logintest.RunRepositoryTests(t, func() login.Repository {
+		return login.NewMemoryRepository()
+	})
+}
+
+func TestFirestoreRepository(t *testing.T) {
+	logintest.RunRepositoryTests(t, func() login.Repository {
+		return login.NewFirestoreRepository(mock.NewNoSQLClient())
+	})
+}
+
+func TestSQLiteRepository(t *testing.T) {
+	dir := t.TempDir()
+	n := 0
+	logintest.RunRepositoryTests(t, func() login.Repository {
+		n++
+		db, err := sql.Open("sqlite", filepath.Join(dir, fmt.Sprintf("test%d.db", n))+"?_pragma=busy_timeout(5000)")
+		if err != nil {
+			t.Fatal(err)
+		}
+		db.SetMaxOpenConns(1)
+		t.Cleanup(func() { _ = db.Close() })
+		repo, err := login.NewSQLRepository(context.Background(), db, storage.SQLite)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return repo
+	})
+}
+
+func TestAddLoginWritesOutboxEntry(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "test.db")+"?_pragma=busy_timeout(5000)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { _ = db.Close() })
+	sqlClient, err := storage.NewSQL(ctx, db, storage.SQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlRepo, err := login.NewSQLRepository(ctx, db, storage.SQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	firestoreClient := mock.NewNoSQLClient()
+
+	for name, backend := range map[string]struct {
+		dbClient storage.Client
+		repo     login.Repository
+	}{
+		"firestore": {firestoreClient, login.NewFirestoreRepository(firestoreClient)},
+		"sqlite":    {sqlClient, sqlRepo},
+	} {
+		box := outbox.New(backend.dbClient)
+		if err = login.AddLogin(ctx, backend.repo, box, "hello@test.com", "password", nil); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		rec, err := backend.repo.GetByUsername(ctx, "hello@test.com")
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		entries, err := backend.dbClient.List(ctx, outbox.CollectionName)
+		if err != nil || len(entries) != 1 {
+			t.Fatalf("%s: expected the created event in the outbox, got %d entries %v", name, len(entries), err)
+		}
+		for _, e := range entries {
+			env, err := events.Parse([]byte(e["Message"].(string)))
+			if err != nil || env.Type != events.LoginCreated || env.UserID != rec.ID {
+				t.Errorf("%s: unexpected outbox entry %v %v", name, e, err)
+			}
+		}
+
+		// Neither the login nor its event is written when the username is taken
+		if err = login.AddLogin(ctx, backend.repo, box, "Hello@Test.com", "password", nil); !errors.Is(err, login.ErrUserExists) {
+			t.Errorf("%s: expected ErrUserExists, got %v", name, err)
+		}
+		if entries, _ = backend.dbClient.List(ctx, outbox.CollectionName); len(entries) != 1 {
+			t.Errorf("%s: no event should be stored for a login that wasn't added, got %d entries", name, len(entries))
+		}
+	}
+}
+
+func TestChangesWriteOutboxEntries(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "test.db")+"?_pragma=busy_timeout(5000)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { _ = db.Close() })
+	sqlClient, err := storage.NewSQL(ctx, db, storage.SQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlRepo, err := login.NewSQLRepository(ctx, db, storage.SQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	firestoreClient := mock.NewNoSQLClient()
+
+	for name, backend := range map[string]struct {
+		dbClient storage.Client
+		repo     login.Repository
+	}{
+		"firestore": {firestoreClient, login.NewFirestoreRepository(firestoreClient)},
+		"sqlite":    {sqlClient, sqlRepo},
+	} {
+		box := outbox.New(backend.dbClient)
+		if err = login.AddLogin(ctx, backend.repo, box, "hello@test.com", "password", nil); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		rec, err := backend.repo.GetByUsername(ctx, "hello@test.com")
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if err = login.SetStatus(ctx, backend.repo, box, rec.ID, data.StatusLocked, "testing", nil); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		auditLog := audit.New(backend.dbClient, box, mock.NewSecretManager())
+		if err = login.DeleteLogin(ctx, backend.repo, backend.dbClient, box, auditLog, rec.ID, nil); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		entries, err := backend.dbClient.List(ctx, outbox.CollectionName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := map[string]bool{}
+		for _, e := range entries {
+			msg := e["Message"].(string)
+			if e["TopicID"] == login.DeletedTopicID && msg == rec.ID {
+				found[login.DeletedTopicID] = true
+			} else if env, err := events.Parse([]byte(msg)); err == nil && env.UserID == rec.ID {
+				found[string(env.Type)] = true
+			}
+		}
+		for _, expected := range []string{string(events.LoginCreated), string(events.AccountLocked), string(events.AccountDeleted), login.DeletedTopicID} {
+			if !found[expected] {
+				t.Errorf("%s: expected %s in the outbox, got %v", name, expected, found)
+			}
+		}
+	}
+}
+
+func TestFirestoreRenameToLegacyUsername(t *testing.T) {
+	ctx := context.Background()
+	db := mock.NewNoSQLClient()
+	repo := login.NewFirestoreRepository(db)
+	// A login written before usernames were reserved has neither a reservation nor a canonical username
+	if err := db.InsertWithID(ctx, login.DetailsCollection, "legacy", map[string]interface{}{"UserName": "legacy@test.com"}); err != nil {
+		t.Fatal(err)
+	}
+	id, err := repo.Create(ctx, &data.LoginDetails{UserName: "hello@test.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, err := repo.GetByID(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.UserName = "legacy@test.com"
+	if err = repo.Update(ctx, rec); !errors.Is(err, login.ErrUserExists) {
+		t.Errorf("expected ErrUserExists renaming to a legacy username, got %v", err)
+	}
+	if exists, _ := db.Exists(ctx, login.UsernamesCollection, "legacy@test.com"); exists {
+		t.Error("the legacy username should not be reserved")
+	}
+
+	// A stale update leaves the reservations as they were
+	stale := *rec
+	rec.UserName = "hello@test.com"
+	rec.StatusReason = "testing"
+	if err = repo.Update(ctx, rec); err != nil {
+		t.Fatal(err)
+	}
+	stale.UserName = "renamed@test.com"
+	if err = repo.Update(ctx, &stale); !errors.Is(err, login.ErrConflict) {
+		t.Errorf("expected ErrConflict, got %v", err)
+	}
+	if exists, _ := db.Exists(ctx, login.UsernamesCollection, "renamed@test.com"); exists {
+		t.Error("a failed rename should not leave its reservation behind")
+	}
+	if exists, _ := db.Exists(ctx, login.UsernamesCollection, "hello@test.com"); !exists {
+		t.Error("a failed rename should not release the current username")
+	}
+}
@@ -0,0 +1,146 @@
+package login
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/events"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/session"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/storage"
+	"github.com/blueambertech/pubsub"
+	"github.com/mitchellh/mapstructure"
+)
+
+const (
+	// ResetsCollection holds password reset tokens, keyed by the SHA-256 hash of the token so that the tokens themselves are
+	// never stored
+	ResetsCollection = "password-resets"
+
+	// ResetTokenLife is how long a password reset token can be used for
+	ResetTokenLife = time.Hour
+)
+
+type passwordReset struct {
+	UserID    string
+	ExpiresAt time.Time
+}
+
+// ChangePassword sets a new password for a login, the password must meet the same requirements as when the login was added
+func ChangePassword(ctx context.Context, repo Repository, userID, password string) error {
+	if len(password) == 0 {
+		return ErrWeakPassword
+	}
+	salt, err := generateSalt()
+	if err != nil {
+		return err
+	}
+	_, err = modify(ctx, repo, userID, func(rec *Record) ([]storage.Write, error) {
+		rec.Salt = salt
+		rec.PassHash = hashPassword(password + salt)
+		rec.HashAlgorithm = HashSHA256x1000
+		return nil, nil
+	})
+	return err
+}
+
+// ForcePasswordReset stops the current password of a login from working, revokes its sessions and creates a single use token
+// for the user to choose a new password with ResetPassword. The token is only sent to the user, as a
+// login.password_reset_requested notification, and the time it expires is returned
+func ForcePasswordReset(ctx context.Context, repo Repository, dbClient storage.Client, eventQueue pubsub.Handler, userID string) (time.Time, error) {
+	// No password hashes to an empty string so the login can't be used until it is reset
+	_, err := modify(ctx, repo, userID, func(rec *Record) ([]storage.Write, error) {
+		rec.PassHash = ""
+		return nil, nil
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+	if _, err = session.RevokeAll(ctx, dbClient, userID); err != nil {
+		return time.Time{}, &StorageError{Op: "revoke sessions", Err: err}
+	}
+
+	b := make([]byte, 32)
+	if _, err = rand.Read(b); err != nil {
+		return time.Time{}, err
+	}
+	resetToken := hex.EncodeToString(b)
+	key := hashResetToken(resetToken)
+	reset := passwordReset{UserID: userID, ExpiresAt: time.Now().Add(ResetTokenLife)}
+	if err = dbClient.InsertWithID(ctx, ResetsCollection, key, &reset); err != nil {
+		return time.Time{}, &StorageError{Op: "store password reset", Err: err}
+	}
+	payload := &events.ResetPayload{ResetToken: resetToken, ExpiresAt: reset.ExpiresAt}
+	if err = events.Notify(ctx, eventQueue, events.PasswordResetRequested, userID, payload); err != nil {
+		// A token the user never receives can't be used, remove it so that the reset can be forced again
+		_ = dbClient.Delete(ctx, ResetsCollection, key)
+		return time.Time{}, &StorageError{Op: "store password reset notification", Err: err}
+	}
+	return reset.ExpiresAt, nil
+}
+
+// ResetPassword sets a new password using a token from ForcePasswordReset and returns the ID of the user it belonged to,
+// ErrInvalidResetToken is returned if the token does not exist, has expired or has already been used
+func ResetPassword(ctx context.Context, repo Repository, dbClient storage.Client, resetToken, password string) (string, error) {
+	if len(password) == 0 {
+		return "", ErrWeakPassword
+	}
+	id := hashResetToken(resetToken)
+	doc, err := dbClient.Read(ctx, ResetsCollection, id)
+	if errors.Is(err, storage.ErrNotFound) {
+		return "", ErrInvalidResetToken
+	} else if err != nil {
+		return "", &StorageError{Op: "read password reset", Err: err}
+	}
+	var reset passwordReset
+	if err = mapstructure.Decode(doc, &reset); err != nil {
+		return "", err
+	}
+	// The token is deleted before it is used so it can't be used twice
+	if err = dbClient.Delete(ctx, ResetsCollection, id); err != nil {
+		return "", &StorageError{Op: "delete password reset", Err: err}
+	}
+	if time.Now().After(reset.ExpiresAt) {
+		return "", ErrInvalidResetToken
+	}
+	return reset.UserID, ChangePassword(ctx, repo, reset.UserID, password)
+}
+
+// PendingResets returns the expiry times of the password reset tokens issued to a user that have not been used
+func PendingResets(ctx context.Context, dbClient storage.Client, userID string) ([]time.Time, error) {
+	docs, err := dbClient.Where(ctx, ResetsCollection, "UserID", "==", userID)
+	if err != nil {
+		return nil, err
+	}
+	expiries := make([]time.Time, 0, len(docs))
+	for _, doc := range docs {
+		var reset passwordReset
+		if err = mapstructure.Decode(doc, &reset); err != nil {
+			return nil, err
+		}
+		expiries = append(expiries, reset.ExpiresAt)
+	}
+	return expiries, nil
+}
+
+// deleteResets removes every password reset token issued to a user
+func deleteResets(ctx context.Context, dbClient storage.Client, userID string) error {
+	docs, err := dbClient.Where(ctx, ResetsCollection, "UserID", "==", userID)
+	if err != nil {
+		return err
+	}
+	for id := range docs {
+		if err = dbClient.Delete(ctx, ResetsCollection, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func hashResetToken(resetToken string) string {
+	h := sha256.Sum256([]byte(resetToken))
+	return hex.EncodeToString(h[:])
+}
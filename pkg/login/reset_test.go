@@ -0,0 +1,135 @@
+package login
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blueambertech-demos/login-svc-gcp/data"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/events"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/session"
+)
+
+func TestForcePasswordReset(t *testing.T) {
+	defer fakeDbClient.ClearData()
+	ctx, canc := context.WithTimeout(context.Background(), time.Second*10)
+	defer canc()
+	if err := AddLogin(ctx, fakeRepo, fakeEventQueue, "hello@test.com", "password", nil); err != nil {
+		t.Error(err)
+		return
+	}
+	rec, err := Authenticate(ctx, fakeRepo, "hello@test.com", "password")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	s := data.Session{ID: "s1", UserID: rec.ID, ExpiresAt: time.Now().Add(time.Hour)}
+	if err = session.Create(ctx, fakeDbClient, &s); err != nil {
+		t.Error(err)
+		return
+	}
+
+	expires, err := ForcePasswordReset(ctx, fakeRepo, fakeDbClient, fakeEventQueue, rec.ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	// The token is only sent to the user
+	msgs := fakeEventQueue.Published(events.NotificationTopicID)
+	if len(msgs) == 0 {
+		t.Fatal("expected a password reset notification")
+	}
+	env, err := events.Parse([]byte(msgs[len(msgs)-1]))
+	if err != nil || env.Type != events.PasswordResetRequested || env.UserID != rec.ID {
+		t.Fatalf("unexpected notification %+v %v", env, err)
+	}
+	var payload events.ResetPayload
+	if err = env.DecodePayload(&payload); err != nil || payload.ResetToken == "" || !payload.ExpiresAt.Equal(expires) {
+		t.Fatalf("unexpected notification payload %+v %v", payload, err)
+	}
+	resetToken := payload.ResetToken
+	for _, msg := range fakeEventQueue.Published(events.TopicID) {
+		if strings.Contains(msg, resetToken) {
+			t.Error("the reset token should not be published to the events topic")
+		}
+	}
+	if _, err = Authenticate(ctx, fakeRepo, "hello@test.com", "password"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Error("old password should not work after a forced reset, got", err)
+	}
+	if sessions, _ := session.List(ctx, fakeDbClient, rec.ID); len(sessions) != 0 {
+		t.Error("sessions should be revoked by a forced reset")
+	}
+
+	if _, err = ResetPassword(ctx, fakeRepo, fakeDbClient, "wrong-token", "newpass"); !errors.Is(err, ErrInvalidResetToken) {
+		t.Error("expected ErrInvalidResetToken for an unknown token, got", err)
+	}
+	userID, err := ResetPassword(ctx, fakeRepo, fakeDbClient, resetToken, "newpass")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if userID != rec.ID {
+		t.Error("reset should return the ID of the user, got", userID)
+	}
+	if _, err = Authenticate(ctx, fakeRepo, "hello@test.com", "newpass"); err != nil {
+		t.Error("new password should work after a reset, got", err)
+	}
+	if _, err = ResetPassword(ctx, fakeRepo, fakeDbClient, resetToken, "another"); !errors.Is(err, ErrInvalidResetToken) {
+		t.Error("reset token should only be usable once, got", err)
+	}
+}
+
+func TestResetPasswordExpired(t *testing.T) {
+	defer fakeDbClient.ClearData()
+	ctx := context.Background()
+	reset := passwordReset{UserID: "user-1", ExpiresAt: time.Now().Add(-time.Minute)}
+	if err := fakeDbClient.InsertWithID(ctx, ResetsCollection, hashResetToken("expired"), &reset); err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err := ResetPassword(ctx, fakeRepo, fakeDbClient, "expired", "newpass"); !errors.Is(err, ErrInvalidResetToken) {
+		t.Error("expected ErrInvalidResetToken for an expired token, got", err)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	ctx := context.Background()
+	repo := NewMemoryRepository()
+	for i := 0; i < 250; i++ {
+		name := "user" + string(rune('a'+i%26)) + "@test.com"
+		if i%2 == 0 {
+			name = "x" + name
+		}
+		if _, err := repo.Create(ctx, &data.LoginDetails{UserName: string(rune('a'+i/26)) + name}); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	seen := map[string]bool{}
+	cursor := ""
+	for {
+		page, next, err := Search(ctx, repo, "XUSER", cursor, 30)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if len(page) > 30 {
+			t.Error("page is larger than the limit:", len(page))
+		}
+		for _, rec := range page {
+			if seen[rec.ID] {
+				t.Error("record returned twice:", rec.UserName)
+			}
+			seen[rec.ID] = true
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if len(seen) != 125 {
+		t.Errorf("expected 125 matches, got %d", len(seen))
+	}
+}
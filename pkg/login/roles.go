@@ -0,0 +1,96 @@
+package login
+
+import (
+	"context"
+	"sort"
+
+	"github.com/blueambertech-demos/login-svc-gcp/data"
+)
+
+// Scopes granted to tokens, each role is granted a fixed set of scopes
+const (
+	ScopeAccount    = "account"
+	ScopeUsersRead  = "users:read"
+	ScopeUsersWrite = "users:write"
+	ScopeService    = "service"
+)
+
+var roleScopes = map[string][]string{
+	data.RoleUser:    {ScopeAccount},
+	data.RoleSupport: {ScopeAccount, ScopeUsersRead},
+	data.RoleAdmin:   {ScopeAccount, ScopeUsersRead, ScopeUsersWrite, ScopeService},
+}
+
+// ValidRole reports whether a role exists
+func ValidRole(role string) bool {
+	_, ok := roleScopes[role]
+	return ok
+}
+
+// Scopes returns the sorted set of scopes granted to the roles
+func Scopes(roles []string) []string {
+	set := map[string]bool{}
+	for _, r := range roles {
+		for _, s := range roleScopes[r] {
+			set[s] = true
+		}
+	}
+	scopes := make([]string, 0, len(set))
+	for s := range set {
+		scopes = append(scopes, s)
+	}
+	sort.Strings(scopes)
+	return scopes
+}
+
+// HasRoles reports whether every one of the wanted roles is in roles
+func HasRoles(roles []string, wanted ...string) bool {
+	for _, w := range wanted {
+		found := false
+		for _, r := range roles {
+			if r == w {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// accountRoles returns the roles of an account, records written before roles were introduced have none and are users
+func accountRoles(d *data.LoginDetails) []string {
+	if len(d.Roles) == 0 {
+		return []string{data.RoleUser}
+	}
+	return d.Roles
+}
+
+// AccountRoles returns the roles of a login record
+func (r *Record) AccountRoles() []string {
+	return accountRoles(&r.LoginDetails)
+}
+
+// SetRoles replaces the roles of an account, ErrInvalidRole is returned if any of the roles do not exist
+func SetRoles(ctx context.Context, repo Repository, userID string, roles []string) error {
+	if roles == nil {
+		roles = []string{}
+	}
+	return UpdateAccount(ctx, repo, nil, userID, &AccountChanges{Roles: roles}, nil)
+}
+
+// BootstrapAdmin grants the admin role to the login with the given username so that the first admin can be created, it does
+// nothing if the login is already an admin
+func BootstrapAdmin(ctx context.Context, repo Repository, userName string) error {
+	rec, err := repo.GetByUsername(ctx, userName)
+	if err != nil {
+		return err
+	}
+	roles := rec.AccountRoles()
+	if HasRoles(roles, data.RoleAdmin) {
+		return nil
+	}
+	return SetRoles(ctx, repo, rec.ID, append(roles, data.RoleAdmin))
+}
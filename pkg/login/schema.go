@@ -0,0 +1,175 @@
+package login
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/blueambertech-demos/login-svc-gcp/data"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/storage"
+)
+
+// HashSHA256x1000 is the password hash algorithm used by hashPassword, 1000 iterations of SHA-256 over the password and salt
+const HashSHA256x1000 = "sha256x1000"
+
+// DetailsMigration upgrades a stored login details document by one schema version
+type DetailsMigration struct {
+	// Version is the schema version of the document once the migration has been applied
+	Version     int
+	Description string
+	Upgrade     func(doc map[string]interface{}) error
+}
+
+// detailsMigrations is the registry of migrations, it must be ordered by version with one migration for each version up to
+// data.LoginDetailsSchemaVersion
+var detailsMigrations = []DetailsMigration{
+	{
+		Version:     1,
+		Description: "record the password hash algorithm",
+		Upgrade: func(doc map[string]interface{}) error {
+			// Every login written before the schema was versioned used the same algorithm
+			if _, ok := doc["HashAlgorithm"]; !ok {
+				doc["HashAlgorithm"] = HashSHA256x1000
+			}
+			return nil
+		},
+	},
+	{
+		Version:     2,
+		Description: "add the account status",
+		Upgrade: func(doc map[string]interface{}) error {
+			if _, ok := doc["Status"]; !ok {
+				doc["Status"] = string(data.StatusActive)
+			}
+			return nil
+		},
+	},
+	{
+		Version:     3,
+		Description: "add roles",
+		Upgrade: func(doc map[string]interface{}) error {
+			if _, ok := doc["Roles"]; !ok {
+				doc["Roles"] = []interface{}{data.RoleUser}
+			}
+			return nil
+		},
+	},
+	{
+		Version:     4,
+		Description: "store the canonical username",
+		Upgrade: func(doc map[string]interface{}) error {
+			userName, _ := doc["UserName"].(string)
+			doc[canonicalField] = CanonicalUsername(userName)
+			return nil
+		},
+	},
+}
+
+// UpgradeDetails applies any migrations needed to bring a stored login details document up to the current schema version, it
+// reports whether the document was changed. Documents written by a newer version of the service are rejected
+func UpgradeDetails(doc map[string]interface{}) (bool, error) {
+	version, err := DetailsVersion(doc)
+	if err != nil {
+		return false, err
+	}
+	if version > data.LoginDetailsSchemaVersion {
+		return false, fmt.Errorf("login details schema version %d is newer than supported version %d", version, data.LoginDetailsSchemaVersion)
+	}
+	changed := false
+	for _, m := range detailsMigrations {
+		if m.Version <= version {
+			continue
+		}
+		if err = m.Upgrade(doc); err != nil {
+			return changed, fmt.Errorf("upgrading login details to version %d: %w", m.Version, err)
+		}
+		doc["SchemaVersion"] = int64(m.Version)
+		changed = true
+	}
+	return changed, nil
+}
+
+// DetailsVersion returns the schema version of a stored login details document, documents without a version are version 0
+func DetailsVersion(doc map[string]interface{}) (int, error) {
+	switch v := doc["SchemaVersion"].(type) {
+	case nil:
+		return 0, nil
+	case int64:
+		return int(v), nil
+	case int:
+		return v, nil
+	case float64:
+		return int(v), nil
+	default:
+		return 0, fmt.Errorf("login details schema version has unexpected type %T", v)
+	}
+}
+
+// MigrationReport summarises a batch migration of the login details collection
+type MigrationReport struct {
+	DryRun   bool `json:"dryRun"`
+	Scanned  int  `json:"scanned"`
+	Migrated int  `json:"migrated"`
+	// Versions counts the documents found at each schema version before they were migrated
+	Versions map[int]int `json:"versions"`
+}
+
+// MigrateDetails upgrades every document in the login details collection to the current schema version. Documents are upgraded
+// when they are read so this is not required, but it allows support for old versions to eventually be removed. Nothing is changed
+// when dryRun is set. The collection is read a page at a time and each document is only written if its revision hasn't changed
+// since it was read, a document updated by the service in between is read and upgraded again
+func MigrateDetails(ctx context.Context, dbClient storage.Client, dryRun bool) (*MigrationReport, error) {
+	report := &MigrationReport{DryRun: dryRun, Versions: map[int]int{}}
+	for after := ""; ; {
+		docs, err := dbClient.ListPage(ctx, DetailsCollection, after, listBatchSize)
+		if err != nil {
+			return report, err
+		}
+		for _, d := range docs {
+			version, err := DetailsVersion(d.Data)
+			if err != nil {
+				return report, fmt.Errorf("login details %s: %w", d.ID, err)
+			}
+			report.Scanned++
+			report.Versions[version]++
+			changed, err := migrateDocument(ctx, dbClient, d.ID, d.Data, dryRun)
+			if err != nil {
+				return report, fmt.Errorf("login details %s: %w", d.ID, err)
+			}
+			if changed {
+				report.Migrated++
+			}
+		}
+		if len(docs) < listBatchSize {
+			return report, nil
+		}
+		after = docs[len(docs)-1].ID
+	}
+}
+
+// migrateDocument upgrades one login details document and writes it back on the condition that its revision is unchanged,
+// reporting whether it needed upgrading. When the condition fails the document is read again and the upgrade retried
+func migrateDocument(ctx context.Context, dbClient storage.Client, id string, doc map[string]interface{}, dryRun bool) (bool, error) {
+	for attempt := 1; ; attempt++ {
+		revision, _ := doc[revisionField].(string)
+		changed, err := UpgradeDetails(doc)
+		if err != nil || !changed || dryRun {
+			return changed, err
+		}
+		if doc[revisionField], err = generateID(); err != nil {
+			return false, err
+		}
+		err = dbClient.UpdateFieldsIf(ctx, DetailsCollection, id, revisionField, revision, doc)
+		if err == nil {
+			return true, nil
+		} else if !errors.Is(err, storage.ErrConflict) || attempt == maxUpdateAttempts {
+			return false, err
+		}
+		if doc, err = dbClient.Read(ctx, DetailsCollection, id); errors.Is(err, storage.ErrNotFound) {
+			// The login was deleted, there is nothing left to upgrade
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package login_test
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/blueambertech-demos/login-svc-gcp/data"
+	"github.com/blueambertech-demos/login-svc-gcp/mock"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/login"
+)
+
+func loadFixture(t *testing.T, name string) map[string]interface{} {
+	b, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc map[string]interface{}
+	if err = json.Unmarshal(b, &doc); err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+func TestReadHistoricalVersions(t *testing.T) {
+	ctx := context.Background()
+	db := mock.NewNoSQLClient()
+	db.SetData(login.DetailsCollection, map[string]map[string]interface{}{
+		"v0": loadFixture(t, "details_v0.json"),
+		"v1": loadFixture(t, "details_v1.json"),
+		"v2": loadFixture(t, "details_v2.json"),
+		"v3": loadFixture(t, "details_v3.json"),
+		"v4": loadFixture(t, "details_v4.json"),
+	})
+	repo := login.NewFirestoreRepository(db)
+	expected := map[string]struct {
+		status data.AccountStatus
+		roles  []string
+	}{
+		"v0": {data.StatusActive, []string{data.RoleUser}},
+		"v1": {data.StatusActive, []string{data.RoleUser}},
+		"v2": {data.StatusDisabled, []string{data.RoleUser}},
+		"v3": {data.StatusActive, []string{data.RoleUser, data.RoleAdmin}},
+		"v4": {data.StatusActive, []string{data.RoleUser, data.RoleSupport}},
+	}
+	for id, want := range expected {
+		rec, err := repo.GetByID(ctx, id)
+		if err != nil {
+			t.Error(id, err)
+			continue
+		}
+		if rec.SchemaVersion != data.LoginDetailsSchemaVersion || rec.HashAlgorithm != login.HashSHA256x1000 {
+			t.Error("record was not upgraded to the current version:", id, rec.SchemaVersion, rec.HashAlgorithm)
+		}
+		if rec.Status != want.status {
+			t.Errorf("expected status %s for %s, got %s", want.status, id, rec.Status)
+		}
+		if len(rec.Roles) != len(want.roles) || !login.HasRoles(rec.Roles, want.roles...) {
+			t.Errorf("expected roles %v for %s, got %v", want.roles, id, rec.Roles)
+		}
+		if rec.PassHash != "c0ffee" || rec.Salt != "5a17" || rec.DateCreated.IsZero() {
+			t.Error("record fields were not decoded:", id, rec)
+		}
+	}
+}
+
+func TestReadFutureVersion(t *testing.T) {
+	db := mock.NewNoSQLClient()
+	db.SetData(login.DetailsCollection, map[string]map[string]interface{}{
+		"future": loadFixture(t, "details_future.json"),
+	})
+	if _, err := login.NewFirestoreRepository(db).GetByID(context.Background(), "future"); err == nil {
+		t.Error("a record written by a newer version of the service should not be decoded")
+	}
+}
+
+func TestUpgradeDetailsCurrentVersion(t *testing.T) {
+	changed, err := login.UpgradeDetails(loadFixture(t, "details_v4.json"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if changed {
+		t.Error("a current version document should not be changed")
+	}
+}
+
+func TestMigrateDetails(t *testing.T) {
+	ctx := context.Background()
+	db := mock.NewNoSQLClient()
+	db.SetData(login.DetailsCollection, map[string]map[string]interface{}{
+		"v0": loadFixture(t, "details_v0.json"),
+		"v1": loadFixture(t, "details_v1.json"),
+		"v2": loadFixture(t, "details_v2.json"),
+		"v3": loadFixture(t, "details_v3.json"),
+		"v4": loadFixture(t, "details_v4.json"),
+	})
+
+	report, err := login.MigrateDetails(ctx, db, true)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if report.Scanned != 5 || report.Migrated != 4 || report.Versions[0] != 1 || report.Versions[4] != 1 {
+		t.Errorf("unexpected dry run report: %+v", report)
+	}
+	doc, _ := db.Read(ctx, login.DetailsCollection, "v0")
+	if _, ok := doc["SchemaVersion"]; ok {
+		t.Error("dry run should not change documents")
+	}
+
+	if _, err = login.MigrateDetails(ctx, db, false); err != nil {
+		t.Error(err)
+		return
+	}
+	doc, _ = db.Read(ctx, login.DetailsCollection, "v0")
+	if v, _ := login.DetailsVersion(doc); v != data.LoginDetailsSchemaVersion || doc["HashAlgorithm"] != login.HashSHA256x1000 || doc["Status"] != "active" {
+		t.Error("document was not migrated:", doc)
+	}
+	// Once migrated a legacy login can be found whatever the case of the username
+	if rec, err := login.NewFirestoreRepository(db).GetByUsername(ctx, "Legacy@Test.com"); err != nil || rec.ID != "v0" {
+		t.Error("migrated login should be found by its canonical username:", rec, err)
+	}
+	report, err = login.MigrateDetails(ctx, db, false)
+	if err != nil || report.Migrated != 0 {
+		t.Error("migrating again should change nothing:", report, err)
+	}
+}
+
+// changingClient changes a login with the repository before the first conditional write, as if a request updated it while it
+// was being migrated
+type changingClient struct {
+	*mock.NoSQLClient
+	change func()
+}
+
+func (c *changingClient) UpdateFieldsIf(ctx context.Context, collection, id, key, value string, fields map[string]interface{}) error {
+	if c.change != nil {
+		c.change()
+		c.change = nil
+	}
+	return c.NoSQLClient.UpdateFieldsIf(ctx, collection, id, key, value, fields)
+}
+
+func TestMigrateDetailsKeepsConcurrentChanges(t *testing.T) {
+	ctx := context.Background()
+	db := mock.NewNoSQLClient()
+	db.SetData(login.DetailsCollection, map[string]map[string]interface{}{"v0": loadFixture(t, "details_v0.json")})
+	repo := login.NewFirestoreRepository(db)
+	client := &changingClient{NoSQLClient: db, change: func() {
+		if err := login.SetStatus(ctx, repo, &mock.PubSubHandler{}, "v0", data.StatusDisabled, "testing", nil); err != nil {
+			t.Error(err)
+		}
+	}}
+
+	if _, err := login.MigrateDetails(ctx, client, false); err != nil {
+		t.Fatal(err)
+	}
+	rec, err := repo.GetByID(ctx, "v0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Status != data.StatusDisabled || rec.SchemaVersion != data.LoginDetailsSchemaVersion {
+		t.Errorf("migration should not overwrite a change made while it ran: %+v", rec.LoginDetails)
+	}
+}
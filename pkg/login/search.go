@@ -0,0 +1,38 @@
+package login
+
+import (
+	"context"
+	"strings"
+)
+
+// searchBatchSize is the number of records read from the repository at a time while searching
+const searchBatchSize = 100
+
+// Search returns up to limit records ordered by ID, starting after the cursor, whose canonical username contains the query. An
+// empty query matches every record. The returned cursor is empty when there are no more records
+func Search(ctx context.Context, repo Repository, query, cursor string, limit int) ([]Record, string, error) {
+	query = CanonicalUsername(query)
+	if query == "" {
+		return repo.List(ctx, cursor, limit)
+	}
+	var matches []Record
+	for {
+		batch, next, err := repo.List(ctx, cursor, searchBatchSize)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, rec := range batch {
+			if !strings.Contains(CanonicalUsername(rec.UserName), query) {
+				continue
+			}
+			matches = append(matches, rec)
+			if limit > 0 && len(matches) == limit {
+				return matches, rec.ID, nil
+			}
+		}
+		if next == "" {
+			return matches, "", nil
+		}
+		cursor = next
+	}
+}
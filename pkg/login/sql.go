@@ -0,0 +1,301 @@
+package login
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/blueambertech-demos/login-svc-gcp/data"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/storage"
+)
+
+var sqlMigrations = []storage.Migration{
+	{
+		Name: "login-0001-logins",
+		Postgres: `CREATE TABLE logins (
+			id TEXT PRIMARY KEY,
+			username TEXT NOT NULL,
+			canonical_username TEXT NOT NULL,
+			pass_hash TEXT NOT NULL,
+			salt TEXT NOT NULL,
+			date_created TIMESTAMPTZ NOT NULL
+		);
+		CREATE UNIQUE INDEX logins_canonical_username ON logins (canonical_username)`,
+		SQLite: `CREATE TABLE logins (
+			id TEXT PRIMARY KEY,
+			username TEXT NOT NULL,
+			canonical_username TEXT NOT NULL,
+			pass_hash TEXT NOT NULL,
+			salt TEXT NOT NULL,
+			date_created TIMESTAMP NOT NULL
+		);
+		CREATE UNIQUE INDEX logins_canonical_username ON logins (canonical_username)`,
+	},
+	{
+		Name:     "login-0002-hash-algorithm",
+		Postgres: `ALTER TABLE logins ADD COLUMN hash_algorithm TEXT NOT NULL DEFAULT '` + HashSHA256x1000 + `'`,
+		SQLite:   `ALTER TABLE logins ADD COLUMN hash_algorithm TEXT NOT NULL DEFAULT '` + HashSHA256x1000 + `'`,
+	},
+	{
+		Name: "login-0003-status",
+		Postgres: `ALTER TABLE logins ADD COLUMN status TEXT NOT NULL DEFAULT 'active',
+			ADD COLUMN status_reason TEXT NOT NULL DEFAULT '',
+			ADD COLUMN status_changed_at TIMESTAMPTZ`,
+		// SQLite can only add one column per statement
+		SQLite: `ALTER TABLE logins ADD COLUMN status TEXT NOT NULL DEFAULT 'active';
+			ALTER TABLE logins ADD COLUMN status_reason TEXT NOT NULL DEFAULT '';
+			ALTER TABLE logins ADD COLUMN status_changed_at TIMESTAMP`,
+	},
+	{
+		// Roles are stored as a comma separated list
+		Name:     "login-0004-roles",
+		Postgres: `ALTER TABLE logins ADD COLUMN roles TEXT NOT NULL DEFAULT '` + data.RoleUser + `'`,
+		SQLite:   `ALTER TABLE logins ADD COLUMN roles TEXT NOT NULL DEFAULT '` + data.RoleUser + `'`,
+	},
+	{
+		Name:     "login-0005-revision",
+		Postgres: `ALTER TABLE logins ADD COLUMN revision TEXT NOT NULL DEFAULT ''`,
+		SQLite:   `ALTER TABLE logins ADD COLUMN revision TEXT NOT NULL DEFAULT ''`,
+	},
+}
+
+const loginColumns = "id, username, pass_hash, salt, date_created, hash_algorithm, status, status_reason, status_changed_at, roles, revision"
+
+// SQLRepository is a Repository that stores login records in the logins table of a PostgreSQL or SQLite database. Usernames are
+// kept unique by a unique index on their canonical form
+type SQLRepository struct {
+	db      *sql.DB
+	dialect storage.Dialect
+}
+
+// NewSQLRepository returns a Repository using the supplied database, any schema migrations that have not been applied are run first
+func NewSQLRepository(ctx context.Context, db *sql.DB, dialect storage.Dialect) (*SQLRepository, error) {
+	if err := storage.Migrate(ctx, db, dialect, sqlMigrations); err != nil {
+		return nil, err
+	}
+	return &SQLRepository{db: db, dialect: dialect}, nil
+}
+
+func (s *SQLRepository) GetByUsername(ctx context.Context, userName string) (*Record, error) {
+	row := s.db.QueryRowContext(ctx, s.dialect.Rebind("SELECT "+loginColumns+" FROM logins WHERE canonical_username = ?"),
+		CanonicalUsername(userName))
+	return scanRecord(row)
+}
+
+func (s *SQLRepository) GetByID(ctx context.Context, id string) (*Record, error) {
+	row := s.db.QueryRowContext(ctx, s.dialect.Rebind("SELECT "+loginColumns+" FROM logins WHERE id = ?"), id)
+	return scanRecord(row)
+}
+
+func (s *SQLRepository) Create(ctx context.Context, details *data.LoginDetails) (string, error) {
+	return s.CreateWith(ctx, details, nil)
+}
+
+// CreateWith inserts the login and the documents returned by with in one transaction, the documents are written to the table
+// used by storage.SQL so that client must have been created with the same database
+func (s *SQLRepository) CreateWith(ctx context.Context, details *data.LoginDetails, with func(id string) ([]storage.Write, error)) (string, error) {
+	id, err := generateID()
+	if err != nil {
+		return "", err
+	}
+	var writes []storage.Write
+	if with != nil {
+		if writes, err = with(id); err != nil {
+			return "", err
+		}
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", &StorageError{Op: "insert login details", Err: err}
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	_, err = tx.ExecContext(ctx, s.dialect.Rebind(`INSERT INTO logins
+		(id, username, canonical_username, pass_hash, salt, date_created, hash_algorithm, status, status_reason, status_changed_at, roles)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		id, details.UserName, CanonicalUsername(details.UserName), details.PassHash, details.Salt, details.DateCreated.UTC(),
+		hashAlgorithm(details), accountStatus(details), details.StatusReason, nullTime(details.StatusChangedAt),
+		strings.Join(accountRoles(details), ","))
+	if s.dialect.IsUniqueViolation(err) {
+		return "", ErrUserExists
+	} else if err != nil {
+		return "", &StorageError{Op: "insert login details", Err: err}
+	}
+	if err = storage.InsertDocuments(ctx, tx, s.dialect, writes...); err != nil {
+		return "", &StorageError{Op: "insert login documents", Err: err}
+	}
+	if err = tx.Commit(); err != nil {
+		return "", &StorageError{Op: "insert login details", Err: err}
+	}
+	return id, nil
+}
+
+// Update replaces the row of a login if its revision has not changed since it was read
+func (s *SQLRepository) Update(ctx context.Context, rec *Record) error {
+	return s.UpdateWith(ctx, rec)
+}
+
+// UpdateWith updates the login in the same way as Update and makes the writes to the table used by storage.SQL in the same
+// transaction
+func (s *SQLRepository) UpdateWith(ctx context.Context, rec *Record, writes ...storage.Write) error {
+	revision, err := generateID()
+	if err != nil {
+		return err
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return &StorageError{Op: "update login details", Err: err}
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	res, err := tx.ExecContext(ctx, s.dialect.Rebind(`UPDATE logins
+		SET username = ?, canonical_username = ?, pass_hash = ?, salt = ?, date_created = ?, hash_algorithm = ?, status = ?,
+		status_reason = ?, status_changed_at = ?, roles = ?, revision = ? WHERE id = ? AND revision = ?`),
+		rec.UserName, CanonicalUsername(rec.UserName), rec.PassHash, rec.Salt, rec.DateCreated.UTC(), hashAlgorithm(&rec.LoginDetails),
+		accountStatus(&rec.LoginDetails), rec.StatusReason, nullTime(rec.StatusChangedAt), strings.Join(rec.AccountRoles(), ","),
+		revision, rec.ID, rec.Revision)
+	if s.dialect.IsUniqueViolation(err) {
+		return ErrUserExists
+	} else if err != nil {
+		return &StorageError{Op: "update login details", Err: err}
+	}
+	if err = requireAffected(res, "update login details"); errors.Is(err, ErrUserNotFound) {
+		// Nothing was updated either because the login doesn't exist or because its revision has changed
+		var exists int
+		err = tx.QueryRowContext(ctx, s.dialect.Rebind("SELECT 1 FROM logins WHERE id = ?"), rec.ID).Scan(&exists)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrUserNotFound
+		} else if err != nil {
+			return &StorageError{Op: "read login details", Err: err}
+		}
+		return ErrConflict
+	} else if err != nil {
+		return err
+	}
+	if err = applyWrites(ctx, tx, s.dialect, writes); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return &StorageError{Op: "update login details", Err: err}
+	}
+	rec.Revision = revision
+	return nil
+}
+
+func (s *SQLRepository) Delete(ctx context.Context, id string) error {
+	return s.DeleteWith(ctx, id)
+}
+
+// DeleteWith deletes the row of a login and makes the writes to the table used by storage.SQL in one transaction
+func (s *SQLRepository) DeleteWith(ctx context.Context, id string, writes ...storage.Write) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return &StorageError{Op: "delete login details", Err: err}
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	res, err := tx.ExecContext(ctx, s.dialect.Rebind("DELETE FROM logins WHERE id = ?"), id)
+	if err != nil {
+		return &StorageError{Op: "delete login details", Err: err}
+	}
+	if err = requireAffected(res, "delete login details"); err != nil {
+		return err
+	}
+	if err = applyWrites(ctx, tx, s.dialect, writes); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return &StorageError{Op: "delete login details", Err: err}
+	}
+	return nil
+}
+
+// applyWrites makes writes to the documents of storage.SQL as part of a change to the logins table
+func applyWrites(ctx context.Context, tx *sql.Tx, dialect storage.Dialect, writes []storage.Write) error {
+	err := storage.ApplyWrites(ctx, tx, dialect, writes...)
+	if errors.Is(err, storage.ErrConflict) {
+		return ErrConflict
+	} else if err != nil {
+		return &StorageError{Op: "write login documents", Err: err}
+	}
+	return nil
+}
+
+func (s *SQLRepository) List(ctx context.Context, cursor string, limit int) ([]Record, string, error) {
+	query := "SELECT " + loginColumns + " FROM logins WHERE id > ? ORDER BY id"
+	args := []interface{}{cursor}
+	if limit > 0 {
+		// Fetch one more than the limit to find out if there is another page
+		query += " LIMIT ?"
+		args = append(args, limit+1)
+	}
+	rows, err := s.db.QueryContext(ctx, s.dialect.Rebind(query), args...)
+	if err != nil {
+		return nil, "", &StorageError{Op: "list login details", Err: err}
+	}
+	defer rows.Close()
+	var records []Record
+	for rows.Next() {
+		rec, err := scanRecord(rows)
+		if err != nil {
+			return nil, "", err
+		}
+		records = append(records, *rec)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, "", &StorageError{Op: "list login details", Err: err}
+	}
+	if limit > 0 && len(records) > limit {
+		return records[:limit], records[limit-1].ID, nil
+	}
+	return records, "", nil
+}
+
+func scanRecord(row interface{ Scan(...interface{}) error }) (*Record, error) {
+	var rec Record
+	var statusChangedAt sql.NullTime
+	var roles string
+	err := row.Scan(&rec.ID, &rec.UserName, &rec.PassHash, &rec.Salt, &rec.DateCreated, &rec.HashAlgorithm, &rec.Status,
+		&rec.StatusReason, &statusChangedAt, &roles, &rec.Revision)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUserNotFound
+	} else if err != nil {
+		return nil, &StorageError{Op: "read login details", Err: err}
+	}
+	// Rows are upgraded by the table migrations so are always at the current version
+	rec.SchemaVersion = data.LoginDetailsSchemaVersion
+	rec.StatusChangedAt = statusChangedAt.Time
+	rec.Roles = strings.Split(roles, ",")
+	return &rec, nil
+}
+
+func accountStatus(d *data.LoginDetails) data.AccountStatus {
+	if d.Status == "" {
+		return data.StatusActive
+	}
+	return d.Status
+}
+
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t.UTC(), Valid: !t.IsZero()}
+}
+
+func hashAlgorithm(d *data.LoginDetails) string {
+	if d.HashAlgorithm == "" {
+		return HashSHA256x1000
+	}
+	return d.HashAlgorithm
+}
+
+func requireAffected(res sql.Result, op string) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return &StorageError{Op: op, Err: err}
+	}
+	if n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
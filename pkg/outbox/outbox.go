@@ -0,0 +1,100 @@
+// Package outbox stores messages in a database collection instead of publishing them straight away, so that a message is
+// never lost when the event queue is unavailable after the change it describes has been saved. A Relay publishes the stored
+// messages in the background, retrying with backoff until they are accepted.
+//
+// Delivery is at least once: a message can be published more than once if the relay stops after publishing it but before
+// removing it, or if two instances relay the same entry. Each entry has an idempotency key that consumers can use to drop
+// duplicates, for event envelopes it is the envelope ID
+package outbox
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/events"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/storage"
+)
+
+// CollectionName is the collection pending messages are stored in
+const CollectionName = "outbox"
+
+// Entry is a message waiting to be published
+type Entry struct {
+	// ID is the idempotency key of the message
+	ID        string
+	TopicID   string
+	Message   string
+	CreatedAt time.Time
+	// Attempts is the number of times publishing has failed, NextAttempt is when the relay will next try
+	Attempts    int
+	NextAttempt time.Time
+	LastError   string
+	// ClaimID is set by the relay that is publishing the entry, see Relay
+	ClaimID string
+}
+
+// Outbox is a pubsub.Handler that writes pushed messages to the outbox collection for a Relay to publish
+type Outbox struct {
+	dbClient storage.Client
+}
+
+// New returns an Outbox that stores messages using the supplied database client
+func New(dbClient storage.Client) *Outbox {
+	return &Outbox{dbClient: dbClient}
+}
+
+// Push stores a message to be published to a topic. Storing the same event envelope twice only publishes it once
+func (o *Outbox) Push(ctx context.Context, topicID, msg string) error {
+	e, err := NewEntry(topicID, msg)
+	if err != nil {
+		return err
+	}
+	err = o.dbClient.InsertWithID(ctx, CollectionName, e.ID, e)
+	if errors.Is(err, storage.ErrAlreadyExists) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("storing outbox entry: %w", err)
+	}
+	return nil
+}
+
+// Write returns the write that stores a message to be published to a topic, for callers that store it with storage.Commit in
+// the same transaction as the change it describes. The client writing it must use the same database as the outbox
+func (o *Outbox) Write(topicID, msg string) (storage.Write, error) {
+	e, err := NewEntry(topicID, msg)
+	if err != nil {
+		return storage.Write{}, err
+	}
+	return storage.Write{Collection: CollectionName, ID: e.ID, Data: e}, nil
+}
+
+// NewEntry returns a new entry for a message that is due to be published straight away
+func NewEntry(topicID, msg string) (*Entry, error) {
+	key, err := idempotencyKey(msg)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	return &Entry{ID: key, TopicID: topicID, Message: msg, CreatedAt: now, NextAttempt: now}, nil
+}
+
+// Subscribe is not supported by the outbox, subscribe with the event queue the relay publishes to
+func (o *Outbox) Subscribe(_ context.Context, _ string, _ time.Duration, _ func(context.Context, []byte)) error {
+	return errors.New("outbox: subscribe is not supported")
+}
+
+// idempotencyKey returns the ID of an event envelope, other messages are given a random key
+func idempotencyKey(msg string) (string, error) {
+	if env, err := events.Parse([]byte(msg)); err == nil {
+		return env.ID, nil
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,221 @@
+package outbox_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/blueambertech-demos/login-svc-gcp/mock"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/events"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/outbox"
+	"github.com/mitchellh/mapstructure"
+)
+
+// fakePublisher records the messages pushed to it and fails while fail is set
+type fakePublisher struct {
+	mu       sync.Mutex
+	fail     bool
+	messages []string
+}
+
+func (p *fakePublisher) Subscribe(_ context.Context, _ string, _ time.Duration, _ func(context.Context, []byte)) error {
+	return nil
+}
+
+func (p *fakePublisher) Push(_ context.Context, _, msg string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.fail {
+		return errors.New("queue unavailable")
+	}
+	p.messages = append(p.messages, msg)
+	return nil
+}
+
+func (p *fakePublisher) published() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.messages...)
+}
+
+func pushEvent(t *testing.T, box *outbox.Outbox) *events.Envelope {
+	t.Helper()
+	env, err := events.New(context.Background(), events.LoginCreated, "user-1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, _ := json.Marshal(env)
+	if err = box.Push(context.Background(), events.TopicID, string(msg)); err != nil {
+		t.Fatal(err)
+	}
+	return env
+}
+
+func TestPushIsIdempotent(t *testing.T) {
+	ctx := context.Background()
+	dbClient := mock.NewNoSQLClient()
+	box := outbox.New(dbClient)
+	env := pushEvent(t, box)
+	msg, _ := json.Marshal(env)
+	if err := box.Push(ctx, events.TopicID, string(msg)); err != nil {
+		t.Error(err)
+	}
+	if err := box.Push(ctx, "other-topic", "not an envelope"); err != nil {
+		t.Error(err)
+	}
+	docs, _ := dbClient.List(ctx, outbox.CollectionName)
+	if len(docs) != 2 {
+		t.Errorf("expected the repeated event to be stored once, got %d entries", len(docs))
+	}
+	if _, ok := docs[env.ID]; !ok {
+		t.Error("event should be stored under its envelope ID")
+	}
+}
+
+func TestRelayRetriesWithBackoff(t *testing.T) {
+	ctx := context.Background()
+	dbClient := mock.NewNoSQLClient()
+	publisher := &fakePublisher{fail: true}
+	relay := outbox.NewRelay(dbClient, publisher)
+	env := pushEvent(t, outbox.New(dbClient))
+
+	if n, err := relay.RelayOnce(ctx); err != nil || n != 0 {
+		t.Errorf("nothing should be published while the queue is down, got %d, %v", n, err)
+	}
+	doc, err := dbClient.Read(ctx, outbox.CollectionName, env.ID)
+	if err != nil {
+		t.Error("failed message should stay in the outbox, got", err)
+		return
+	}
+	var e outbox.Entry
+	_ = mapstructure.Decode(doc, &e)
+	if e.Attempts != 1 || e.LastError == "" || !e.NextAttempt.After(time.Now()) {
+		t.Errorf("failure should be recorded with a delayed next attempt: %+v", e)
+	}
+
+	publisher.fail = false
+	if n, _ := relay.RelayOnce(ctx); n != 0 {
+		t.Error("message should not be retried before its next attempt")
+	}
+	e.NextAttempt = time.Now().Add(-time.Second)
+	_ = dbClient.Update(ctx, outbox.CollectionName, env.ID, &e)
+	if n, err := relay.RelayOnce(ctx); err != nil || n != 1 {
+		t.Errorf("expected the message to be published once due, got %d, %v", n, err)
+	}
+	if _, err = dbClient.Read(ctx, outbox.CollectionName, env.ID); err == nil {
+		t.Error("published message should be removed from the outbox")
+	}
+	if msgs := publisher.published(); len(msgs) != 1 {
+		t.Errorf("expected one published message, got %d", len(msgs))
+	}
+}
+
+func TestRelayStopFlushes(t *testing.T) {
+	dbClient := mock.NewNoSQLClient()
+	publisher := &fakePublisher{}
+	relay := outbox.NewRelay(dbClient, publisher)
+	relay.Interval = time.Hour
+	relay.Start(context.Background())
+
+	// Pushed after the first pass, so only the final pass on Stop publishes it
+	time.Sleep(10 * time.Millisecond)
+	env := pushEvent(t, outbox.New(dbClient))
+	ctx, canc := context.WithTimeout(context.Background(), time.Second)
+	defer canc()
+	if err := relay.Stop(ctx); err != nil {
+		t.Error(err)
+	}
+	msgs := publisher.published()
+	if len(msgs) != 1 {
+		t.Errorf("expected the pending message to be published on stop, got %d", len(msgs))
+		return
+	}
+	if got, err := events.Parse([]byte(msgs[0])); err != nil || got.ID != env.ID {
+		t.Errorf("unexpected published message: %s", msgs[0])
+	}
+}
+
+func TestRelayBatchSize(t *testing.T) {
+	ctx := context.Background()
+	dbClient := mock.NewNoSQLClient()
+	publisher := &fakePublisher{}
+	relay := outbox.NewRelay(dbClient, publisher)
+	relay.BatchSize = 2
+	box := outbox.New(dbClient)
+	first := pushEvent(t, box)
+	for i := 0; i < 2; i++ {
+		pushEvent(t, box)
+	}
+	if n, err := relay.RelayOnce(ctx); err != nil || n != 2 {
+		t.Errorf("expected a batch of 2 to be published, got %d, %v", n, err)
+	}
+	if _, err := dbClient.Read(ctx, outbox.CollectionName, first.ID); err == nil {
+		t.Error("the entry that was due first should be published first")
+	}
+	if n, err := relay.RelayOnce(ctx); err != nil || n != 1 {
+		t.Errorf("expected the rest to be published on the next check, got %d, %v", n, err)
+	}
+}
+
+func TestRelaysClaimEntries(t *testing.T) {
+	ctx := context.Background()
+	dbClient := mock.NewNoSQLClient()
+	publisher := &fakePublisher{}
+	box := outbox.New(dbClient)
+	for i := 0; i < 50; i++ {
+		pushEvent(t, box)
+	}
+
+	// Relays on different instances read the same due entries, each entry is only published by the relay that claims it
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := outbox.NewRelay(dbClient, publisher).RelayOnce(ctx); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	seen := map[string]bool{}
+	for _, msg := range publisher.published() {
+		env, _ := events.Parse([]byte(msg))
+		if seen[env.ID] {
+			t.Errorf("%s was published more than once", env.ID)
+		}
+		seen[env.ID] = true
+	}
+	if len(seen) != 50 {
+		t.Errorf("expected every entry to be published, got %d", len(seen))
+	}
+}
+
+func TestRelayLeaseHidesClaimedEntry(t *testing.T) {
+	ctx := context.Background()
+	dbClient := mock.NewNoSQLClient()
+	env := pushEvent(t, outbox.New(dbClient))
+	// A relay that claimed the entry and stopped before publishing it
+	if err := dbClient.UpdateFieldsIf(ctx, outbox.CollectionName, env.ID, "ClaimID", "", map[string]interface{}{
+		"ClaimID":     "other-relay",
+		"NextAttempt": time.Now().Add(time.Minute),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	publisher := &fakePublisher{}
+	relay := outbox.NewRelay(dbClient, publisher)
+	if n, _ := relay.RelayOnce(ctx); n != 0 {
+		t.Error("a claimed entry should not be published by another relay during the lease")
+	}
+	if err := dbClient.UpdateFields(ctx, outbox.CollectionName, env.ID, map[string]interface{}{
+		"NextAttempt": time.Now().Add(-time.Second),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := relay.RelayOnce(ctx); err != nil || n != 1 {
+		t.Errorf("the entry should be published once the lease is over, got %d, %v", n, err)
+	}
+}
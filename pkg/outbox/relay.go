@@ -0,0 +1,208 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/blueambertech-demos/login-svc-gcp/data"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/storage"
+	"github.com/blueambertech/pubsub"
+	"github.com/mitchellh/mapstructure"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+const (
+	// DefaultInterval is how often the relay checks for messages to publish
+	DefaultInterval = time.Second
+	// DefaultBatchSize is the most messages published on each check
+	DefaultBatchSize = 100
+
+	minBackoff = time.Second
+	maxBackoff = 5 * time.Minute
+
+	// claimLease is how long an entry claimed by a relay is hidden from other relays, the entry of a relay that stops before
+	// publishing it is picked up again once the lease is over
+	claimLease = time.Minute
+)
+
+var (
+	meter               = otel.Meter(data.ServiceName)
+	publishedCounter, _ = meter.Int64Counter("outbox.published",
+		metric.WithDescription("Number of outbox messages published"))
+	failedCounter, _ = meter.Int64Counter("outbox.publish_failures",
+		metric.WithDescription("Number of attempts to publish an outbox message that failed"))
+	lagHistogram, _ = meter.Float64Histogram("outbox.publish_lag",
+		metric.WithDescription("Time from a message being stored to it being published"), metric.WithUnit("s"))
+)
+
+// Relay publishes the messages stored in the outbox to an event queue, messages that fail to publish are retried with
+// exponential backoff. Each check reads only the entries that are due, up to the batch size, and claims each entry before
+// publishing it by moving its next attempt past a lease, so that relays on several instances don't publish the same entries
+type Relay struct {
+	dbClient  storage.Client
+	publisher pubsub.Handler
+
+	// Interval is how often the outbox is checked and BatchSize is the most messages published on each check
+	Interval  time.Duration
+	BatchSize int
+
+	pending atomic.Int64
+	cancel  context.CancelFunc
+	done    chan struct{}
+	mu      sync.Mutex
+}
+
+// NewRelay returns a Relay that publishes the messages in the outbox using the supplied database client to publisher
+func NewRelay(dbClient storage.Client, publisher pubsub.Handler) *Relay {
+	r := &Relay{dbClient: dbClient, publisher: publisher, Interval: DefaultInterval, BatchSize: DefaultBatchSize}
+	_, _ = meter.Int64ObservableGauge("outbox.pending",
+		metric.WithDescription("Number of outbox messages due to be published at the last check, up to the batch size"),
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			o.Observe(r.pending.Load())
+			return nil
+		}))
+	return r
+}
+
+// Start runs the relay in the background until Stop is called
+func (r *Relay) Start(ctx context.Context) {
+	ctx, r.cancel = context.WithCancel(ctx)
+	r.done = make(chan struct{})
+	go func() {
+		defer close(r.done)
+		ticker := time.NewTicker(r.Interval)
+		defer ticker.Stop()
+		for {
+			// Errors are retried on the next tick, failures of individual messages are recorded on the entries
+			_, _ = r.RelayOnce(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop stops the background relay, waiting for the batch in progress, then makes a final pass to publish messages stored
+// since. It returns early if ctx is done first
+func (r *Relay) Stop(ctx context.Context) error {
+	if r.cancel == nil {
+		return nil
+	}
+	r.cancel()
+	select {
+	case <-r.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	_, err := r.RelayOnce(ctx)
+	return err
+}
+
+// RelayOnce publishes the messages that are due, in the order they became due, and returns how many were published. A message
+// that is published is removed from the outbox, one that fails is kept and its next attempt is delayed
+func (r *Relay) RelayOnce(ctx context.Context) (int, error) {
+	// Only one pass runs at a time so Stop's final pass can't publish the same entries as the background loop
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now().UTC()
+	docs, err := r.dbClient.ListBefore(ctx, CollectionName, "NextAttempt", now, r.BatchSize)
+	if err != nil {
+		return 0, fmt.Errorf("listing outbox: %w", err)
+	}
+	r.pending.Store(int64(len(docs)))
+
+	published := 0
+	for _, doc := range docs {
+		if ctx.Err() != nil {
+			return published, ctx.Err()
+		}
+		var e Entry
+		if err = mapstructure.Decode(doc.Data, &e); err != nil {
+			return published, fmt.Errorf("decoding outbox entry %s: %w", doc.ID, err)
+		}
+		e.ID = doc.ID
+		claimed, err := r.claim(ctx, &e, now)
+		if err != nil {
+			return published, err
+		}
+		if !claimed {
+			continue
+		}
+		ok, err := r.publish(ctx, &e)
+		if ok {
+			published++
+		}
+		if err != nil {
+			return published, err
+		}
+	}
+	r.pending.Add(-int64(published))
+	return published, nil
+}
+
+// claim gives an entry a new claim ID and moves its next attempt to the end of the lease, if the claim ID is still the one it
+// was read with. It returns false if another relay claimed or removed the entry first
+func (r *Relay) claim(ctx context.Context, e *Entry, now time.Time) (bool, error) {
+	claimID, err := storage.NewID()
+	if err != nil {
+		return false, err
+	}
+	next := now.Add(claimLease)
+	err = r.dbClient.UpdateFieldsIf(ctx, CollectionName, e.ID, "ClaimID", e.ClaimID, map[string]interface{}{
+		"ClaimID":     claimID,
+		"NextAttempt": next,
+	})
+	if errors.Is(err, storage.ErrConflict) || errors.Is(err, storage.ErrNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("claiming outbox entry %s: %w", e.ID, err)
+	}
+	e.ClaimID, e.NextAttempt = claimID, next
+	return true, nil
+}
+
+// publish publishes one claimed entry and removes it from the outbox, or records the failure and when to try again. It returns
+// true if the message was published, the error is only for a failure to update the outbox
+func (r *Relay) publish(ctx context.Context, e *Entry) (bool, error) {
+	attrs := metric.WithAttributes(attribute.String("topic", e.TopicID))
+	if err := r.publisher.Push(ctx, e.TopicID, e.Message); err != nil {
+		failedCounter.Add(ctx, 1, attrs)
+		e.Attempts++
+		// The failure is not recorded if the lease ran out and another relay has claimed the entry
+		err = r.dbClient.UpdateFieldsIf(ctx, CollectionName, e.ID, "ClaimID", e.ClaimID, map[string]interface{}{
+			"Attempts":    e.Attempts,
+			"NextAttempt": time.Now().Add(backoff(e.Attempts)).UTC(),
+			"LastError":   err.Error(),
+		})
+		if err != nil && !errors.Is(err, storage.ErrNotFound) && !errors.Is(err, storage.ErrConflict) {
+			return false, fmt.Errorf("updating outbox entry %s: %w", e.ID, err)
+		}
+		return false, nil
+	}
+	publishedCounter.Add(ctx, 1, attrs)
+	lagHistogram.Record(ctx, time.Since(e.CreatedAt).Seconds(), attrs)
+	// Another instance may have published and removed the entry already
+	if err := r.dbClient.Delete(ctx, CollectionName, e.ID); err != nil && !errors.Is(err, storage.ErrNotFound) {
+		// The message will be published again, consumers drop it using the idempotency key
+		return true, fmt.Errorf("removing outbox entry %s: %w", e.ID, err)
+	}
+	return true, nil
+}
+
+// backoff returns the delay before the next attempt to publish a message that has failed the given number of times
+func backoff(attempts int) time.Duration {
+	d := minBackoff << (attempts - 1)
+	if d > maxBackoff || d <= 0 {
+		return maxBackoff
+	}
+	return d
+}
@@ -0,0 +1,131 @@
+package reconcile
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/blueambertech-demos/login-svc-gcp/data"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/login"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/session"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/storage"
+	"github.com/mitchellh/mapstructure"
+)
+
+// DisabledCollection holds the duplicate login records removed by ActionDisable so they can be reviewed or restored
+const DisabledCollection = "details-disabled"
+
+type Action string
+
+const (
+	// ActionReport only reports duplicates
+	ActionReport Action = "report"
+	// ActionDelete keeps the oldest record for each username and deletes the others without keeping a copy, nothing from the
+	// deleted records is carried over to the one that is kept
+	ActionDelete Action = "delete"
+	// ActionDisable keeps the oldest record for each username and moves the others to DisabledCollection
+	ActionDisable Action = "disable"
+)
+
+type Record struct {
+	ID          string    `json:"id"`
+	UserName    string    `json:"userName"`
+	DateCreated time.Time `json:"dateCreated"`
+	Kept        bool      `json:"kept"`
+}
+
+type Duplicate struct {
+	Username string   `json:"username"`
+	Records  []Record `json:"records"`
+}
+
+type Report struct {
+	Action     Action      `json:"action"`
+	DryRun     bool        `json:"dryRun"`
+	Scanned    int         `json:"scanned"`
+	Duplicates []Duplicate `json:"duplicates"`
+}
+
+// ParseAction validates an action name
+func ParseAction(s string) (Action, error) {
+	switch a := Action(s); a {
+	case ActionReport, ActionDelete, ActionDisable:
+		return a, nil
+	}
+	return "", fmt.Errorf("unknown action %q, must be one of report, delete or disable", s)
+}
+
+// Run scans the login details collection for records that share a canonical username, the same key login.Repository looks
+// usernames up by, and applies the action to each group of duplicates. The oldest record in a group is kept, nothing is
+// changed when dryRun is set
+func Run(ctx context.Context, dbClient storage.Client, action Action, dryRun bool) (*Report, error) {
+	docs, err := dbClient.List(ctx, login.DetailsCollection)
+	if err != nil {
+		return nil, err
+	}
+	groups := map[string][]Record{}
+	for id, doc := range docs {
+		var d data.LoginDetails
+		if err = mapstructure.Decode(doc, &d); err != nil {
+			return nil, fmt.Errorf("decoding login details %s: %w", id, err)
+		}
+		canonical := login.CanonicalUsername(d.UserName)
+		groups[canonical] = append(groups[canonical], Record{ID: id, UserName: d.UserName, DateCreated: d.DateCreated})
+	}
+
+	report := &Report{Action: action, DryRun: dryRun, Scanned: len(docs), Duplicates: []Duplicate{}}
+	for canonical, records := range groups {
+		if len(records) < 2 {
+			continue
+		}
+		sort.Slice(records, func(i, j int) bool {
+			if records[i].DateCreated.Equal(records[j].DateCreated) {
+				return records[i].ID < records[j].ID
+			}
+			return records[i].DateCreated.Before(records[j].DateCreated)
+		})
+		records[0].Kept = true
+		report.Duplicates = append(report.Duplicates, Duplicate{Username: canonical, Records: records})
+	}
+	sort.Slice(report.Duplicates, func(i, j int) bool {
+		return report.Duplicates[i].Username < report.Duplicates[j].Username
+	})
+
+	if dryRun || action == ActionReport {
+		return report, nil
+	}
+	for _, dup := range report.Duplicates {
+		if err = resolve(ctx, dbClient, action, dup, docs); err != nil {
+			return report, fmt.Errorf("resolving duplicates of %s: %w", dup.Username, err)
+		}
+	}
+	return report, nil
+}
+
+func resolve(ctx context.Context, dbClient storage.Client, action Action, dup Duplicate, docs map[string]map[string]interface{}) error {
+	kept := dup.Records[0]
+	for _, r := range dup.Records[1:] {
+		if action == ActionDisable {
+			err := dbClient.InsertWithID(ctx, DisabledCollection, r.ID, docs[r.ID])
+			if err != nil && !errors.Is(err, storage.ErrAlreadyExists) {
+				return err
+			}
+		}
+		if err := dbClient.Delete(ctx, login.DetailsCollection, r.ID); err != nil {
+			return err
+		}
+		if _, err := session.RevokeAll(ctx, dbClient, r.ID); err != nil {
+			return err
+		}
+	}
+
+	// Make sure the username is reserved for the record that was kept
+	reservation := data.UsernameReservation{UserID: kept.ID, DateCreated: kept.DateCreated}
+	err := dbClient.InsertWithID(ctx, login.UsernamesCollection, dup.Username, &reservation)
+	if errors.Is(err, storage.ErrAlreadyExists) {
+		return dbClient.Update(ctx, login.UsernamesCollection, dup.Username, &reservation)
+	}
+	return err
+}
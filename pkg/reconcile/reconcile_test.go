@@ -0,0 +1,123 @@
+package reconcile
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/blueambertech-demos/login-svc-gcp/mock"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/login"
+)
+
+var fakeDbClient *mock.NoSQLClient
+
+func TestMain(m *testing.M) {
+	fakeDbClient = mock.NewNoSQLClient()
+	m.Run()
+}
+
+func TestRunReport(t *testing.T) {
+	defer fakeDbClient.ClearData()
+	seedDuplicates()
+	report, err := Run(context.Background(), fakeDbClient, ActionReport, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if report.Scanned != 4 || len(report.Duplicates) != 1 {
+		t.Errorf("expected 1 duplicate from 4 records, got %d from %d", len(report.Duplicates), report.Scanned)
+		return
+	}
+	dup := report.Duplicates[0]
+	if dup.Username != "dup@test.com" || len(dup.Records) != 3 || dup.Records[0].ID != "oldest" || !dup.Records[0].Kept {
+		t.Errorf("incorrect duplicate report: %+v", dup)
+	}
+	if n := countDocs(login.DetailsCollection); n != 4 {
+		t.Errorf("report should not change data, %d records left", n)
+	}
+}
+
+func TestRunDryRun(t *testing.T) {
+	defer fakeDbClient.ClearData()
+	seedDuplicates()
+	if _, err := Run(context.Background(), fakeDbClient, ActionDelete, true); err != nil {
+		t.Error(err)
+		return
+	}
+	if n := countDocs(login.DetailsCollection); n != 4 {
+		t.Errorf("dry run should not change data, %d records left", n)
+	}
+}
+
+func TestRunDelete(t *testing.T) {
+	defer fakeDbClient.ClearData()
+	seedDuplicates()
+	ctx := context.Background()
+	if _, err := Run(ctx, fakeDbClient, ActionDelete, false); err != nil {
+		t.Error(err)
+		return
+	}
+	if n := countDocs(login.DetailsCollection); n != 2 {
+		t.Errorf("expected 2 records after delete, got %d", n)
+	}
+	if ok, _ := fakeDbClient.Exists(ctx, login.DetailsCollection, "oldest"); !ok {
+		t.Error("oldest record should be kept")
+	}
+	assertReservation(t, "dup@test.com", "oldest")
+}
+
+func TestRunDisable(t *testing.T) {
+	defer fakeDbClient.ClearData()
+	seedDuplicates()
+	ctx := context.Background()
+	if _, err := Run(ctx, fakeDbClient, ActionDisable, false); err != nil {
+		t.Error(err)
+		return
+	}
+	if n := countDocs(login.DetailsCollection); n != 2 {
+		t.Errorf("expected 2 records after disable, got %d", n)
+	}
+	if n := countDocs(DisabledCollection); n != 2 {
+		t.Errorf("expected 2 disabled records, got %d", n)
+	}
+	assertReservation(t, "dup@test.com", "oldest")
+}
+
+func TestParseAction(t *testing.T) {
+	if _, err := ParseAction("delete"); err != nil {
+		t.Error(err)
+	}
+	if _, err := ParseAction("merge"); err == nil {
+		t.Error("unknown action should be rejected")
+	}
+}
+
+func seedDuplicates() {
+	base := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	fakeDbClient.SetData(login.DetailsCollection, map[string]map[string]interface{}{
+		"oldest": {"UserName": "dup@test.com", "PassHash": "a", "Salt": "a", "DateCreated": base},
+		"newer":  {"UserName": "Dup@Test.com", "PassHash": "b", "Salt": "b", "DateCreated": base.Add(time.Hour)},
+		"newest": {"UserName": "dup@test.com", "PassHash": "c", "Salt": "c", "DateCreated": base.Add(2 * time.Hour)},
+		"single": {"UserName": "single@test.com", "PassHash": "d", "Salt": "d", "DateCreated": base},
+	})
+	fakeDbClient.SetData(login.UsernamesCollection, map[string]map[string]interface{}{
+		"dup@test.com": {"UserID": "newest", "DateCreated": base},
+	})
+}
+
+func countDocs(collection string) int {
+	docs, _ := fakeDbClient.List(context.Background(), collection)
+	return len(docs)
+}
+
+func assertReservation(t *testing.T, username, userID string) {
+	t.Helper()
+	doc, err := fakeDbClient.Read(context.Background(), login.UsernamesCollection, username)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if doc["UserID"] != userID {
+		t.Errorf("username reserved for %v, expected %s", doc["UserID"], userID)
+	}
+}
@@ -0,0 +1,123 @@
+// Package redact removes sensitive values from structs before they are logged, traced or written to output. A struct field is
+// sensitive when it is tagged `redact:"true"`
+package redact
+
+import (
+	"fmt"
+	"log/slog"
+	"reflect"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Placeholder replaces the value of sensitive string fields
+const Placeholder = "[REDACTED]"
+
+// Copy returns a copy of v with every sensitive field replaced, string fields are set to Placeholder and fields of other types
+// to their zero value. Nested structs and pointers to structs are redacted too, v itself is never modified
+func Copy[T any](v T) T {
+	rv := reflect.ValueOf(&v).Elem()
+	redactValue(rv)
+	return v
+}
+
+// Field is the name and redacted value of an exported struct field
+type Field struct {
+	Name  string
+	Value interface{}
+}
+
+// Fields returns the exported fields of a struct, or pointer to a struct, in declaration order with sensitive fields redacted
+func Fields(v interface{}) []Field {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Pointer {
+		if rv.IsNil() {
+			return nil
+		}
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return nil
+	}
+	cp := reflect.New(rv.Type()).Elem()
+	cp.Set(rv)
+	redactValue(cp)
+
+	t := cp.Type()
+	fields := make([]Field, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		if !t.Field(i).IsExported() {
+			continue
+		}
+		fields = append(fields, Field{Name: t.Field(i).Name, Value: cp.Field(i).Interface()})
+	}
+	return fields
+}
+
+// LogValue returns a slog group of the redacted fields of a struct, it can be used to implement slog.LogValuer
+func LogValue(v interface{}) slog.Value {
+	fields := Fields(v)
+	attrs := make([]slog.Attr, len(fields))
+	for i, f := range fields {
+		attrs[i] = slog.Any(f.Name, f.Value)
+	}
+	return slog.GroupValue(attrs...)
+}
+
+// Attributes returns the redacted fields of a struct as trace span attributes, each key is the field name after the prefix
+func Attributes(prefix string, v interface{}) []attribute.KeyValue {
+	fields := Fields(v)
+	attrs := make([]attribute.KeyValue, len(fields))
+	for i, f := range fields {
+		key := prefix + "." + f.Name
+		switch fv := f.Value.(type) {
+		case string:
+			attrs[i] = attribute.String(key, fv)
+		case bool:
+			attrs[i] = attribute.Bool(key, fv)
+		case int:
+			attrs[i] = attribute.Int(key, fv)
+		case int64:
+			attrs[i] = attribute.Int64(key, fv)
+		case float64:
+			attrs[i] = attribute.Float64(key, fv)
+		case time.Time:
+			attrs[i] = attribute.String(key, fv.Format(time.RFC3339Nano))
+		default:
+			attrs[i] = attribute.String(key, fmt.Sprint(fv))
+		}
+	}
+	return attrs
+}
+
+func redactValue(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() || v.Elem().Kind() != reflect.Struct {
+			return
+		}
+		// Point at a copy so that the original struct is left alone
+		cp := reflect.New(v.Elem().Type())
+		cp.Elem().Set(v.Elem())
+		redactValue(cp.Elem())
+		v.Set(cp)
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := v.Field(i)
+			if !f.CanSet() {
+				continue
+			}
+			if t.Field(i).Tag.Get("redact") == "true" {
+				if f.Kind() == reflect.String {
+					f.SetString(Placeholder)
+				} else {
+					f.Set(reflect.Zero(f.Type()))
+				}
+				continue
+			}
+			redactValue(f)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package redact
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+type secretDoc struct {
+	Name   string
+	Secret string `redact:"true"`
+	Pin    int    `redact:"true"`
+	Inner  innerDoc
+	Ptr    *innerDoc
+	hidden string
+}
+
+type innerDoc struct {
+	Token string `redact:"true"`
+}
+
+func newSecretDoc() secretDoc {
+	return secretDoc{
+		Name:   "name",
+		Secret: "s3cret",
+		Pin:    1234,
+		Inner:  innerDoc{Token: "inner-t0ken"},
+		Ptr:    &innerDoc{Token: "ptr-t0ken"},
+		hidden: "unexported",
+	}
+}
+
+var secrets = []string{"s3cret", "1234", "inner-t0ken", "ptr-t0ken"}
+
+func assertRedacted(t *testing.T, out string) {
+	t.Helper()
+	for _, s := range secrets {
+		if strings.Contains(out, s) {
+			t.Errorf("output contains secret %q: %s", s, out)
+		}
+	}
+	if !strings.Contains(out, "name") {
+		t.Error("output is missing fields that are not sensitive:", out)
+	}
+}
+
+func TestCopy(t *testing.T) {
+	d := newSecretDoc()
+	c := Copy(d)
+	j, _ := json.Marshal(c)
+	assertRedacted(t, string(j))
+	if c.Secret != Placeholder || c.Pin != 0 {
+		t.Error("sensitive fields were not replaced:", c)
+	}
+	if d.Secret != "s3cret" || d.Ptr.Token != "ptr-t0ken" {
+		t.Error("the original value should not be modified")
+	}
+}
+
+func TestCopyPointer(t *testing.T) {
+	d := newSecretDoc()
+	c := Copy(&d)
+	if c == &d || d.Secret != "s3cret" {
+		t.Error("the original value should not be modified")
+	}
+	j, _ := json.Marshal(c)
+	assertRedacted(t, string(j))
+}
+
+func TestLogValue(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+	logger.Info("test", "doc", LogValue(newSecretDoc()))
+	assertRedacted(t, buf.String())
+}
+
+func TestAttributes(t *testing.T) {
+	attrs := Attributes("doc", newSecretDoc())
+	var out []string
+	for _, a := range attrs {
+		out = append(out, fmt.Sprintf("%s=%s", a.Key, a.Value.Emit()))
+	}
+	assertRedacted(t, strings.Join(out, " "))
+	if len(attrs) != 5 || attrs[0].Key != "doc.Name" {
+		t.Error("unexpected attributes:", out)
+	}
+}
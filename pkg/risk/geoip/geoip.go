@@ -0,0 +1,101 @@
+// Package geoip locates IP addresses using a local MaxMind DB (MMDB) file such as GeoLite2-City, it implements risk.Locator.
+// The file is decoded with github.com/oschwald/maxminddb-golang, it is read into memory once and never changed
+package geoip
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/risk"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// ErrInvalidDatabase is returned for a file that is not a MaxMind DB or is corrupt
+var ErrInvalidDatabase = errors.New("geoip: invalid database")
+
+// Reader looks up addresses in an MMDB file held in memory, it is safe for concurrent use
+type Reader struct {
+	db *maxminddb.Reader
+}
+
+// cityLocation is the part of a GeoIP2 or GeoLite2 City record used to locate an address
+type cityLocation struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	Location struct {
+		Latitude  *float64 `maxminddb:"latitude"`
+		Longitude *float64 `maxminddb:"longitude"`
+	} `maxminddb:"location"`
+}
+
+// Open reads the database at path
+func Open(path string) (*Reader, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return New(buf)
+}
+
+// New returns a Reader for a database already in memory
+func New(buf []byte) (*Reader, error) {
+	db, err := maxminddb.FromBytes(buf)
+	if err != nil {
+		return nil, invalid(err)
+	}
+	if v := db.Metadata.IPVersion; v != 4 && v != 6 {
+		return nil, fmt.Errorf("%w: unsupported IP version %d", ErrInvalidDatabase, v)
+	}
+	return &Reader{db: db}, nil
+}
+
+// Locate returns the location of an IP address, it returns nil if the address is not in the database or its record has no
+// coordinates
+func (r *Reader) Locate(ip string) (*risk.Location, error) {
+	addr, ok := r.address(net.ParseIP(ip))
+	if !ok {
+		return nil, nil
+	}
+	var rec cityLocation
+	if err := r.db.Lookup(addr, &rec); err != nil {
+		return nil, invalid(err)
+	}
+	if rec.Location.Latitude == nil || rec.Location.Longitude == nil {
+		return nil, nil
+	}
+	return &risk.Location{Country: rec.Country.ISOCode, Latitude: *rec.Location.Latitude, Longitude: *rec.Location.Longitude}, nil
+}
+
+// Lookup returns the record for an IP address decoded into maps, slices and scalar values, or nil if the address is not in
+// the database
+func (r *Reader) Lookup(ip net.IP) (map[string]interface{}, error) {
+	addr, ok := r.address(ip)
+	if !ok {
+		return nil, nil
+	}
+	var rec map[string]interface{}
+	if err := r.db.Lookup(addr, &rec); err != nil {
+		return nil, invalid(err)
+	}
+	return rec, nil
+}
+
+// address returns the form of ip to look up, ok is false for a missing address or an IPv6 address in an IPv4 database, which
+// can't be found
+func (r *Reader) address(ip net.IP) (net.IP, bool) {
+	if ip == nil {
+		return nil, false
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4, true
+	}
+	return ip, r.db.Metadata.IPVersion == 6
+}
+
+// invalid wraps an error reading the database in ErrInvalidDatabase
+func invalid(err error) error {
+	return fmt.Errorf("%w: %v", ErrInvalidDatabase, err)
+}
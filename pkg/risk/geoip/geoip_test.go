@@ -0,0 +1,321 @@
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// metadataMarker starts the metadata section at the end of the file, dataSeparator is the number of zero bytes between the
+// search tree and the data section
+var metadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+const dataSeparator = 16
+
+type testNetwork struct {
+	cidr   string
+	record map[string]interface{}
+}
+
+var testNetworks = []testNetwork{
+	{"81.2.69.0/24", cityRecord("GB", 51.5142, -0.0931)},
+	{"175.16.199.0/24", cityRecord("CN", 43.88, 125.3228)},
+	{"2001:db8::/32", cityRecord("US", 37.751, -97.822)},
+	{"89.160.20.112/28", map[string]interface{}{"country": map[string]interface{}{"iso_code": "SE"}}},
+}
+
+// corruptNetwork has a record that is a pointer to itself
+var corruptNetwork = testNetwork{cidr: "198.51.100.0/24"}
+
+func cityRecord(country string, lat, lon float64) map[string]interface{} {
+	return map[string]interface{}{
+		"country":  map[string]interface{}{"iso_code": country, "names": map[string]interface{}{"en": country}},
+		"location": map[string]interface{}{"latitude": lat, "longitude": lon, "accuracy_radius": uint64(100)},
+		"subdivisions": []interface{}{
+			map[string]interface{}{"iso_code": "X"},
+		},
+	}
+}
+
+func TestLocate(t *testing.T) {
+	for _, tc := range []struct {
+		ipVersion, recordSize int
+	}{{4, 24}, {6, 24}, {6, 28}, {6, 32}} {
+		networks := testNetworks
+		if tc.ipVersion == 4 {
+			networks = networks[:2]
+		}
+		r, err := New(buildDB(t, tc.ipVersion, tc.recordSize, networks))
+		if err != nil {
+			t.Fatal(err)
+		}
+		loc, err := r.Locate("81.2.69.160")
+		if err != nil || loc == nil {
+			t.Fatalf("IPv%d/%d: expected a location, got %v %v", tc.ipVersion, tc.recordSize, loc, err)
+		}
+		if loc.Country != "GB" || loc.Latitude != 51.5142 || loc.Longitude != -0.0931 {
+			t.Errorf("IPv%d/%d: unexpected location %+v", tc.ipVersion, tc.recordSize, loc)
+		}
+		if loc, _ = r.Locate("175.16.199.1"); loc == nil || loc.Country != "CN" {
+			t.Errorf("IPv%d/%d: unexpected location %+v", tc.ipVersion, tc.recordSize, loc)
+		}
+		for _, ip := range []string{"10.0.0.1", "81.2.70.1", "not an ip"} {
+			if loc, err = r.Locate(ip); loc != nil || err != nil {
+				t.Errorf("IPv%d/%d: %s should not be found, got %+v %v", tc.ipVersion, tc.recordSize, ip, loc, err)
+			}
+		}
+		if tc.ipVersion == 6 {
+			if loc, _ = r.Locate("2001:db8::1"); loc == nil || loc.Country != "US" {
+				t.Errorf("IPv6/%d: unexpected location %+v", tc.recordSize, loc)
+			}
+			// A record without coordinates can't be used to measure distances
+			if loc, err = r.Locate("89.160.20.120"); loc != nil || err != nil {
+				t.Errorf("IPv6/%d: a record without a location should not be returned, got %+v %v", tc.recordSize, loc, err)
+			}
+		}
+	}
+}
+
+func TestLookupFollowsPointers(t *testing.T) {
+	r, err := New(buildDB(t, 4, 24, testNetworks[:2]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, err := r.Lookup(net.ParseIP("81.2.69.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := rec["country"].(map[string]interface{})["names"].(map[string]interface{})
+	if names["en"] != "shared" {
+		t.Errorf("country names should be read through the pointer, got %v", names)
+	}
+	location := rec["location"].(map[string]interface{})
+	if location["accuracy_radius"] != uint64(100) {
+		t.Errorf("unexpected accuracy radius %v", location["accuracy_radius"])
+	}
+	if subs, _ := rec["subdivisions"].([]interface{}); len(subs) != 1 {
+		t.Errorf("unexpected subdivisions %v", rec["subdivisions"])
+	}
+}
+
+func TestOpen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := os.WriteFile(path, buildDB(t, 6, 28, testNetworks), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	r, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loc, _ := r.Locate("81.2.69.1"); loc == nil {
+		t.Error("expected a location")
+	}
+	if _, err = Open(filepath.Join(t.TempDir(), "missing.mmdb")); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
+
+func TestInvalidDatabase(t *testing.T) {
+	valid := buildDB(t, 4, 24, testNetworks[:2])
+	for name, buf := range map[string][]byte{
+		"empty":     nil,
+		"truncated": valid[len(valid)-20:],
+		"no tree":   append([]byte{}, valid[bytes.LastIndex(valid, metadataMarker):]...),
+	} {
+		if _, err := New(buf); !errors.Is(err, ErrInvalidDatabase) {
+			t.Errorf("%s: expected ErrInvalidDatabase, got %v", name, err)
+		}
+	}
+
+	// A record that points to itself must not be followed forever
+	r, err := New(buildDB(t, 4, 24, append(testNetworks[:2:2], corruptNetwork)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = r.Locate("198.51.100.1"); !errors.Is(err, ErrInvalidDatabase) {
+		t.Errorf("expected ErrInvalidDatabase for a pointer to a pointer, got %v", err)
+	}
+	if loc, err := r.Locate("81.2.69.1"); err != nil || loc == nil {
+		t.Errorf("valid records should still be found, got %+v %v", loc, err)
+	}
+}
+
+// buildDB writes a database containing networks in the MaxMind DB format
+func buildDB(t *testing.T, ipVersion, recordSize int, networks []testNetwork) []byte {
+	t.Helper()
+	w := &dbWriter{}
+	// Every record shares the same country names map through a pointer, as real databases do
+	shared := w.data.Len()
+	w.encode(map[string]interface{}{"en": "shared"})
+
+	// Records in the tree are either a node index, or dataRef-k for the kth record, or empty
+	const empty, dataRef = -1, -2
+	nodes := [][2]int{{empty, empty}}
+	var offsets []int
+	for k, n := range networks {
+		_, ipNet, err := net.ParseCIDR(n.cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ip := ipNet.IP
+		ones, _ := ipNet.Mask.Size()
+		if ip4 := ip.To4(); ip4 != nil && ipVersion == 6 {
+			ip, ones = append(make(net.IP, 12), ip4...), ones+96
+		} else if ip4 != nil {
+			ip = ip4
+		}
+		node := 0
+		for i := 0; i < ones; i++ {
+			bit := int(ip[i/8]>>(7-uint(i%8))) & 1
+			if i == ones-1 {
+				nodes[node][bit] = dataRef - k
+				break
+			}
+			if nodes[node][bit] == empty {
+				nodes = append(nodes, [2]int{empty, empty})
+				nodes[node][bit] = len(nodes) - 1
+			}
+			node = nodes[node][bit]
+		}
+		offset := w.data.Len()
+		offsets = append(offsets, offset)
+		if n.record == nil {
+			w.pointer(offset)
+			continue
+		}
+		w.encodeRecord(n.record, shared)
+	}
+
+	var tree []byte
+	for _, n := range nodes {
+		var values [2]uint32
+		for bit, v := range n {
+			switch {
+			case v == empty:
+				values[bit] = uint32(len(nodes))
+			case v <= dataRef:
+				values[bit] = uint32(len(nodes) + dataSeparator + offsets[dataRef-v])
+			default:
+				values[bit] = uint32(v)
+			}
+		}
+		switch recordSize {
+		case 24:
+			tree = append(tree, byte(values[0]>>16), byte(values[0]>>8), byte(values[0]),
+				byte(values[1]>>16), byte(values[1]>>8), byte(values[1]))
+		case 28:
+			tree = append(tree, byte(values[0]>>16), byte(values[0]>>8), byte(values[0]),
+				byte(values[0]>>20)&0xf0|byte(values[1]>>24)&0x0f, byte(values[1]>>16), byte(values[1]>>8), byte(values[1]))
+		default:
+			tree = binary.BigEndian.AppendUint32(tree, values[0])
+			tree = binary.BigEndian.AppendUint32(tree, values[1])
+		}
+	}
+
+	meta := &dbWriter{}
+	meta.encode(map[string]interface{}{
+		"binary_format_major_version": uint64(2),
+		"binary_format_minor_version": uint64(0),
+		"node_count":                  uint64(len(nodes)),
+		"record_size":                 uint64(recordSize),
+		"ip_version":                  uint64(ipVersion),
+		"database_type":               "Test-City",
+		"languages":                   []interface{}{"en"},
+	})
+	buf := append(tree, make([]byte, dataSeparator)...)
+	buf = append(buf, w.data.Bytes()...)
+	buf = append(buf, metadataMarker...)
+	return append(buf, meta.data.Bytes()...)
+}
+
+type dbWriter struct {
+	data bytes.Buffer
+}
+
+// encodeRecord encodes a record with the names of its country replaced by a pointer to shared
+func (w *dbWriter) encodeRecord(rec map[string]interface{}, shared int) {
+	w.control(7, len(rec))
+	for _, k := range sortedKeys(rec) {
+		w.encode(k)
+		country, ok := rec[k].(map[string]interface{})
+		if k != "country" || !ok || country["names"] == nil {
+			w.encode(rec[k])
+			continue
+		}
+		w.control(7, len(country))
+		for _, ck := range sortedKeys(country) {
+			w.encode(ck)
+			if ck == "names" {
+				w.pointer(shared)
+				continue
+			}
+			w.encode(country[ck])
+		}
+	}
+}
+
+// pointer writes a pointer to the field at offset in the data section, offsets up to 2047 are supported
+func (w *dbWriter) pointer(offset int) {
+	w.data.Write([]byte{1<<5 | byte(offset>>8)&7, byte(offset)})
+}
+
+func (w *dbWriter) encode(v interface{}) {
+	switch t := v.(type) {
+	case string:
+		w.control(2, len(t))
+		w.data.WriteString(t)
+	case float64:
+		w.control(3, 8)
+		_ = binary.Write(&w.data, binary.BigEndian, math.Float64bits(t))
+	case uint64:
+		w.control(6, 4)
+		_ = binary.Write(&w.data, binary.BigEndian, uint32(t))
+	case map[string]interface{}:
+		w.control(7, len(t))
+		for _, k := range sortedKeys(t) {
+			w.encode(k)
+			w.encode(t[k])
+		}
+	case []interface{}:
+		w.control(11, len(t))
+		for _, e := range t {
+			w.encode(e)
+		}
+	}
+}
+
+// control writes the control byte of a field, types above 7 are extended and sizes from 29 use extra bytes
+func (w *dbWriter) control(typ, size int) {
+	var ext []byte
+	ctrl := byte(typ) << 5
+	if typ > 7 {
+		ctrl, ext = 0, []byte{byte(typ - 7)}
+	}
+	switch {
+	case size < 29:
+		ctrl |= byte(size)
+	case size < 285:
+		ctrl |= 29
+		ext = append(ext, byte(size-29))
+	default:
+		ctrl |= 30
+		ext = append(ext, byte((size-285)>>8), byte(size-285))
+	}
+	w.data.WriteByte(ctrl)
+	w.data.Write(ext)
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
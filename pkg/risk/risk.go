@@ -0,0 +1,130 @@
+// Package risk scores login attempts for signs that they are not being made by the owner of the account, such as an unfamiliar
+// device, travel since the last login that would be impossible, or a burst of failed attempts. Each check is a Rule so that
+// deployments can choose and tune their own. Rules only look at the Attempt they are given, which the caller fills in from the
+// request and the account history, so they can be tested with fixed inputs
+package risk
+
+import "time"
+
+// Decision is what should happen to a scored login attempt
+type Decision string
+
+const (
+	Allow Decision = "allow"
+	// StepUp means the attempt should only succeed once the user has completed a second factor
+	StepUp Decision = "step_up"
+	Block  Decision = "block"
+)
+
+// Location is where an IP address is, as found by a Locator
+type Location struct {
+	Country   string  `json:"country,omitempty"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// Locator finds the location of an IP address, it returns nil without an error when the address is not known
+type Locator interface {
+	Locate(ip string) (*Location, error)
+}
+
+// Login is a previous successful login to the account
+type Login struct {
+	Time      time.Time
+	IP        string
+	UserAgent string
+	DeviceID  string
+	// Location is nil when it was not known
+	Location *Location
+}
+
+// Attempt is a login attempt with valid credentials and what is known about the account, it is the only input to rules
+type Attempt struct {
+	UserID    string
+	Time      time.Time
+	IP        string
+	UserAgent string
+	// DeviceID identifies the client from a long lived cookie, it is empty when the client has not been given one
+	DeviceID string
+	// Location is where the IP is, nil when it is not known
+	Location *Location
+	// History is the previous logins to the account, most recent first
+	History []Login
+	// AccountFailures is the number of recent failed logins to the account
+	AccountFailures int
+	// IPFailures is the number of recent failed logins from the IP and IPUsernames the number of different usernames they were for
+	IPFailures  int
+	IPUsernames int
+}
+
+// LastLogin returns the most recent previous login, or nil if this is the first
+func (a *Attempt) LastLogin() *Login {
+	if len(a.History) == 0 {
+		return nil
+	}
+	return &a.History[0]
+}
+
+// Rule is a single check of a login attempt
+type Rule interface {
+	// Name identifies the rule in signals, it should not change once deployed
+	Name() string
+	// Evaluate returns the score the rule adds to the attempt and the reason, a score of 0 means nothing was found
+	Evaluate(a *Attempt) (int, string)
+}
+
+// Signal is a rule that found something in an attempt
+type Signal struct {
+	Rule   string `json:"rule"`
+	Score  int    `json:"score"`
+	Reason string `json:"reason"`
+}
+
+// Assessment is the result of scoring an attempt
+type Assessment struct {
+	Score    int      `json:"score"`
+	Decision Decision `json:"decision"`
+	// Suspicious is true when the score reached the SuspiciousScore of the Engine or the attempt was not allowed, suspicious
+	// attempts should be reported
+	Suspicious bool     `json:"suspicious"`
+	Signals    []Signal `json:"signals,omitempty"`
+}
+
+// Engine scores attempts with a set of rules. The score of an attempt is the sum of the scores of its signals, and the
+// thresholds decide what is done about it. A threshold of 0 is disabled
+type Engine struct {
+	Rules           []Rule
+	SuspiciousScore int
+	StepUpScore     int
+	BlockScore      int
+}
+
+// NewEngine returns an engine using DefaultRules that reports suspicious attempts but allows all of them
+func NewEngine() *Engine {
+	return &Engine{Rules: DefaultRules(), SuspiciousScore: 30}
+}
+
+// Assess runs every rule against the attempt
+func (e *Engine) Assess(a *Attempt) *Assessment {
+	result := &Assessment{Decision: Allow}
+	for _, rule := range e.Rules {
+		score, reason := rule.Evaluate(a)
+		if score == 0 {
+			continue
+		}
+		result.Score += score
+		result.Signals = append(result.Signals, Signal{Rule: rule.Name(), Score: score, Reason: reason})
+	}
+	switch {
+	case reached(result.Score, e.BlockScore):
+		result.Decision = Block
+	case reached(result.Score, e.StepUpScore):
+		result.Decision = StepUp
+	}
+	result.Suspicious = result.Decision != Allow || reached(result.Score, e.SuspiciousScore)
+	return result
+}
+
+func reached(score, threshold int) bool {
+	return threshold > 0 && score >= threshold
+}
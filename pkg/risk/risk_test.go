@@ -0,0 +1,142 @@
+package risk
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+var (
+	now    = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	london = &Location{Country: "GB", Latitude: 51.5074, Longitude: -0.1278}
+	paris  = &Location{Country: "FR", Latitude: 48.8566, Longitude: 2.3522}
+	sydney = &Location{Country: "AU", Latitude: -33.8688, Longitude: 151.2093}
+	leeds  = &Location{Country: "GB", Latitude: 53.8008, Longitude: -1.5491}
+)
+
+func attempt(loc *Location, history ...Login) *Attempt {
+	return &Attempt{
+		UserID:    "user-1",
+		Time:      now,
+		IP:        "203.0.113.1",
+		UserAgent: "browser/1",
+		DeviceID:  "device-1",
+		Location:  loc,
+		History:   history,
+	}
+}
+
+func previous(ago time.Duration, loc *Location) Login {
+	return Login{Time: now.Add(-ago), UserAgent: "browser/1", DeviceID: "device-1", Location: loc}
+}
+
+func TestDistance(t *testing.T) {
+	if km := Distance(london, paris); math.Abs(km-344) > 2 {
+		t.Errorf("expected about 344 km from London to Paris, got %.1f", km)
+	}
+	if km := Distance(london, sydney); math.Abs(km-16994) > 20 {
+		t.Errorf("expected about 16994 km from London to Sydney, got %.1f", km)
+	}
+	if km := Distance(paris, paris); km != 0 {
+		t.Errorf("expected no distance between the same place, got %.1f", km)
+	}
+}
+
+func TestRules(t *testing.T) {
+	unknownDevice := previous(time.Hour, london)
+	unknownDevice.DeviceID = "device-2"
+	noCookie := attempt(london, unknownDevice)
+	noCookie.DeviceID = ""
+
+	for _, tc := range []struct {
+		name    string
+		rule    Rule
+		attempt *Attempt
+		score   int
+	}{
+		{"first login is not a new device", &NewDevice{Score: 30}, attempt(london), 0},
+		{"known device", &NewDevice{Score: 30}, attempt(london, previous(time.Hour, london)), 0},
+		{"new device", &NewDevice{Score: 30}, attempt(london, unknownDevice), 30},
+		{"no cookie with a known user agent", &NewDevice{Score: 30}, noCookie, 0},
+
+		{"same country", &NewCountry{Score: 20}, attempt(leeds, previous(time.Hour, london)), 0},
+		{"new country", &NewCountry{Score: 20}, attempt(paris, previous(48*time.Hour, london)), 20},
+		{"no located history", &NewCountry{Score: 20}, attempt(paris, previous(time.Hour, nil)), 0},
+		{"unknown location", &NewCountry{Score: 20}, attempt(nil, previous(time.Hour, london)), 0},
+
+		{"possible travel", &ImpossibleTravel{MaxSpeedKmh: 1000, MinDistanceKm: 500, Score: 60},
+			attempt(sydney, previous(24*time.Hour, london)), 0},
+		{"impossible travel", &ImpossibleTravel{MaxSpeedKmh: 1000, MinDistanceKm: 500, Score: 60},
+			attempt(sydney, previous(time.Hour, london)), 60},
+		{"short distances are ignored", &ImpossibleTravel{MaxSpeedKmh: 1000, MinDistanceKm: 500, Score: 60},
+			attempt(paris, previous(time.Minute, london)), 0},
+		{"travel from the last located login", &ImpossibleTravel{MaxSpeedKmh: 1000, MinDistanceKm: 500, Score: 60},
+			attempt(sydney, previous(time.Minute, nil), previous(2*time.Hour, london)), 60},
+		{"simultaneous logins", &ImpossibleTravel{MaxSpeedKmh: 1000, MinDistanceKm: 500, Score: 60},
+			attempt(sydney, previous(0, london)), 60},
+
+		{"recently used", &Dormant{After: 180 * 24 * time.Hour, Score: 10}, attempt(london, previous(24*time.Hour, london)), 0},
+		{"dormant", &Dormant{After: 180 * 24 * time.Hour, Score: 10}, attempt(london, previous(200*24*time.Hour, london)), 10},
+
+		{"few failures", &FailureRate{Failures: 5, Score: 30}, &Attempt{AccountFailures: 4}, 0},
+		{"many failures", &FailureRate{Failures: 5, Score: 30}, &Attempt{AccountFailures: 5}, 30},
+
+		{"failures for one username", &CredentialStuffing{Usernames: 10, Score: 50}, &Attempt{IPFailures: 50, IPUsernames: 1}, 0},
+		{"failures for many usernames", &CredentialStuffing{Usernames: 10, Score: 50}, &Attempt{IPFailures: 12, IPUsernames: 12}, 50},
+	} {
+		score, reason := tc.rule.Evaluate(tc.attempt)
+		if score != tc.score {
+			t.Errorf("%s: expected a score of %d, got %d", tc.name, tc.score, score)
+		}
+		if score != 0 && reason == "" {
+			t.Errorf("%s: a signal should have a reason", tc.name)
+		}
+	}
+}
+
+func TestAssess(t *testing.T) {
+	e := &Engine{Rules: DefaultRules(), SuspiciousScore: 30, StepUpScore: 50, BlockScore: 100}
+
+	a := attempt(london, previous(time.Hour, london))
+	if result := e.Assess(a); result.Score != 0 || result.Decision != Allow || result.Suspicious || len(result.Signals) != 0 {
+		t.Errorf("a login from a known device and place should be allowed, got %+v", result)
+	}
+
+	a.DeviceID = "device-2"
+	if result := e.Assess(a); result.Score != 30 || result.Decision != Allow || !result.Suspicious {
+		t.Errorf("a new device should be suspicious but allowed, got %+v", result)
+	}
+
+	a.Location = sydney
+	result := e.Assess(a)
+	if result.Score != 110 || result.Decision != Block || len(result.Signals) != 3 {
+		t.Errorf("a new device in a new country an hour after the last login should be blocked, got %+v", result)
+	}
+	for i, name := range []string{"new_device", "new_country", "impossible_travel"} {
+		if i < len(result.Signals) && result.Signals[i].Rule != name {
+			t.Errorf("expected signal %d to be %s, got %s", i, name, result.Signals[i].Rule)
+		}
+	}
+
+	a = attempt(london, previous(time.Hour, london))
+	a.AccountFailures = 8
+	a.IPFailures, a.IPUsernames = 3, 1
+	if result = e.Assess(a); result.Decision != Allow || !result.Suspicious {
+		t.Errorf("a login after many failures should be suspicious, got %+v", result)
+	}
+	a.IPFailures, a.IPUsernames = 30, 20
+	if result = e.Assess(a); result.Score != 80 || result.Decision != StepUp {
+		t.Errorf("a login from a credential stuffing IP after many failures should need step up, got %+v", result)
+	}
+}
+
+func TestAssessCustomRules(t *testing.T) {
+	e := &Engine{Rules: []Rule{&CredentialStuffing{Usernames: 3, Score: 10}}, StepUpScore: 5}
+	result := e.Assess(&Attempt{IPFailures: 3, IPUsernames: 3})
+	if result.Decision != StepUp || !result.Suspicious {
+		t.Errorf("an attempt that needs step up should be suspicious even without a suspicious threshold, got %+v", result)
+	}
+	if result = NewEngine().Assess(&Attempt{IPFailures: 100, IPUsernames: 100, AccountFailures: 100}); result.Decision != Allow {
+		t.Errorf("the default engine should only report attempts, got %+v", result)
+	}
+}
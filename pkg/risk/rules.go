@@ -0,0 +1,163 @@
+package risk
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+const earthRadiusKm = 6371
+
+// DefaultRules returns the built in rules with their default scores
+func DefaultRules() []Rule {
+	return []Rule{
+		&NewDevice{Score: 30},
+		&NewCountry{Score: 20},
+		&ImpossibleTravel{MaxSpeedKmh: 1000, MinDistanceKm: 500, Score: 60},
+		&Dormant{After: 180 * 24 * time.Hour, Score: 10},
+		&FailureRate{Failures: 5, Score: 30},
+		&CredentialStuffing{Usernames: 10, Score: 50},
+	}
+}
+
+// NewDevice scores a login from a device the account has not logged in from before. Devices are matched by the device ID,
+// or by user agent for clients without one. The first login to an account is never new
+type NewDevice struct {
+	Score int
+}
+
+func (r *NewDevice) Name() string { return "new_device" }
+
+func (r *NewDevice) Evaluate(a *Attempt) (int, string) {
+	if len(a.History) == 0 {
+		return 0, ""
+	}
+	for _, l := range a.History {
+		if a.DeviceID != "" && l.DeviceID == a.DeviceID {
+			return 0, ""
+		}
+		if a.DeviceID == "" && l.UserAgent == a.UserAgent {
+			return 0, ""
+		}
+	}
+	return r.Score, "device has not been used with this account before"
+}
+
+// NewCountry scores a login from a country the account has not logged in from before, it does nothing when the location of
+// the attempt or of every previous login is unknown
+type NewCountry struct {
+	Score int
+}
+
+func (r *NewCountry) Name() string { return "new_country" }
+
+func (r *NewCountry) Evaluate(a *Attempt) (int, string) {
+	if a.Location == nil || a.Location.Country == "" {
+		return 0, ""
+	}
+	known := false
+	for _, l := range a.History {
+		if l.Location == nil || l.Location.Country == "" {
+			continue
+		}
+		if l.Location.Country == a.Location.Country {
+			return 0, ""
+		}
+		known = true
+	}
+	if !known {
+		return 0, ""
+	}
+	return r.Score, "first login from " + a.Location.Country
+}
+
+// ImpossibleTravel scores a login that is too far from the last located login to have been reached in the time between them.
+// Distances under MinDistanceKm are ignored because IP locations are approximate
+type ImpossibleTravel struct {
+	MaxSpeedKmh   float64
+	MinDistanceKm float64
+	Score         int
+}
+
+func (r *ImpossibleTravel) Name() string { return "impossible_travel" }
+
+func (r *ImpossibleTravel) Evaluate(a *Attempt) (int, string) {
+	if a.Location == nil {
+		return 0, ""
+	}
+	for _, l := range a.History {
+		if l.Location == nil {
+			continue
+		}
+		km := Distance(l.Location, a.Location)
+		if km < r.MinDistanceKm {
+			return 0, ""
+		}
+		hours := a.Time.Sub(l.Time).Hours()
+		if hours > 0 && km/hours <= r.MaxSpeedKmh {
+			return 0, ""
+		}
+		return r.Score, fmt.Sprintf("%.0f km from the last login %s earlier", km, a.Time.Sub(l.Time).Round(time.Minute))
+	}
+	return 0, ""
+}
+
+// Dormant scores the first login after the account has not been used for a long time
+type Dormant struct {
+	After time.Duration
+	Score int
+}
+
+func (r *Dormant) Name() string { return "dormant_account" }
+
+func (r *Dormant) Evaluate(a *Attempt) (int, string) {
+	last := a.LastLogin()
+	if last == nil || a.Time.Sub(last.Time) < r.After {
+		return 0, ""
+	}
+	return r.Score, fmt.Sprintf("no login for %d days", int(a.Time.Sub(last.Time).Hours()/24))
+}
+
+// FailureRate scores a login to an account that has had at least Failures recent failed logins, which suggests its password
+// has been guessed
+type FailureRate struct {
+	Failures int
+	Score    int
+}
+
+func (r *FailureRate) Name() string { return "failure_rate" }
+
+func (r *FailureRate) Evaluate(a *Attempt) (int, string) {
+	if a.AccountFailures < r.Failures {
+		return 0, ""
+	}
+	return r.Score, fmt.Sprintf("%d recent failed logins to the account", a.AccountFailures)
+}
+
+// CredentialStuffing scores a login from an IP that has recently failed to log in as at least Usernames different users, the
+// pattern of trying leaked username and password pairs against the service
+type CredentialStuffing struct {
+	Usernames int
+	Score     int
+}
+
+func (r *CredentialStuffing) Name() string { return "credential_stuffing" }
+
+func (r *CredentialStuffing) Evaluate(a *Attempt) (int, string) {
+	if a.IPUsernames < r.Usernames {
+		return 0, ""
+	}
+	return r.Score, fmt.Sprintf("%d recent failed logins from the IP for %d usernames", a.IPFailures, a.IPUsernames)
+}
+
+// Distance returns the great circle distance between two locations in kilometres
+func Distance(from, to *Location) float64 {
+	lat1, lat2 := radians(from.Latitude), radians(to.Latitude)
+	dLat, dLon := lat2-lat1, radians(to.Longitude-from.Longitude)
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(h))
+}
+
+func radians(deg float64) float64 {
+	return deg * math.Pi / 180
+}
@@ -0,0 +1,141 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/blueambertech-demos/login-svc-gcp/data"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/storage"
+	"github.com/mitchellh/mapstructure"
+)
+
+const (
+	collectionName = "sessions"
+
+	// lastSeenInterval limits how often the last seen time of a session is written back to the database
+	lastSeenInterval = time.Minute
+)
+
+// ErrNotFound is returned when a session does not exist or does not belong to the requesting user
+var ErrNotFound = errors.New("session not found")
+
+// Create stores a new session record, the session ID should be the ID (jti) of the token it was issued with
+func Create(ctx context.Context, dbClient storage.Client, s *data.Session) error {
+	return dbClient.InsertWithID(ctx, collectionName, s.ID, s)
+}
+
+// Get reads a session by ID
+func Get(ctx context.Context, dbClient storage.Client, id string) (*data.Session, error) {
+	doc, err := dbClient.Read(ctx, collectionName, id)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	var s data.Session
+	if err = mapstructure.Decode(doc, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// List returns the active sessions for a user, most recently created first
+func List(ctx context.Context, dbClient storage.Client, userID string) ([]data.Session, error) {
+	all, err := ListAll(ctx, dbClient, userID)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	sessions := all[:0]
+	for _, s := range all {
+		if s.Active(now) {
+			sessions = append(sessions, s)
+		}
+	}
+	return sessions, nil
+}
+
+// Touch records that the session has just been used, writes are skipped if it was last seen very recently. Only the last
+// seen time is written so that a session revoked since it was read stays revoked
+func Touch(ctx context.Context, dbClient storage.Client, s *data.Session) error {
+	now := time.Now()
+	if now.Sub(s.LastSeen) < lastSeenInterval {
+		return nil
+	}
+	s.LastSeen = now
+	return dbClient.UpdateFields(ctx, collectionName, s.ID, map[string]interface{}{"LastSeen": now})
+}
+
+// Revoke revokes a single session belonging to a user so that its token can no longer be used
+func Revoke(ctx context.Context, dbClient storage.Client, userID, id string) error {
+	s, err := Get(ctx, dbClient, id)
+	if err != nil {
+		return err
+	}
+	if s.UserID != userID {
+		return ErrNotFound
+	}
+	return revoke(ctx, dbClient, s)
+}
+
+// RevokeAll revokes every active session belonging to a user and returns the number revoked
+func RevokeAll(ctx context.Context, dbClient storage.Client, userID string) (int, error) {
+	sessions, err := List(ctx, dbClient, userID)
+	if err != nil {
+		return 0, err
+	}
+	for i := range sessions {
+		if err = revoke(ctx, dbClient, &sessions[i]); err != nil {
+			return i, err
+		}
+	}
+	return len(sessions), nil
+}
+
+func revoke(ctx context.Context, dbClient storage.Client, s *data.Session) error {
+	if s.Revoked {
+		return nil
+	}
+	s.Revoked = true
+	s.RevokedAt = time.Now()
+	return dbClient.UpdateFields(ctx, collectionName, s.ID, map[string]interface{}{"Revoked": true, "RevokedAt": s.RevokedAt})
+}
+
+// ListAll returns every session record of a user, including revoked and expired sessions, most recently created first
+func ListAll(ctx context.Context, dbClient storage.Client, userID string) ([]data.Session, error) {
+	docs, err := dbClient.Where(ctx, collectionName, "UserID", "==", userID)
+	if err != nil {
+		return nil, err
+	}
+	sessions := make([]data.Session, 0, len(docs))
+	for _, doc := range docs {
+		var s data.Session
+		if err = mapstructure.Decode(doc, &s); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].CreatedAt.After(sessions[j].CreatedAt)
+	})
+	return sessions, nil
+}
+
+// DeleteAll removes every session record of a user and returns the number deleted, tokens issued with the sessions can no
+// longer be used
+func DeleteAll(ctx context.Context, dbClient storage.Client, userID string) (int, error) {
+	docs, err := dbClient.Where(ctx, collectionName, "UserID", "==", userID)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for id := range docs {
+		if err = dbClient.Delete(ctx, collectionName, id); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,207 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/blueambertech-demos/login-svc-gcp/data"
+	"github.com/blueambertech-demos/login-svc-gcp/mock"
+)
+
+var fakeDbClient *mock.NoSQLClient
+
+func TestMain(m *testing.M) {
+	fakeDbClient = mock.NewNoSQLClient()
+	m.Run()
+}
+
+func TestCreateAndGet(t *testing.T) {
+	defer fakeDbClient.ClearData()
+	ctx := context.Background()
+	if err := Create(ctx, fakeDbClient, newTestSession("s1", "user-1")); err != nil {
+		t.Error(err)
+		return
+	}
+	s, err := Get(ctx, fakeDbClient, "s1")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if s.UserID != "user-1" || s.UserAgent != "test-agent" {
+		t.Errorf("session not stored correctly: %+v", s)
+	}
+	if _, err = Get(ctx, fakeDbClient, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestList(t *testing.T) {
+	defer fakeDbClient.ClearData()
+	ctx := context.Background()
+	older := newTestSession("s1", "user-1")
+	older.CreatedAt = older.CreatedAt.Add(-time.Minute)
+	expired := newTestSession("s3", "user-1")
+	expired.ExpiresAt = time.Now().Add(-time.Minute)
+	for _, s := range []*data.Session{older, newTestSession("s2", "user-1"), expired, newTestSession("s4", "user-2")} {
+		if err := Create(ctx, fakeDbClient, s); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	sessions, err := List(ctx, fakeDbClient, "user-1")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(sessions) != 2 {
+		t.Errorf("expected 2 active sessions, got %d", len(sessions))
+		return
+	}
+	if sessions[0].ID != "s2" {
+		t.Errorf("sessions not ordered newest first, got %s", sessions[0].ID)
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	defer fakeDbClient.ClearData()
+	ctx := context.Background()
+	if err := Create(ctx, fakeDbClient, newTestSession("s1", "user-1")); err != nil {
+		t.Error(err)
+		return
+	}
+	if err := Revoke(ctx, fakeDbClient, "user-2", "s1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("revoking another user's session should fail with ErrNotFound, got %v", err)
+	}
+	if err := Revoke(ctx, fakeDbClient, "user-1", "s1"); err != nil {
+		t.Error(err)
+		return
+	}
+	s, err := Get(ctx, fakeDbClient, "s1")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if s.Active(time.Now()) {
+		t.Error("session should no longer be active")
+	}
+}
+
+func TestRevokeAll(t *testing.T) {
+	defer fakeDbClient.ClearData()
+	ctx := context.Background()
+	for _, s := range []*data.Session{newTestSession("s1", "user-1"), newTestSession("s2", "user-1"), newTestSession("s3", "user-2")} {
+		if err := Create(ctx, fakeDbClient, s); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	n, err := RevokeAll(ctx, fakeDbClient, "user-1")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if n != 2 {
+		t.Errorf("expected 2 sessions revoked, got %d", n)
+	}
+	if sessions, _ := List(ctx, fakeDbClient, "user-2"); len(sessions) != 1 {
+		t.Error("other users sessions should not be revoked")
+	}
+}
+
+func TestDeleteAll(t *testing.T) {
+	defer fakeDbClient.ClearData()
+	ctx := context.Background()
+	for _, s := range []*data.Session{newTestSession("s1", "user-1"), newTestSession("s2", "user-1"), newTestSession("s3", "user-2")} {
+		if err := Create(ctx, fakeDbClient, s); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	if err := Revoke(ctx, fakeDbClient, "user-1", "s2"); err != nil {
+		t.Error(err)
+		return
+	}
+	n, err := DeleteAll(ctx, fakeDbClient, "user-1")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if n != 2 {
+		t.Errorf("expected revoked and active sessions to be deleted, got %d", n)
+	}
+	if sessions, _ := ListAll(ctx, fakeDbClient, "user-1"); len(sessions) != 0 {
+		t.Error("sessions were not deleted")
+	}
+	if sessions, _ := ListAll(ctx, fakeDbClient, "user-2"); len(sessions) != 1 {
+		t.Error("other users sessions should not be deleted")
+	}
+}
+
+func TestTouch(t *testing.T) {
+	defer fakeDbClient.ClearData()
+	ctx := context.Background()
+	s := newTestSession("s1", "user-1")
+	s.LastSeen = time.Now().Add(-time.Hour)
+	if err := Create(ctx, fakeDbClient, s); err != nil {
+		t.Error(err)
+		return
+	}
+	if err := Touch(ctx, fakeDbClient, s); err != nil {
+		t.Error(err)
+		return
+	}
+	stored, err := Get(ctx, fakeDbClient, "s1")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if time.Since(stored.LastSeen) > time.Minute {
+		t.Error("last seen time was not updated")
+	}
+}
+
+func TestTouchAfterRevoke(t *testing.T) {
+	defer fakeDbClient.ClearData()
+	ctx := context.Background()
+	s := newTestSession("s1", "user-1")
+	s.LastSeen = time.Now().Add(-time.Hour)
+	if err := Create(ctx, fakeDbClient, s); err != nil {
+		t.Fatal(err)
+	}
+	// A request reads the session, then it is revoked before the request records that it was used
+	read, err := Get(ctx, fakeDbClient, "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = Revoke(ctx, fakeDbClient, "user-1", "s1"); err != nil {
+		t.Fatal(err)
+	}
+	if err = Touch(ctx, fakeDbClient, read); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := Get(ctx, fakeDbClient, "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stored.Revoked || stored.RevokedAt.IsZero() {
+		t.Error("touching a session should not undo its revocation")
+	}
+	if time.Since(stored.LastSeen) > time.Minute {
+		t.Error("last seen time was not updated")
+	}
+}
+
+func newTestSession(id, userID string) *data.Session {
+	now := time.Now()
+	return &data.Session{
+		ID:        id,
+		UserID:    userID,
+		UserAgent: "test-agent",
+		IP:        "127.0.0.1",
+		CreatedAt: now,
+		LastSeen:  now,
+		ExpiresAt: now.Add(time.Hour),
+	}
+}
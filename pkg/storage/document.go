@@ -0,0 +1,148 @@
+package storage
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"reflect"
+	"strings"
+	"time"
+)
+
+const idChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// NewID returns a random 20 character ID in the same format as Firestore auto generated document IDs
+func NewID() (string, error) {
+	b := make([]byte, 20)
+	for i := range b {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(idChars))))
+		if err != nil {
+			return "", err
+		}
+		b[i] = idChars[n.Int64()]
+	}
+	return string(b), nil
+}
+
+// ToDocument converts a struct, pointer to a struct or map into a document, values are converted to the types the Firestore
+// client returns when reading a document so that other implementations of Client behave in the same way
+func ToDocument(data interface{}) (map[string]interface{}, error) {
+	v, err := toValue(reflect.ValueOf(data))
+	if err != nil {
+		return nil, err
+	}
+	doc, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("storage: document data must be a struct or map, got %T", data)
+	}
+	return doc, nil
+}
+
+// toValue converts a value into the types the Firestore client returns when reading a document
+func toValue(v reflect.Value) (interface{}, error) {
+	if !v.IsValid() {
+		return nil, nil
+	}
+	if t, ok := v.Interface().(time.Time); ok {
+		return t, nil
+	}
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return nil, nil
+		}
+		return toValue(v.Elem())
+	case reflect.String:
+		return v.String(), nil
+	case reflect.Bool:
+		return v.Bool(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int(), nil
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return int64(v.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), nil
+	case reflect.Slice:
+		if v.IsNil() {
+			return nil, nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return append([]byte(nil), v.Bytes()...), nil
+		}
+		fallthrough
+	case reflect.Array:
+		s := make([]interface{}, v.Len())
+		for i := range s {
+			e, err := toValue(v.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			s[i] = e
+		}
+		return s, nil
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return nil, errors.New("storage: map keys must be strings")
+		}
+		if v.IsNil() {
+			return nil, nil
+		}
+		m := make(map[string]interface{}, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			e, err := toValue(iter.Value())
+			if err != nil {
+				return nil, err
+			}
+			m[iter.Key().String()] = e
+		}
+		return m, nil
+	case reflect.Struct:
+		m := make(map[string]interface{}, v.NumField())
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Type().Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			name := f.Name
+			if tag, _, _ := strings.Cut(f.Tag.Get("firestore"), ","); tag == "-" {
+				continue
+			} else if tag != "" {
+				name = tag
+			}
+			e, err := toValue(v.Field(i))
+			if err != nil {
+				return nil, err
+			}
+			m[name] = e
+		}
+		return m, nil
+	}
+	return nil, fmt.Errorf("storage: unsupported field type %s", v.Type())
+}
+
+// CopyDocument copies a document deeply enough that changes made by the caller can't affect the stored document
+func CopyDocument(d map[string]interface{}) map[string]interface{} {
+	c := make(map[string]interface{}, len(d))
+	for k, v := range d {
+		c[k] = copyValue(v)
+	}
+	return c
+}
+
+func copyValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		return CopyDocument(t)
+	case []interface{}:
+		s := make([]interface{}, len(t))
+		for i, e := range t {
+			s[i] = copyValue(e)
+		}
+		return s
+	case []byte:
+		return append([]byte(nil), t...)
+	}
+	return v
+}
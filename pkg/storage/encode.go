@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// JSON has no time, integer or binary types, so values of these types are wrapped in an object with a single key naming the type
+// when a document is encoded, and unwrapped when it is decoded
+const (
+	timeKey  = "$time"
+	intKey   = "$int"
+	bytesKey = "$bytes"
+)
+
+func encodeDocument(data interface{}) ([]byte, error) {
+	doc, err := ToDocument(data)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(wrapValue(doc))
+}
+
+func decodeDocument(raw []byte) (map[string]interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	doc, err := unwrapValue(v)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("storage: stored document is a %T", doc)
+	}
+	return m, nil
+}
+
+func wrapValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case time.Time:
+		return map[string]interface{}{timeKey: t.Format(time.RFC3339Nano)}
+	case int64:
+		return map[string]interface{}{intKey: strconv.FormatInt(t, 10)}
+	case []byte:
+		return map[string]interface{}{bytesKey: base64.StdEncoding.EncodeToString(t)}
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			m[k] = wrapValue(e)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(t))
+		for i, e := range t {
+			s[i] = wrapValue(e)
+		}
+		return s
+	}
+	return v
+}
+
+func unwrapValue(v interface{}) (interface{}, error) {
+	switch t := v.(type) {
+	case json.Number:
+		return t.Float64()
+	case map[string]interface{}:
+		if len(t) == 1 {
+			if s, ok := t[timeKey].(string); ok {
+				return time.Parse(time.RFC3339Nano, s)
+			}
+			if s, ok := t[intKey].(string); ok {
+				return strconv.ParseInt(s, 10, 64)
+			}
+			if s, ok := t[bytesKey].(string); ok {
+				return base64.StdEncoding.DecodeString(s)
+			}
+		}
+		m := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			u, err := unwrapValue(e)
+			if err != nil {
+				return nil, err
+			}
+			m[k] = u
+		}
+		return m, nil
+	case []interface{}:
+		s := make([]interface{}, len(t))
+		for i, e := range t {
+			u, err := unwrapValue(e)
+			if err != nil {
+				return nil, err
+			}
+			s[i] = u
+		}
+		return s, nil
+	}
+	return v, nil
+}
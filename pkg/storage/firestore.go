@@ -0,0 +1,231 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Firestore is a Client backed by a Google Firestore database
+type Firestore struct {
+	client *firestore.Client
+}
+
+// NewFirestore returns a new Firestore client for the specified project and database
+func NewFirestore(projID, dbName string) (*Firestore, error) {
+	ctx, canc := context.WithTimeout(context.Background(), 5*time.Second)
+	defer canc()
+	fsc, err := firestore.NewClientWithDatabase(ctx, projID, dbName)
+	if err != nil {
+		return nil, err
+	}
+	return &Firestore{client: fsc}, nil
+}
+
+// Close closes down the firestore client
+func (f *Firestore) Close() error {
+	return f.client.Close()
+}
+
+// Read reads a document from the specified collection by ID, ErrNotFound is returned if it does not exist
+func (f *Firestore) Read(ctx context.Context, collection, id string) (map[string]interface{}, error) {
+	doc, err := f.client.Collection(collection).Doc(id).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return doc.Data(), nil
+}
+
+// Insert inserts a new document into the specified collection with the data provided, returns the ID of the newly inserted doc
+func (f *Firestore) Insert(ctx context.Context, collection string, data interface{}) (string, error) {
+	docRef, _, err := f.client.Collection(collection).Add(ctx, data)
+	if err != nil {
+		return "", err
+	}
+	return docRef.ID, nil
+}
+
+// InsertWithID inserts a new document with an existing ID into the specified collection, ErrAlreadyExists is returned if a doc with
+// this ID already exists. Firestore performs the existence check and the write atomically
+func (f *Firestore) InsertWithID(ctx context.Context, collection, id string, data interface{}) error {
+	_, err := f.client.Collection(collection).Doc(id).Create(ctx, data)
+	if status.Code(err) == codes.AlreadyExists {
+		return ErrAlreadyExists
+	}
+	return err
+}
+
+// InsertAll creates every document in one transaction, ErrAlreadyExists is returned and nothing is written if any of them
+// already exists
+func (f *Firestore) InsertAll(ctx context.Context, writes ...Write) error {
+	for _, w := range writes {
+		if w.Op != OpInsert {
+			return fmt.Errorf("storage: InsertAll given a write that is not an insert: %s/%s", w.Collection, w.ID)
+		}
+	}
+	return f.Commit(ctx, writes...)
+}
+
+// Commit makes the writes in a transaction, the documents that are updated or deleted are read first to check they exist and
+// meet their condition as Firestore transactions must make every read before any write
+func (f *Firestore) Commit(ctx context.Context, writes ...Write) error {
+	err := f.client.RunTransaction(ctx, func(_ context.Context, tx *firestore.Transaction) error {
+		for _, w := range writes {
+			if w.Op == OpInsert {
+				continue
+			}
+			doc, err := tx.Get(f.client.Collection(w.Collection).Doc(w.ID))
+			if status.Code(err) == codes.NotFound {
+				return ErrNotFound
+			} else if err != nil {
+				return err
+			}
+			if err = checkCondition(w, doc.Data()); err != nil {
+				return err
+			}
+		}
+		for _, w := range writes {
+			docRef := f.client.Collection(w.Collection).Doc(w.ID)
+			var err error
+			switch w.Op {
+			case OpInsert:
+				err = tx.Create(docRef, w.Data)
+			case OpUpdate:
+				err = tx.Update(docRef, fieldUpdates(w.Fields))
+			case OpDelete:
+				err = tx.Delete(docRef)
+			default:
+				err = fmt.Errorf("storage: unknown write op %d", w.Op)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if status.Code(err) == codes.AlreadyExists {
+		return ErrAlreadyExists
+	}
+	return err
+}
+
+func fieldUpdates(fields map[string]interface{}) []firestore.Update {
+	updates := make([]firestore.Update, 0, len(fields))
+	for k, v := range fields {
+		updates = append(updates, firestore.Update{FieldPath: firestore.FieldPath{k}, Value: v})
+	}
+	return updates
+}
+
+// Update replaces the contents of an existing document, ErrNotFound is returned if it does not exist
+func (f *Firestore) Update(ctx context.Context, collection, id string, data interface{}) error {
+	docRef := f.client.Collection(collection).Doc(id)
+	return f.client.RunTransaction(ctx, func(_ context.Context, tx *firestore.Transaction) error {
+		_, err := tx.Get(docRef)
+		if status.Code(err) == codes.NotFound {
+			return ErrNotFound
+		} else if err != nil {
+			return err
+		}
+		return tx.Set(docRef, data)
+	})
+}
+
+// UpdateFields sets the named top level fields of an existing document, ErrNotFound is returned if it does not exist
+func (f *Firestore) UpdateFields(ctx context.Context, collection, id string, fields map[string]interface{}) error {
+	_, err := f.client.Collection(collection).Doc(id).Update(ctx, fieldUpdates(fields))
+	if status.Code(err) == codes.NotFound {
+		return ErrNotFound
+	}
+	return err
+}
+
+// UpdateFieldsIf sets the named top level fields of an existing document in a transaction if the key field still holds value,
+// a missing field holds an empty string. ErrConflict is returned if it holds something else and ErrNotFound if the document
+// does not exist
+func (f *Firestore) UpdateFieldsIf(ctx context.Context, collection, id, key, value string, fields map[string]interface{}) error {
+	return f.Commit(ctx, UpdateIf(collection, id, key, value, fields))
+}
+
+// Delete removes a document from the specified collection, deleting a document that does not exist is not an error
+func (f *Firestore) Delete(ctx context.Context, collection, id string) error {
+	_, err := f.client.Collection(collection).Doc(id).Delete(ctx)
+	return err
+}
+
+// Where reads documents from the specified collection using a key, operator and value. Operator must be one of
+// "==", "!=", "<", "<=", ">", ">=", "array-contains", "array-contains-any", "in" or "not-in", the last three take a comma
+// separated list of values
+func (f *Firestore) Where(ctx context.Context, collection, key, operator, value string) (map[string]map[string]interface{}, error) {
+	docs, err := f.client.Collection(collection).Where(key, operator, ListValue(operator, value)).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]map[string]interface{}, len(docs))
+	for _, d := range docs {
+		m[d.Ref.ID] = d.Data()
+	}
+	return m, nil
+}
+
+// List reads every document in the specified collection
+func (f *Firestore) List(ctx context.Context, collection string) (map[string]map[string]interface{}, error) {
+	docs, err := f.client.Collection(collection).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]map[string]interface{}, len(docs))
+	for _, d := range docs {
+		m[d.Ref.ID] = d.Data()
+	}
+	return m, nil
+}
+
+// ListPage reads up to limit documents from the specified collection in ID order, starting after the document with the ID
+// after, or from the start when after is empty
+func (f *Firestore) ListPage(ctx context.Context, collection, after string, limit int) ([]Document, error) {
+	q := f.client.Collection(collection).OrderBy(firestore.DocumentID, firestore.Asc).Limit(limit)
+	if after != "" {
+		q = q.StartAfter(after)
+	}
+	docs, err := q.Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	page := make([]Document, len(docs))
+	for i, d := range docs {
+		page[i] = Document{ID: d.Ref.ID, Data: d.Data()}
+	}
+	return page, nil
+}
+
+// ListBefore reads up to limit documents from the specified collection whose key field is a time at or before t, ordered by
+// that field
+func (f *Firestore) ListBefore(ctx context.Context, collection, key string, t time.Time, limit int) ([]Document, error) {
+	docs, err := f.client.Collection(collection).Where(key, "<=", t).OrderBy(key, firestore.Asc).Limit(limit).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	page := make([]Document, len(docs))
+	for i, d := range docs {
+		page[i] = Document{ID: d.Ref.ID, Data: d.Data()}
+	}
+	return page, nil
+}
+
+// Exists checks if a document exists with this ID in the specified collection
+func (f *Firestore) Exists(ctx context.Context, collection, id string) (bool, error) {
+	_, err := f.client.Collection(collection).Doc(id).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Matcher returns a func that reports whether a document field satisfies a Where clause. The value is a string, so only string
+// fields and string elements of array fields can be equal to it or compare with it, as with Firestore "!=" and "not-in" also
+// match fields holding other types, but not null fields. The "in", "not-in" and "array-contains-any" operators take a comma separated list of values
+func Matcher(operator, value string) (func(field interface{}) bool, error) {
+	switch operator {
+	case "==":
+		return func(field interface{}) bool { return field == value }, nil
+	case "!=":
+		return func(field interface{}) bool { return field != nil && field != value }, nil
+	case "<", "<=", ">", ">=":
+		return func(field interface{}) bool {
+			s, ok := field.(string)
+			return ok && compare(s, operator, value)
+		}, nil
+	case "array-contains":
+		return func(field interface{}) bool { return containsAny(field, []string{value}) }, nil
+	case "array-contains-any":
+		values := strings.Split(value, ",")
+		return func(field interface{}) bool { return containsAny(field, values) }, nil
+	case "in":
+		values := strings.Split(value, ",")
+		return func(field interface{}) bool { return oneOf(field, values) }, nil
+	case "not-in":
+		values := strings.Split(value, ",")
+		return func(field interface{}) bool { return field != nil && !oneOf(field, values) }, nil
+	}
+	return nil, fmt.Errorf("unsupported operator %q", operator)
+}
+
+// ListValue returns the value a Where clause should be given, converting the comma separated list taken by the "in",
+// "not-in" and "array-contains-any" operators into a slice
+func ListValue(operator, value string) interface{} {
+	switch operator {
+	case "in", "not-in", "array-contains-any":
+		return strings.Split(value, ",")
+	}
+	return value
+}
+
+func compare(field, operator, value string) bool {
+	switch operator {
+	case "<":
+		return field < value
+	case "<=":
+		return field <= value
+	case ">":
+		return field > value
+	}
+	return field >= value
+}
+
+func oneOf(field interface{}, values []string) bool {
+	for _, v := range values {
+		if field == v {
+			return true
+		}
+	}
+	return false
+}
+
+func containsAny(field interface{}, values []string) bool {
+	elems, ok := field.([]interface{})
+	if !ok {
+		return false
+	}
+	for _, e := range elems {
+		if oneOf(e, values) {
+			return true
+		}
+	}
+	return false
+}
+
+// SortBefore returns up to limit of the documents whose key field is a time at or before t, ordered by that field and then by
+// ID, for clients that evaluate ListBefore in the service
+func SortBefore(docs map[string]map[string]interface{}, key string, t time.Time, limit int) []Document {
+	var due []Document
+	for id, doc := range docs {
+		if v, ok := doc[key].(time.Time); ok && !v.After(t) {
+			due = append(due, Document{ID: id, Data: doc})
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		a, b := due[i].Data[key].(time.Time), due[j].Data[key].(time.Time)
+		if !a.Equal(b) {
+			return a.Before(b)
+		}
+		return due[i].ID < due[j].ID
+	})
+	if len(due) > limit {
+		due = due[:limit]
+	}
+	return due
+}
@@ -0,0 +1,37 @@
+package storage
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMatcherUnsupportedOperator(t *testing.T) {
+	if _, err := Matcher("~=", "x"); err == nil {
+		t.Error("unsupported operator should be rejected")
+	}
+}
+
+func TestMatcherNullField(t *testing.T) {
+	for _, op := range []string{"!=", "not-in"} {
+		match, err := Matcher(op, "x")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if match(nil) {
+			t.Errorf("%s should not match a null field", op)
+		}
+		if !match(int64(1)) {
+			t.Errorf("%s should match a field of another type", op)
+		}
+	}
+}
+
+func TestListValue(t *testing.T) {
+	if v := ListValue("in", "a,b"); !reflect.DeepEqual(v, []string{"a", "b"}) {
+		t.Errorf("incorrect list value: %v", v)
+	}
+	if v := ListValue("==", "a,b"); v != "a,b" {
+		t.Errorf("value should be unchanged: %v", v)
+	}
+}
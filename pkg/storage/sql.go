@@ -0,0 +1,382 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Dialect identifies the SQL database a client is connected to
+type Dialect int
+
+const (
+	Postgres Dialect = iota
+	SQLite
+)
+
+// ParseDialect returns the dialect with the given driver name
+func ParseDialect(name string) (Dialect, error) {
+	switch name {
+	case "postgres":
+		return Postgres, nil
+	case "sqlite":
+		return SQLite, nil
+	}
+	return 0, fmt.Errorf("unknown sql dialect %q", name)
+}
+
+// Rebind rewrites a query written with ? placeholders for the dialect
+func (d Dialect) Rebind(query string) string {
+	if d != Postgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// IsUniqueViolation reports whether an error was caused by a unique constraint
+func (d Dialect) IsUniqueViolation(err error) bool {
+	switch d {
+	case Postgres:
+		var pgErr interface{ SQLState() string }
+		return errors.As(err, &pgErr) && pgErr.SQLState() == "23505"
+	case SQLite:
+		var sqliteErr interface{ Code() int }
+		// The primary result code for all constraint violations is SQLITE_CONSTRAINT
+		return errors.As(err, &sqliteErr) && sqliteErr.Code()&0xff == 19
+	}
+	return false
+}
+
+// Migration is a named schema change, migrations are applied in order and each is only applied once
+type Migration struct {
+	Name     string
+	Postgres string
+	SQLite   string
+}
+
+// Migrate applies any of the migrations that have not already been applied to the database, recording each in the
+// schema_migrations table
+func Migrate(ctx context.Context, db *sql.DB, dialect Dialect, migrations []Migration) error {
+	_, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		name TEXT PRIMARY KEY,
+		applied_at TIMESTAMP NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if err = applyMigration(ctx, db, dialect, m); err != nil {
+			return fmt.Errorf("migration %s: %w", m.Name, err)
+		}
+	}
+	return nil
+}
+
+func applyMigration(ctx context.Context, db *sql.DB, dialect Dialect, m Migration) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var applied int
+	err = tx.QueryRowContext(ctx, dialect.Rebind("SELECT COUNT(*) FROM schema_migrations WHERE name = ?"), m.Name).Scan(&applied)
+	if err != nil || applied > 0 {
+		return err
+	}
+	stmt := m.Postgres
+	if dialect == SQLite {
+		stmt = m.SQLite
+	}
+	if _, err = tx.ExecContext(ctx, stmt); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, dialect.Rebind("INSERT INTO schema_migrations (name, applied_at) VALUES (?, ?)"), m.Name, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+var sqlMigrations = []Migration{
+	{
+		Name: "storage-0001-documents",
+		Postgres: `CREATE TABLE documents (
+			collection TEXT NOT NULL,
+			id TEXT NOT NULL,
+			data JSONB NOT NULL,
+			PRIMARY KEY (collection, id)
+		)`,
+		SQLite: `CREATE TABLE documents (
+			collection TEXT NOT NULL,
+			id TEXT NOT NULL,
+			data TEXT NOT NULL,
+			PRIMARY KEY (collection, id)
+		)`,
+	},
+}
+
+// SQL is a Client that stores documents as JSON in a table of a PostgreSQL or SQLite database, it allows the service to run
+// without Firestore. Where queries are evaluated in the service rather than the database so are only suitable for
+// collections of a modest size
+type SQL struct {
+	db      *sql.DB
+	dialect Dialect
+}
+
+// NewSQL returns a Client using the supplied database, the documents table is created if it does not exist
+func NewSQL(ctx context.Context, db *sql.DB, dialect Dialect) (*SQL, error) {
+	if err := Migrate(ctx, db, dialect, sqlMigrations); err != nil {
+		return nil, err
+	}
+	return &SQL{db: db, dialect: dialect}, nil
+}
+
+func (s *SQL) Read(ctx context.Context, collection, id string) (map[string]interface{}, error) {
+	var raw []byte
+	err := s.db.QueryRowContext(ctx, s.dialect.Rebind("SELECT data FROM documents WHERE collection = ? AND id = ?"), collection, id).Scan(&raw)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return decodeDocument(raw)
+}
+
+func (s *SQL) Insert(ctx context.Context, collection string, data interface{}) (string, error) {
+	for {
+		id, err := NewID()
+		if err != nil {
+			return "", err
+		}
+		err = s.InsertWithID(ctx, collection, id, data)
+		if !errors.Is(err, ErrAlreadyExists) {
+			return id, err
+		}
+	}
+}
+
+func (s *SQL) InsertWithID(ctx context.Context, collection, id string, data interface{}) error {
+	raw, err := encodeDocument(data)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, s.dialect.Rebind("INSERT INTO documents (collection, id, data) VALUES (?, ?, ?)"), collection, id, string(raw))
+	if s.dialect.IsUniqueViolation(err) {
+		return ErrAlreadyExists
+	}
+	return err
+}
+
+func (s *SQL) InsertAll(ctx context.Context, writes ...Write) error {
+	for _, w := range writes {
+		if w.Op != OpInsert {
+			return fmt.Errorf("storage: InsertAll given a write that is not an insert: %s/%s", w.Collection, w.ID)
+		}
+	}
+	return s.Commit(ctx, writes...)
+}
+
+func (s *SQL) Commit(ctx context.Context, writes ...Write) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	if err = ApplyWrites(ctx, tx, s.dialect, writes...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ApplyWrites makes writes to the documents table as part of a transaction, so that other tables in the same database can be
+// changed atomically with them. Documents that are updated or deleted are read first, locking their rows on PostgreSQL, to check
+// they exist and meet their condition
+func ApplyWrites(ctx context.Context, tx *sql.Tx, dialect Dialect, writes ...Write) error {
+	for _, w := range writes {
+		if w.Op == OpInsert {
+			if err := InsertDocuments(ctx, tx, dialect, w); err != nil {
+				return err
+			}
+			continue
+		}
+		query := "SELECT data FROM documents WHERE collection = ? AND id = ?"
+		if dialect == Postgres {
+			query += " FOR UPDATE"
+		}
+		var raw []byte
+		err := tx.QueryRowContext(ctx, dialect.Rebind(query), w.Collection, w.ID).Scan(&raw)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		} else if err != nil {
+			return err
+		}
+		doc, err := decodeDocument(raw)
+		if err != nil {
+			return err
+		}
+		if err = checkCondition(w, doc); err != nil {
+			return err
+		}
+		switch w.Op {
+		case OpUpdate:
+			for k, v := range w.Fields {
+				doc[k] = v
+			}
+			if raw, err = encodeDocument(doc); err != nil {
+				return err
+			}
+			_, err = tx.ExecContext(ctx, dialect.Rebind("UPDATE documents SET data = ? WHERE collection = ? AND id = ?"), string(raw), w.Collection, w.ID)
+		case OpDelete:
+			_, err = tx.ExecContext(ctx, dialect.Rebind("DELETE FROM documents WHERE collection = ? AND id = ?"), w.Collection, w.ID)
+		default:
+			err = fmt.Errorf("storage: unknown write op %d", w.Op)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// InsertDocuments inserts documents into the documents table as part of a transaction, so that other tables in the same database
+// can be changed atomically with them. ErrAlreadyExists is returned if any of them already exists
+func InsertDocuments(ctx context.Context, tx *sql.Tx, dialect Dialect, writes ...Write) error {
+	for _, w := range writes {
+		raw, err := encodeDocument(w.Data)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, dialect.Rebind("INSERT INTO documents (collection, id, data) VALUES (?, ?, ?)"), w.Collection, w.ID, string(raw))
+		if dialect.IsUniqueViolation(err) {
+			return ErrAlreadyExists
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SQL) Update(ctx context.Context, collection, id string, data interface{}) error {
+	raw, err := encodeDocument(data)
+	if err != nil {
+		return err
+	}
+	res, err := s.db.ExecContext(ctx, s.dialect.Rebind("UPDATE documents SET data = ? WHERE collection = ? AND id = ?"), string(raw), collection, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// UpdateFields reads, changes and writes the document in a transaction, the row is locked on PostgreSQL so that concurrent
+// updates of other fields are not lost
+func (s *SQL) UpdateFields(ctx context.Context, collection, id string, fields map[string]interface{}) error {
+	return s.Commit(ctx, Write{Collection: collection, ID: id, Op: OpUpdate, Fields: fields})
+}
+
+// UpdateFieldsIf changes the document in the same way as UpdateFields, checking the key field once the row is locked. On
+// SQLite the transaction holds the only write connection
+func (s *SQL) UpdateFieldsIf(ctx context.Context, collection, id, key, value string, fields map[string]interface{}) error {
+	return s.Commit(ctx, UpdateIf(collection, id, key, value, fields))
+}
+
+func (s *SQL) Delete(ctx context.Context, collection, id string) error {
+	_, err := s.db.ExecContext(ctx, s.dialect.Rebind("DELETE FROM documents WHERE collection = ? AND id = ?"), collection, id)
+	return err
+}
+
+// Where supports the same operators and value format as Firestore, see Matcher
+func (s *SQL) Where(ctx context.Context, collection, key, operator, value string) (map[string]map[string]interface{}, error) {
+	match, err := Matcher(operator, value)
+	if err != nil {
+		return nil, err
+	}
+	docs, err := s.List(ctx, collection)
+	if err != nil {
+		return nil, err
+	}
+	for id, doc := range docs {
+		if field, ok := doc[key]; !ok || !match(field) {
+			delete(docs, id)
+		}
+	}
+	return docs, nil
+}
+
+func (s *SQL) List(ctx context.Context, collection string) (map[string]map[string]interface{}, error) {
+	rows, err := s.db.QueryContext(ctx, s.dialect.Rebind("SELECT id, data FROM documents WHERE collection = ?"), collection)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	docs := map[string]map[string]interface{}{}
+	for rows.Next() {
+		var id string
+		var raw []byte
+		if err = rows.Scan(&id, &raw); err != nil {
+			return nil, err
+		}
+		if docs[id], err = decodeDocument(raw); err != nil {
+			return nil, err
+		}
+	}
+	return docs, rows.Err()
+}
+
+func (s *SQL) ListPage(ctx context.Context, collection, after string, limit int) ([]Document, error) {
+	query := "SELECT id, data FROM documents WHERE collection = ? AND id > ? ORDER BY id LIMIT ?"
+	rows, err := s.db.QueryContext(ctx, s.dialect.Rebind(query), collection, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var page []Document
+	for rows.Next() {
+		var d Document
+		var raw []byte
+		if err = rows.Scan(&d.ID, &raw); err != nil {
+			return nil, err
+		}
+		if d.Data, err = decodeDocument(raw); err != nil {
+			return nil, err
+		}
+		page = append(page, d)
+	}
+	return page, rows.Err()
+}
+
+// ListBefore is evaluated in the service in the same way as Where
+func (s *SQL) ListBefore(ctx context.Context, collection, key string, t time.Time, limit int) ([]Document, error) {
+	docs, err := s.List(ctx, collection)
+	if err != nil {
+		return nil, err
+	}
+	return SortBefore(docs, key, t, limit), nil
+}
+
+func (s *SQL) Exists(ctx context.Context, collection, id string) (bool, error) {
+	_, err := s.Read(ctx, collection, id)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,52 @@
+package storage_test
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/storage"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/storage/storagetest"
+	_ "modernc.org/sqlite"
+)
+
+func openSQLite(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "test.db")+"?_pragma=busy_timeout(5000)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// SQLite only allows one writer at a time
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { _ = db.Close() })
+	return db
+}
+
+func TestSQLiteConformance(t *testing.T) {
+	client, err := storage.NewSQL(context.Background(), openSQLite(t), storage.SQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storagetest.RunClientTests(t, client)
+}
+
+func TestMigrateIsRepeatable(t *testing.T) {
+	ctx := context.Background()
+	db := openSQLite(t)
+	for i := 0; i < 2; i++ {
+		if _, err := storage.NewSQL(ctx, db, storage.SQLite); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+}
+
+func TestRebind(t *testing.T) {
+	q := "SELECT data FROM documents WHERE collection = ? AND id = ?"
+	if got := storage.Postgres.Rebind(q); got != "SELECT data FROM documents WHERE collection = $1 AND id = $2" {
+		t.Error("unexpected postgres query:", got)
+	}
+	if got := storage.SQLite.Rebind(q); got != q {
+		t.Error("unexpected sqlite query:", got)
+	}
+}
@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/blueambertech/db"
+)
+
+var (
+	// ErrNotFound is returned when a document does not exist in a collection
+	ErrNotFound = errors.New("document not found")
+	// ErrAlreadyExists is returned by InsertWithID when a document with the ID already exists
+	ErrAlreadyExists = errors.New("document already exists")
+	// ErrConflict is returned by UpdateFieldsIf and Commit when a document no longer holds the value it was read with
+	ErrConflict = errors.New("document has changed")
+)
+
+// Client is a NoSQL database client, it extends db.NoSQLClient with the operations needed to change or remove
+// documents after they have been created. InsertWithID must have create-if-absent semantics, checking for an existing
+// document and creating the new one atomically, so that it can be used to enforce unique keys. UpdateFields changes only the
+// named top level fields of a document, leaving the others as they are, so concurrent writes to different fields don't undo
+// each other. ListPage reads a collection a page at a time in document ID order, so large collections can be walked without
+// reading every document for each page.
+//
+// InsertAll inserts several documents, possibly in different collections, in one transaction with the same semantics as
+// InsertWithID, if any of them already exists ErrAlreadyExists is returned and none are written. ListBefore reads the documents
+// whose time field is at or before a time, in order of that field. UpdateFieldsIf only changes a document while a string field
+// still holds the value it was read with, so that one of several instances can claim a document.
+//
+// Commit makes several writes, possibly in different collections, in one transaction. Inserts have the semantics of InsertAll,
+// updates and deletes return ErrNotFound when the document doesn't exist and ErrConflict when their condition doesn't hold, if
+// any write fails none are made
+type Client interface {
+	db.NoSQLClient
+	Update(ctx context.Context, collection, id string, data interface{}) error
+	UpdateFields(ctx context.Context, collection, id string, fields map[string]interface{}) error
+	Delete(ctx context.Context, collection, id string) error
+	List(ctx context.Context, collection string) (map[string]map[string]interface{}, error)
+	ListPage(ctx context.Context, collection, after string, limit int) ([]Document, error)
+	InsertAll(ctx context.Context, writes ...Write) error
+	ListBefore(ctx context.Context, collection, key string, t time.Time, limit int) ([]Document, error)
+	UpdateFieldsIf(ctx context.Context, collection, id, key, value string, fields map[string]interface{}) error
+	Commit(ctx context.Context, writes ...Write) error
+}
+
+// Document is a document read from a collection along with its ID
+type Document struct {
+	ID   string
+	Data map[string]interface{}
+}
+
+// WriteOp is the change a Write makes to a document
+type WriteOp int
+
+const (
+	// OpInsert creates a document holding Data, it is the zero value so that a Write only needs Data to insert
+	OpInsert WriteOp = iota
+	// OpUpdate sets the top level Fields of an existing document
+	OpUpdate
+	// OpDelete removes an existing document
+	OpDelete
+)
+
+// Write is a change to a document made by InsertAll, which only accepts inserts, or Commit
+type Write struct {
+	Collection string
+	ID         string
+	Data       interface{}
+	Op         WriteOp
+	Fields     map[string]interface{}
+	// IfKey and IfValue make an update or delete conditional on the string field IfKey still holding IfValue, as with
+	// UpdateFieldsIf. There is no condition when IfKey is empty
+	IfKey   string
+	IfValue string
+}
+
+// UpdateIf returns a Write that sets fields of a document while its string field key holds value
+func UpdateIf(collection, id, key, value string, fields map[string]interface{}) Write {
+	return Write{Collection: collection, ID: id, Op: OpUpdate, Fields: fields, IfKey: key, IfValue: value}
+}
+
+// DeleteIf returns a Write that deletes a document while its string field key holds value
+func DeleteIf(collection, id, key, value string) Write {
+	return Write{Collection: collection, ID: id, Op: OpDelete, IfKey: key, IfValue: value}
+}
+
+// checkCondition returns ErrConflict when a document doesn't meet the condition of a write
+func checkCondition(w Write, doc map[string]interface{}) error {
+	if w.IfKey == "" {
+		return nil
+	}
+	if current, _ := doc[w.IfKey].(string); current != w.IfValue {
+		return ErrConflict
+	}
+	return nil
+}
@@ -0,0 +1,465 @@
+// Package storagetest provides a conformance test suite for implementations of storage.Client
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/storage"
+)
+
+type testDoc struct {
+	Name    string
+	Group   string
+	Count   int
+	Tags    []string
+	Created time.Time
+	Nested  nestedDoc
+}
+
+type nestedDoc struct {
+	Value string
+}
+
+// RunClientTests runs the conformance suite against a client. Each test uses its own collection with a unique name so the suite
+// can be run against a shared database
+func RunClientTests(t *testing.T, client storage.Client) {
+	tests := []struct {
+		name string
+		test func(*testing.T, storage.Client, string)
+	}{
+		{"InsertAndRead", testInsertAndRead},
+		{"InsertUniqueIDs", testInsertUniqueIDs},
+		{"InsertWithIDExists", testInsertWithIDExists},
+		{"InsertWithIDConcurrent", testInsertWithIDConcurrent},
+		{"ReadMissing", testReadMissing},
+		{"Update", testUpdate},
+		{"UpdateFields", testUpdateFields},
+		{"UpdateFieldsIf", testUpdateFieldsIf},
+		{"InsertAll", testInsertAll},
+		{"Commit", testCommit},
+		{"Delete", testDelete},
+		{"Exists", testExists},
+		{"CollectionsIsolated", testCollectionsIsolated},
+		{"Where", testWhere},
+		{"ListPage", testListPage},
+		{"ListBefore", testListBefore},
+	}
+	run := time.Now().UnixNano()
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.test(t, client, fmt.Sprintf("storagetest-%d-%s", run, tc.name))
+		})
+	}
+}
+
+func testInsertAndRead(t *testing.T, client storage.Client, collection string) {
+	ctx := context.Background()
+	created := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	id, err := client.Insert(ctx, collection, &testDoc{Name: "a", Count: 3, Tags: []string{"x", "y"}, Created: created, Nested: nestedDoc{Value: "n"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err := client.Read(ctx, collection, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc["Name"] != "a" || doc["Count"] != int64(3) {
+		t.Errorf("incorrect scalar fields: %v", doc)
+	}
+	if tags, ok := doc["Tags"].([]interface{}); !ok || len(tags) != 2 || tags[0] != "x" {
+		t.Errorf("incorrect array field: %#v", doc["Tags"])
+	}
+	if c, ok := doc["Created"].(time.Time); !ok || !c.Equal(created) {
+		t.Errorf("incorrect time field: %#v", doc["Created"])
+	}
+	if n, ok := doc["Nested"].(map[string]interface{}); !ok || n["Value"] != "n" {
+		t.Errorf("incorrect nested field: %#v", doc["Nested"])
+	}
+}
+
+func testInsertUniqueIDs(t *testing.T, client storage.Client, collection string) {
+	ctx := context.Background()
+	ids := map[string]bool{}
+	for i := 0; i < 10; i++ {
+		id, err := client.Insert(ctx, collection, &testDoc{Name: fmt.Sprint(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ids[id] {
+			t.Fatalf("duplicate ID %s", id)
+		}
+		ids[id] = true
+	}
+	docs, err := client.List(ctx, collection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 10 {
+		t.Errorf("expected 10 documents, got %d", len(docs))
+	}
+}
+
+func testInsertWithIDExists(t *testing.T, client storage.Client, collection string) {
+	ctx := context.Background()
+	if err := client.InsertWithID(ctx, collection, "doc", &testDoc{Name: "first"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.InsertWithID(ctx, collection, "doc", &testDoc{Name: "second"}); !errors.Is(err, storage.ErrAlreadyExists) {
+		t.Errorf("expected ErrAlreadyExists, got %v", err)
+	}
+	if doc, err := client.Read(ctx, collection, "doc"); err != nil || doc["Name"] != "first" {
+		t.Errorf("existing document should not be overwritten: %v %v", doc, err)
+	}
+}
+
+func testInsertWithIDConcurrent(t *testing.T, client storage.Client, collection string) {
+	ctx := context.Background()
+	const attempts = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, attempts)
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- client.InsertWithID(ctx, collection, "doc", &testDoc{Name: fmt.Sprint(i)})
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	var succeeded int
+	for err := range errs {
+		if err == nil {
+			succeeded++
+		} else if !errors.Is(err, storage.ErrAlreadyExists) {
+			t.Error("unexpected error:", err)
+		}
+	}
+	if succeeded != 1 {
+		t.Errorf("expected exactly one insert to succeed, %d did", succeeded)
+	}
+}
+
+func testReadMissing(t *testing.T, client storage.Client, collection string) {
+	if _, err := client.Read(context.Background(), collection, "missing"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func testUpdate(t *testing.T, client storage.Client, collection string) {
+	ctx := context.Background()
+	if err := client.Update(ctx, collection, "missing", &testDoc{}); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("expected ErrNotFound updating a missing document, got %v", err)
+	}
+	if err := client.InsertWithID(ctx, collection, "doc", &testDoc{Name: "a", Group: "g"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Update(ctx, collection, "doc", &testDoc{Name: "b"}); err != nil {
+		t.Fatal(err)
+	}
+	doc, err := client.Read(ctx, collection, "doc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc["Name"] != "b" || doc["Group"] != "" {
+		t.Errorf("update should replace the document: %v", doc)
+	}
+}
+
+func testUpdateFields(t *testing.T, client storage.Client, collection string) {
+	ctx := context.Background()
+	if err := client.UpdateFields(ctx, collection, "missing", map[string]interface{}{"Name": "b"}); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("expected ErrNotFound updating a missing document, got %v", err)
+	}
+	if err := client.InsertWithID(ctx, collection, "doc", &testDoc{Name: "a", Group: "g", Count: 1}); err != nil {
+		t.Fatal(err)
+	}
+	created := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	if err := client.UpdateFields(ctx, collection, "doc", map[string]interface{}{"Name": "b", "Created": created}); err != nil {
+		t.Fatal(err)
+	}
+	doc, err := client.Read(ctx, collection, "doc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc["Name"] != "b" || doc["Group"] != "g" || doc["Count"] != int64(1) {
+		t.Errorf("only the named fields should change: %v", doc)
+	}
+	if c, ok := doc["Created"].(time.Time); !ok || !c.Equal(created) {
+		t.Errorf("unexpected time field: %v", doc["Created"])
+	}
+}
+
+func testUpdateFieldsIf(t *testing.T, client storage.Client, collection string) {
+	ctx := context.Background()
+	fields := map[string]interface{}{"Group": "claimed", "Count": 2}
+	if err := client.UpdateFieldsIf(ctx, collection, "missing", "Group", "", fields); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("expected ErrNotFound updating a missing document, got %v", err)
+	}
+	if err := client.InsertWithID(ctx, collection, "doc", &testDoc{Name: "a", Count: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.UpdateFieldsIf(ctx, collection, "doc", "Group", "other", fields); !errors.Is(err, storage.ErrConflict) {
+		t.Errorf("expected ErrConflict when the field has another value, got %v", err)
+	}
+	// An empty string matches the empty field
+	if err := client.UpdateFieldsIf(ctx, collection, "doc", "Group", "", fields); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.UpdateFieldsIf(ctx, collection, "doc", "Group", "", map[string]interface{}{"Count": 3}); !errors.Is(err, storage.ErrConflict) {
+		t.Errorf("expected ErrConflict once the field has changed, got %v", err)
+	}
+	doc, err := client.Read(ctx, collection, "doc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc["Name"] != "a" || doc["Group"] != "claimed" || doc["Count"] != int64(2) {
+		t.Errorf("only the first update should be applied: %v", doc)
+	}
+	// A field that isn't set only matches an empty string
+	if err = client.UpdateFieldsIf(ctx, collection, "doc", "Missing", "", map[string]interface{}{"Count": 4}); err != nil {
+		t.Error(err)
+	}
+}
+
+func testInsertAll(t *testing.T, client storage.Client, collection string) {
+	ctx := context.Background()
+	other := collection + "-other"
+	writes := []storage.Write{
+		{Collection: collection, ID: "a", Data: &testDoc{Name: "a"}},
+		{Collection: other, ID: "b", Data: &testDoc{Name: "b"}},
+	}
+	if err := client.InsertAll(ctx, writes...); err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range writes {
+		if doc, err := client.Read(ctx, w.Collection, w.ID); err != nil || doc["Name"] != w.ID {
+			t.Errorf("expected %s to be inserted, got %v %v", w.ID, doc, err)
+		}
+	}
+	// Nothing is written when one of the documents exists
+	err := client.InsertAll(ctx,
+		storage.Write{Collection: collection, ID: "c", Data: &testDoc{Name: "c"}},
+		storage.Write{Collection: other, ID: "b", Data: &testDoc{Name: "changed"}})
+	if !errors.Is(err, storage.ErrAlreadyExists) {
+		t.Errorf("expected ErrAlreadyExists, got %v", err)
+	}
+	if exists, _ := client.Exists(ctx, collection, "c"); exists {
+		t.Error("no document should be inserted when one already exists")
+	}
+	if doc, _ := client.Read(ctx, other, "b"); doc["Name"] != "b" {
+		t.Errorf("existing document should not change: %v", doc)
+	}
+}
+
+func testCommit(t *testing.T, client storage.Client, collection string) {
+	ctx := context.Background()
+	other := collection + "-other"
+	if err := client.InsertWithID(ctx, collection, "a", &testDoc{Name: "a", Group: "one"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.InsertWithID(ctx, other, "b", &testDoc{Name: "b", Group: "one"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing is written when any write fails
+	failing := [][]storage.Write{
+		{storage.UpdateIf(collection, "a", "Group", "two", map[string]interface{}{"Count": 1})},
+		{storage.DeleteIf(other, "b", "Group", "two")},
+		{{Collection: collection, ID: "missing", Op: storage.OpUpdate, Fields: map[string]interface{}{"Count": 1}}},
+		{{Collection: collection, ID: "missing", Op: storage.OpDelete}},
+		{{Collection: other, ID: "b", Data: &testDoc{Name: "changed"}}},
+	}
+	expected := []error{storage.ErrConflict, storage.ErrConflict, storage.ErrNotFound, storage.ErrNotFound, storage.ErrAlreadyExists}
+	for i, writes := range failing {
+		writes = append([]storage.Write{
+			{Collection: collection, ID: "c", Data: &testDoc{Name: "c"}},
+			storage.UpdateIf(collection, "a", "Group", "one", map[string]interface{}{"Name": "changed"}),
+		}, writes...)
+		if err := client.Commit(ctx, writes...); !errors.Is(err, expected[i]) {
+			t.Errorf("commit %d: expected %v, got %v", i, expected[i], err)
+		}
+	}
+	if exists, _ := client.Exists(ctx, collection, "c"); exists {
+		t.Error("no document should be inserted when a write fails")
+	}
+	if doc, _ := client.Read(ctx, collection, "a"); doc["Name"] != "a" {
+		t.Errorf("no document should be updated when a write fails: %v", doc)
+	}
+
+	err := client.Commit(ctx,
+		storage.Write{Collection: collection, ID: "c", Data: &testDoc{Name: "c"}},
+		storage.UpdateIf(collection, "a", "Group", "one", map[string]interface{}{"Group": "two", "Count": 2}),
+		storage.DeleteIf(other, "b", "Group", "one"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := client.Exists(ctx, collection, "c"); !exists {
+		t.Error("expected c to be inserted")
+	}
+	if doc, _ := client.Read(ctx, collection, "a"); doc["Name"] != "a" || doc["Group"] != "two" || doc["Count"] != int64(2) {
+		t.Errorf("expected only the named fields of a to be updated: %v", doc)
+	}
+	if exists, _ := client.Exists(ctx, other, "b"); exists {
+		t.Error("expected b to be deleted")
+	}
+}
+
+func testDelete(t *testing.T, client storage.Client, collection string) {
+	ctx := context.Background()
+	if err := client.InsertWithID(ctx, collection, "doc", &testDoc{Name: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Delete(ctx, collection, "doc"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Read(ctx, collection, "doc"); !errors.Is(err, storage.ErrNotFound) {
+		t.Errorf("expected ErrNotFound after delete, got %v", err)
+	}
+	if err := client.Delete(ctx, collection, "doc"); err != nil {
+		t.Errorf("deleting a missing document should not fail, got %v", err)
+	}
+}
+
+func testExists(t *testing.T, client storage.Client, collection string) {
+	ctx := context.Background()
+	if ok, err := client.Exists(ctx, collection, "doc"); ok || err != nil {
+		t.Errorf("missing document should not exist: %v %v", ok, err)
+	}
+	if err := client.InsertWithID(ctx, collection, "doc", &testDoc{Name: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := client.Exists(ctx, collection, "doc"); !ok || err != nil {
+		t.Errorf("document should exist: %v %v", ok, err)
+	}
+}
+
+func testCollectionsIsolated(t *testing.T, client storage.Client, collection string) {
+	ctx := context.Background()
+	if err := client.InsertWithID(ctx, collection+"-a", "doc", &testDoc{Name: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.InsertWithID(ctx, collection+"-b", "doc", &testDoc{Name: "b"}); err != nil {
+		t.Errorf("the same ID should be usable in another collection: %v", err)
+	}
+	docs, err := client.Where(ctx, collection+"-b", "Name", "==", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 0 {
+		t.Error("documents from another collection should not be returned")
+	}
+}
+
+func testWhere(t *testing.T, client storage.Client, collection string) {
+	ctx := context.Background()
+	seed := map[string]*testDoc{
+		"a": {Name: "alpha", Group: "one", Count: 1, Tags: []string{"red", "green"}},
+		"b": {Name: "bravo", Group: "one", Count: 2, Tags: []string{"blue"}},
+		"c": {Name: "charlie", Group: "two", Count: 3},
+		"d": {Name: "delta", Group: "three", Count: 4, Tags: []string{"green"}},
+	}
+	for id, d := range seed {
+		if err := client.InsertWithID(ctx, collection, id, d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		key, op, value string
+		want           []string
+	}{
+		{"Group", "==", "one", []string{"a", "b"}},
+		{"Group", "!=", "one", []string{"c", "d"}},
+		{"Name", "<", "charlie", []string{"a", "b"}},
+		{"Name", "<=", "charlie", []string{"a", "b", "c"}},
+		{"Name", ">", "charlie", []string{"d"}},
+		{"Name", ">=", "charlie", []string{"c", "d"}},
+		{"Tags", "array-contains", "green", []string{"a", "d"}},
+		{"Tags", "array-contains-any", "blue,red", []string{"a", "b"}},
+		{"Group", "in", "two,three", []string{"c", "d"}},
+		{"Group", "not-in", "one,two", []string{"d"}},
+		{"Missing", "==", "x", []string{}},
+		// The value is a string so it never equals a numeric field
+		{"Count", "==", "1", []string{}},
+	}
+	for _, tc := range tests {
+		docs, err := client.Where(ctx, collection, tc.key, tc.op, tc.value)
+		if err != nil {
+			t.Errorf("%s %s %s: %v", tc.key, tc.op, tc.value, err)
+			continue
+		}
+		got := make([]string, 0, len(docs))
+		for id := range docs {
+			got = append(got, id)
+		}
+		sort.Strings(got)
+		if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Errorf("%s %s %s: expected %v got %v", tc.key, tc.op, tc.value, tc.want, got)
+		}
+	}
+}
+
+func testListPage(t *testing.T, client storage.Client, collection string) {
+	ctx := context.Background()
+	for _, id := range []string{"d", "b", "e", "a", "c"} {
+		if err := client.InsertWithID(ctx, collection, id, &testDoc{Name: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var got []string
+	after := ""
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatal("expected 3 pages")
+		}
+		page, err := client.ListPage(ctx, collection, after, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page) == 0 {
+			break
+		}
+		for _, d := range page {
+			if d.Data["Name"] != d.ID {
+				t.Errorf("unexpected data for %s: %v", d.ID, d.Data)
+			}
+			got = append(got, d.ID)
+		}
+		after = page[len(page)-1].ID
+	}
+	if fmt.Sprint(got) != "[a b c d e]" {
+		t.Errorf("expected every document in ID order, got %v", got)
+	}
+	if page, err := client.ListPage(ctx, collection, "b", 10); err != nil || len(page) != 3 || page[0].ID != "c" {
+		t.Errorf("expected the documents after b, got %v %v", page, err)
+	}
+}
+
+func testListBefore(t *testing.T, client storage.Client, collection string) {
+	ctx := context.Background()
+	base := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	for id, offset := range map[string]int{"a": 3, "b": 1, "c": 2, "d": 10} {
+		if err := client.InsertWithID(ctx, collection, id, &testDoc{Name: id, Created: base.Add(time.Duration(offset) * time.Minute)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	page, err := client.ListBefore(ctx, collection, "Created", base.Add(5*time.Minute), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]string, len(page))
+	for i, d := range page {
+		got[i] = d.ID
+	}
+	if fmt.Sprint(got) != "[b c a]" {
+		t.Errorf("expected the documents at or before the time in order, got %v", got)
+	}
+	if page, err = client.ListBefore(ctx, collection, "Created", base.Add(3*time.Minute), 1); err != nil || len(page) != 1 || page[0].ID != "b" {
+		t.Errorf("expected the earliest document, got %v %v", page, err)
+	}
+}
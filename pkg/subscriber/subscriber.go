@@ -0,0 +1,320 @@
+// Package subscriber applies user lifecycle events published by other services, such as the profile service deleting or
+// suspending a user, to login records. Each subscription is bound to an Action.
+//
+// Messages are JSON objects with an id, used to ignore redelivered messages, the userId to act on and an optional reason:
+//
+//	{"id": "4f1c...", "userId": "a1b2...", "reason": "account closed by user"}
+//
+// The event queue acknowledges a message once it has been handled, so handling failures are retried here with backoff.
+// Messages that can't be parsed, or that still fail after every attempt, are recorded in the dead letter collection. Neither
+// collection holds personal data, so they don't need erasing or exporting with the rest of a user's data
+package subscriber
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blueambertech-demos/login-svc-gcp/data"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/audit"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/login"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/redact"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/session"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/storage"
+	"github.com/blueambertech/pubsub"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+const (
+	// ProcessedCollection records the messages that have been handled, keyed by a hash of the subscription and message ID. The
+	// entries only hold the subscription and the time
+	ProcessedCollection = "processed-messages"
+	// DeadLetterCollection records the messages that could not be handled, see DeadLetter
+	DeadLetterCollection = "dead-letters"
+
+	// DefaultRefreshRate is how often subscriptions are checked for new messages
+	DefaultRefreshRate = time.Second
+	// DefaultMaxAttempts is how many times a message is tried before it is dead lettered
+	DefaultMaxAttempts = 5
+
+	retryBackoff = 100 * time.Millisecond
+	restartDelay = 5 * time.Second
+)
+
+// Action is what is done to the login of the user named in a message
+type Action string
+
+const (
+	// ActionDelete erases the login and its sessions
+	ActionDelete Action = "delete"
+	// ActionDisable disables the login so it can't be used to log in and its tokens are rejected
+	ActionDisable Action = "disable"
+	// ActionRevokeSessions revokes every session of the login
+	ActionRevokeSessions Action = "revoke-sessions"
+)
+
+// Outcomes of handling a message
+const (
+	OutcomeApplied    = "applied"
+	OutcomeDuplicate  = "duplicate"
+	OutcomeDeadLetter = "dead_letter"
+)
+
+// ErrPoisonMessage is the reason given for dead lettering a message that can never be handled
+var ErrPoisonMessage = errors.New("subscriber: message is not a valid lifecycle event")
+
+var messagesCounter, _ = otel.Meter(data.ServiceName).Int64Counter("subscriber.messages",
+	metric.WithDescription("Number of lifecycle messages received, by subscription and outcome"))
+
+// Message is a user lifecycle event from another service
+type Message struct {
+	ID     string `json:"id"`
+	UserID string `json:"userId"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// DeadLetter records a message that could not be handled. The body is not kept as it holds the user ID and reason, the message
+// is identified by its ID and the SHA-256 of its body so that it can be found in the publisher's copy and sent again. The user
+// ID is replaced in the error
+type DeadLetter struct {
+	Subscription string
+	MessageID    string
+	Digest       string
+	Error        string
+	Attempts     int
+	Time         time.Time
+}
+
+// ParseBindings parses a comma separated list of subscription=action pairs, such as "user-deleted=delete,user-suspended=disable"
+func ParseBindings(s string) (map[string]Action, error) {
+	bindings := map[string]Action{}
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		subID, action, ok := strings.Cut(pair, "=")
+		subID, action = strings.TrimSpace(subID), strings.TrimSpace(action)
+		if !ok || subID == "" {
+			return nil, fmt.Errorf("invalid subscription binding %q, expected subscription=action", pair)
+		}
+		switch Action(action) {
+		case ActionDelete, ActionDisable, ActionRevokeSessions:
+			bindings[subID] = Action(action)
+		default:
+			return nil, fmt.Errorf("unknown action %q for subscription %s, expected delete, disable or revoke-sessions", action, subID)
+		}
+	}
+	return bindings, nil
+}
+
+// Subscriber consumes lifecycle messages from a set of subscriptions
+type Subscriber struct {
+	queue      pubsub.Handler
+	repo       login.Repository
+	dbClient   storage.Client
+	eventQueue pubsub.Handler
+	auditLog   *audit.Log
+	bindings   map[string]Action
+
+	// RefreshRate is passed to the queue's Subscribe and MaxAttempts is how many times a message is tried before it is dead
+	// lettered
+	RefreshRate time.Duration
+	MaxAttempts int
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// New returns a Subscriber that receives messages from queue and applies them to the logins in repo. Events caused by the
+// changes, such as a login being deleted, are published to eventQueue and each change is recorded in auditLog
+func New(queue pubsub.Handler, repo login.Repository, dbClient storage.Client, eventQueue pubsub.Handler, auditLog *audit.Log, bindings map[string]Action) *Subscriber {
+	return &Subscriber{
+		queue:       queue,
+		repo:        repo,
+		dbClient:    dbClient,
+		eventQueue:  eventQueue,
+		auditLog:    auditLog,
+		bindings:    bindings,
+		RefreshRate: DefaultRefreshRate,
+		MaxAttempts: DefaultMaxAttempts,
+	}
+}
+
+// Start subscribes to each bound subscription in the background until Stop is called
+func (s *Subscriber) Start(ctx context.Context) {
+	ctx, s.cancel = context.WithCancel(ctx)
+	for subID, action := range s.bindings {
+		s.wg.Add(1)
+		go func(subID string, action Action) {
+			defer s.wg.Done()
+			s.run(ctx, subID, action)
+		}(subID, action)
+	}
+}
+
+// Stop stops receiving messages and waits for the messages being handled, it returns early if ctx is done first
+func (s *Subscriber) Stop(ctx context.Context) error {
+	if s.cancel == nil {
+		return nil
+	}
+	s.cancel()
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// run subscribes until ctx is done, subscribing again if the subscription fails
+func (s *Subscriber) run(ctx context.Context, subID string, action Action) {
+	for {
+		err := s.queue.Subscribe(ctx, subID, s.RefreshRate, func(c context.Context, msg []byte) {
+			// Handling is finished even when shutting down so that a message is never acknowledged half applied
+			s.Handle(context.WithoutCancel(c), subID, action, msg)
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Subscription %s failed, restarting: %v", subID, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(restartDelay):
+		}
+	}
+}
+
+// Handle applies one message and returns the outcome. A message that has already been applied is ignored
+func (s *Subscriber) Handle(ctx context.Context, subID string, action Action, msgData []byte) string {
+	outcome := s.handle(ctx, subID, action, msgData)
+	messagesCounter.Add(ctx, 1, metric.WithAttributes(attribute.String("subscription", subID), attribute.String("outcome", outcome)))
+	return outcome
+}
+
+func (s *Subscriber) handle(ctx context.Context, subID string, action Action, msgData []byte) string {
+	var msg Message
+	if err := json.Unmarshal(msgData, &msg); err != nil || msg.UserID == "" {
+		s.deadLetter(ctx, subID, &msg, msgData, ErrPoisonMessage, 1)
+		return OutcomeDeadLetter
+	}
+	key := processedKey(subID, &msg, msgData)
+	if _, err := s.dbClient.Read(ctx, ProcessedCollection, key); err == nil {
+		return OutcomeDuplicate
+	}
+
+	var err error
+	for attempt := 1; attempt <= s.MaxAttempts; attempt++ {
+		if err = s.apply(ctx, subID, action, &msg); err == nil {
+			break
+		}
+		if attempt == s.MaxAttempts {
+			s.deadLetter(ctx, subID, &msg, msgData, err, attempt)
+			return OutcomeDeadLetter
+		}
+		time.Sleep(retryBackoff << (attempt - 1))
+	}
+	// If this fails the message is applied again when it is redelivered, which every action allows
+	processed := map[string]interface{}{"Subscription": subID, "Time": time.Now().UTC()}
+	if err = s.dbClient.InsertWithID(ctx, ProcessedCollection, key, processed); err != nil && !errors.Is(err, storage.ErrAlreadyExists) {
+		log.Printf("Failed to record message %s on %s as processed: %v", key, subID, err)
+	}
+	return OutcomeApplied
+}
+
+// apply carries out the action for a message and audits it, a login that doesn't exist is treated as already handled
+func (s *Subscriber) apply(ctx context.Context, subID string, action Action, msg *Message) error {
+	reason := msg.Reason
+	if reason == "" {
+		reason = "received on " + subID
+	}
+	var err error
+	var auditType string
+	switch action {
+	case ActionDelete:
+		auditType = audit.AccountDeleted
+		err = login.DeleteLogin(ctx, s.repo, s.dbClient, s.eventQueue, s.auditLog, msg.UserID, nil)
+	case ActionDisable:
+		auditType = audit.StatusChanged
+		err = login.SetStatus(ctx, s.repo, s.eventQueue, msg.UserID, data.StatusDisabled, reason, nil)
+	case ActionRevokeSessions:
+		auditType = audit.SessionsRevoked
+		if _, err = s.repo.GetByID(ctx, msg.UserID); err == nil {
+			_, err = session.RevokeAll(ctx, s.dbClient, msg.UserID)
+		}
+	default:
+		return fmt.Errorf("unknown action %q", action)
+	}
+	if errors.Is(err, login.ErrUserNotFound) {
+		return nil
+	}
+	s.audit(ctx, auditType, subID, msg, reason, err)
+	return err
+}
+
+// audit records an action taken for a message, there is no actor as the change was made by another service
+func (s *Subscriber) audit(ctx context.Context, auditType, subID string, msg *Message, reason string, err error) {
+	rec := &audit.Record{
+		Type:     auditType,
+		TargetID: msg.UserID,
+		Outcome:  audit.Success,
+		Reason:   subID + ": " + reason,
+	}
+	if auditType == audit.StatusChanged {
+		rec.Reason = subID + ": " + string(data.StatusDisabled) + ": " + reason
+	}
+	if err != nil {
+		rec.Outcome = audit.Failure
+		rec.Reason = subID + ": " + err.Error()
+	}
+	if aErr := s.auditLog.Write(ctx, rec); aErr != nil {
+		log.Printf("Failed to audit %s of %s from %s: %v", auditType, msg.UserID, subID, aErr)
+	}
+}
+
+func (s *Subscriber) deadLetter(ctx context.Context, subID string, msg *Message, msgData []byte, reason error, attempts int) {
+	digest := sha256.Sum256(msgData)
+	dl := DeadLetter{
+		Subscription: subID,
+		MessageID:    msg.ID,
+		Digest:       hex.EncodeToString(digest[:]),
+		Error:        reason.Error(),
+		Attempts:     attempts,
+		Time:         time.Now().UTC(),
+	}
+	if msg.UserID != "" {
+		dl.Error = strings.ReplaceAll(dl.Error, msg.UserID, redact.Placeholder)
+	}
+	id, err := storage.NewID()
+	if err == nil {
+		err = s.dbClient.InsertWithID(ctx, DeadLetterCollection, id, &dl)
+	}
+	if err != nil {
+		log.Printf("Failed to dead letter message %s on %s: %v", dl.Digest, subID, err)
+	}
+}
+
+// processedKey identifies a message for idempotency, messages without an ID are identified by their content. The message ID
+// comes from another service so it is hashed rather than used as a document ID, which can't contain some characters
+func processedKey(subID string, msg *Message, msgData []byte) string {
+	key := subID + "\x00id\x00" + msg.ID
+	if msg.ID == "" {
+		key = subID + "\x00body\x00" + string(msgData)
+	}
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:])
+}
@@ -0,0 +1,221 @@
+package subscriber_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blueambertech-demos/login-svc-gcp/data"
+	"github.com/blueambertech-demos/login-svc-gcp/mock"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/audit"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/login"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/session"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/subscriber"
+)
+
+var errUnavailable = errors.New("storage unavailable")
+
+// flakyRepository fails the first reads by ID, the error names the login as storage errors can
+type flakyRepository struct {
+	login.Repository
+	failures int
+}
+
+func (r *flakyRepository) GetByID(ctx context.Context, id string) (*login.Record, error) {
+	if r.failures > 0 {
+		r.failures--
+		return nil, fmt.Errorf("reading login %s: %w", id, errUnavailable)
+	}
+	return r.Repository.GetByID(ctx, id)
+}
+
+func newAuditLog(dbClient *mock.NoSQLClient) *audit.Log {
+	return audit.New(dbClient, &mock.PubSubHandler{}, mock.NewSecretManager())
+}
+
+func addUser(t *testing.T, repo login.Repository, userName string) string {
+	t.Helper()
+	ctx := context.Background()
+	if err := login.AddLogin(ctx, repo, &mock.PubSubHandler{}, userName, "password", nil); err != nil {
+		t.Fatal(err)
+	}
+	rec, err := repo.GetByUsername(ctx, userName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rec.ID
+}
+
+// waitFor polls until check returns true or a second has passed
+func waitFor(t *testing.T, what string, check func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !check() {
+		if time.Now().After(deadline) {
+			t.Error("timed out waiting for", what)
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestParseBindings(t *testing.T) {
+	bindings, err := subscriber.ParseBindings("user-deleted=delete, user-suspended=disable,")
+	if err != nil || len(bindings) != 2 || bindings["user-suspended"] != subscriber.ActionDisable {
+		t.Errorf("unexpected bindings: %v, %v", bindings, err)
+	}
+	if bindings, err = subscriber.ParseBindings(""); err != nil || len(bindings) != 0 {
+		t.Error("empty bindings should be allowed, got", err)
+	}
+	for _, s := range []string{"user-deleted", "user-deleted=explode", "=delete"} {
+		if _, err = subscriber.ParseBindings(s); err == nil {
+			t.Error("expected an error parsing", s)
+		}
+	}
+}
+
+func TestSubscriberAppliesMessages(t *testing.T) {
+	ctx := context.Background()
+	dbClient := mock.NewNoSQLClient()
+	repo := login.NewFirestoreRepository(dbClient)
+	queue := &mock.PubSubHandler{}
+	deleted := addUser(t, repo, "deleted@test.com")
+	suspended := addUser(t, repo, "suspended@test.com")
+	if err := session.Create(ctx, dbClient, &data.Session{ID: "s1", UserID: suspended, ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+
+	auditLog := newAuditLog(dbClient)
+	sub := subscriber.New(queue, repo, dbClient, &mock.PubSubHandler{}, auditLog, map[string]subscriber.Action{
+		"user-deleted":   subscriber.ActionDelete,
+		"user-suspended": subscriber.ActionDisable,
+		"user-signout":   subscriber.ActionRevokeSessions,
+	})
+	sub.RefreshRate = time.Millisecond
+	sub.Start(ctx)
+
+	_ = queue.Push(ctx, "user-deleted", `{"id":"m1","userId":"`+deleted+`"}`)
+	_ = queue.Push(ctx, "user-suspended", `{"id":"m2","userId":"`+suspended+`","reason":"terms violation"}`)
+	_ = queue.Push(ctx, "user-signout", `{"id":"m3","userId":"`+suspended+`"}`)
+	waitFor(t, "the login to be deleted", func() bool {
+		_, err := repo.GetByID(ctx, deleted)
+		return errors.Is(err, login.ErrUserNotFound)
+	})
+	waitFor(t, "the login to be disabled", func() bool {
+		rec, err := repo.GetByID(ctx, suspended)
+		return err == nil && rec.Status == data.StatusDisabled && rec.StatusReason == "terms violation"
+	})
+	waitFor(t, "the sessions to be revoked", func() bool {
+		sessions, err := session.List(ctx, dbClient, suspended)
+		return err == nil && len(sessions) == 0
+	})
+
+	stopCtx, canc := context.WithTimeout(ctx, time.Second)
+	defer canc()
+	if err := sub.Stop(stopCtx); err != nil {
+		t.Error(err)
+	}
+
+	// Every change is audited with the subscription it was received on
+	for userID, types := range map[string][]string{
+		deleted:   {audit.AccountDeleted},
+		suspended: {audit.StatusChanged, audit.SessionsRevoked},
+	} {
+		records, err := auditLog.Query(ctx, userID, time.Time{}, time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := map[string]bool{}
+		for _, rec := range records {
+			if rec.Outcome == audit.Success && rec.ActorID == "" && strings.HasPrefix(rec.Reason, "user-") {
+				found[rec.Type] = true
+			}
+		}
+		for _, typ := range types {
+			if !found[typ] {
+				t.Errorf("expected %s of %s to be audited, got %+v", typ, userID, records)
+			}
+		}
+	}
+}
+
+func TestSubscriberIdempotent(t *testing.T) {
+	ctx := context.Background()
+	dbClient := mock.NewNoSQLClient()
+	repo := login.NewFirestoreRepository(dbClient)
+	sub := subscriber.New(&mock.PubSubHandler{}, repo, dbClient, &mock.PubSubHandler{}, newAuditLog(dbClient), nil)
+	userID := addUser(t, repo, "hello@test.com")
+
+	// The message ID is chosen by another service, it is never used as a document ID
+	msg := []byte(`{"id":"m1/../x","userId":"` + userID + `"}`)
+	if outcome := sub.Handle(ctx, "user-suspended", subscriber.ActionDisable, msg); outcome != subscriber.OutcomeApplied {
+		t.Error("expected the first delivery to be applied, got", outcome)
+	}
+	if err := login.SetStatus(ctx, repo, &mock.PubSubHandler{}, userID, data.StatusActive, "appeal upheld", nil); err != nil {
+		t.Fatal(err)
+	}
+	if outcome := sub.Handle(ctx, "user-suspended", subscriber.ActionDisable, msg); outcome != subscriber.OutcomeDuplicate {
+		t.Error("expected a redelivery to be ignored, got", outcome)
+	}
+	if rec, _ := repo.GetByID(ctx, userID); rec.Status != data.StatusActive {
+		t.Error("a redelivered message should not be applied again")
+	}
+	processed, _ := dbClient.List(ctx, subscriber.ProcessedCollection)
+	for id := range processed {
+		if len(id) != 64 || strings.Contains(id, "m1") {
+			t.Errorf("processed message key should be a hash, got %s", id)
+		}
+	}
+	missing := []byte(`{"id":"m2","userId":"missing"}`)
+	if outcome := sub.Handle(ctx, "user-deleted", subscriber.ActionDelete, missing); outcome != subscriber.OutcomeApplied {
+		t.Error("a message for a login that doesn't exist should be treated as applied, got", outcome)
+	}
+}
+
+func TestSubscriberDeadLetters(t *testing.T) {
+	ctx := context.Background()
+	dbClient := mock.NewNoSQLClient()
+	repo := &flakyRepository{Repository: login.NewFirestoreRepository(dbClient)}
+	sub := subscriber.New(&mock.PubSubHandler{}, repo, dbClient, &mock.PubSubHandler{}, newAuditLog(dbClient), nil)
+	sub.MaxAttempts = 3
+	userID := addUser(t, repo, "hello@test.com")
+
+	for _, msg := range []string{"not json", `{"id":"m1"}`} {
+		if outcome := sub.Handle(ctx, "user-deleted", subscriber.ActionDelete, []byte(msg)); outcome != subscriber.OutcomeDeadLetter {
+			t.Errorf("expected %s to be dead lettered, got %s", msg, outcome)
+		}
+	}
+
+	// Transient failures are retried
+	repo.failures = 2
+	msg := []byte(`{"id":"m2","userId":"` + userID + `"}`)
+	if outcome := sub.Handle(ctx, "user-signout", subscriber.ActionRevokeSessions, msg); outcome != subscriber.OutcomeApplied {
+		t.Error("expected the message to be applied after retrying, got", outcome)
+	}
+	repo.failures = 3
+	msg = []byte(`{"id":"m3","userId":"` + userID + `","reason":"closed by user"}`)
+	if outcome := sub.Handle(ctx, "user-signout", subscriber.ActionRevokeSessions, msg); outcome != subscriber.OutcomeDeadLetter {
+		t.Error("expected the message to be dead lettered after every attempt failed, got", outcome)
+	}
+
+	letters, _ := dbClient.List(ctx, subscriber.DeadLetterCollection)
+	if len(letters) != 3 {
+		t.Errorf("expected 3 dead letters, got %d", len(letters))
+	}
+	digest := sha256.Sum256(msg)
+	for _, l := range letters {
+		if l["Subscription"] == "user-signout" && (l["MessageID"] != "m3" || l["Digest"] != hex.EncodeToString(digest[:]) ||
+			!strings.Contains(l["Error"].(string), errUnavailable.Error()) || l["Attempts"] != int64(3)) {
+			t.Errorf("unexpected dead letter: %v", l)
+		}
+		// The body is not kept and the user ID is removed from the error
+		if s := fmt.Sprint(l); strings.Contains(s, userID) || strings.Contains(s, "closed by user") || strings.Contains(s, "not json") {
+			t.Errorf("dead letter should not hold the message body: %s", s)
+		}
+	}
+}
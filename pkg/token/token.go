@@ -0,0 +1,150 @@
+package token
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/blueambertech/secretmanager"
+	"github.com/golang-jwt/jwt"
+)
+
+const secretKeyName = "jwt-auth-token-key"
+
+// Claims are the claims carried by the JWTs issued by this service, the standard ID (jti) claim links a token to its session
+// and the subject (sub) claim holds the user ID. Scope is a space separated list of scopes as in RFC 8693
+type Claims struct {
+	jwt.StandardClaims
+	Roles []string `json:"roles,omitempty"`
+	Scope string   `json:"scope,omitempty"`
+}
+
+// HasRole reports whether the token was issued to a user with the role
+func (c *Claims) HasRole(role string) bool {
+	for _, r := range c.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// HasScope reports whether the token was granted the scope
+func (c *Claims) HasScope(scope string) bool {
+	for _, s := range strings.Fields(c.Scope) {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// New returns the claims for a new token belonging to the specified user, each token is given a unique ID
+func New(userID string, issuedAt time.Time, life time.Duration) (*Claims, error) {
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	return &Claims{
+		StandardClaims: jwt.StandardClaims{
+			Id:        id,
+			Subject:   userID,
+			IssuedAt:  issuedAt.Unix(),
+			ExpiresAt: issuedAt.Add(life).Unix(),
+		},
+	}, nil
+}
+
+// Sign creates a signed JWT containing the claims using the secret key stored in the secret manager
+func Sign(ctx context.Context, sm secretmanager.SecretManager, claims *Claims) (string, error) {
+	k, err := getSecretKey(ctx, sm)
+	if err != nil {
+		return "", err
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(k)
+}
+
+// Parse verifies a signed JWT and returns its claims
+func Parse(ctx context.Context, sm secretmanager.SecretManager, tokenString string) (*Claims, error) {
+	var claims Claims
+	t, err := jwt.ParseWithClaims(tokenString, &claims, func(t *jwt.Token) (interface{}, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
+		}
+		return getSecretKey(ctx, sm)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !t.Valid {
+		return nil, errors.New("token invalid")
+	}
+	return &claims, nil
+}
+
+// FromRequest extracts the bearer token string from the Authorization header of a request
+func FromRequest(r *http.Request) (string, error) {
+	tokenHeader := r.Header.Get("Authorization")
+	if tokenHeader == "" {
+		return "", errors.New("no auth header")
+	}
+	tokenString, ok := strings.CutPrefix(tokenHeader, "Bearer ")
+	if !ok || tokenString == "" {
+		return "", errors.New("invalid token format")
+	}
+	return tokenString, nil
+}
+
+func getSecretKey(ctx context.Context, sm secretmanager.SecretManager) ([]byte, error) {
+	secretKey, err := sm.Get(ctx, secretKeyName)
+	if err != nil {
+		return nil, err
+	}
+	switch v := secretKey.(type) {
+	case []byte:
+		return v, nil
+	case string:
+		return []byte(v), nil
+	default:
+		return nil, errors.New("secret value was an unrecognised type")
+	}
+}
+
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// CSRF returns the CSRF token for the token with the given ID. It is derived from the token ID using the secret key so it
+// can be checked without storing it, and cannot be forged without the key
+func CSRF(ctx context.Context, sm secretmanager.SecretManager, tokenID string) (string, error) {
+	k, err := getSecretKey(ctx, sm)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, k)
+	mac.Write([]byte("csrf:" + tokenID))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// VerifyCSRF checks that a CSRF token was issued for the token with the given ID
+func VerifyCSRF(ctx context.Context, sm secretmanager.SecretManager, tokenID, csrfToken string) error {
+	expected, err := CSRF(ctx, sm, tokenID)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(expected), []byte(csrfToken)) {
+		return errors.New("csrf token invalid")
+	}
+	return nil
+}
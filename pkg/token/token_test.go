@@ -0,0 +1,121 @@
+package token
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/blueambertech-demos/login-svc-gcp/mock"
+)
+
+func TestSignAndParse(t *testing.T) {
+	ctx := context.Background()
+	sm := mock.NewSecretManager()
+	claims, err := New("user-1", time.Now(), time.Hour)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	tokenString, err := Sign(ctx, sm, claims)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	result, err := Parse(ctx, sm, tokenString)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if result.Subject != "user-1" || result.Id != claims.Id {
+		t.Errorf("claims not preserved, expected %s/%s got %s/%s", "user-1", claims.Id, result.Subject, result.Id)
+	}
+}
+
+func TestRolesAndScope(t *testing.T) {
+	ctx := context.Background()
+	sm := mock.NewSecretManager()
+	claims, err := New("user-1", time.Now(), time.Hour)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	claims.Roles = []string{"user", "admin"}
+	claims.Scope = "account service"
+	tokenString, err := Sign(ctx, sm, claims)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	result, err := Parse(ctx, sm, tokenString)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !result.HasRole("admin") || result.HasRole("support") {
+		t.Error("roles not preserved:", result.Roles)
+	}
+	if !result.HasScope("service") || result.HasScope("serv") {
+		t.Error("scope not preserved:", result.Scope)
+	}
+}
+
+func TestParseExpired(t *testing.T) {
+	ctx := context.Background()
+	sm := mock.NewSecretManager()
+	claims, err := New("user-1", time.Now().Add(-2*time.Hour), time.Hour)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	tokenString, err := Sign(ctx, sm, claims)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err = Parse(ctx, sm, tokenString); err == nil {
+		t.Error("expired token should be rejected")
+	}
+}
+
+func TestNewUniqueIDs(t *testing.T) {
+	a, _ := New("user-1", time.Now(), time.Hour)
+	b, _ := New("user-1", time.Now(), time.Hour)
+	if a.Id == b.Id {
+		t.Error("token IDs should be unique")
+	}
+}
+
+func TestFromRequest(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	if _, err := FromRequest(r); err == nil {
+		t.Error("missing header should be rejected")
+	}
+	r.Header.Set("Authorization", "Basic abc")
+	if _, err := FromRequest(r); err == nil {
+		t.Error("non bearer header should be rejected")
+	}
+	r.Header.Set("Authorization", "Bearer abc")
+	if tokenString, err := FromRequest(r); err != nil || tokenString != "abc" {
+		t.Errorf("incorrect token extracted: %s, %v", tokenString, err)
+	}
+}
+
+func TestCSRF(t *testing.T) {
+	ctx := context.Background()
+	sm := mock.NewSecretManager()
+	csrfToken, err := CSRF(ctx, sm, "token-1")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if err = VerifyCSRF(ctx, sm, "token-1", csrfToken); err != nil {
+		t.Error(err)
+	}
+	if err = VerifyCSRF(ctx, sm, "token-2", csrfToken); err == nil {
+		t.Error("csrf token should not be valid for a different token ID")
+	}
+	if err = VerifyCSRF(ctx, sm, "token-1", ""); err == nil {
+		t.Error("empty csrf token should be rejected")
+	}
+}
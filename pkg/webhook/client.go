@@ -0,0 +1,63 @@
+package webhook
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// ErrBlockedAddress is returned when a delivery would connect to an address that isn't public
+var ErrBlockedAddress = errors.New("webhook: endpoint address is not public")
+
+// reservedNetworks are ranges that net.IP doesn't classify but that aren't public, "this network" and carrier grade NAT
+var reservedNetworks = []*net.IPNet{
+	{IP: net.IPv4(0, 0, 0, 0), Mask: net.CIDRMask(8, 32)},
+	{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)},
+}
+
+// NewClient returns a http client for delivering webhooks that only connects to public addresses. The address is checked when
+// each connection is made, after DNS resolution, so a registered hostname can't later be pointed at an internal service.
+// Redirects are not followed and proxies from the environment are not used, as either would connect somewhere other than the
+// checked address
+func NewClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout, Control: dialControl}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// dialControl refuses connections to addresses that aren't public, it is called with the resolved IP
+func dialControl(_, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !publicIP(ip) {
+		return fmt.Errorf("%w: %s", ErrBlockedAddress, host)
+	}
+	return nil
+}
+
+func publicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() ||
+		ip.IsUnspecified() {
+		return false
+	}
+	for _, n := range reservedNetworks {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
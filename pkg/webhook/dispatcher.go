@@ -0,0 +1,404 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/blueambertech-demos/login-svc-gcp/data"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/events"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/storage"
+	"github.com/blueambertech/pubsub"
+	"github.com/mitchellh/mapstructure"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+const (
+	// DeliveriesCollection holds the state of every delivery
+	DeliveriesCollection = "webhook-deliveries"
+
+	// DefaultSubscriptionID is the Pub/Sub subscription to the login events topic the dispatcher receives events from
+	DefaultSubscriptionID = "login-events-webhooks"
+	// DefaultMaxAttempts is how many times a delivery is tried before it is marked as failed
+	DefaultMaxAttempts = 8
+
+	// claimLease is how long a delivery claimed by a dispatcher is hidden from the others, a delivery whose dispatcher stops
+	// before sending it is picked up again once the lease is over
+	claimLease = time.Minute
+)
+
+// DeliveryState is the progress of a delivery
+type DeliveryState string
+
+const (
+	// StatePending deliveries are waiting for their next attempt
+	StatePending DeliveryState = "pending"
+	// StateDelivered deliveries were accepted with a 2xx response
+	StateDelivered DeliveryState = "delivered"
+	// StateFailed deliveries were not accepted after every attempt
+	StateFailed DeliveryState = "failed"
+)
+
+var deliveriesCounter, _ = otel.Meter(data.ServiceName).Int64Counter("webhook.delivery_attempts",
+	metric.WithDescription("Number of webhook delivery attempts, by outcome"))
+
+// Delivery is one event being sent to one subscription, its ID is the same for every attempt
+type Delivery struct {
+	ID             string        `json:"id"`
+	SubscriptionID string        `json:"subscriptionId"`
+	EventID        string        `json:"eventId"`
+	EventType      string        `json:"eventType"`
+	Body           string        `json:"-"`
+	State          DeliveryState `json:"state"`
+	Attempts       int           `json:"attempts"`
+	NextAttempt    time.Time     `json:"nextAttempt"`
+	LastStatus     int           `json:"lastStatus,omitempty"`
+	LastError      string        `json:"lastError,omitempty"`
+	CreatedAt      time.Time     `json:"createdAt"`
+	DeliveredAt    *time.Time    `json:"deliveredAt,omitempty"`
+	// UserID is the user the event is about, so that the deliveries of a user can be exported and erased
+	UserID string `json:"userId,omitempty"`
+	// ClaimID is set by the dispatcher that is sending the delivery
+	ClaimID string `json:"-"`
+}
+
+// Dispatcher receives login events from Pub/Sub and delivers them to the webhook subscriptions that want them. Received events
+// are only stored as pending deliveries, which are sent by the retry loop, and deliveries that fail are retried with
+// exponential backoff. Each delivery is claimed before it is sent so that dispatchers on several instances don't send it twice
+type Dispatcher struct {
+	dbClient storage.Client
+	queue    pubsub.Handler
+	client   *http.Client
+
+	// SubscriptionID is the Pub/Sub subscription events are received from, RefreshRate is passed to Subscribe and RetryInterval
+	// is how often pending deliveries are checked
+	SubscriptionID string
+	RefreshRate    time.Duration
+	RetryInterval  time.Duration
+	// MaxAttempts is how many times a delivery is tried, the delay after the first failure is MinBackoff and doubles with each
+	// failure up to MaxBackoff
+	MaxAttempts int
+	MinBackoff  time.Duration
+	MaxBackoff  time.Duration
+
+	retryMu sync.Mutex
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+// NewDispatcher returns a Dispatcher that receives events from queue and sends them with client, which should come from
+// NewClient
+func NewDispatcher(dbClient storage.Client, queue pubsub.Handler, client *http.Client) *Dispatcher {
+	return &Dispatcher{
+		dbClient:       dbClient,
+		queue:          queue,
+		client:         client,
+		SubscriptionID: DefaultSubscriptionID,
+		RefreshRate:    time.Second,
+		RetryInterval:  2 * time.Second,
+		MaxAttempts:    DefaultMaxAttempts,
+		MinBackoff:     10 * time.Second,
+		MaxBackoff:     time.Hour,
+	}
+}
+
+// Start receives events and retries failed deliveries in the background until Stop is called
+func (d *Dispatcher) Start(ctx context.Context) {
+	ctx, d.cancel = context.WithCancel(ctx)
+	d.wg.Add(2)
+	go func() {
+		defer d.wg.Done()
+		for ctx.Err() == nil {
+			err := d.queue.Subscribe(ctx, d.SubscriptionID, d.RefreshRate, func(c context.Context, msg []byte) {
+				if err := d.Dispatch(context.WithoutCancel(c), msg); err != nil {
+					log.Println("Failed to dispatch webhook event:", err)
+				}
+			})
+			if err != nil && ctx.Err() == nil {
+				log.Printf("Webhook subscription %s failed, restarting: %v", d.SubscriptionID, err)
+				select {
+				case <-ctx.Done():
+				case <-time.After(d.RetryInterval):
+				}
+			}
+		}
+	}()
+	go func() {
+		defer d.wg.Done()
+		ticker := time.NewTicker(d.RetryInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if _, err := d.RetryOnce(ctx); err != nil && ctx.Err() == nil {
+					log.Println("Failed to retry webhook deliveries:", err)
+				}
+			}
+		}
+	}()
+}
+
+// Stop stops receiving events and retrying deliveries, waiting for the work in progress unless ctx is done first. Pending
+// deliveries are retried when the service starts again
+func (d *Dispatcher) Stop(ctx context.Context) error {
+	if d.cancel == nil {
+		return nil
+	}
+	d.cancel()
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Dispatch creates a pending delivery of an event envelope for each subscription that wants it, the deliveries are sent by
+// RetryOnce. An event that is received again does not create new deliveries
+func (d *Dispatcher) Dispatch(ctx context.Context, msg []byte) error {
+	env, err := events.Parse(msg)
+	if err != nil {
+		// Nothing could ever deliver this message, so it isn't retried
+		log.Println("Dropping webhook event that can't be parsed:", err)
+		return nil
+	}
+	subs, err := listWithSecrets(ctx, d.dbClient)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	for i := range subs {
+		if !subs[i].Wants(env.Type) {
+			continue
+		}
+		del := Delivery{
+			ID:             env.ID + "-" + subs[i].ID,
+			SubscriptionID: subs[i].ID,
+			EventID:        env.ID,
+			EventType:      string(env.Type),
+			UserID:         env.UserID,
+			Body:           string(msg),
+			State:          StatePending,
+			NextAttempt:    now,
+			CreatedAt:      now,
+		}
+		err = d.dbClient.InsertWithID(ctx, DeliveriesCollection, del.ID, &del)
+		if err != nil && !errors.Is(err, storage.ErrAlreadyExists) {
+			return fmt.Errorf("storing webhook delivery: %w", err)
+		}
+	}
+	return nil
+}
+
+// RetryOnce attempts the pending deliveries that are due and returns how many were delivered. Deliveries to subscriptions that
+// have been deleted are marked as failed and deliveries claimed by another dispatcher are skipped
+func (d *Dispatcher) RetryOnce(ctx context.Context) (int, error) {
+	d.retryMu.Lock()
+	defer d.retryMu.Unlock()
+
+	pending, err := d.dbClient.Where(ctx, DeliveriesCollection, "State", "==", string(StatePending))
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	due := make([]Delivery, 0, len(pending))
+	for id, doc := range pending {
+		var del Delivery
+		if err = mapstructure.Decode(doc, &del); err != nil {
+			return 0, fmt.Errorf("decoding webhook delivery %s: %w", id, err)
+		}
+		if !del.NextAttempt.After(now) {
+			due = append(due, del)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].CreatedAt.Before(due[j].CreatedAt)
+	})
+
+	subs, err := listWithSecrets(ctx, d.dbClient)
+	if err != nil {
+		return 0, err
+	}
+	byID := make(map[string]*Subscription, len(subs))
+	for i := range subs {
+		byID[subs[i].ID] = &subs[i]
+	}
+	delivered := 0
+	for i := range due {
+		del := &due[i]
+		claimed, err := d.claim(ctx, del)
+		if err != nil {
+			return delivered, err
+		}
+		if !claimed {
+			continue
+		}
+		sub, ok := byID[del.SubscriptionID]
+		if !ok {
+			del.State, del.LastError = StateFailed, ErrNotFound.Error()
+			if err = d.dbClient.Update(ctx, DeliveriesCollection, del.ID, del); err != nil {
+				return delivered, err
+			}
+			continue
+		}
+		if err = d.attempt(ctx, sub, del); err != nil {
+			return delivered, err
+		}
+		if del.State == StateDelivered {
+			delivered++
+		}
+	}
+	return delivered, nil
+}
+
+// Deliveries returns the deliveries made to a subscription, most recent first
+func Deliveries(ctx context.Context, dbClient storage.Client, subscriptionID string) ([]Delivery, error) {
+	docs, err := dbClient.Where(ctx, DeliveriesCollection, "SubscriptionID", "==", subscriptionID)
+	if err != nil {
+		return nil, err
+	}
+	deliveries := make([]Delivery, 0, len(docs))
+	for id, doc := range docs {
+		var del Delivery
+		if err = mapstructure.Decode(doc, &del); err != nil {
+			return nil, fmt.Errorf("decoding webhook delivery %s: %w", id, err)
+		}
+		deliveries = append(deliveries, del)
+	}
+	sort.Slice(deliveries, func(i, j int) bool {
+		return deliveries[i].CreatedAt.After(deliveries[j].CreatedAt)
+	})
+	return deliveries, nil
+}
+
+// UserDeliveries returns the deliveries of events about a user, most recent first
+func UserDeliveries(ctx context.Context, dbClient storage.Client, userID string) ([]Delivery, error) {
+	docs, err := dbClient.Where(ctx, DeliveriesCollection, "UserID", "==", userID)
+	if err != nil {
+		return nil, err
+	}
+	deliveries := make([]Delivery, 0, len(docs))
+	for id, doc := range docs {
+		var del Delivery
+		if err = mapstructure.Decode(doc, &del); err != nil {
+			return nil, fmt.Errorf("decoding webhook delivery %s: %w", id, err)
+		}
+		deliveries = append(deliveries, del)
+	}
+	sort.Slice(deliveries, func(i, j int) bool {
+		return deliveries[i].CreatedAt.After(deliveries[j].CreatedAt)
+	})
+	return deliveries, nil
+}
+
+// DeleteUserDeliveries removes the deliveries of events about a user, including any still pending, and returns the number
+// deleted
+func DeleteUserDeliveries(ctx context.Context, dbClient storage.Client, userID string) (int, error) {
+	docs, err := dbClient.Where(ctx, DeliveriesCollection, "UserID", "==", userID)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for id := range docs {
+		if err = dbClient.Delete(ctx, DeliveriesCollection, id); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// claim gives a delivery a new claim ID and moves its next attempt to the end of the lease, if the claim ID is still the one it
+// was read with. It returns false if another dispatcher claimed or removed the delivery first
+func (d *Dispatcher) claim(ctx context.Context, del *Delivery) (bool, error) {
+	claimID, err := storage.NewID()
+	if err != nil {
+		return false, err
+	}
+	next := time.Now().Add(claimLease).UTC()
+	err = d.dbClient.UpdateFieldsIf(ctx, DeliveriesCollection, del.ID, "ClaimID", del.ClaimID, map[string]interface{}{
+		"ClaimID":     claimID,
+		"NextAttempt": next,
+	})
+	if errors.Is(err, storage.ErrConflict) || errors.Is(err, storage.ErrNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("claiming webhook delivery %s: %w", del.ID, err)
+	}
+	del.ClaimID, del.NextAttempt = claimID, next
+	return true, nil
+}
+
+// attempt sends a delivery once and stores its new state, the returned error is only for a failure to store the state
+func (d *Dispatcher) attempt(ctx context.Context, sub *Subscription, del *Delivery) error {
+	del.Attempts++
+	status, err := d.send(ctx, sub, del)
+	del.LastStatus = status
+	outcome := "delivered"
+	if err == nil {
+		now := time.Now().UTC()
+		del.State, del.LastError, del.DeliveredAt = StateDelivered, "", &now
+	} else {
+		outcome = "failed"
+		del.LastError = err.Error()
+		if del.Attempts >= d.MaxAttempts {
+			del.State = StateFailed
+		} else {
+			del.NextAttempt = time.Now().Add(d.backoff(del.Attempts)).UTC()
+		}
+	}
+	deliveriesCounter.Add(ctx, 1, metric.WithAttributes(attribute.String("outcome", outcome)))
+	if err = d.dbClient.Update(ctx, DeliveriesCollection, del.ID, del); err != nil {
+		return fmt.Errorf("updating webhook delivery %s: %w", del.ID, err)
+	}
+	return nil
+}
+
+// send POSTs the signed event to the subscription URL, any response other than 2xx is an error
+func (d *Dispatcher) send(ctx context.Context, sub *Subscription, del *Delivery) (int, error) {
+	body := []byte(del.Body)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderID, del.ID)
+	req.Header.Set(HeaderEvent, del.EventType)
+	req.Header.Set(HeaderTimestamp, fmt.Sprint(now.Unix()))
+	req.Header.Set(HeaderSignature, Sign(sub.Secret, now, body))
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("webhook endpoint returned %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	b := d.MinBackoff << (attempts - 1)
+	if b > d.MaxBackoff || b < d.MinBackoff {
+		return d.MaxBackoff
+	}
+	return b
+}
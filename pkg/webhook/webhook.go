@@ -0,0 +1,171 @@
+// Package webhook delivers login events to external HTTP endpoints for partners that can't consume Pub/Sub. Partners register a
+// Subscription with the URL to call, the event types they want and a secret. Each event is POSTed as the JSON envelope from
+// the events package, signed with HMAC-SHA256 over the timestamp and body:
+//
+//	X-Webhook-ID: <delivery ID, the same for every retry>
+//	X-Webhook-Event: <event type>
+//	X-Webhook-Timestamp: <unix seconds>
+//	X-Webhook-Signature: sha256=<hex HMAC-SHA256 of "<timestamp>.<body>" keyed with the secret>
+//
+// Receivers should check the signature with VerifySignature and drop deliveries whose ID they have already seen.
+//
+// Subscription URLs must be https. The Dispatcher should be given a client from NewClient, which refuses to connect to
+// loopback, private and link-local addresses, so that a subscription can't be used to reach internal services
+package webhook
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/events"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/storage"
+	"github.com/mitchellh/mapstructure"
+)
+
+const (
+	// SubscriptionsCollection holds the registered webhook subscriptions
+	SubscriptionsCollection = "webhooks"
+
+	// Request headers
+	HeaderID        = "X-Webhook-ID"
+	HeaderEvent     = "X-Webhook-Event"
+	HeaderTimestamp = "X-Webhook-Timestamp"
+	HeaderSignature = "X-Webhook-Signature"
+
+	// AllEvents subscribes to every event type
+	AllEvents = "*"
+
+	signaturePrefix = "sha256="
+)
+
+var (
+	// ErrNotFound is returned when a subscription does not exist
+	ErrNotFound = errors.New("webhook: subscription not found")
+	// ErrInvalidSubscription is returned by Register for a URL that isn't absolute https, or no event types
+	ErrInvalidSubscription = errors.New("webhook: a https url and at least one event type are required")
+	// ErrInvalidSignature is returned by VerifySignature
+	ErrInvalidSignature = errors.New("webhook: invalid signature")
+)
+
+// Subscription is an endpoint that events are delivered to
+type Subscription struct {
+	ID         string    `json:"id"`
+	URL        string    `json:"url"`
+	EventTypes []string  `json:"eventTypes"`
+	Secret     string    `json:"-" redact:"true"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+// Wants returns true if the subscription is for the event type
+func (s *Subscription) Wants(eventType events.Type) bool {
+	for _, t := range s.EventTypes {
+		if t == AllEvents || t == string(eventType) {
+			return true
+		}
+	}
+	return false
+}
+
+// Register stores a new subscription, a random secret is generated if none is given. The returned subscription includes the
+// secret, it is not returned by List
+func Register(ctx context.Context, dbClient storage.Client, rawURL string, eventTypes []string, secret string) (*Subscription, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "https" || u.Host == "" || len(eventTypes) == 0 {
+		return nil, ErrInvalidSubscription
+	}
+	if secret == "" {
+		if secret, err = randomHex(32); err != nil {
+			return nil, err
+		}
+	}
+	id, err := storage.NewID()
+	if err != nil {
+		return nil, err
+	}
+	sub := Subscription{ID: id, URL: u.String(), EventTypes: eventTypes, Secret: secret, CreatedAt: time.Now().UTC()}
+	if err = dbClient.InsertWithID(ctx, SubscriptionsCollection, id, &sub); err != nil {
+		return nil, err
+	}
+	return &sub, nil
+}
+
+// List returns every subscription, oldest first, without their secrets
+func List(ctx context.Context, dbClient storage.Client) ([]Subscription, error) {
+	subs, err := listWithSecrets(ctx, dbClient)
+	for i := range subs {
+		subs[i].Secret = ""
+	}
+	return subs, err
+}
+
+// Delete removes a subscription, deliveries already made to it are kept
+func Delete(ctx context.Context, dbClient storage.Client, id string) error {
+	if _, err := dbClient.Read(ctx, SubscriptionsCollection, id); errors.Is(err, storage.ErrNotFound) {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+	return dbClient.Delete(ctx, SubscriptionsCollection, id)
+}
+
+func listWithSecrets(ctx context.Context, dbClient storage.Client) ([]Subscription, error) {
+	docs, err := dbClient.List(ctx, SubscriptionsCollection)
+	if err != nil {
+		return nil, err
+	}
+	subs := make([]Subscription, 0, len(docs))
+	for id, doc := range docs {
+		var s Subscription
+		if err = mapstructure.Decode(doc, &s); err != nil {
+			return nil, fmt.Errorf("decoding webhook subscription %s: %w", id, err)
+		}
+		subs = append(subs, s)
+	}
+	sort.Slice(subs, func(i, j int) bool {
+		return subs[i].CreatedAt.Before(subs[j].CreatedAt)
+	})
+	return subs, nil
+}
+
+// Sign returns the X-Webhook-Signature header value for a body sent at the given time
+func Sign(secret string, timestamp time.Time, body []byte) string {
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write([]byte(strconv.FormatInt(timestamp.Unix(), 10) + "."))
+	m.Write(body)
+	return signaturePrefix + hex.EncodeToString(m.Sum(nil))
+}
+
+// VerifySignature checks the timestamp and signature headers of a delivery, deliveries with a timestamp further than tolerance
+// from now are rejected to limit replays
+func VerifySignature(secret, timestamp, signature string, body []byte, tolerance time.Duration) error {
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	t := time.Unix(ts, 0)
+	if d := time.Since(t); d > tolerance || d < -tolerance {
+		return ErrInvalidSignature
+	}
+	if !strings.HasPrefix(signature, signaturePrefix) || !hmac.Equal([]byte(Sign(secret, t, body)), []byte(signature)) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
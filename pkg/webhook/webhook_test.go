@@ -0,0 +1,303 @@
+package webhook_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/blueambertech-demos/login-svc-gcp/mock"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/events"
+	"github.com/blueambertech-demos/login-svc-gcp/pkg/webhook"
+)
+
+// receiver is a webhook endpoint that checks signatures and records the events it accepts
+type receiver struct {
+	mu       sync.Mutex
+	secret   string
+	fail     bool
+	received []*events.Envelope
+	ids      []string
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	body, _ := io.ReadAll(r.Body)
+	if err := webhook.VerifySignature(rc.secret, r.Header.Get(webhook.HeaderTimestamp), r.Header.Get(webhook.HeaderSignature), body, time.Minute); err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if rc.fail {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	env, err := events.Parse(body)
+	if err != nil || string(env.Type) != r.Header.Get(webhook.HeaderEvent) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	rc.received = append(rc.received, env)
+	rc.ids = append(rc.ids, r.Header.Get(webhook.HeaderID))
+}
+
+func (rc *receiver) events() []*events.Envelope {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return append([]*events.Envelope(nil), rc.received...)
+}
+
+func newEvent(t *testing.T, eventType events.Type) []byte {
+	t.Helper()
+	env, err := events.New(context.Background(), eventType, "user-1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, _ := json.Marshal(env)
+	return msg
+}
+
+func TestRegister(t *testing.T) {
+	ctx := context.Background()
+	dbClient := mock.NewNoSQLClient()
+	for _, u := range []string{"ftp://example.com", "http://example.com/hook", "/relative", "https://"} {
+		if _, err := webhook.Register(ctx, dbClient, u, []string{webhook.AllEvents}, ""); !errors.Is(err, webhook.ErrInvalidSubscription) {
+			t.Errorf("expected ErrInvalidSubscription for %s, got %v", u, err)
+		}
+	}
+	if _, err := webhook.Register(ctx, dbClient, "https://example.com/hook", nil, ""); !errors.Is(err, webhook.ErrInvalidSubscription) {
+		t.Error("expected ErrInvalidSubscription without event types, got", err)
+	}
+	sub, err := webhook.Register(ctx, dbClient, "https://example.com/hook", []string{string(events.LoginCreated)}, "")
+	if err != nil || sub.Secret == "" {
+		t.Errorf("expected a subscription with a generated secret, got %+v, %v", sub, err)
+		return
+	}
+	subs, err := webhook.List(ctx, dbClient)
+	if err != nil || len(subs) != 1 || subs[0].ID != sub.ID || subs[0].Secret != "" {
+		t.Errorf("expected the subscription to be listed without its secret, got %+v, %v", subs, err)
+	}
+	if err = webhook.Delete(ctx, dbClient, sub.ID); err != nil {
+		t.Error(err)
+	}
+	if err = webhook.Delete(ctx, dbClient, sub.ID); !errors.Is(err, webhook.ErrNotFound) {
+		t.Error("expected ErrNotFound deleting a missing subscription, got", err)
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	body := []byte(`{"id":"1"}`)
+	now := time.Now()
+	sig := webhook.Sign("secret", now, body)
+	timestamp := func(t time.Time) string { return strconv.FormatInt(t.Unix(), 10) }
+	if err := webhook.VerifySignature("secret", timestamp(now), sig, body, time.Minute); err != nil {
+		t.Error(err)
+	}
+	if err := webhook.VerifySignature("wrong", timestamp(now), sig, body, time.Minute); !errors.Is(err, webhook.ErrInvalidSignature) {
+		t.Error("expected ErrInvalidSignature for the wrong secret, got", err)
+	}
+	if err := webhook.VerifySignature("secret", timestamp(now), sig, []byte(`{"id":"2"}`), time.Minute); !errors.Is(err, webhook.ErrInvalidSignature) {
+		t.Error("expected ErrInvalidSignature for a changed body, got", err)
+	}
+	old := now.Add(-time.Hour)
+	if err := webhook.VerifySignature("secret", timestamp(old), webhook.Sign("secret", old, body), body, time.Minute); !errors.Is(err, webhook.ErrInvalidSignature) {
+		t.Error("expected ErrInvalidSignature for an old timestamp, got", err)
+	}
+}
+
+func TestDispatchDeliversSignedEvents(t *testing.T) {
+	ctx := context.Background()
+	dbClient := mock.NewNoSQLClient()
+	rc := &receiver{secret: "partner-secret"}
+	server := httptest.NewTLSServer(rc)
+	defer server.Close()
+	sub, err := webhook.Register(ctx, dbClient, server.URL, []string{string(events.LoginCreated), string(events.LoginFailed)}, rc.secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := webhook.NewDispatcher(dbClient, &mock.PubSubHandler{}, server.Client())
+
+	created := newEvent(t, events.LoginCreated)
+	for _, msg := range [][]byte{created, newEvent(t, events.LoginSucceeded), created, []byte("not an event")} {
+		if err = d.Dispatch(ctx, msg); err != nil {
+			t.Error(err)
+		}
+	}
+	// Dispatch only stores the delivery, it is sent by the retry loop
+	if deliveries, _ := webhook.Deliveries(ctx, dbClient, sub.ID); len(rc.events()) != 0 || len(deliveries) != 1 ||
+		deliveries[0].State != webhook.StatePending || deliveries[0].Attempts != 0 {
+		t.Fatalf("dispatch should only store a pending delivery, got %+v", deliveries)
+	}
+	if n, err := d.RetryOnce(ctx); err != nil || n != 1 {
+		t.Errorf("expected the pending delivery to be sent, got %d, %v", n, err)
+	}
+	got := rc.events()
+	if len(got) != 1 || got[0].Type != events.LoginCreated {
+		t.Errorf("expected only the created event to be delivered once, got %d events", len(got))
+	}
+	deliveries, err := webhook.Deliveries(ctx, dbClient, sub.ID)
+	if err != nil || len(deliveries) != 1 || deliveries[0].State != webhook.StateDelivered || deliveries[0].LastStatus != http.StatusOK ||
+		deliveries[0].DeliveredAt == nil || deliveries[0].ID != rc.ids[0] {
+		t.Errorf("unexpected delivery state: %+v, %v", deliveries, err)
+	}
+}
+
+func TestDispatchRetriesWithBackoff(t *testing.T) {
+	ctx := context.Background()
+	dbClient := mock.NewNoSQLClient()
+	rc := &receiver{secret: "partner-secret", fail: true}
+	server := httptest.NewTLSServer(rc)
+	defer server.Close()
+	sub, err := webhook.Register(ctx, dbClient, server.URL, []string{webhook.AllEvents}, rc.secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := webhook.NewDispatcher(dbClient, &mock.PubSubHandler{}, server.Client())
+	d.MaxAttempts = 3
+
+	if err = d.Dispatch(ctx, newEvent(t, events.LoginCreated)); err != nil {
+		t.Error(err)
+	}
+	if n, _ := d.RetryOnce(ctx); n != 0 {
+		t.Error("delivery should fail while the endpoint is down")
+	}
+	deliveries, _ := webhook.Deliveries(ctx, dbClient, sub.ID)
+	if len(deliveries) != 1 || deliveries[0].State != webhook.StatePending || deliveries[0].LastStatus != http.StatusServiceUnavailable ||
+		!deliveries[0].NextAttempt.After(time.Now()) {
+		t.Errorf("failed delivery should be pending with a delayed next attempt: %+v", deliveries)
+		return
+	}
+	if n, _ := d.RetryOnce(ctx); n != 0 || len(rc.events()) != 0 {
+		t.Error("delivery should not be retried before its next attempt")
+	}
+
+	// With no backoff each retry is due straight away
+	d.MinBackoff = 0
+	if err = d.Dispatch(ctx, newEvent(t, events.LoginFailed)); err != nil {
+		t.Error(err)
+	}
+	rc.mu.Lock()
+	rc.fail = false
+	rc.mu.Unlock()
+	if n, err := d.RetryOnce(ctx); err != nil || n != 1 {
+		t.Errorf("expected the due delivery to succeed on retry, got %d, %v", n, err)
+	}
+
+	rc.mu.Lock()
+	rc.fail = true
+	rc.mu.Unlock()
+	if err = d.Dispatch(ctx, newEvent(t, events.AccountLocked)); err != nil {
+		t.Error(err)
+	}
+	for i := 0; i < 3; i++ {
+		_, _ = d.RetryOnce(ctx)
+	}
+	var states []webhook.DeliveryState
+	deliveries, _ = webhook.Deliveries(ctx, dbClient, sub.ID)
+	for _, del := range deliveries {
+		states = append(states, del.State)
+		if del.EventType == string(events.AccountLocked) && (del.State != webhook.StateFailed || del.Attempts != 3) {
+			t.Errorf("delivery should fail after the maximum attempts: %+v", del)
+		}
+	}
+	if len(states) != 3 {
+		t.Error("expected three deliveries, got", states)
+	}
+}
+
+func TestDispatcherReceivesFromPubSub(t *testing.T) {
+	dbClient := mock.NewNoSQLClient()
+	rc := &receiver{secret: "partner-secret"}
+	server := httptest.NewTLSServer(rc)
+	defer server.Close()
+	if _, err := webhook.Register(context.Background(), dbClient, server.URL, []string{webhook.AllEvents}, rc.secret); err != nil {
+		t.Fatal(err)
+	}
+	queue := &mock.PubSubHandler{}
+	queue.AddSubscription(webhook.DefaultSubscriptionID, events.TopicID)
+	d := webhook.NewDispatcher(dbClient, queue, server.Client())
+	d.RefreshRate = time.Millisecond
+	d.RetryInterval = time.Millisecond
+	d.Start(context.Background())
+
+	if err := events.Publish(context.Background(), queue, events.LoginCreated, "user-1", nil); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(rc.events()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := rc.events(); len(got) != 1 || got[0].UserID != "user-1" {
+		t.Errorf("expected the published event to be delivered, got %d events", len(got))
+	}
+	ctx, canc := context.WithTimeout(context.Background(), time.Second)
+	defer canc()
+	if err := d.Stop(ctx); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDispatchersClaimDeliveries(t *testing.T) {
+	ctx := context.Background()
+	dbClient := mock.NewNoSQLClient()
+	rc := &receiver{secret: "partner-secret"}
+	server := httptest.NewTLSServer(rc)
+	defer server.Close()
+	if _, err := webhook.Register(ctx, dbClient, server.URL, []string{webhook.AllEvents}, rc.secret); err != nil {
+		t.Fatal(err)
+	}
+	d := webhook.NewDispatcher(dbClient, &mock.PubSubHandler{}, server.Client())
+	for i := 0; i < 20; i++ {
+		if err := d.Dispatch(ctx, newEvent(t, events.LoginCreated)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Dispatchers on different instances read the same pending deliveries, each is only sent by the one that claims it
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := webhook.NewDispatcher(dbClient, &mock.PubSubHandler{}, server.Client()).RetryOnce(ctx); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	seen := map[string]bool{}
+	for _, env := range rc.events() {
+		if seen[env.ID] {
+			t.Errorf("%s was delivered more than once", env.ID)
+		}
+		seen[env.ID] = true
+	}
+	if len(seen) != 20 {
+		t.Errorf("expected every delivery to be sent, got %d", len(seen))
+	}
+}
+
+func TestClientRefusesInternalAddresses(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("the client should not connect to a loopback address")
+	}))
+	defer server.Close()
+	client := webhook.NewClient(time.Second)
+	// The hostname is only resolved to a blocked address when the connection is made
+	for _, u := range []string{server.URL, strings.Replace(server.URL, "127.0.0.1", "localhost", 1), "https://169.254.169.254/", "https://10.0.0.1/", "https://[::1]/"} {
+		resp, err := client.Post(u, "application/json", strings.NewReader("{}"))
+		if err == nil {
+			resp.Body.Close()
+		}
+		if !errors.Is(err, webhook.ErrBlockedAddress) {
+			t.Errorf("%s: expected ErrBlockedAddress, got %v", u, err)
+		}
+	}
+}